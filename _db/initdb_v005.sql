@@ -0,0 +1,64 @@
+CREATE TABLE IF NOT EXISTS DF_COUPON
+(
+    ID                BIGINT NOT NULL AUTO_INCREMENT,
+    SERIAL            VARCHAR(64) NOT NULL,
+    CODE              VARCHAR(64) NOT NULL,
+    KIND              VARCHAR(32) NOT NULL,
+    EXPIRE_ON         DATETIME NOT NULL COMMENT 'UTC',
+    AMOUNT            DOUBLE(10,2) NOT NULL COMMENT 'deprecated, use AMOUNT_FEN',
+    AMOUNT_FEN        BIGINT NOT NULL DEFAULT 0,
+    CURRENCY          VARCHAR(3) NOT NULL DEFAULT 'CNY',
+    CREATE_AT         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UPDATE_AT         TIMESTAMP,
+    USE_TIME          DATETIME COMMENT 'UTC',
+    USERNAME          VARCHAR(32),
+    NAMESPACE         VARCHAR(64),
+    STATUS            VARCHAR(32),
+    PRIMARY KEY (ID)
+) DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS DF_COUPON_PROVIDE
+(
+    ID                BIGINT NOT NULL AUTO_INCREMENT,
+    TO_USER           VARCHAR(64) NOT NULL,
+    PROVIDE_TIME      DATETIME NOT NULL,
+    PRIMARY KEY (ID)
+) DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS DF_COUPON_OUTBOX
+(
+    ID                BIGINT NOT NULL AUTO_INCREMENT,
+    SERIAL            VARCHAR(64) NOT NULL COMMENT 'idempotency key of the recharge',
+    REGION            VARCHAR(32) NOT NULL,
+    USERNAME          VARCHAR(32) NOT NULL,
+    NAMESPACE         VARCHAR(64) NOT NULL,
+    AMOUNT            DOUBLE(10,2) NOT NULL COMMENT 'deprecated, use AMOUNT_FEN',
+    AMOUNT_FEN        BIGINT NOT NULL DEFAULT 0,
+    STATUS            VARCHAR(32) NOT NULL COMMENT 'pending, delivered or failed',
+    ATTEMPTS          INT NOT NULL DEFAULT 0,
+    NEXT_TRY_AT       DATETIME NOT NULL,
+    LAST_ERROR        VARCHAR(255),
+    CREATE_AT         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (ID),
+    KEY (SERIAL),
+    KEY (STATUS, NEXT_TRY_AT)
+) DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS DF_COUPON_STATUS_LOG
+(
+    ID                BIGINT NOT NULL AUTO_INCREMENT,
+    SERIAL            VARCHAR(64) NOT NULL,
+    FROM_STATUS       VARCHAR(32) NOT NULL COMMENT 'empty for a new coupon',
+    TO_STATUS         VARCHAR(32) NOT NULL,
+    OPERATOR          VARCHAR(64) NOT NULL,
+    CREATE_AT         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (ID),
+    KEY (SERIAL)
+) DEFAULT CHARSET=UTF8;
+
+CREATE TABLE IF NOT EXISTS DF_ITEM_STAT
+(
+   STAT_KEY     VARCHAR(255) NOT NULL COMMENT '3*255 = 765 < 767',
+   STAT_VALUE   INT NOT NULL,
+   PRIMARY KEY (STAT_KEY)
+) DEFAULT CHARSET=UTF8;
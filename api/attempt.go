@@ -0,0 +1,154 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+//=============================================================
+// codes are guessed by looking them up again and again. The failed
+// lookups of a user and of an ip are counted in a sliding window,
+// too many of them lock the user or the ip out for a while.
+//=============================================================
+
+const (
+	defaultAttemptWindow    = 10 * 60 // seconds
+	defaultAttemptLockout   = 15 * 60 // seconds
+	defaultUserAttemptLimit = 10
+	defaultIPAttemptLimit   = 50
+
+	// a service looking up for its users without telling which one is
+	// counted as a whole, it has more users than an address.
+	defaultServiceAttemptLimit = 200
+)
+
+var (
+	attemptStore = models.NewMemoryAttemptStore()
+
+	attemptWindow    = defaultAttemptWindow * time.Second
+	attemptLockout   = defaultAttemptLockout * time.Second
+	userAttemptLimit = defaultUserAttemptLimit
+	ipAttemptLimit   = defaultIPAttemptLimit
+
+	serviceAttemptLimit = defaultServiceAttemptLimit
+)
+
+// SetAttemptStore injects the storage of the failed lookups, it is in
+// memory by default.
+func SetAttemptStore(store models.AttemptStore) {
+	attemptStore = store
+}
+
+// initAttemptLimits loads the limits, a limit of 0 is no limit.
+func initAttemptLimits() {
+	attemptWindow = time.Duration(envInt("COUPON_ATTEMPT_WINDOW", defaultAttemptWindow)) * time.Second
+	attemptLockout = time.Duration(envInt("COUPON_ATTEMPT_LOCKOUT", defaultAttemptLockout)) * time.Second
+	userAttemptLimit = envInt("COUPON_USER_ATTEMPT_LIMIT", defaultUserAttemptLimit)
+	ipAttemptLimit = envInt("COUPON_IP_ATTEMPT_LIMIT", defaultIPAttemptLimit)
+	serviceAttemptLimit = envInt("COUPON_SERVICE_ATTEMPT_LIMIT", defaultServiceAttemptLimit)
+	logger.Info("Failed lookups: %d per user, %d per ip, %d per service in %v, lockout %v.",
+		userAttemptLimit, ipAttemptLimit, serviceAttemptLimit, attemptWindow, attemptLockout)
+}
+
+type attemptKey struct {
+	key   string
+	limit int
+}
+
+// lookupGuard counts the failed code lookups of a request.
+type lookupGuard struct {
+	keys []attemptKey
+}
+
+func newLookupGuard(r *http.Request, username string) *lookupGuard {
+	g := &lookupGuard{}
+	if userAttemptLimit > 0 {
+		g.keys = append(g.keys, attemptKey{"user:" + username, userAttemptLimit})
+	}
+	if ipAttemptLimit > 0 {
+		g.keys = append(g.keys, attemptKey{"ip:" + clientIP(r), ipAttemptLimit})
+	}
+	return g
+}
+
+// newServiceLookupGuard is the guard of a lookup by a service for one of
+// its users. The account and the address of the service are shared by all
+// its users, so only the user is counted if it is known, or the service
+// with its own limit.
+func newServiceLookupGuard(service, username string) *lookupGuard {
+	g := &lookupGuard{}
+	if username != "" {
+		if userAttemptLimit > 0 {
+			g.keys = append(g.keys, attemptKey{"user:" + username, userAttemptLimit})
+		}
+	} else if serviceAttemptLimit > 0 {
+		g.keys = append(g.keys, attemptKey{"service:" + service, serviceAttemptLimit})
+	}
+	return g
+}
+
+// check returns ErrorCodeTooManyAttempts if the user or the ip is locked
+// out, and sets Retry-After of w. A failed store lets the lookup go.
+func (g *lookupGuard) check(w http.ResponseWriter) *Error {
+	now := time.Now()
+	for _, k := range g.keys {
+		until, err := attemptStore.LockedUntil(k.key, now)
+		if err != nil {
+			logger.Error("LockedUntil (%s) err: %v", k.key, err)
+			continue
+		}
+		if !until.IsZero() {
+			retryAfter := int(until.Sub(now)/time.Second) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			return GetError2(ErrorCodeTooManyAttempts, fmt.Sprintf("retry after %d seconds", retryAfter))
+		}
+	}
+	return nil
+}
+
+// observe counts e if it is a failed lookup, and locks out the keys over
+// their limits. It returns e.
+func (g *lookupGuard) observe(e *Error) *Error {
+	if e == nil || e.code != ErrorCodeInvalidCouponCode && e.code != ErrorCodeGetCouponNotExsit {
+		return e
+	}
+
+	now := time.Now()
+	for _, k := range g.keys {
+		n, err := attemptStore.RecordFailure(k.key, now, attemptWindow)
+		if err != nil {
+			logger.Error("RecordFailure (%s) err: %v", k.key, err)
+			continue
+		}
+		if n < k.limit {
+			continue
+		}
+		logger.Warn("%s failed %d lookups in %v, locked out for %v.", k.key, n, attemptWindow, attemptLockout)
+		if err := attemptStore.Lock(k.key, now.Add(attemptLockout)); err != nil {
+			logger.Error("Lock (%s) err: %v", k.key, err)
+		}
+	}
+	return e
+}
+
+// clientIP is the last address of X-Forwarded-For, which is appended by
+// the router in front of the service, or the peer address.
+func clientIP(r *http.Request) string {
+	if values := r.Header["X-Forwarded-For"]; len(values) > 0 {
+		addrs := strings.Split(values[len(values)-1], ",")
+		if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func lookupCode(code, forwardedFor string) *httptest.ResponseRecorder {
+	router := httprouter.New()
+	router.GET("/charge/v1/coupons/:code", RetrieveCoupon)
+
+	r, err := http.NewRequest("GET", "/charge/v1/coupons/"+code+"?region=cn-north-1", nil)
+	if err != nil {
+		panic(err)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Authorization", "Bearer test")
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUserLockoutOffline(t *testing.T) {
+	setupMemoryStore(t)
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	for i := 0; i < defaultUserAttemptLimit; i++ {
+		if w := lookupCode("not-a-code", ""); parseResult(t, w).Code != ErrorCodeInvalidCouponCode {
+			t.Fatalf("lookup %d of an invalid code: %s", i, w.Body.String())
+		}
+	}
+
+	// the user is locked out, even with a valid code.
+	w := lookupCode(created.Code, "")
+	if w.Code != http.StatusTooManyRequests || parseResult(t, w).Code != ErrorCodeTooManyAttempts {
+		t.Fatalf("lookup of a locked out user: %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("no Retry-After of a locked out user")
+	}
+	if code := useCouponCode(t, created.Serial, created.Code); code != ErrorCodeTooManyAttempts {
+		t.Fatalf("use by a locked out user: %d", code)
+	}
+}
+
+func TestIPLockoutOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func(user, ip int) {
+		userAttemptLimit, ipAttemptLimit = user, ip
+	}(userAttemptLimit, ipAttemptLimit)
+	userAttemptLimit, ipAttemptLimit = 0, 3
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	for i := 0; i < 3; i++ {
+		lookupCode("not-a-code", "10.0.0.1, 198.51.100.7")
+	}
+	if w := lookupCode(created.Code, "198.51.100.7"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("lookup from a locked out ip: %d %s", w.Code, w.Body.String())
+	}
+
+	// the first addresses can be forged by the client, only the last counts.
+	if w := lookupCode(created.Code, "198.51.100.7, 198.51.100.8"); parseResult(t, w).Code != ErrorCodeNone {
+		t.Fatalf("lookup from another ip: %s", w.Body.String())
+	}
+	if w := lookupCode(strings.ToLower(created.Code), ""); parseResult(t, w).Code != ErrorCodeNone {
+		t.Fatalf("lookup from the peer address: %s", w.Body.String())
+	}
+}
+
+func TestServiceLockoutOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func(users []string) { AdminUsers = users }(AdminUsers)
+	AdminUsers = []string{"local"}
+
+	// the billing service evaluates mistyped codes of many users.
+	created := createTestCoupon(t, `{"kind": "fixed_off", "expire_on": 30, "amount": 10}`)
+	for i := 0; i < defaultIPAttemptLimit+1; i++ {
+		evaluateTestCoupon(t, `{"code": "not-a-code", "order_total": 30, "username": "user`+strconv.Itoa(i)+`"}`)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 30}`); code != ErrorCodeNone {
+		t.Fatalf("evaluate by a billing service: %d", code)
+	}
+
+	// only the user who mistypes is locked out.
+	for i := 0; i < defaultUserAttemptLimit; i++ {
+		evaluateTestCoupon(t, `{"code": "not-a-code", "order_total": 30, "username": "alice"}`)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 30, "username": "Alice"}`); code != ErrorCodeTooManyAttempts {
+		t.Fatalf("evaluate for a locked out user: %d", code)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 30, "username": "bob"}`); code != ErrorCodeNone {
+		t.Fatalf("evaluate for another user: %d", code)
+	}
+
+	// without the user, the service is counted with its own limit.
+	for i := 0; i < defaultServiceAttemptLimit; i++ {
+		evaluateTestCoupon(t, `{"code": "not-a-code", "order_total": 30}`)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 30}`); code != ErrorCodeTooManyAttempts {
+		t.Fatalf("evaluate by a locked out billing service: %d", code)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 30, "username": "bob"}`); code != ErrorCodeNone {
+		t.Fatalf("evaluate for a user by a locked out billing service: %d", code)
+	}
+
+	// the others evaluate for themselves only.
+	AdminUsers = nil
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 30, "username": "bob"}`); code != ErrorCodePermissionDenied {
+		t.Fatalf("evaluate for another user by a user: %d", code)
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func useCouponIn(t *testing.T, serial, code, namespace string) uint {
+	w := doRequest(UseCoupon, "PUT", "/charge/v1/coupons/use/:serial", "/charge/v1/coupons/use/"+serial+"?region=cn-north-1",
+		`{"code": "`+code+`", "namespace": "`+namespace+`"}`)
+	return parseResultData(t, w, nil)
+}
+
+func TestBoundCouponOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	// the test requests are all of user local
+	others := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "bound_username": "bob"}`)
+	if code := retrieveCouponCode(t, others.Code); code != ErrorCodeCouponNotForUser {
+		t.Fatalf("retrieve a coupon of another user: %d", code)
+	}
+	if code := useCouponCode(t, others.Serial, others.Code); code != ErrorCodeCouponNotForUser {
+		t.Fatalf("use a coupon of another user: %d", code)
+	}
+	history, _ := getCouponStore().CouponStatusHistory(others.Serial)
+	if len(history) != 1 {
+		t.Fatalf("a coupon of another user is changed: %+v", history)
+	}
+
+	mine := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "bound_username": "Local", "bound_namespace": "team-*"}`)
+	w := doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+mine.Code+"?region=cn-north-1", "")
+	coupon := &models.RetrieveResult{}
+	if code := parseResultData(t, w, coupon); code != ErrorCodeNone || coupon.BoundUsername != "local" || coupon.BoundNamespace != "team-*" {
+		t.Fatalf("retrieve a bound coupon: %s", w.Body.String())
+	}
+	if code := useCouponIn(t, mine.Serial, mine.Code, "ns1"); code != ErrorCodeCouponNotForUser {
+		t.Fatalf("use a coupon out of its namespaces: %d", code)
+	}
+	if code := useCouponIn(t, mine.Serial, mine.Code, "team-a"); code != ErrorCodeNone {
+		t.Fatalf("use a bound coupon: %d", code)
+	}
+	if len(*calls) != 1 || (*calls)[0].namespace != "team-a" {
+		t.Fatalf("unexpected recharges: %v", *calls)
+	}
+
+	coupons := createTestBatch(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 2, "bound_namespace": "ns2"}`)
+	if code := useCouponCode(t, coupons[0][0], coupons[0][1]); code != ErrorCodeCouponNotForUser {
+		t.Fatalf("use a batch coupon out of its namespace: %d", code)
+	}
+	if code := useCouponIn(t, coupons[1][0], coupons[1][1], "ns2"); code != ErrorCodeNone {
+		t.Fatalf("use a bound batch coupon: %d", code)
+	}
+
+	for _, body := range []string{
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "bound_namespace": "team-["}`,
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "bound_namespace": "team/a"}`,
+	} {
+		w := doRequest(CreateCoupon, "POST", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1", body)
+		if code := parseResultData(t, w, nil); code != ErrorCodeInvalidParameters {
+			t.Errorf("create %s: %d", body, code)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/common"
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+// rows written between two flushes of a serial/code download
+const csvFlushRows = 100
+
+type batchCreateInfo struct {
+	createInfo
+	Number     int   `json:"number"`
+	CampaignId int64 `json:"campaign_id,omitempty"`
+}
+
+// CreateCouponBatch creates number coupons in the campaign of campaign_id,
+// or as a new active campaign without one, and returns the serial/code list
+// as a csv download.
+func CreateCouponBatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", loggedURL(r))
+	logger.Info("Begin create coupon batch handler.")
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	//只有管理员才可以调这个API
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	correctInput := []string{"kind", "expire_on", "number"}
+	info := &batchCreateInfo{}
+	err := common.ParseRequestJsonIntoWithValidateParams(r, correctInput, info)
+	if err != nil {
+		logger.Error("Parse body err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
+		return
+	}
+
+	coupon, err := info.coupon(time.Now())
+	if err == nil && (info.Number < 1 || info.Number > models.MaxCampaignCoupons) {
+		err = fmt.Errorf("number should be in [1, %d]", models.MaxCampaignCoupons)
+	}
+	if err != nil {
+		logger.Error("Validate create info err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+		return
+	}
+
+	// a collision anywhere rolls the batch back, it is retried as a whole.
+	var codes []*models.CampaignCoupon
+	var campaign *models.Campaign
+	err = retryOnCodeCollision(func() (err error) {
+		codes = make([]*models.CampaignCoupon, info.Number)
+		for i := range codes {
+			codes[i] = &models.CampaignCoupon{Serial: genSerial(), Code: genCode()}
+		}
+		campaign = &models.Campaign{Id: info.CampaignId, Status: models.CampaignStatus_Active, Currency: coupon.Currency}
+		campaign, err = store.CreateCouponBatch(campaign, coupon, codes, username)
+		return err
+	})
+	if err == models.ErrCampaignNotFound {
+		JsonResult(w, http.StatusNotFound, GetError(ErrorCodeCampaignNotExist), nil)
+		return
+	} else if err != nil {
+		logger.Error("Create coupon batch err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeCreateCoupon, err.Error()), nil)
+		return
+	}
+
+	writeCampaignCoupons(w, campaign.Id, true, func(f func(c *models.CampaignCoupon) error) error {
+		for _, c := range codes {
+			if err := f(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	logger.Info("End create coupon batch handler.")
+}
+
+// DownloadCampaignCoupons returns the serial/code prefix list of a campaign
+// as a csv download, the codes are not saved and can't be downloaded again.
+func DownloadCampaignCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin download campaign coupons handler.")
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	id, e := campaignIdParam(params)
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, e, nil)
+		return
+	}
+	campaign, err := store.RetrieveCampaign(id)
+	if err != nil {
+		logger.Error("Retrieve campaign err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCampaign, err.Error()), nil)
+		return
+	} else if campaign == nil {
+		JsonResult(w, http.StatusNotFound, GetError(ErrorCodeCampaignNotExist), nil)
+		return
+	}
+
+	writeCampaignCoupons(w, campaign.Id, false, func(f func(c *models.CampaignCoupon) error) error {
+		return store.ScanCampaignCoupons(campaign.Id, f)
+	})
+
+	logger.Info("End download campaign coupons handler.")
+}
+
+type campaignCreateInfo struct {
+	Name     string          `json:"name"`
+	Currency models.Currency `json:"currency,omitempty"`
+	Budget   models.Amount   `json:"budget,omitempty"`
+	StartAt  *time.Time      `json:"start_at,omitempty"`
+	EndAt    *time.Time      `json:"end_at,omitempty"`
+	Status   string          `json:"status,omitempty"`
+}
+
+// CreateCampaign creates an empty campaign, it is a draft unless the
+// status is given. Coupons are added by CreateCouponBatch.
+func CreateCampaign(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", r.URL)
+	logger.Info("Begin create campaign handler.")
+
+	store, username, ok := campaignAdminStore(w, r)
+	if !ok {
+		return
+	}
+
+	info := &campaignCreateInfo{}
+	err := common.ParseRequestJsonIntoWithValidateParams(r, []string{"name"}, info)
+	if err != nil {
+		logger.Error("Parse body err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
+		return
+	}
+
+	campaign := &models.Campaign{
+		Name:     info.Name,
+		Currency: info.Currency,
+		Budget:   info.Budget,
+		StartAt:  info.StartAt,
+		EndAt:    info.EndAt,
+		Status:   models.CampaignStatus(info.Status),
+	}
+	campaign, err = store.CreateCampaign(campaign, username)
+	if err != nil {
+		logger.Error("Create campaign err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeCreateCampaign, err.Error()), nil)
+		return
+	}
+
+	logger.Info("End create campaign handler.")
+	JsonResult(w, http.StatusOK, nil, campaign)
+}
+
+func RetrieveCampaign(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin retrieve campaign handler.")
+
+	store, _, ok := campaignAdminStore(w, r)
+	if !ok {
+		return
+	}
+
+	id, e := campaignIdParam(params)
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, e, nil)
+		return
+	}
+	campaign, err := store.RetrieveCampaign(id)
+	if err != nil {
+		logger.Error("Retrieve campaign err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCampaign, err.Error()), nil)
+		return
+	} else if campaign == nil {
+		JsonResult(w, http.StatusNotFound, GetError(ErrorCodeCampaignNotExist), nil)
+		return
+	}
+
+	logger.Info("End retrieve campaign handler.")
+	JsonResult(w, http.StatusOK, nil, campaign)
+}
+
+func QueryCampaignList(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin query campaign list handler.")
+
+	store, _, ok := campaignAdminStore(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.Form.Get("status")
+	offset, size := OptionalOffsetAndSize(r, 30, 1, 100)
+
+	count, campaigns, err := store.QueryCampaigns(status, offset, size)
+	if err != nil {
+		logger.Error("Query campaigns err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCampaign, err.Error()), nil)
+		return
+	}
+
+	logger.Info("End query campaign list handler.")
+	JsonResult(w, http.StatusOK, nil, NewQueryListResult(count, campaigns))
+}
+
+// UpdateCampaign changes the given fields of a campaign. Pausing it blocks
+// the retrieval, providing and use of its coupons until it is active again.
+func UpdateCampaign(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: PUT %v.", r.URL)
+	logger.Info("Begin update campaign handler.")
+
+	store, _, ok := campaignAdminStore(w, r)
+	if !ok {
+		return
+	}
+
+	id, e := campaignIdParam(params)
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, e, nil)
+		return
+	}
+
+	update := &models.CampaignUpdate{}
+	if err := common.ParseRequestJsonInto(r, update); err != nil {
+		logger.Error("Parse body err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
+		return
+	}
+
+	updateCampaign(w, store, id, update)
+
+	logger.Info("End update campaign handler.")
+}
+
+// CloseCampaign closes a campaign for good, its coupons are kept.
+func CloseCampaign(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: DELETE %v.", r.URL)
+	logger.Info("Begin close campaign handler.")
+
+	store, _, ok := campaignAdminStore(w, r)
+	if !ok {
+		return
+	}
+
+	id, e := campaignIdParam(params)
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, e, nil)
+		return
+	}
+
+	closed := models.CampaignStatus_Closed
+	updateCampaign(w, store, id, &models.CampaignUpdate{Status: &closed})
+
+	logger.Info("End close campaign handler.")
+}
+
+func updateCampaign(w http.ResponseWriter, store models.CouponStore, id int64, update *models.CampaignUpdate) {
+	campaign, err := store.UpdateCampaign(id, update)
+	if err == models.ErrCampaignNotFound {
+		JsonResult(w, http.StatusNotFound, GetError(ErrorCodeCampaignNotExist), nil)
+		return
+	} else if err != nil {
+		logger.Error("Update campaign (%d) err: %v", id, err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeUpdateCampaign, err.Error()), nil)
+		return
+	}
+
+	JsonResult(w, http.StatusOK, nil, campaign)
+}
+
+// campaignAdminStore returns the coupon store for an admin user, or writes
+// the error response.
+func campaignAdminStore(w http.ResponseWriter, r *http.Request) (models.CouponStore, string, bool) {
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return nil, "", false
+	}
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return nil, "", false
+	}
+	logger.Debug("username:%v", username)
+
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return nil, "", false
+	}
+	return store, username, true
+}
+
+func campaignIdParam(params httprouter.Params) (int64, *Error) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, GetError2(ErrorCodeInvalidParameters, "invalid campaign id")
+	}
+	return id, nil
+}
+
+func writeCampaignCoupons(w http.ResponseWriter, campaignId int64, withCode bool, scan func(f func(c *models.CampaignCoupon) error) error) {
+	w.Header().Set("X-Campaign-Id", strconv.FormatInt(campaignId, 10))
+	writeCouponsCsv(w, fmt.Sprintf("campaign-%d.csv", campaignId), withCode, scan)
+}
+
+// writeCouponsCsv streams the coupons produced by scan as csv, with
+// their codes when they are just created, or the code prefixes. The
+// status is sent before the first row, so an error in the middle can
+// only be logged, and the download is cut short.
+func writeCouponsCsv(w http.ResponseWriter, filename string, withCode bool, scan func(f func(c *models.CampaignCoupon) error) error) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	writer := csv.NewWriter(w)
+	if withCode {
+		writer.Write([]string{"serial", "code"})
+	} else {
+		writer.Write([]string{"serial", "code_prefix"})
+	}
+
+	rows := 0
+	err := scan(func(c *models.CampaignCoupon) error {
+		code := c.Code
+		if !withCode {
+			code = c.CodePrefix
+		}
+		writer.Write([]string{strings.ToUpper(c.Serial), strings.ToUpper(code)})
+		if rows++; rows%csvFlushRows == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return writer.Error()
+	})
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		logger.Error("Write coupons (%s) err: %v", filename, err)
+	}
+}
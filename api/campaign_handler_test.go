@@ -0,0 +1,279 @@
+package api
+
+import (
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func readCampaignCsv(t *testing.T, body string) [][]string {
+	return readCsv(t, body, "code")
+}
+
+func readCsv(t *testing.T, body, codeColumn string) [][]string {
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv (%s) err: %v", body, err)
+	}
+	if len(records) == 0 || records[0][0] != "serial" || records[0][1] != codeColumn {
+		t.Fatalf("bad csv header: %v", records)
+	}
+	return records[1:]
+}
+
+func TestCreateCouponBatchOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	w := doRequest(CreateCouponBatch, "POST", "/charge/v1/coupons/batch", "/charge/v1/coupons/batch?region=cn-north-1",
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 5}`)
+	if w.Code != 200 || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("create batch: %d %s", w.Code, w.Body.String())
+	}
+	campaignId := w.Header().Get("X-Campaign-Id")
+	if campaignId != "1" || !strings.Contains(w.Header().Get("Content-Disposition"), "campaign-1.csv") {
+		t.Fatalf("unexpected headers: %v", w.Header())
+	}
+	created := readCampaignCsv(t, w.Body.String())
+	if len(created) != 5 {
+		t.Fatalf("%d coupons created, want 5", len(created))
+	}
+
+	// download again, only the code prefixes are known now
+	w = doRequest(DownloadCampaignCoupons, "GET", "/charge/v1/campaigns/:id/coupons",
+		"/charge/v1/campaigns/"+campaignId+"/coupons?region=cn-north-1", "")
+	downloaded := readCsv(t, w.Body.String(), "code_prefix")
+	if len(downloaded) != len(created) {
+		t.Fatalf("downloaded %v, created %v", downloaded, created)
+	}
+	for i := range created {
+		if downloaded[i][0] != created[i][0] || downloaded[i][1] != created[i][1][:4] {
+			t.Errorf("downloaded %v, created %v", downloaded[i], created[i])
+		}
+	}
+
+	// the coupons can be used
+	useTestCoupon(t, &models.CreateResult{Serial: created[0][0], Code: created[0][1]})
+
+	w = doRequest(DownloadCampaignCoupons, "GET", "/charge/v1/campaigns/:id/coupons",
+		"/charge/v1/campaigns/2/coupons?region=cn-north-1", "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeCampaignNotExist {
+		t.Fatalf("download a nonexistent campaign: %s", w.Body.String())
+	}
+
+	for _, body := range []string{
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 0}`,
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 10001}`,
+		`{"kind": "recharge", "expire_on": 30, "amount": 0, "number": 1}`,
+	} {
+		w = doRequest(CreateCouponBatch, "POST", "/charge/v1/coupons/batch", "/charge/v1/coupons/batch?region=cn-north-1", body)
+		if code := parseResultData(t, w, nil); code != ErrorCodeInvalidParameters {
+			t.Errorf("create batch with %s: %s", body, w.Body.String())
+		}
+	}
+}
+
+func TestCreateCouponBatchMysql(t *testing.T) {
+	setupFakeDB(t)
+
+	w := doRequest(CreateCouponBatch, "POST", "/charge/v1/coupons/batch", "/charge/v1/coupons/batch?region=cn-north-1",
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 1200}`)
+	if len(readCampaignCsv(t, w.Body.String())) != 1200 {
+		t.Fatalf("create batch: %s", w.Body.String())
+	}
+
+	couponInserts, logInserts := 0, 0
+	for _, stmt := range theFakeDriver.log() {
+		switch {
+		case strings.HasPrefix(stmt.query, "insert into DF_COUPON ("):
+			couponInserts++
+			if n := len(stmt.args); n > 500*17 {
+				t.Errorf("too many args in an insert: %d", n)
+			}
+		case strings.HasPrefix(stmt.query, "insert into DF_COUPON_STATUS_LOG"):
+			logInserts++
+		}
+	}
+	if couponInserts != 3 || logInserts != 3 {
+		t.Errorf("%d coupon inserts and %d log inserts, want 3 and 3", couponInserts, logInserts)
+	}
+}
+
+func createTestCampaign(t *testing.T, body string) *models.Campaign {
+	w := doRequest(CreateCampaign, "POST", "/charge/v1/campaigns", "/charge/v1/campaigns?region=cn-north-1", body)
+	campaign := &models.Campaign{}
+	if code := parseResultData(t, w, campaign); code != ErrorCodeNone {
+		t.Fatalf("create campaign: %s", w.Body.String())
+	}
+	return campaign
+}
+
+func createTestBatch(t *testing.T, body string) [][]string {
+	w := doRequest(CreateCouponBatch, "POST", "/charge/v1/coupons/batch", "/charge/v1/coupons/batch?region=cn-north-1", body)
+	if w.Code != 200 {
+		t.Fatalf("create batch: %d %s", w.Code, w.Body.String())
+	}
+	return readCampaignCsv(t, w.Body.String())
+}
+
+func updateTestCampaign(t *testing.T, id, body string) (uint, *models.Campaign) {
+	w := doRequest(UpdateCampaign, "PUT", "/charge/v1/campaigns/:id", "/charge/v1/campaigns/"+id+"?region=cn-north-1", body)
+	campaign := &models.Campaign{}
+	return parseResultData(t, w, campaign), campaign
+}
+
+func retrieveCouponCode(t *testing.T, code string) uint {
+	w := doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+code+"?region=cn-north-1", "")
+	return parseResultData(t, w, nil)
+}
+
+func useCouponCode(t *testing.T, serial, code string) uint {
+	w := doRequest(UseCoupon, "PUT", "/charge/v1/coupons/use/:serial", "/charge/v1/coupons/use/"+serial+"?region=cn-north-1",
+		`{"code": "`+code+`", "namespace": "ns1"}`)
+	return parseResultData(t, w, nil)
+}
+
+func TestCampaignLifecycleOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	campaign := createTestCampaign(t, `{"name": "spring", "budget": 15}`)
+	if campaign.Id != 1 || campaign.Status != models.CampaignStatus_Draft || campaign.Budget != 1500 {
+		t.Fatalf("unexpected campaign: %+v", campaign)
+	}
+
+	coupons := createTestBatch(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 2, "campaign_id": 1}`)
+
+	// a draft campaign is not open yet
+	if code := retrieveCouponCode(t, coupons[0][1]); code != ErrorCodeCampaignNotActive {
+		t.Fatalf("retrieve a coupon of a draft campaign: %d", code)
+	}
+	if code, _ := updateTestCampaign(t, "1", `{"status": "active"}`); code != ErrorCodeNone {
+		t.Fatalf("activate campaign: %d", code)
+	}
+	if code := retrieveCouponCode(t, coupons[0][1]); code != ErrorCodeNone {
+		t.Fatalf("retrieve a coupon of an active campaign: %d", code)
+	}
+
+	// pausing blocks retrieving, providing and using
+	if code, _ := updateTestCampaign(t, "1", `{"status": "paused"}`); code != ErrorCodeNone {
+		t.Fatalf("pause campaign: %d", code)
+	}
+	if code := retrieveCouponCode(t, coupons[0][1]); code != ErrorCodeCampaignNotActive {
+		t.Errorf("retrieve a coupon of a paused campaign: %d", code)
+	}
+	if code := useCouponCode(t, coupons[0][0], coupons[0][1]); code != ErrorCodeCampaignNotActive {
+		t.Errorf("use a coupon of a paused campaign: %d", code)
+	}
+	w := doRequest(ProvideCoupons, "POST", "/charge/v1/provide/coupons", "/charge/v1/provide/coupons", `{"openId": "wx-user-1", "provideTime": 1483584876}`)
+	if code := parseResultData(t, w, nil); code != ErrorNoMoreCoupon {
+		t.Errorf("provide a coupon of a paused campaign: %s", w.Body.String())
+	}
+
+	// resume, then the budget allows only one coupon of 10
+	if code, _ := updateTestCampaign(t, "1", `{"status": "active"}`); code != ErrorCodeNone {
+		t.Fatalf("resume campaign: %d", code)
+	}
+	if code := useCouponCode(t, coupons[0][0], coupons[0][1]); code != ErrorCodeNone {
+		t.Fatalf("use a coupon of a resumed campaign: %d", code)
+	}
+	if code := useCouponCode(t, coupons[1][0], coupons[1][1]); code != ErrorCodeCampaignExhausted {
+		t.Errorf("use a coupon over the budget: %d", code)
+	}
+
+	w = doRequest(RetrieveCampaign, "GET", "/charge/v1/campaigns/:id", "/charge/v1/campaigns/1?region=cn-north-1", "")
+	if code := parseResultData(t, w, campaign); code != ErrorCodeNone || campaign.Spent != 1000 || campaign.Number != 2 {
+		t.Fatalf("retrieve campaign: %s", w.Body.String())
+	}
+
+	// raising the budget lets the second one through
+	if code, _ := updateTestCampaign(t, "1", `{"budget": 20}`); code != ErrorCodeNone {
+		t.Fatalf("raise budget: %d", code)
+	}
+	if code := useCouponCode(t, coupons[1][0], coupons[1][1]); code != ErrorCodeNone {
+		t.Errorf("use a coupon after raising the budget: %d", code)
+	}
+
+	createTestCampaign(t, `{"name": "summer", "status": "active"}`)
+	list := &struct {
+		Total   int64              `json:"total"`
+		Results []*models.Campaign `json:"results"`
+	}{}
+	w = doRequest(QueryCampaignList, "GET", "/charge/v1/campaigns", "/charge/v1/campaigns?status=active&region=cn-north-1", "")
+	if code := parseResultData(t, w, list); code != ErrorCodeNone || list.Total != 2 || list.Results[0].Name != "summer" {
+		t.Fatalf("list campaigns: %s", w.Body.String())
+	}
+
+	// a closed campaign stays closed
+	w = doRequest(CloseCampaign, "DELETE", "/charge/v1/campaigns/:id", "/charge/v1/campaigns/1?region=cn-north-1", "")
+	if code := parseResultData(t, w, campaign); code != ErrorCodeNone || campaign.Status != models.CampaignStatus_Closed {
+		t.Fatalf("close campaign: %s", w.Body.String())
+	}
+	if code, _ := updateTestCampaign(t, "1", `{"status": "active"}`); code != ErrorCodeUpdateCampaign {
+		t.Errorf("reopen a closed campaign: %d", code)
+	}
+	w = doRequest(CreateCouponBatch, "POST", "/charge/v1/coupons/batch", "/charge/v1/coupons/batch?region=cn-north-1",
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 1, "campaign_id": 1}`)
+	if code := parseResultData(t, w, nil); code != ErrorCodeCreateCoupon {
+		t.Errorf("add coupons to a closed campaign: %s", w.Body.String())
+	}
+	if code, _ := updateTestCampaign(t, "3", `{"status": "paused"}`); code != ErrorCodeCampaignNotExist {
+		t.Errorf("update a nonexistent campaign: %d", code)
+	}
+}
+
+func TestCampaignWindowOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	startAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	createTestCampaign(t, `{"name": "later", "status": "active", "start_at": "`+startAt+`"}`)
+	coupons := createTestBatch(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 1, "campaign_id": 1}`)
+
+	if code := useCouponCode(t, coupons[0][0], coupons[0][1]); code != ErrorCodeCampaignNotActive {
+		t.Errorf("use a coupon before the campaign starts: %d", code)
+	}
+
+	endAt := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	if code, _ := updateTestCampaign(t, "1", `{"end_at": "`+endAt+`"}`); code != ErrorCodeUpdateCampaign {
+		t.Errorf("end a campaign before it starts: %d", code)
+	}
+	startAt = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	if code, _ := updateTestCampaign(t, "1", `{"start_at": "`+startAt+`"}`); code != ErrorCodeNone {
+		t.Fatalf("start campaign: %d", code)
+	}
+	if code := useCouponCode(t, coupons[0][0], coupons[0][1]); code != ErrorCodeNone {
+		t.Errorf("use a coupon in the window: %d", code)
+	}
+}
+
+func TestCampaignBudgetRefundedOffline(t *testing.T) {
+	setupMemoryStore(t)
+	flakyRecharge(rechargeMaxAttempts)
+	rechargeRetryBase = 0
+	defer func() {
+		rechargeFunc = couponRecharge
+		rechargeRetryBase = 30 * time.Second
+	}()
+
+	createTestCampaign(t, `{"name": "tight", "status": "active", "budget": 10}`)
+	coupons := createTestBatch(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 1, "campaign_id": 1}`)
+	if code := useCouponCode(t, coupons[0][0], coupons[0][1]); code != ErrorCodeNone {
+		t.Fatalf("use coupon: %d", code)
+	}
+	for i := 0; i < rechargeMaxAttempts; i++ {
+		dispatchRecharges()
+	}
+
+	// the failed recharge gives the budget back with the coupon
+	campaign, _ := getCouponStore().RetrieveCampaign(1)
+	if campaign.Spent != 0 {
+		t.Fatalf("spent = %v after compensation, want 0", campaign.Spent)
+	}
+	if code := useCouponCode(t, coupons[0][0], coupons[0][1]); code != ErrorCodeNone {
+		t.Errorf("use a compensated coupon: %d", code)
+	}
+}
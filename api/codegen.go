@@ -0,0 +1,351 @@
+package api
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+//=============================================================
+// serials and codes are drawn from crypto/rand, so they can't be
+// guessed and don't repeat after a restart. The last character of
+// a code is a Luhn mod N check character over the code alphabet.
+//=============================================================
+
+const (
+	letterBytes = "abcdefghjklmnpqrstuvwxyz0123456789"
+	randNumber  = "0123456789"
+
+	// 19 random characters and the check character, 5 groups of 4
+	// for humans, and longer than the legacy codes.
+	defaultCodeLength   = 20
+	defaultSerialLength = 15
+
+	// SERIAL and CODE are VARCHAR(64), a serial is "df" + digits + "r".
+	maxCodeLength   = 64
+	maxSerialLength = 61
+
+	// a collision with an existing serial or code is retried with new ones.
+	maxCodeCollisionRetries = 5
+
+	// codes issued before the check character, kept valid while
+	// COUPON_LEGACY_CODES is not "no". They have no check character, so
+	// only the codes of another shape are checked meanwhile.
+	legacyCodeLength   = 16
+	legacyCodeAlphabet = letterBytes
+)
+
+var legacyCodesAllowed = true
+
+// promo codes are chosen by the admins for the multi-use coupons, such as
+// "NEWYEAR2027". They have no check character, so they are shorter than
+// the legacy codes and mix letters and digits, and the typos of the other
+// codes or plain words are still rejected without a trip to the database.
+const (
+	minPromoCodeLength = 6
+	maxPromoCodeLength = legacyCodeLength - 1
+)
+
+// confusables maps the characters people mix up, a character is only
+// replaced if it is not in the alphabet and its partner is.
+var confusables = map[byte][]byte{
+	'o': {'0'}, '0': {'o'},
+	'i': {'1', 'l'}, 'l': {'1', 'i'}, '1': {'l', 'i'},
+}
+
+// codeGenerator draws length characters uniformly from alphabet.
+type codeGenerator struct {
+	alphabet string
+	length   int
+	source   io.Reader
+}
+
+var (
+	serialGen = &codeGenerator{alphabet: randNumber, length: defaultSerialLength, source: rand.Reader}
+	codeGen   = &codeGenerator{alphabet: letterBytes, length: defaultCodeLength, source: rand.Reader}
+)
+
+// newCodeGenerator validates the alphabet and length. Codes are saved in
+// lower case, so the alphabet is too, and must not repeat a character.
+func newCodeGenerator(alphabet string, length, maxLength int) (*codeGenerator, error) {
+	alphabet = strings.ToLower(alphabet)
+	if len(alphabet) < 2 || len(alphabet) > 256 {
+		return nil, fmt.Errorf("alphabet should have 2 to 256 characters: %q", alphabet)
+	}
+	for i := 0; i < len(alphabet); i++ {
+		if alphabet[i] <= ' ' || alphabet[i] > '~' || strings.IndexByte(alphabet[i+1:], alphabet[i]) >= 0 {
+			return nil, fmt.Errorf("alphabet should have distinct printable ascii characters: %q", alphabet)
+		}
+	}
+	if length < 8 || length > maxLength {
+		return nil, fmt.Errorf("length should be in [8, %d]: %d", maxLength, length)
+	}
+	return &codeGenerator{alphabet: alphabet, length: length, source: rand.Reader}, nil
+}
+
+// generate rejects the random bytes beyond the largest multiple of the
+// alphabet size, so every character is equally likely.
+func (g *codeGenerator) generate() (string, error) {
+	n := len(g.alphabet)
+	limit := 256 - 256%n
+	b := make([]byte, g.length)
+	buf := make([]byte, g.length)
+	for i := 0; i < len(b); {
+		if _, err := io.ReadFull(g.source, buf); err != nil {
+			return "", err
+		}
+		for _, r := range buf {
+			if int(r) < limit && i < len(b) {
+				b[i] = g.alphabet[int(r)%n]
+				i++
+			}
+		}
+	}
+	return string(b), nil
+}
+
+// initCodeGenerators configures the generators with COUPON_CODE_ALPHABET,
+// COUPON_CODE_LENGTH and COUPON_SERIAL_LENGTH. Serials are always digits.
+func initCodeGenerators() {
+	alphabet := os.Getenv("COUPON_CODE_ALPHABET")
+	if alphabet == "" {
+		alphabet = letterBytes
+	}
+	if g, err := newCodeGenerator(alphabet, envInt("COUPON_CODE_LENGTH", defaultCodeLength), maxCodeLength); err != nil {
+		logger.Error("Invalid code generator config: %v, use the default.", err)
+	} else {
+		codeGen = g
+	}
+
+	if g, err := newCodeGenerator(randNumber, envInt("COUPON_SERIAL_LENGTH", defaultSerialLength), maxSerialLength); err != nil {
+		logger.Error("Invalid serial generator config: %v, use the default.", err)
+	} else {
+		serialGen = g
+	}
+	legacyCodesAllowed = os.Getenv("COUPON_LEGACY_CODES") != "no"
+	logger.Info("Coupon code: %d of %q, serial: %d digits, legacy codes allowed: %v.",
+		codeGen.length, codeGen.alphabet, serialGen.length, legacyCodesAllowed)
+}
+
+func envInt(name string, defaultValue int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		logger.Error("Invalid %s (%s): %v", name, s, err)
+		return defaultValue
+	}
+	return n
+}
+
+// crypto/rand doesn't fail on the supported platforms, if it does the
+// service can't issue coupons safely at all.
+func mustGenerate(g *codeGenerator) string {
+	s, err := g.generate()
+	if err != nil {
+		panic(fmt.Sprintf("generate random code err: %v", err))
+	}
+	return s
+}
+
+func genSerial() string {
+	return "df" + mustGenerate(serialGen) + "r"
+}
+
+// genCode returns length-1 random characters and the check character.
+func genCode() string {
+	g := *codeGen
+	g.length--
+	payload := mustGenerate(&g)
+	return payload + string(codeGen.checkChar(payload))
+}
+
+// luhnSum is the Luhn mod N sum of code, doubling every second character
+// from the right, starting at the rightmost one if double is set.
+func (g *codeGenerator) luhnSum(code string, double bool) int {
+	n := len(g.alphabet)
+	sum := 0
+	for i := len(code) - 1; i >= 0; i-- {
+		addend := strings.IndexByte(g.alphabet, code[i])
+		if double {
+			addend *= 2
+			addend = addend/n + addend%n
+		}
+		sum += addend
+		double = !double
+	}
+	return sum % n
+}
+
+func (g *codeGenerator) checkChar(payload string) byte {
+	n := len(g.alphabet)
+	return g.alphabet[(n-g.luhnSum(payload, true))%n]
+}
+
+// valid reports whether code has the length, the alphabet and the check
+// character of g. code must be normalized.
+func (g *codeGenerator) valid(code string) bool {
+	if len(code) != g.length {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(g.alphabet, code[i]) < 0 {
+			return false
+		}
+	}
+	return g.luhnSum(code, false) == 0
+}
+
+// normalize drops the dashes and spaces people type or copy, lowers the
+// case and replaces the confusables, so "ABCD-EFGH 1JKL-MN0P" is read
+// as the code it was printed for.
+func (g *codeGenerator) normalize(code string) string {
+	b := make([]byte, 0, len(code))
+	for _, r := range strings.ToLower(code) {
+		if r == '-' || r == ' ' || r == '\t' {
+			continue
+		}
+		if r > '~' {
+			return code // not a code, left for validate to reject
+		}
+		c := byte(r)
+		if strings.IndexByte(g.alphabet, c) < 0 {
+			for _, partner := range confusables[c] {
+				if strings.IndexByte(g.alphabet, partner) >= 0 {
+					c = partner
+					break
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// validateCode normalizes a code typed by a user, and rejects it if it
+// can't be a code, without a trip to the database.
+func validateCode(code string) (string, *Error) {
+	normalized := codeGen.normalize(code)
+	if codeGen.valid(normalized) || legacyCodesAllowed && isLegacyCode(normalized) {
+		return normalized, nil
+	}
+	if promo := normalizePromoCode(code); isPromoCode(promo) {
+		return promo, nil
+	}
+	return "", GetError(ErrorCodeInvalidCouponCode)
+}
+
+// validatePromoCode normalizes the promo code of a new coupon, and rejects
+// it if it can't be told from the other codes.
+func validatePromoCode(code string) (string, error) {
+	promo := normalizePromoCode(code)
+	if !isPromoCode(promo) {
+		return "", fmt.Errorf("code should be %d to %d characters of both letters and digits, but not %d",
+			minPromoCodeLength, maxPromoCodeLength, codeGen.length)
+	}
+	return promo, nil
+}
+
+// normalizePromoCode drops the dashes and spaces and lowers the case, the
+// confusables are not replaced as a promo code is spelled by the admins.
+func normalizePromoCode(code string) string {
+	b := make([]byte, 0, len(code))
+	for _, r := range strings.ToLower(code) {
+		if r == '-' || r == ' ' || r == '\t' {
+			continue
+		}
+		if r > '~' {
+			return code // not a code, left for isPromoCode to reject
+		}
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+func isPromoCode(code string) bool {
+	if len(code) < minPromoCodeLength || len(code) > maxPromoCodeLength || len(code) == codeGen.length {
+		return false
+	}
+	letters, digits := 0, 0
+	for i := 0; i < len(code); i++ {
+		switch c := code[i]; {
+		case 'a' <= c && c <= 'z':
+			letters++
+		case '0' <= c && c <= '9':
+			digits++
+		default:
+			return false
+		}
+	}
+	return letters > 0 && digits > 0
+}
+
+func isLegacyCode(code string) bool {
+	if len(code) != legacyCodeLength {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(legacyCodeAlphabet, code[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// formatCode groups a code by 4 characters for humans, XXXX-XXXX-XXXX-XXXX.
+func formatCode(code string) string {
+	groups := make([]string, 0, len(code)/4+1)
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	groups = append(groups, code)
+	return strings.ToUpper(strings.Join(groups, "-"))
+}
+
+// loggedURL is r.URL for the logs, the code in /charge/v1/coupons/:code is
+// masked but its first 4 characters, as the codes must not be logged.
+func loggedURL(r *http.Request) string {
+	const prefix = "/charge/v1/coupons/"
+	if !strings.HasPrefix(r.URL.Path, prefix) || r.Method != "GET" && r.Method != "POST" {
+		return r.URL.String()
+	}
+
+	code, rest := r.URL.Path[len(prefix):], ""
+	if i := strings.Index(code, "/"); i >= 0 {
+		code, rest = code[:i], code[i:]
+	}
+	switch code {
+	case "batch", "offline", "evaluate":
+		return r.URL.String()
+	}
+	if len(code) > 4 {
+		code = code[:4]
+	}
+
+	masked := prefix + code + "****" + rest
+	if r.URL.RawQuery != "" {
+		masked += "?" + r.URL.RawQuery
+	}
+	return masked
+}
+
+// retryOnCodeCollision calls create until it doesn't fail for a taken
+// serial or code, create must generate new ones on each call.
+func retryOnCodeCollision(create func() error) error {
+	for i := 0; ; i++ {
+		err := create()
+		if err != models.ErrCouponCodeConflict || i == maxCodeCollisionRetries {
+			return err
+		}
+		logger.Warn("Coupon serial or code collision, retry (%d).", i+1)
+	}
+}
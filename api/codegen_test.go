@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Each round re-initializes the generators as a process start does, the
+// old unseeded math/rand generator gave the same codes in every round.
+func TestCodesUniqueAcrossRestarts(t *testing.T) {
+	defer initCodeGenerators()
+
+	serials, codes := map[string]bool{}, map[string]bool{}
+	for restart := 0; restart < 5; restart++ {
+		initCodeGenerators()
+		for i := 0; i < 2000; i++ {
+			serial, code := genSerial(), genCode()
+			if serials[serial] || codes[code] {
+				t.Fatalf("restart %d: %s/%s is generated before", restart, serial, code)
+			}
+			serials[serial], codes[code] = true, true
+		}
+	}
+}
+
+func TestCodeGeneratorConfig(t *testing.T) {
+	os.Setenv("COUPON_CODE_ALPHABET", "ABCDEFGH23456789")
+	os.Setenv("COUPON_CODE_LENGTH", "20")
+	defer func() {
+		os.Unsetenv("COUPON_CODE_ALPHABET")
+		os.Unsetenv("COUPON_CODE_LENGTH")
+		initCodeGenerators()
+	}()
+	initCodeGenerators()
+
+	code := genCode()
+	if len(code) != 20 || strings.Trim(code, "abcdefgh23456789") != "" {
+		t.Errorf("unexpected code: %s", code)
+	}
+	if serial := genSerial(); len(serial) != 2+defaultSerialLength+1 || !strings.HasPrefix(serial, "df") {
+		t.Errorf("unexpected serial: %s", serial)
+	}
+
+	for _, c := range []struct {
+		alphabet string
+		length   int
+	}{
+		{"a", 16},
+		{"abca", 16},
+		{"ab c", 16},
+		{"abcd", 7},
+		{"abcd", 65},
+	} {
+		if _, err := newCodeGenerator(c.alphabet, c.length, maxCodeLength); err == nil {
+			t.Errorf("newCodeGenerator(%q, %d) should fail", c.alphabet, c.length)
+		}
+	}
+}
+
+// repeatSource makes the next times draws of g the same, then goes on
+// with crypto/rand.
+func repeatSource(g *codeGenerator, times int) io.Reader {
+	return io.MultiReader(bytes.NewReader(make([]byte, g.length*times)), rand.Reader)
+}
+
+func TestCreateCouponRetriesOnCollision(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() {
+		rechargeFunc = couponRecharge
+		serialGen.source, codeGen.source = rand.Reader, rand.Reader
+	}()
+
+	serialGen.source, codeGen.source = repeatSource(serialGen, 2), repeatSource(codeGen, 2)
+	first := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	second := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	if first.Serial == second.Serial || first.Code == second.Code {
+		t.Fatalf("collision is not retried: %+v %+v", first, second)
+	}
+
+	// a collision inside a batch is retried too
+	serialGen.source, codeGen.source = repeatSource(serialGen, 2), repeatSource(codeGen, 2)
+	coupons := createTestBatch(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "number": 2}`)
+	if len(coupons) != 2 || coupons[0][1] == coupons[1][1] {
+		t.Fatalf("collision in a batch is not retried: %v", coupons)
+	}
+}
+
+func TestCodeCheckCharacter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code := genCode()
+		if len(code) != defaultCodeLength || !codeGen.valid(code) {
+			t.Fatalf("generated code %s is not valid", code)
+		}
+
+		// every single typo is caught
+		for j := 0; j < len(code); j++ {
+			for k := 0; k < len(codeGen.alphabet); k++ {
+				if typo := code[:j] + codeGen.alphabet[k:k+1] + code[j+1:]; typo != code && codeGen.valid(typo) {
+					t.Fatalf("typo %s of %s is valid", typo, code)
+				}
+			}
+		}
+	}
+}
+
+func TestValidatePromoCode(t *testing.T) {
+	for typed, want := range map[string]string{
+		"NEWYEAR2027":   "newyear2027",
+		"new-year 2027": "newyear2027",
+		"SAVE10":        "save10",
+		"O0IL1O":        "o0il1o", // the confusables are kept
+	} {
+		if promo, err := validatePromoCode(typed); err != nil || promo != want {
+			t.Errorf("validatePromoCode(%q) = %q, %v, want %q", typed, promo, err, want)
+		}
+		if normalized, e := validateCode(typed); e != nil || normalized != want {
+			t.Errorf("validateCode(%q) = %q, %v, want %q", typed, normalized, e, want)
+		}
+	}
+
+	// too short or long, without letters or digits, or of other characters.
+	for _, typed := range []string{"sav1", "newyearparty", "20272027", "newyear2027abcdef", "newyear_2027", "新年2027abc"} {
+		if _, err := validatePromoCode(typed); err == nil {
+			t.Errorf("promo code %q is not rejected", typed)
+		}
+		if _, e := validateCode(typed); e == nil {
+			t.Errorf("malformed code %q is not rejected", typed)
+		}
+	}
+}
+
+func TestValidateCode(t *testing.T) {
+	defer func() { legacyCodesAllowed = true }()
+
+	payload := "0011abcdefghjklmnpq"
+	code := payload + string(codeGen.checkChar(payload))
+	for _, typed := range []string{
+		code,
+		strings.ToUpper(code),
+		formatCode(code),
+		"OOII-" + strings.ToUpper(code[4:8]) + " " + code[8:],
+	} {
+		if normalized, e := validateCode(typed); e != nil || normalized != code {
+			t.Errorf("validateCode(%q) = %q, %v, want %q", typed, normalized, e, code)
+		}
+	}
+
+	mistyped := "1011" + code[4:]
+	if _, e := validateCode(mistyped); e == nil || e.code != ErrorCodeInvalidCouponCode {
+		t.Errorf("mistyped code %s is not rejected", mistyped)
+	}
+	for _, typed := range []string{"", "abc", code + "a", "中文中文中文中文中文中文中文中文"} {
+		if _, e := validateCode(typed); e == nil {
+			t.Errorf("malformed code %q is not rejected", typed)
+		}
+	}
+
+	// a code issued before the check character
+	legacy := "abcdefghjklmnpqr"
+	if codeGen.valid(legacy) {
+		t.Fatalf("bad test data, %s has a valid check character", legacy)
+	}
+	if _, e := validateCode(legacy); e != nil {
+		t.Errorf("legacy code is rejected: %v", e)
+	}
+	legacyCodesAllowed = false
+	if _, e := validateCode(legacy); e == nil {
+		t.Errorf("legacy code is accepted when it is not allowed")
+	}
+}
+
+func TestRetrieveMistypedCouponOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	if code := retrieveCouponCode(t, formatCode(created.Code)); code != ErrorCodeNone {
+		t.Errorf("retrieve coupon by the formatted code: %d", code)
+	}
+
+	typo := []byte(strings.ToLower(created.Code))
+	typo[3] = codeGen.alphabet[(strings.IndexByte(codeGen.alphabet, typo[3])+1)%len(codeGen.alphabet)]
+	if code := retrieveCouponCode(t, string(typo)); code != ErrorCodeInvalidCouponCode {
+		t.Errorf("retrieve coupon by a mistyped code: %d", code)
+	}
+	if code := useCouponCode(t, created.Serial, string(typo)); code != ErrorCodeInvalidCouponCode {
+		t.Errorf("use coupon by a mistyped code: %d", code)
+	}
+	if code := useCouponCode(t, created.Serial, formatCode(created.Code)); code != ErrorCodeNone {
+		t.Errorf("use coupon by the formatted code: %d", code)
+	}
+}
+
+func TestLoggedURL(t *testing.T) {
+	for _, c := range []struct{ method, url, want string }{
+		{"GET", "/charge/v1/coupons/abcd-efgh-jkmn?region=cn-north-1", "/charge/v1/coupons/abcd****?region=cn-north-1"},
+		{"POST", "/charge/v1/coupons/abcdefghjkmn/holds", "/charge/v1/coupons/abcd****/holds"},
+		{"POST", "/charge/v1/coupons/abcdefghjkmn/claim", "/charge/v1/coupons/abcd****/claim"},
+		{"POST", "/charge/v1/coupons/evaluate?region=cn-north-1", "/charge/v1/coupons/evaluate?region=cn-north-1"},
+		{"DELETE", "/charge/v1/coupons/serial0001", "/charge/v1/coupons/serial0001"},
+		{"GET", "/charge/v1/coupons?page=2", "/charge/v1/coupons?page=2"},
+	} {
+		r, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := loggedURL(r); got != c.want {
+			t.Errorf("loggedURL(%s %s) = %s, want %s", c.method, c.url, got, c.want)
+		}
+	}
+}
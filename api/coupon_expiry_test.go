@@ -0,0 +1,131 @@
+package api
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func TestExpireCouponsOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	overdue := createTestCoupon(t, `{"kind": "recharge", "expire_on": -2, "amount": 10}`)
+	alive := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+
+	store := getCouponStore()
+	if n, err := store.ExpireCoupons(time.Now(), 100); err != nil || n != 1 {
+		t.Fatalf("ExpireCoupons = %d, %v, want 1", n, err)
+	}
+	if n, _ := store.ExpireCoupons(time.Now(), 100); n != 0 {
+		t.Fatalf("an expired coupon is expired again")
+	}
+
+	// an expired coupon is never provided.
+	_, codes, err := store.ProvideCoupon("2", "", "local", genCode)
+	if err != nil || len(codes) != 1 {
+		t.Fatalf("provided %v, %v, want 1 code", codes, err)
+	}
+	if provided, _ := store.RetrieveCouponByID(codes[0], "local"); provided == nil || !strings.EqualFold(provided.Serial, alive.Serial) {
+		t.Fatalf("provided %v, want %s", provided, alive.Serial)
+	}
+
+	history, _ := store.CouponStatusHistory(overdue.Serial)
+	last := history[len(history)-1]
+	if last.To != models.CouponStatus_Expired || last.Operator != models.Operator_System {
+		t.Errorf("last transition = %+v", last)
+	}
+}
+
+func TestExpireCouponsMysql(t *testing.T) {
+	setupFakeDB(t)
+
+	theFakeDriver.queryHook = func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if strings.HasPrefix(query, "select SERIAL, STATUS from") {
+			return []string{"SERIAL", "STATUS"}, [][]driver.Value{{args[len(args)-2], "provided"}}
+		}
+		return []string{"SERIAL"}, [][]driver.Value{{"df1r"}, {"df2r"}}
+	}
+	theFakeDriver.execHook = func(query string, args []driver.Value) int64 {
+		// df2r is used by someone after it is listed.
+		if strings.HasPrefix(query, "update DF_COUPON") && args[len(args)-2] == "df2r" {
+			return 0
+		}
+		return 1
+	}
+
+	n, err := getCouponStore().ExpireCoupons(time.Now(), 100)
+	if err != nil || n != 1 {
+		t.Fatalf("ExpireCoupons = %d, %v, want 1", n, err)
+	}
+
+	for _, stmt := range theFakeDriver.log() {
+		if strings.HasPrefix(stmt.query, "select SERIAL") &&
+			!strings.Contains(stmt.query, "STATUS in (?, ?, ?) and EXPIRE_ON <= ?") {
+			t.Errorf("overdue coupons are not checked: %s", stmt.query)
+		}
+	}
+}
+
+func TestExpireTime(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	ServiceLocation = shanghai
+	defer func() { ServiceLocation = time.UTC }()
+
+	// 2017-01-05 17:00 in Shanghai
+	now := time.Date(2017, 1, 5, 9, 0, 0, 0, time.UTC)
+	cases := []struct {
+		expireOn string
+		endOfDay bool
+		want     time.Time
+	}{
+		{`30`, false, now.Add(30 * 24 * time.Hour)},
+		{`"2017-02-01T12:00:00+08:00"`, false, time.Date(2017, 2, 1, 4, 0, 0, 0, time.UTC)},
+		{`"2017-02-01T12:00:00Z"`, false, time.Date(2017, 2, 1, 12, 0, 0, 0, time.UTC)},
+		// the end of 2017-01-06 in Shanghai
+		{`1`, true, time.Date(2017, 1, 6, 16, 0, 0, 0, time.UTC)},
+		// 2017-02-01 20:00 in Shanghai
+		{`"2017-02-01T12:00:00Z"`, true, time.Date(2017, 2, 1, 16, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		info := &createInfo{ExpireOn: []byte(c.expireOn), EndOfDay: c.endOfDay}
+		got, err := info.expireTime(now)
+		if err != nil || !got.Equal(c.want) || got.Location() != time.UTC {
+			t.Errorf("expireTime(%s, %v) = %v, %v, want %v", c.expireOn, c.endOfDay, got, err, c.want)
+		}
+	}
+
+	for _, bad := range []string{`"2017-02-01"`, `1.5`, `true`} {
+		info := &createInfo{ExpireOn: []byte(bad)}
+		if _, err := info.expireTime(now); err == nil {
+			t.Errorf("expireTime(%s) is accepted", bad)
+		}
+	}
+}
+
+func TestUseExpiredCouponOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	expireOn := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": "`+expireOn+`", "amount": 10}`)
+
+	usePath := "/charge/v1/coupons/use/" + created.Serial + "?region=cn-north-1"
+	useBody := `{"code": "` + created.Code + `", "namespace": "ns1"}`
+	w := doRequest(UseCoupon, "PUT", "/charge/v1/coupons/use/:serial", usePath, useBody)
+	if code := parseResultData(t, w, nil); code != ErrorCodeCouponHasExpired {
+		t.Fatalf("use an expired coupon: %s", w.Body.String())
+	}
+
+	w = doRequest(CreateCoupon, "POST", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1",
+		`{"kind": "recharge", "expire_on": "next week", "amount": 10}`)
+	if code := parseResultData(t, w, nil); code != ErrorCodeInvalidParameters {
+		t.Fatalf("create with a bad expire_on: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+// couponFilterFromQuery reads the filters of the coupon list from the query
+// of r. Times are RFC3339 or dates like 2006-01-02 in UTC, amounts are in
+// yuan.
+func couponFilterFromQuery(r *http.Request) (*models.CouponFilter, *Error) {
+	filter := &models.CouponFilter{
+		Kind:         r.Form.Get("kind"),
+		Status:       models.CouponStatus(r.Form.Get("status")),
+		Username:     r.Form.Get("username"),
+		Namespace:    r.Form.Get("namespace"),
+		SerialPrefix: r.Form.Get("serial_prefix"),
+	}
+
+	var err error
+	for _, p := range []struct {
+		name   string
+		amount **models.Amount
+	}{{"min_amount", &filter.MinAmount}, {"max_amount", &filter.MaxAmount}} {
+		if s := r.Form.Get(p.name); s != "" && err == nil {
+			var amount models.Amount
+			if amount, err = models.ValidateAmount(s); err != nil {
+				err = fmt.Errorf("invalid %s: %s", p.name, s)
+			}
+			*p.amount = &amount
+		}
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"create_from", &filter.CreateFrom}, {"create_to", &filter.CreateTo},
+		{"expire_from", &filter.ExpireFrom}, {"expire_to", &filter.ExpireTo},
+		{"use_from", &filter.UseFrom}, {"use_to", &filter.UseTo},
+	} {
+		if s := r.Form.Get(p.name); s != "" && err == nil {
+			*p.t, err = parseQueryTime(p.name, s)
+		}
+	}
+	if s := r.Form.Get("campaign_id"); s != "" && err == nil {
+		if filter.CampaignId, err = strconv.ParseInt(s, 10, 64); err != nil {
+			err = fmt.Errorf("invalid campaign_id: %s", s)
+		}
+	}
+	if err == nil {
+		err = filter.Validate()
+	}
+	if err != nil {
+		return nil, GetError2(ErrorCodeInvalidParameters, err.Error())
+	}
+	return filter, nil
+}
+
+func parseQueryTime(name, s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s: %s", name, s)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func queryCouponList(t *testing.T, query string) ([]*models.CouponRecord, uint) {
+	w := doRequest(QueryCouponList, "GET", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1&"+query, "")
+	var records []*models.CouponRecord
+	list := &QueryListResult{Results: &records}
+	return records, parseResultData(t, w, list)
+}
+
+func TestQueryCouponListFiltersOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	small := createTestCoupon(t, `{"kind": "recharge", "expire_on": 10, "amount": 10}`)
+	large := createTestCoupon(t, `{"kind": "recharge", "expire_on": 20, "amount": 100}`)
+	createTestCoupon(t, `{"kind": "percentage", "expire_on": 30, "amount": 50, "percent_off": 20}`)
+	if err := redeemAs(t, large, "alice"); err != nil {
+		t.Fatalf("use a coupon: %v", err)
+	}
+
+	cases := []struct {
+		query   string
+		serials []string
+	}{
+		{"kind=recharge&orderby=amount&sortorder=asc", []string{small.Serial, large.Serial}},
+		{"kind=recharge&orderby=amount", []string{large.Serial, small.Serial}},
+		{"kind=recharge&min_amount=20&max_amount=100", []string{large.Serial}},
+		{"status=used&username=alice&namespace=alice", []string{large.Serial}},
+		{"status=available&kind=recharge", []string{small.Serial}},
+		{"use_from=2000-01-01", []string{large.Serial}},
+		{"serial_prefix=" + small.Serial, []string{small.Serial}},
+		{"username=bob", nil},
+	}
+	for _, c := range cases {
+		records, code := queryCouponList(t, c.query)
+		if code != ErrorCodeNone || len(records) != len(c.serials) {
+			t.Errorf("%s: %d %d records", c.query, code, len(records))
+			continue
+		}
+		for i, serial := range c.serials {
+			if !strings.EqualFold(records[i].Serial, serial) {
+				t.Errorf("%s: records[%d] = %s, want %s", c.query, i, records[i].Serial, serial)
+			}
+		}
+	}
+
+	// the admins see the whole record.
+	records, _ := queryCouponList(t, "status=used")
+	if len(records) != 1 || records[0].UseTime == nil || records[0].CreateAt.IsZero() || records[0].Kind != models.CouponKind_Recharge {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+
+	for _, query := range []string{"orderby=CREATE_TIME", "status=lost", "min_amount=x", "create_from=yesterday",
+		"min_amount=100&max_amount=10", "campaign_id=abc"} {
+		if _, code := queryCouponList(t, query); code != ErrorCodeInvalidParameters {
+			t.Errorf("%s: %d", query, code)
+		}
+	}
+}
+
+func pageCouponList(t *testing.T, query string) (*models.CouponPage, uint) {
+	w := doRequest(QueryCouponList, "GET", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1&"+query, "")
+	page := &models.CouponPage{}
+	return page, parseResultData(t, w, page)
+}
+
+func TestQueryCouponListCursorOffline(t *testing.T) {
+	setupMemoryStore(t)
+
+	// the same amounts are ordered by the ids.
+	var serials []string
+	for _, amount := range []int{10, 10, 20, 10, 30} {
+		created := createTestCoupon(t, fmt.Sprintf(`{"kind": "recharge", "expire_on": 30, "amount": %d}`, amount))
+		serials = append(serials, strings.ToLower(created.Serial))
+	}
+	want := []string{serials[0], serials[1], serials[3], serials[2], serials[4]}
+
+	var got []string
+	var pages []*models.CouponPage
+	query := "orderby=amount&sortorder=asc&size=2&total=true&cursor="
+	for cursor := ""; ; {
+		page, code := pageCouponList(t, query+cursor)
+		if code != ErrorCodeNone || page.Total == nil || *page.Total != 5 {
+			t.Fatalf("page after %q: %d %+v", cursor, code, page)
+		}
+		for _, r := range page.Results {
+			got = append(got, r.Serial)
+		}
+		pages = append(pages, page)
+		if cursor = page.Next; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("paged %v, want %v", got, want)
+	}
+	if len(pages) != 3 || pages[0].Prev != "" || pages[2].Prev == "" {
+		t.Fatalf("unexpected pages: %+v", pages)
+	}
+
+	// back from the last page.
+	page, code := pageCouponList(t, "orderby=amount&sortorder=asc&size=2&cursor="+pages[2].Prev)
+	if code != ErrorCodeNone || page.Total != nil || len(page.Results) != 2 ||
+		page.Results[0].Serial != want[2] || page.Results[1].Serial != want[3] || page.Prev == "" || page.Next == "" {
+		t.Fatalf("previous page: %d %+v", code, page)
+	}
+
+	// a cursor is only valid for its sort.
+	for _, query := range []string{"cursor=x", "orderby=amount&sortorder=desc&cursor=" + pages[0].Next, "cursor=" + pages[0].Next} {
+		if _, code := pageCouponList(t, query); code != ErrorCodeInvalidParameters {
+			t.Errorf("%s: %d", query, code)
+		}
+	}
+}
+
+func TestQueryCouponListCursorSql(t *testing.T) {
+	setupFakeDB(t)
+	AdminUsers = []string{"local"}
+
+	if _, code := pageCouponList(t, "cursor="); code != ErrorCodeNone {
+		t.Fatalf("first page: %d", code)
+	}
+	stmts := theFakeDriver.log()
+	if len(stmts) == 0 {
+		t.Fatalf("no statement issued")
+	}
+	for _, stmt := range stmts {
+		if q := strings.ToLower(stmt.query); strings.Contains(q, "count(") || strings.Contains(q, "offset") {
+			t.Errorf("a page by cursor is not by keys: %s", stmt.query)
+		}
+	}
+}
@@ -2,43 +2,151 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/asiainfoLDP/datafoundry_coupon/common"
 	"github.com/asiainfoLDP/datafoundry_coupon/log"
 	"github.com/asiainfoLDP/datafoundry_coupon/models"
 	"github.com/julienschmidt/httprouter"
-	"math/rand"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 )
 
-const (
-	letterBytes = "abcdefghjklmnpqrstuvwxyz0123456789"
-	randNumber  = "0123456789"
-)
-
 var logger = log.GetLogger()
 
 var AdminUsers = make([]string, 0)
 
+// ServiceLocation is the timezone in which "end of day" is computed.
+var ServiceLocation = time.UTC
+
+var couponStore models.CouponStore
+
+// SetCouponStore injects the storage used by all coupon handlers.
+func SetCouponStore(store models.CouponStore) {
+	couponStore = store
+}
+
+func getCouponStore() models.CouponStore {
+	if couponStore == nil || !couponStore.Available() {
+		return nil
+	}
+	return couponStore
+}
+
 func init() {
 	initAdminUser()
+	initServiceLocation()
+	initCodeGenerators()
+	initOfflineKey()
+	initAttemptLimits()
 }
 
 type createInfo struct {
-	Kind     string  `json:"kind,omitempty"`
-	ExpireOn int     `json:"expire_on,omitempty"`
-	Amount   float32 `json:"amount,omitempty"`
+	Kind     string          `json:"kind,omitempty"`
+	Amount   models.Amount   `json:"amount,omitempty"`
+	Currency models.Currency `json:"currency,omitempty"`
+
+	// the terms of the discount kinds, see models.CouponTerms.
+	PercentOff int           `json:"percent_off,omitempty"`
+	MinSpend   models.Amount `json:"min_spend,omitempty"`
+	PlanId     string        `json:"plan_id,omitempty"`
+
+	// a coupon is single use without MaxRedemptions, PerUserLimit 0 is no limit.
+	MaxRedemptions int `json:"max_redemptions,omitempty"`
+	PerUserLimit   int `json:"per_user_limit,omitempty"`
+
+	// only BoundUsername can use the coupon, in the namespaces matching
+	// BoundNamespace, which may be a glob pattern such as "team-*".
+	BoundUsername  string `json:"bound_username,omitempty"`
+	BoundNamespace string `json:"bound_namespace,omitempty"`
+
+	// ExpireOn is a day count or a RFC 3339 timestamp, if EndOfDay is set,
+	// the coupon expires at the end of that day in ServiceLocation.
+	ExpireOn json.RawMessage `json:"expire_on,omitempty"`
+	EndOfDay bool            `json:"end_of_day,omitempty"`
+}
+
+// couponCreateInfo is the createInfo of a single coupon, a multi-use coupon
+// may have a promo code chosen by the admin instead of a generated one.
+type couponCreateInfo struct {
+	createInfo
+	Code string `json:"code,omitempty"`
+}
+
+// coupon validates info and returns the coupon to create, without serial and code.
+func (info *createInfo) coupon(now time.Time) (*models.Coupon, error) {
+	//转换成过期时间
+	expireOn, err := info.expireTime(now)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, err := models.ValidateKind(info.Kind)
+	if err != nil {
+		return nil, err
+	}
+	currency, err := models.ValidateCurrency(info.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	coupon := &models.Coupon{
+		Kind:       kind,
+		ExpireOn:   expireOn,
+		Amount:     info.Amount,
+		Currency:   currency,
+		PercentOff: info.PercentOff,
+		MinSpend:   info.MinSpend,
+		PlanId:     info.PlanId,
+
+		MaxRedemptions: info.MaxRedemptions,
+		PerUserLimit:   info.PerUserLimit,
+	}
+	if err := models.ValidateTerms(coupon.Terms()); err != nil {
+		return nil, err
+	}
+	if err := models.ValidateLimits(coupon.MaxRedemptions, coupon.PerUserLimit); err != nil {
+		return nil, err
+	}
+	coupon.BoundUsername, coupon.BoundNamespace, err = models.ValidateBinding(info.BoundUsername, info.BoundNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// expireTime converts the expire_on of a create request to an instant.
+func (info *createInfo) expireTime(now time.Time) (time.Time, error) {
+	var expireOn time.Time
+
+	var days int
+	var timestamp string
+	if err := json.Unmarshal(info.ExpireOn, &days); err == nil {
+		expireOn = now.Add(time.Hour * 24 * time.Duration(days))
+	} else if err := json.Unmarshal(info.ExpireOn, &timestamp); err == nil {
+		expireOn, err = time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("expire_on should be a day count or a RFC 3339 timestamp: %v", err)
+		}
+	} else {
+		return time.Time{}, fmt.Errorf("expire_on should be a day count or a RFC 3339 timestamp: %s", info.ExpireOn)
+	}
+
+	if info.EndOfDay {
+		y, m, d := expireOn.In(ServiceLocation).Date()
+		expireOn = time.Date(y, m, d+1, 0, 0, 0, 0, ServiceLocation)
+	}
+	return expireOn.UTC(), nil
 }
 
 func CreateCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	logger.Info("Request url: POST %v.", r.URL)
 	logger.Info("Begin create coupon handler.")
 
-	db := models.GetDB()
-	if db == nil {
-		logger.Warn("Get db is nil.")
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
 		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
 		return
 	}
@@ -59,8 +167,8 @@ func CreateCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Para
 		return
 	}
 
-	correctInput := []string{"kind", "expire_on", "amount"}
-	createInfo := &createInfo{}
+	correctInput := []string{"kind", "expire_on"}
+	createInfo := &couponCreateInfo{}
 	err := common.ParseRequestJsonIntoWithValidateParams(r, correctInput, createInfo)
 	if err != nil {
 		logger.Error("Parse body err: %v", err)
@@ -68,20 +176,37 @@ func CreateCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Para
 		return
 	}
 
-	//转换成过期时间
-	expireDate := time.Now().Add(time.Hour * 24 * time.Duration(createInfo.ExpireOn)).UTC()
-
-	coupon := &models.Coupon{}
-	coupon.ExpireOn = expireDate
-	coupon.Kind = createInfo.Kind
-	coupon.Amount = createInfo.Amount
-	coupon.Serial = "df" + genSerial() + "r"
-	coupon.Code = genCode()
-
-	logger.Debug("coupon: %v", coupon)
+	coupon, err := createInfo.coupon(time.Now())
+	promoCode := ""
+	if err == nil && createInfo.Code != "" {
+		if coupon.MaxRedemptions < 2 {
+			err = fmt.Errorf("code is only for the multi-use coupons")
+		} else {
+			promoCode, err = validatePromoCode(createInfo.Code)
+		}
+	}
+	if err != nil {
+		logger.Error("Validate create info err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+		return
+	}
 
 	//create coupon in database
-	result, err := models.CreateCoupon(db, coupon)
+	var result *models.CreateResult
+	err = retryOnCodeCollision(func() (err error) {
+		coupon.Serial = genSerial()
+		coupon.Code = promoCode
+		if coupon.Code == "" {
+			coupon.Code = genCode()
+		}
+		logger.Debug("coupon: %s", coupon.Serial)
+		result, err = store.CreateCoupon(coupon, username)
+		if err == models.ErrCouponCodeConflict && promoCode != "" {
+			// a taken promo code is taken again on a retry.
+			return fmt.Errorf("code %s is taken", strings.ToUpper(promoCode))
+		}
+		return err
+	})
 	if err != nil {
 		logger.Error("Create plan err: %v", err)
 		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeCreateCoupon, err.Error()), nil)
@@ -110,21 +235,21 @@ func DeleteCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Para
 		return
 	}
 
-	db := models.GetDB()
-	if db == nil {
-		logger.Warn("Get db is nil.")
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
 		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
 		return
 	}
 
-	couponId := params.ByName("id")
+	couponId := params.ByName("serial")
 	logger.Debug("Coupon id: %s.", couponId)
 
 	// /delete in database
-	err := models.DeleteCoupon(db, couponId)
+	err := store.DeleteCoupon(couponId, username)
 	if err != nil {
 		logger.Error("Delete coupon err: %v", err)
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeDeleteCoupon, err.Error()), nil)
+		JsonResult(w, http.StatusBadRequest, getCouponError(ErrorCodeDeleteCoupon, err), nil)
 		return
 	}
 
@@ -132,51 +257,130 @@ func DeleteCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Para
 	JsonResult(w, http.StatusOK, nil, nil)
 }
 
+// RetrieveCoupon reads the coupon of a code, the coupon is not changed.
 func RetrieveCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Request url: GET %v.", loggedURL(r))
 	logger.Info("Begin retrieve coupon handler.")
 
+	coupon, status, e := retrieveCoupon(w, r, params, false)
+	if e != nil {
+		JsonResult(w, status, e, nil)
+		return
+	}
+
+	logger.Info("End retrieve coupon handler.")
+	JsonResult(w, http.StatusOK, nil, coupon)
+}
+
+// ClaimCoupon reads the coupon of a code, and marks it queried, so it is
+// not provided to others any more.
+func ClaimCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", loggedURL(r))
+	logger.Info("Begin claim coupon handler.")
+
+	coupon, status, e := retrieveCoupon(w, r, params, true)
+	if e != nil {
+		JsonResult(w, status, e, nil)
+		return
+	}
+
+	logger.Info("End claim coupon handler.")
+	JsonResult(w, http.StatusOK, nil, coupon)
+}
+
+func retrieveCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params, claim bool) (*models.RetrieveResult, int, *Error) {
 	r.ParseForm()
 	region := r.Form.Get("region")
 	logger.Info("region: %s", region)
 	username, e := validateAuth(r.Header.Get("Authorization"), region)
 	if e != nil {
-		JsonResult(w, http.StatusUnauthorized, e, nil)
-		return
+		return nil, http.StatusUnauthorized, e
 	}
 	logger.Debug("username:%v", username)
 
-	db := models.GetDB()
-	if db == nil {
-		logger.Warn("Get db is nil.")
-		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
-		return
+	guard := newLookupGuard(r, username)
+	if e := guard.check(w); e != nil {
+		return nil, http.StatusTooManyRequests, e
 	}
 
-	couponId := params.ByName("code")
-	coupon, err := models.RetrieveCouponByID(db, couponId)
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		return nil, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized)
+	}
+	retrieve := store.RetrieveCouponByID
+	if claim {
+		retrieve = store.ClaimCoupon
+	}
+
+	var coupon *models.RetrieveResult
+	var err error
+	if code, offline := parseOfflineCode(params.ByName("code")); offline != nil {
+		// an offline coupon is only saved when it is redeemed.
+		coupon, err = retrieve(code, username)
+		if err == nil && coupon == nil {
+			coupon = offline.retrieveResult(code, time.Now())
+		}
+	} else if couponId, e := validateCode(params.ByName("code")); e != nil {
+		return nil, http.StatusBadRequest, guard.observe(e)
+	} else {
+		coupon, err = retrieve(couponId, username)
+	}
 	if err != nil {
 		logger.Error("Get coupon err: %v", err)
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCouponById, err.Error()), nil)
-		return
+		return nil, http.StatusBadRequest, guard.observe(getCouponError(ErrorCodeGetCouponById, err))
 	} else if coupon == nil {
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCouponNotExsit, "This coupon does not exist."), nil)
+		return nil, http.StatusBadRequest, guard.observe(GetError2(ErrorCodeGetCouponNotExsit, "This coupon does not exist."))
+	}
+
+	if !models.CanTransit(coupon.Status, models.CouponStatus_Used) {
+		err := &models.TransitionError{From: coupon.Status, To: models.CouponStatus_Used}
+		return nil, http.StatusBadRequest, getCouponError(ErrorCodeGetCoupon, err)
+	}
+
+	return coupon, http.StatusOK, nil
+}
+
+// RetrieveCouponRecord returns the full record of a coupon by its serial,
+// without changing the coupon.
+func RetrieveCouponRecord(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin retrieve coupon record handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	//只有管理员才可以调这个API
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
 		return
 	}
 
-	if coupon.Status == "used" {
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeCouponHasUsed, "This coupon does has used."), nil)
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
 		return
-	} else if coupon.Status == "expired" {
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeCouponHasExpired, "This coupon does has expired."), nil)
+	}
+
+	record, err := store.RetrieveCouponBySerial(params.ByName("serial"))
+	if err != nil {
+		logger.Error("Get coupon record err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCoupon, err.Error()), nil)
 		return
-	} else if coupon.Status == "unavailable" {
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeCouponUnavailable, "This coupon is not available."), nil)
+	} else if record == nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCouponNotExsit, "This coupon does not exist."), nil)
 		return
 	}
 
-	logger.Info("End retrieve coupon handler.")
-	JsonResult(w, http.StatusOK, nil, coupon)
+	logger.Info("End retrieve coupon record handler.")
+	JsonResult(w, http.StatusOK, nil, record)
 }
 
 func QueryCouponList(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -197,22 +401,45 @@ func QueryCouponList(w http.ResponseWriter, r *http.Request, params httprouter.P
 		return
 	}
 
-	db := models.GetDB()
-	if db == nil {
-		logger.Warn("Get db is nil.")
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
 		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
 		return
 	}
 
-	r.ParseForm()
-
-	kind := r.Form.Get("kind")
+	filter, e := couponFilterFromQuery(r)
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, e, nil)
+		return
+	}
 
 	offset, size := OptionalOffsetAndSize(r, 30, 1, 100)
-	orderBy := models.ValidateOrderBy(r.Form.Get("orderby"))
+	orderBy, err := models.ValidateOrderBy(r.Form.Get("orderby"))
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+		return
+	}
 	sortOrder := models.ValidateSortOrder(r.Form.Get("sortorder"), false)
 
-	count, coupons, err := models.QueryCoupons(db, kind, orderBy, sortOrder, offset, size)
+	// with a cursor, "" for the first page, the list is paged by keys.
+	if cursor, ok := r.Form["cursor"]; ok {
+		withTotal := optionalBoolParamInQuery(r, "total", false)
+		page, err := store.PageCoupons(filter, orderBy, sortOrder, cursor[0], size, withTotal)
+		if err == models.ErrInvalidCursor {
+			JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+			return
+		} else if err != nil {
+			JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeQueryCoupons, err.Error()), nil)
+			return
+		}
+
+		logger.Info("End retrieve coupon list handler.")
+		JsonResult(w, http.StatusOK, nil, page)
+		return
+	}
+
+	count, coupons, err := store.QueryCoupons(filter, orderBy, sortOrder, offset, size)
 	if err != nil {
 		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeQueryCoupons, err.Error()), nil)
 		return
@@ -226,9 +453,24 @@ func UseCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params)
 	logger.Info("Request url: PUT %v.", r.URL)
 	logger.Info("Begin use a coupon handler.")
 
-	db := models.GetDB()
-	if db == nil {
-		logger.Warn("Get db is nil.")
+	useCoupon(w, r, params.ByName("serial"), "")
+}
+
+// UseCouponCode uses the coupon of a code alone, such as a promo code
+// shared by many users, who don't know its serial.
+func UseCouponCode(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", loggedURL(r))
+	logger.Info("Begin use a coupon code handler.")
+
+	useCoupon(w, r, "", params.ByName("code"))
+}
+
+// useCoupon uses the coupon of serial and the code in the body, or of
+// code without serial.
+func useCoupon(w http.ResponseWriter, r *http.Request, serial, code string) {
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
 		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
 		return
 	}
@@ -242,9 +484,16 @@ func UseCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params)
 	}
 	logger.Debug("username:%v", username)
 
-	serial := params.ByName("serial")
+	guard := newLookupGuard(r, username)
+	if e := guard.check(w); e != nil {
+		JsonResult(w, http.StatusTooManyRequests, e, nil)
+		return
+	}
 
 	correctInput := []string{"code", "namespace"}
+	if serial == "" {
+		correctInput = []string{"namespace"}
+	}
 	useInfo := &models.UseInfo{}
 	err := common.ParseRequestJsonIntoWithValidateParams(r, correctInput, useInfo)
 	if err != nil {
@@ -252,27 +501,43 @@ func UseCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params)
 		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
 		return
 	}
+	if serial == "" {
+		useInfo.Code = code
+	}
 	useInfo.Serial = serial
 	useInfo.Username = username
+	useInfo.Region = region
 	useInfo.Use_time = time.Now()
 
-	getResult, err := models.RetrieveCouponByID(db, useInfo.Code)
-	if err != nil {
-		logger.Error("db get coupon err: %v", err)
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCoupon, err.Error()), nil)
+	// the namespace is credited, so the user must be able to access it.
+	if e := checkNamespace(r.Header.Get("Authorization"), region, username, useInfo.Namespace); e != nil {
+		JsonResult(w, namespaceErrorStatus(e), e, nil)
 		return
 	}
-
-	callback := func() error {
-		return couponRecharge(region, serial, username, useInfo.Namespace, getResult.Amount)
-
+	if code, offline := parseOfflineCode(useInfo.Code); offline != nil {
+		useInfo.Code = code
+		if serial == "" {
+			useInfo.Serial = offline.serial()
+		}
+		e = saveOfflineCoupon(store, useInfo, offline)
+	} else {
+		useInfo.Code, e = validateCode(useInfo.Code)
+	}
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, guard.observe(e), nil)
+		return
 	}
 
-	result, err := models.UseCoupon(db, useInfo, callback)
+	// the coupon is used and its recharge is queued in one transaction,
+	// if the recharge fails here, the dispatcher will retry it.
+	result, entry, err := store.UseCoupon(useInfo)
 	if err != nil {
-		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeUseCoupon, err.Error()), nil)
+		JsonResult(w, http.StatusBadRequest, guard.observe(getCouponError(ErrorCodeUseCoupon, err)), nil)
 		return
 	}
+	if deliverRecharge(store, entry) {
+		result.RechargeStatus = models.OutboxStatus_Delivered
+	}
 
 	logger.Info("End use a coupon handler.")
 	JsonResult(w, http.StatusOK, nil, result)
@@ -282,9 +547,9 @@ func ProvideCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Pa
 	logger.Info("Request url: POST %v.", r.URL)
 	logger.Info("Begin provide coupons handler.")
 
-	db := models.GetDB()
-	if db == nil {
-		logger.Warn("Get db is nil.")
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
 		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
 		return
 	}
@@ -314,7 +579,7 @@ func ProvideCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Pa
 	tm := time.Unix(fromUserInfo.Provide_time, 0)
 	timeStr := tm.Format("2006-01-02 15:04:05.999999")
 
-	err, isProvide := models.JudgeIsProvide(db, fromUserInfo, timeStr)
+	err, isProvide := store.JudgeIsProvide(fromUserInfo, timeStr)
 	logger.Info("isProvide: %v.", isProvide)
 	if err != nil {
 		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeProvideCoupons, err.Error()), nil)
@@ -332,7 +597,13 @@ func ProvideCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Pa
 
 	number := r.Form.Get("number")
 	amount := r.Form.Get("amount")
-	count, codes, err := models.ProvideCoupon(db, number, amount)
+	// the provided coupons get new codes, only their digests are saved.
+	var count int64
+	var codes []string
+	err = retryOnCodeCollision(func() (err error) {
+		count, codes, err = store.ProvideCoupon(number, amount, fromUserInfo.OpenId, genCode)
+		return err
+	})
 	if err != nil {
 		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeProvideCoupons, err.Error()), nil)
 		return
@@ -343,13 +614,10 @@ func ProvideCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Pa
 		return
 	}
 
-	resultCode := codes[0]
-	resultCode = resultCode[0:4] + "-" + resultCode[4:8] + "-" + resultCode[8:12] + "-" + resultCode[12:16]
-
 	var card = struct {
 		IsProvide bool   `json:"isProvide"`
 		Code      string `json:"code"`
-	}{false, strings.ToUpper(resultCode)}
+	}{false, formatCode(codes[0])}
 
 	logger.Info("End provide coupons handler.")
 	JsonResult(w, http.StatusOK, nil, card)
@@ -359,9 +627,9 @@ func FetchCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Para
 	logger.Info("Request url: %s %v.", r.Method, r.URL)
 	logger.Info("Begin fetch coupons handler.")
 
-	db := models.GetDB()
-	if db == nil {
-		logger.Warn("Get db is nil.")
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
 		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
 		return
 	}
@@ -399,20 +667,127 @@ func FetchCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Para
 	logger.Info("End fetch coupons handler.")
 }
 
-func genSerial() string {
-	b := make([]byte, 15)
-	for i := range b {
-		b[i] = randNumber[rand.Intn(len(randNumber))]
+func CouponStatusHistory(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin coupon status history handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
 	}
-	return string(b)
+	logger.Debug("username:%v", username)
+
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	history, err := store.CouponStatusHistory(params.ByName("serial"))
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCoupon, err.Error()), nil)
+		return
+	}
+
+	logger.Info("End coupon status history handler.")
+	JsonResult(w, http.StatusOK, nil, history)
 }
 
-func genCode() string {
-	b := make([]byte, 16)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+// CouponRedemptions lists the uses of a coupon (admin).
+func CouponRedemptions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin coupon redemptions handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	redemptions, err := store.CouponRedemptions(params.ByName("serial"))
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCoupon, err.Error()), nil)
+		return
 	}
-	return string(b)
+
+	logger.Info("End coupon redemptions handler.")
+	JsonResult(w, http.StatusOK, nil, redemptions)
+}
+
+// getCouponError reports the lifecycle errors of models with their own
+// codes, and the others with defaultCode.
+func getCouponError(defaultCode uint, err error) *Error {
+	if e, ok := err.(*models.TransitionError); ok {
+		switch e.From {
+		case models.CouponStatus_Used:
+			return GetError2(ErrorCodeCouponHasUsed, e.Error())
+		case models.CouponStatus_Expired:
+			return GetError2(ErrorCodeCouponHasExpired, e.Error())
+		case models.CouponStatus_Unavailable:
+			return GetError2(ErrorCodeCouponUnavailable, e.Error())
+		case models.CouponStatus_Revoked:
+			return GetError2(ErrorCodeCouponRevoked, e.Error())
+		}
+		return GetError2(ErrorCodeIllegalTransition, e.Error())
+	}
+
+	switch err {
+	case models.ErrCouponNotFound:
+		return GetError2(ErrorCodeGetCouponNotExsit, err.Error())
+	case models.ErrCouponStatusConflict:
+		return GetError2(ErrorCodeCouponStatusConflict, err.Error())
+	case models.ErrCampaignNotActive:
+		return GetError2(ErrorCodeCampaignNotActive, err.Error())
+	case models.ErrCampaignBudgetExhausted:
+		return GetError2(ErrorCodeCampaignExhausted, err.Error())
+	case models.ErrCouponUserLimitReached:
+		return GetError2(ErrorCodeCouponUserLimit, err.Error())
+	case models.ErrCouponNotForUser:
+		return GetError2(ErrorCodeCouponNotForUser, err.Error())
+	case models.ErrCouponHeld:
+		return GetError2(ErrorCodeCouponHeld, err.Error())
+	case models.ErrHoldNotFound:
+		return GetError2(ErrorCodeHoldNotExist, err.Error())
+	case models.ErrHoldExpired:
+		return GetError2(ErrorCodeHoldExpired, err.Error())
+	case models.ErrHoldNotActive:
+		return GetError2(ErrorCodeHoldNotActive, err.Error())
+	case models.ErrHoldRegion:
+		return GetError2(ErrorCodeHoldRegion, err.Error())
+	case models.ErrRedemptionNotFound:
+		return GetError2(ErrorCodeRedemptionNotExist, err.Error())
+	case models.ErrRechargePending:
+		return GetError2(ErrorCodeRechargePending, err.Error())
+	}
+	if _, ok := err.(*models.NotApplicableError); ok {
+		return GetError2(ErrorCodeCouponNotApplicable, err.Error())
+	}
+
+	return GetError2(defaultCode, err.Error())
 }
 
 func validateAuth(token, region string) (string, *Error) {
@@ -438,6 +813,21 @@ func initAdminUser() {
 	logger.Info("Admin users: %v.", AdminUsers)
 }
 
+// initServiceLocation loads the timezone named by TIME_ZONE, UTC by default.
+func initServiceLocation() {
+	name := os.Getenv("TIME_ZONE")
+	if name == "" {
+		return
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Error("Load timezone (%s) err: %v, use UTC.", name, err)
+		return
+	}
+	ServiceLocation = loc
+	logger.Info("Service timezone: %v.", ServiceLocation)
+}
+
 func checkAdminUsers(user string) bool {
 	for _, adminUser := range AdminUsers {
 		if adminUser == user {
@@ -0,0 +1,503 @@
+package api
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+var injectionPayloads = []string{
+	`' OR '1'='1`,
+	`abc' OR 1=1 -- `,
+	`x'; DROP TABLE DF_COUPON; --`,
+	`x" or status="available`,
+	`\' or 1=1 #`,
+	`1' UNION SELECT SERIAL, CODE, AMOUNT, STATUS FROM DF_COUPON -- `,
+	`%' AND SLEEP(5) AND '%'='`,
+}
+
+func init() {
+	Debug = true
+}
+
+func setupFakeDB(t *testing.T) {
+	db := openFakeDB()
+	SetCouponStore(models.NewMysqlStore(func() *sql.DB { return db }))
+	theFakeDriver.reset()
+	theFakeOpenShift.reset()
+	SetAttemptStore(models.NewMemoryAttemptStore())
+}
+
+func doRequest(handle httprouter.Handle, method, pattern, path string, body string) *httptest.ResponseRecorder {
+	router := httprouter.New()
+	router.Handle(method, pattern, handle)
+
+	r, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Authorization", "Bearer test")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func parseResult(t *testing.T, w *httptest.ResponseRecorder) *Result {
+	result := &Result{}
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatalf("Unmarshal (%s) err: %v", w.Body.String(), err)
+	}
+	return result
+}
+
+func TestRetrieveCouponInjection(t *testing.T) {
+	setupFakeDB(t)
+
+	for _, payload := range injectionPayloads {
+		theFakeDriver.reset()
+
+		// the handler rejects it as a malformed code before the db
+		path := "/charge/v1/coupons/" + strings.Replace(url.QueryEscape(payload), "+", "%20", -1) + "?region=cn-north-1"
+		w := doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", path, "")
+
+		result := parseResult(t, w)
+		if result.Code != ErrorCodeInvalidCouponCode {
+			t.Errorf("payload %q: code = %d, want %d", payload, result.Code, ErrorCodeInvalidCouponCode)
+		}
+		if stmts := theFakeDriver.log(); len(stmts) != 0 {
+			t.Errorf("payload %q: malformed code reaches the db: %s", payload, stmts[0].query)
+		}
+
+		// and the store binds it anyway
+		if coupon, err := getCouponStore().RetrieveCouponByID(payload, "user"); err != nil || coupon != nil {
+			t.Errorf("payload %q: RetrieveCouponByID = %v, %v", payload, coupon, err)
+		}
+		stmts := theFakeDriver.log()
+		if len(stmts) == 0 {
+			t.Fatalf("payload %q: no statement issued", payload)
+		}
+		for _, stmt := range stmts {
+			if strings.Contains(strings.ToLower(stmt.query), strings.ToLower(payload)) {
+				t.Errorf("payload %q leaked into sql: %s", payload, stmt.query)
+			}
+			if strings.Contains(stmt.query, "'") {
+				t.Errorf("quoted literal in sql: %s", stmt.query)
+			}
+		}
+
+		// only the digest of a code reaches the db, as an arg
+		bound := false
+		for _, arg := range stmts[0].args {
+			if digest, ok := arg.(string); ok && len(digest) == 64 && strings.Trim(digest, "0123456789abcdef") == "" {
+				bound = true
+			}
+			if arg == strings.ToLower(payload) {
+				t.Errorf("payload %q is sent to the db in plain", payload)
+			}
+		}
+		if !bound {
+			t.Errorf("payload %q not bound as a digest: %v", payload, stmts[0].args)
+		}
+	}
+}
+
+func parseResultData(t *testing.T, w *httptest.ResponseRecorder, data interface{}) uint {
+	result := &Result{Data: data}
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatalf("Unmarshal (%s) err: %v", w.Body.String(), err)
+	}
+	return result.Code
+}
+
+type rechargeCall struct {
+	region, serial, username, namespace string
+	amount                              models.Amount
+}
+
+func setupMemoryStore(t *testing.T) *[]rechargeCall {
+	SetCouponStore(models.NewMemoryStore())
+	AdminUsers = []string{"local"}
+	theFakeOpenShift.reset()
+	SetAttemptStore(models.NewMemoryAttemptStore())
+
+	return stubRecharge()
+}
+
+func stubRecharge() *[]rechargeCall {
+	var mu sync.Mutex
+	calls := &[]rechargeCall{}
+	rechargeFunc = func(region, serial, username, namespace string, amount models.Amount) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*calls = append(*calls, rechargeCall{region, serial, username, namespace, amount})
+		return nil
+	}
+	return calls
+}
+
+func createTestCoupon(t *testing.T, body string) *models.CreateResult {
+	w := doRequest(CreateCoupon, "POST", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1", body)
+	created := &models.CreateResult{}
+	if code := parseResultData(t, w, created); code != ErrorCodeNone {
+		t.Fatalf("create coupon: %s", w.Body.String())
+	}
+	return created
+}
+
+func TestCouponLifecycleOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 68}`)
+	if created.Amount != 6800 || created.Serial == "" || created.Code == "" {
+		t.Fatalf("unexpected created coupon: %+v", created)
+	}
+
+	// list
+	w := doRequest(QueryCouponList, "GET", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1", "")
+	list := &struct {
+		Total   int64                    `json:"total"`
+		Results []*models.RetrieveResult `json:"results"`
+	}{}
+	if code := parseResultData(t, w, list); code != ErrorCodeNone || list.Total != 1 || len(list.Results) != 1 {
+		t.Fatalf("list coupons: %s", w.Body.String())
+	}
+
+	// retrieve
+	w = doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+created.Code+"?region=cn-north-1", "")
+	retrieved := &models.RetrieveResult{}
+	if code := parseResultData(t, w, retrieved); code != ErrorCodeNone || retrieved.Status != "available" {
+		t.Fatalf("retrieve coupon: %s", w.Body.String())
+	}
+
+	// use
+	usePath := "/charge/v1/coupons/use/" + created.Serial + "?region=cn-north-1"
+	useBody := `{"code": "` + created.Code + `", "namespace": "ns1"}`
+	w = doRequest(UseCoupon, "PUT", "/charge/v1/coupons/use/:serial", usePath, useBody)
+	used := &models.UseResult{}
+	if code := parseResultData(t, w, used); code != ErrorCodeNone || used.Amount != 6800 || used.Namespace != "ns1" {
+		t.Fatalf("use coupon: %s", w.Body.String())
+	}
+	if len(*calls) != 1 || (*calls)[0].namespace != "ns1" || (*calls)[0].amount != 6800 {
+		t.Fatalf("recharge calls: %+v", *calls)
+	}
+
+	// use again
+	w = doRequest(UseCoupon, "PUT", "/charge/v1/coupons/use/:serial", usePath, useBody)
+	if code := parseResultData(t, w, nil); code != ErrorCodeCouponHasUsed {
+		t.Fatalf("use a used coupon: %s", w.Body.String())
+	}
+	if len(*calls) != 1 {
+		t.Fatalf("recharge calls: %+v", *calls)
+	}
+
+	w = doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+created.Code+"?region=cn-north-1", "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeCouponHasUsed {
+		t.Fatalf("retrieve a used coupon: %s", w.Body.String())
+	}
+}
+
+func TestProvideAndDeleteCouponOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	first := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 20}`)
+
+	// delete the first one, then only the second can be provided.
+	w := doRequest(DeleteCoupon, "DELETE", "/charge/v1/coupons/:serial", "/charge/v1/coupons/"+first.Serial+"?region=cn-north-1", "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeNone {
+		t.Fatalf("delete coupon: %s", w.Body.String())
+	}
+
+	card := &struct {
+		IsProvide bool   `json:"isProvide"`
+		Code      string `json:"code"`
+	}{}
+	body := `{"openId": "wx-user-1", "provideTime": 1483584876}`
+	w = doRequest(ProvideCoupons, "POST", "/charge/v1/provide/coupons", "/charge/v1/provide/coupons", body)
+	if code := parseResultData(t, w, card); code != ErrorCodeNone || card.IsProvide || len(card.Code) != 24 {
+		t.Fatalf("provide coupon: %s", w.Body.String())
+	}
+
+	w = doRequest(ProvideCoupons, "POST", "/charge/v1/provide/coupons", "/charge/v1/provide/coupons", body)
+	if code := parseResultData(t, w, card); code != ErrorCodeNone || !card.IsProvide {
+		t.Fatalf("provide coupon twice: %s", w.Body.String())
+	}
+
+	w = doRequest(ProvideCoupons, "POST", "/charge/v1/provide/coupons", "/charge/v1/provide/coupons", `{"openId": "wx-user-2", "provideTime": 1483584876}`)
+	if code := parseResultData(t, w, nil); code != ErrorNoMoreCoupon {
+		t.Fatalf("provide with an empty pool: %s", w.Body.String())
+	}
+}
+
+func useConcurrently(t *testing.T, serial, code string, n int) int32 {
+	usePath := "/charge/v1/coupons/use/" + serial + "?region=cn-north-1"
+	useBody := `{"code": "` + code + `", "namespace": "ns1"}`
+
+	var succeeded int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			w := doRequest(UseCoupon, "PUT", "/charge/v1/coupons/use/:serial", usePath, useBody)
+			if code := parseResultData(t, w, nil); code == ErrorCodeNone {
+				atomic.AddInt32(&succeeded, 1)
+			} else if code != ErrorCodeCouponHasUsed && code != ErrorCodeCouponStatusConflict && code != ErrorCodeCouponUserLimit {
+				t.Errorf("unexpected result: %s", w.Body.String())
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	return succeeded
+}
+
+func TestUseCouponConcurrentlyOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 68}`)
+
+	succeeded := useConcurrently(t, created.Serial, created.Code, 64)
+	if succeeded != 1 {
+		t.Errorf("%d redemptions succeeded, want 1", succeeded)
+	}
+	if len(*calls) != 1 {
+		t.Errorf("%d recharge callbacks, want 1", len(*calls))
+	}
+}
+
+// The fake db lets every redemption read the coupon as available, as if
+// the row lock were missing, only the conditional update decides.
+func TestUseCouponConcurrentlyMysql(t *testing.T) {
+	setupFakeDB(t)
+	calls := stubRecharge()
+	defer func() { rechargeFunc = couponRecharge }()
+
+	var updated int32
+	theFakeDriver.queryHook = func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if strings.HasPrefix(query, "select SERIAL, KIND, AMOUNT_FEN, CURRENCY, EXPIRE_ON, STATUS") {
+			return []string{"SERIAL", "KIND", "AMOUNT_FEN", "CURRENCY", "EXPIRE_ON", "STATUS", "CAMPAIGN_ID",
+					"MAX_REDEMPTIONS", "PER_USER_LIMIT", "REDEMPTIONS", "HOLDS", "BOUND_USERNAME", "BOUND_NAMESPACE"},
+				[][]driver.Value{{"df123r", "recharge", int64(6800), "CNY", time.Now().Add(240 * time.Hour), "available", nil,
+					int64(1), int64(0), int64(0), int64(0), "", ""}}
+		}
+		return []string{"SERIAL", "EXPIRE_ON", "AMOUNT_FEN", "CURRENCY", "STATUS", "CAMPAIGN_ID"},
+			[][]driver.Value{{"df123r", time.Now().Add(240 * time.Hour), int64(6800), "CNY", "available", nil}}
+	}
+	theFakeDriver.execHook = func(query string, args []driver.Value) int64 {
+		if strings.Contains(query, "USE_TIME = ?") && atomic.AddInt32(&updated, 1) == 1 {
+			return 1
+		}
+		return 0
+	}
+
+	succeeded := useConcurrently(t, "df123r", genCode(), 64)
+	if succeeded != 1 {
+		t.Errorf("%d redemptions succeeded, want 1", succeeded)
+	}
+	if len(*calls) != 1 {
+		t.Errorf("%d recharge callbacks, want 1", len(*calls))
+	}
+
+	for _, stmt := range theFakeDriver.log() {
+		if strings.HasPrefix(stmt.query, "select SERIAL, KIND") && !strings.HasSuffix(stmt.query, "FOR UPDATE") {
+			t.Errorf("coupon row is not locked: %s", stmt.query)
+		}
+	}
+}
+
+func TestCouponStatusHistoryOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+
+	// a queried coupon can be deleted, but only once.
+	doRequest(ClaimCoupon, "POST", "/charge/v1/coupons/:code/claim", "/charge/v1/coupons/"+created.Code+"/claim?region=cn-north-1", "")
+	deletePath := "/charge/v1/coupons/" + created.Serial + "?region=cn-north-1"
+	w := doRequest(DeleteCoupon, "DELETE", "/charge/v1/coupons/:serial", deletePath, "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeNone {
+		t.Fatalf("delete a queried coupon: %s", w.Body.String())
+	}
+	w = doRequest(DeleteCoupon, "DELETE", "/charge/v1/coupons/:serial", deletePath, "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeCouponUnavailable {
+		t.Fatalf("delete a deleted coupon: %s", w.Body.String())
+	}
+	w = doRequest(DeleteCoupon, "DELETE", "/charge/v1/coupons/:serial", "/charge/v1/coupons/df000r?region=cn-north-1", "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeGetCouponNotExsit {
+		t.Fatalf("delete a nonexistent coupon: %s", w.Body.String())
+	}
+
+	w = doRequest(CouponStatusHistory, "GET", "/charge/v1/history/coupons/:serial",
+		"/charge/v1/history/coupons/"+created.Serial+"?region=cn-north-1", "")
+	history := []*models.StatusTransition{}
+	if code := parseResultData(t, w, &history); code != ErrorCodeNone {
+		t.Fatalf("coupon status history: %s", w.Body.String())
+	}
+
+	expected := []models.CouponStatus{
+		models.CouponStatus_Available, models.CouponStatus_Queried, models.CouponStatus_Unavailable,
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("history: %s", w.Body.String())
+	}
+	for i, to := range expected {
+		if history[i].To != to || history[i].Operator != "local" {
+			t.Errorf("history[%d] = %+v, want to %s", i, history[i], to)
+		}
+	}
+}
+
+func TestProvideCouponNewCodeOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+
+	card := &struct {
+		IsProvide bool   `json:"isProvide"`
+		Code      string `json:"code"`
+	}{}
+	w := doRequest(ProvideCoupons, "POST", "/charge/v1/provide/coupons", "/charge/v1/provide/coupons", `{"openId": "wx-user-1", "provideTime": 1483584876}`)
+	if code := parseResultData(t, w, card); code != ErrorCodeNone || card.Code == "" {
+		t.Fatalf("provide coupon: %s", w.Body.String())
+	}
+
+	// the code given out replaces the one returned at creation
+	if code := retrieveCouponCode(t, created.Code); code != ErrorCodeGetCouponNotExsit {
+		t.Errorf("retrieve a provided coupon by its old code: %d", code)
+	}
+	w = doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+card.Code+"?region=cn-north-1", "")
+	retrieved := &models.RetrieveResult{}
+	if code := parseResultData(t, w, retrieved); code != ErrorCodeNone || !strings.EqualFold(retrieved.Serial, created.Serial) {
+		t.Fatalf("retrieve a provided coupon: %s", w.Body.String())
+	}
+	if !strings.EqualFold(retrieved.CodePrefix, card.Code[:4]) {
+		t.Errorf("code prefix = %s, want %s", retrieved.CodePrefix, card.Code[:4])
+	}
+	if strings.Contains(strings.ToLower(w.Body.String()), strings.ToLower(strings.Replace(card.Code, "-", "", -1))) {
+		t.Errorf("the code is returned again: %s", w.Body.String())
+	}
+}
+
+func TestProvideCouponNumber(t *testing.T) {
+	setupFakeDB(t)
+
+	for _, number := range []string{"0", "-1", "101"} {
+		theFakeDriver.reset()
+		path := "/charge/v1/provide/coupons?number=" + number
+		w := doRequest(ProvideCoupons, "POST", "/charge/v1/provide/coupons", path, `{"openId": "wx-user-1", "provideTime": 1483584876}`)
+		if code := parseResultData(t, w, nil); code != ErrorCodeProvideCoupons {
+			t.Errorf("provide %s coupons: %s", number, w.Body.String())
+		}
+		for _, stmt := range theFakeDriver.log() {
+			if strings.Contains(stmt.query, "DF_COUPON ") || strings.HasSuffix(stmt.query, "DF_COUPON") {
+				t.Errorf("provide %s coupons reaches DF_COUPON: %s", number, stmt.query)
+			}
+		}
+	}
+}
+
+func TestProvideCouponPoolOffline(t *testing.T) {
+	setupMemoryStore(t)
+
+	// the codes of these coupons may have been handed out, they are kept.
+	kept := []*models.CreateResult{
+		createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 5}`),
+		createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "bound_username": "alice"}`),
+		createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "bound_namespace": "team-*"}`),
+	}
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+
+	count, codes, err := getCouponStore().ProvideCoupon("5", "", "local", genCode)
+	if err != nil || count != 1 || len(codes) != 1 {
+		t.Fatalf("provide coupons: %d %v %v", count, codes, err)
+	}
+	if code := retrieveCouponCode(t, created.Code); code != ErrorCodeGetCouponNotExsit {
+		t.Errorf("retrieve a provided coupon by its old code: %d", code)
+	}
+	for _, c := range kept {
+		if record, _ := getCouponStore().RetrieveCouponBySerial(c.Serial); record == nil || record.Status != models.CouponStatus_Available {
+			t.Errorf("coupon %s out of the pool is provided: %+v", c.Serial, record)
+		}
+	}
+}
+
+func TestClaimCouponOffline(t *testing.T) {
+	setupMemoryStore(t)
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+
+	// a lookup doesn't change the coupon.
+	w := doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+created.Code+"?region=cn-north-1", "")
+	coupon := &models.RetrieveResult{}
+	if code := parseResultData(t, w, coupon); code != ErrorCodeNone || coupon.Status != models.CouponStatus_Available {
+		t.Fatalf("retrieve a coupon: %s", w.Body.String())
+	}
+	if history, _ := getCouponStore().CouponStatusHistory(created.Serial); len(history) != 1 {
+		t.Fatalf("a lookup changes the coupon: %v", history)
+	}
+
+	w = doRequest(ClaimCoupon, "POST", "/charge/v1/coupons/:code/claim", "/charge/v1/coupons/"+created.Code+"/claim?region=cn-north-1", "")
+	if code := parseResultData(t, w, coupon); code != ErrorCodeNone || coupon.Status != models.CouponStatus_Queried {
+		t.Fatalf("claim a coupon: %s", w.Body.String())
+	}
+	w = doRequest(ClaimCoupon, "POST", "/charge/v1/coupons/:code/claim", "/charge/v1/coupons/"+created.Code+"/claim?region=cn-north-1", "")
+	if code := parseResultData(t, w, coupon); code != ErrorCodeNone || coupon.Status != models.CouponStatus_Queried {
+		t.Fatalf("claim a coupon twice: %s", w.Body.String())
+	}
+	if history, _ := getCouponStore().CouponStatusHistory(created.Serial); len(history) != 2 {
+		t.Fatalf("unexpected history of a claimed coupon: %v", history)
+	}
+}
+
+func TestRetrieveCouponRecordOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	if err := redeemAs(t, created, "alice"); err != nil {
+		t.Fatalf("use a coupon: %v", err)
+	}
+
+	path := "/charge/v1/records/coupons/" + created.Serial + "?region=cn-north-1"
+	w := doRequest(RetrieveCouponRecord, "GET", "/charge/v1/records/coupons/:serial", path, "")
+	record := &models.CouponRecord{}
+	if code := parseResultData(t, w, record); code != ErrorCodeNone {
+		t.Fatalf("retrieve a coupon record: %s", w.Body.String())
+	}
+	if record.Kind != models.CouponKind_Recharge || record.Status != models.CouponStatus_Used || record.CreateAt.IsZero() ||
+		record.UseTime == nil || record.Username != "alice" || record.Namespace != "alice" {
+		t.Fatalf("unexpected coupon record: %s", w.Body.String())
+	}
+
+	w = doRequest(RetrieveCouponRecord, "GET", "/charge/v1/records/coupons/:serial",
+		"/charge/v1/records/coupons/df000r?region=cn-north-1", "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeGetCouponNotExsit || w.Code != http.StatusBadRequest {
+		t.Fatalf("retrieve a nonexistent coupon record: %d %s", w.Code, w.Body.String())
+	}
+
+	AdminUsers = []string{"admin"}
+	w = doRequest(RetrieveCouponRecord, "GET", "/charge/v1/records/coupons/:serial", path, "")
+	if code := parseResultData(t, w, nil); code != ErrorCodePermissionDenied {
+		t.Fatalf("retrieve a coupon record as a user: %s", w.Body.String())
+	}
+}
@@ -21,29 +21,56 @@ const (
 
 	ErrorCodeNone = 0
 
-	ErrorCodeUnkown            = 1300
-	ErrorCodeJsonBuilding      = 1301
-	ErrorCodeParseJsonFailed   = 1302
-	ErrorCodeUrlNotSupported   = 1303
-	ErrorCodeDbNotInitlized    = 1304
-	ErrorCodeAuthFailed        = 1305
-	ErrorCodePermissionDenied  = 1306
-	ErrorCodeInvalidParameters = 1307
-	ErrorCodeCreateCoupon      = 1308
-	ErrorCodeUseCoupon         = 1309
-	ErrorCodeDeleteCoupon      = 1310
-	ErrorCodeGetCoupon         = 1311
-	ErrorCodeQueryCoupons      = 1312
-	ErrorCodeCallRecharge      = 1313
-	ErrorCodeGetCouponById     = 1314
-	ErrorCodeCouponHasUsed     = 1315
-	ErrorCodeCouponHasExpired  = 1316
-	ErrorCodeCouponUnavailable = 1317
-	ErrorCodeGetCouponNotExsit = 1318
-	ErrorCodeProvideCoupons    = 1319
-	ErrorCouponHasProvided     = 1320
-	ErrorNoMoreCoupon          = 1321
-	ErrorCodeInputParam        = 1322
+	ErrorCodeUnkown               = 1300
+	ErrorCodeJsonBuilding         = 1301
+	ErrorCodeParseJsonFailed      = 1302
+	ErrorCodeUrlNotSupported      = 1303
+	ErrorCodeDbNotInitlized       = 1304
+	ErrorCodeAuthFailed           = 1305
+	ErrorCodePermissionDenied     = 1306
+	ErrorCodeInvalidParameters    = 1307
+	ErrorCodeCreateCoupon         = 1308
+	ErrorCodeUseCoupon            = 1309
+	ErrorCodeDeleteCoupon         = 1310
+	ErrorCodeGetCoupon            = 1311
+	ErrorCodeQueryCoupons         = 1312
+	ErrorCodeCallRecharge         = 1313
+	ErrorCodeGetCouponById        = 1314
+	ErrorCodeCouponHasUsed        = 1315
+	ErrorCodeCouponHasExpired     = 1316
+	ErrorCodeCouponUnavailable    = 1317
+	ErrorCodeGetCouponNotExsit    = 1318
+	ErrorCodeProvideCoupons       = 1319
+	ErrorCouponHasProvided        = 1320
+	ErrorNoMoreCoupon             = 1321
+	ErrorCodeInputParam           = 1322
+	ErrorCodeIllegalTransition    = 1323
+	ErrorCodeCouponStatusConflict = 1324
+	ErrorCodeGetCampaign          = 1325
+	ErrorCodeCampaignNotExist     = 1326
+	ErrorCodeCampaignNotActive    = 1327
+	ErrorCodeCampaignExhausted    = 1328
+	ErrorCodeCreateCampaign       = 1329
+	ErrorCodeUpdateCampaign       = 1330
+	ErrorCodeInvalidCouponCode    = 1331
+	ErrorCodeOfflineDisabled      = 1332
+	ErrorCodeCouponNotApplicable  = 1333
+	ErrorCodeCouponUserLimit      = 1334
+	ErrorCodeCouponNotForUser     = 1335
+	ErrorCodeNamespaceForbidden   = 1336
+	ErrorCodeCheckNamespace       = 1337
+	ErrorCodeCouponHeld           = 1338
+	ErrorCodeHoldNotExist         = 1339
+	ErrorCodeHoldExpired          = 1340
+	ErrorCodeHoldNotActive        = 1341
+	ErrorCodeHoldCoupon           = 1342
+	ErrorCodeCouponRevoked        = 1343
+	ErrorCodeRedemptionNotExist   = 1344
+	ErrorCodeRechargePending      = 1345
+	ErrorCodeRefundRecharge       = 1346
+	ErrorCodeReverseRedemption    = 1347
+	ErrorCodeTooManyAttempts      = 1348
+	ErrorCodeHoldRegion           = 1349
 
 	NumErrors = 1500 // about 12k memroy wasted
 )
@@ -70,6 +97,39 @@ func init() {
 
 	initError(ErrorCodeInputParam, "input params is not correct")
 
+	initError(ErrorCodeCouponHasUsed, "the coupon has used")
+	initError(ErrorCodeCouponHasExpired, "the coupon has expired")
+	initError(ErrorCodeCouponUnavailable, "the coupon is not available")
+	initError(ErrorCodeGetCouponNotExsit, "the coupon does not exist")
+	initError(ErrorCodeIllegalTransition, "illegal coupon status transition")
+	initError(ErrorCodeCouponStatusConflict, "the coupon status is changed concurrently")
+
+	initError(ErrorCodeGetCampaign, "failed to retrieve campaign")
+	initError(ErrorCodeCampaignNotExist, "the campaign does not exist")
+	initError(ErrorCodeCampaignNotActive, "the campaign of the coupon is not active")
+	initError(ErrorCodeCampaignExhausted, "the budget of the campaign is exhausted")
+	initError(ErrorCodeCreateCampaign, "failed to create campaign")
+	initError(ErrorCodeUpdateCampaign, "failed to update campaign")
+	initError(ErrorCodeInvalidCouponCode, "the coupon code is malformed, please check it")
+	initError(ErrorCodeOfflineDisabled, "offline coupons are not enabled")
+	initError(ErrorCodeCouponNotApplicable, "the coupon is not applicable")
+	initError(ErrorCodeCouponUserLimit, "the coupon has been used by the user as many times as allowed")
+	initError(ErrorCodeCouponNotForUser, "the coupon is bound to another user or namespace")
+	initError(ErrorCodeNamespaceForbidden, "the user can't access the namespace")
+	initError(ErrorCodeCheckNamespace, "failed to check the namespace")
+	initError(ErrorCodeCouponHeld, "the coupon is held by other checkouts")
+	initError(ErrorCodeHoldNotExist, "the hold does not exist")
+	initError(ErrorCodeHoldExpired, "the hold has expired")
+	initError(ErrorCodeHoldNotActive, "the hold has been confirmed or released")
+	initError(ErrorCodeHoldCoupon, "failed to hold a coupon")
+	initError(ErrorCodeCouponRevoked, "the coupon has been revoked")
+	initError(ErrorCodeRedemptionNotExist, "the redemption does not exist or has been reversed")
+	initError(ErrorCodeRechargePending, "the recharge of the redemption is not delivered yet")
+	initError(ErrorCodeRefundRecharge, "failed to refund the recharge")
+	initError(ErrorCodeReverseRedemption, "failed to reverse a redemption")
+	initError(ErrorCodeTooManyAttempts, "too many failed coupon lookups, please try again later")
+	initError(ErrorCodeHoldRegion, "the hold is made in another region")
+
 	ErrorNone = GetError(ErrorCodeNone)
 	ErrorUnkown = GetError(ErrorCodeUnkown)
 	ErrorJsonBuilding = GetError(ErrorCodeJsonBuilding)
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/common"
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+type evaluateInfo struct {
+	Code       string          `json:"code"`
+	OrderTotal models.Amount   `json:"order_total"`
+	Currency   models.Currency `json:"currency,omitempty"`
+	PlanId     string          `json:"plan_id,omitempty"`
+	Namespace  string          `json:"namespace,omitempty"`
+	// the user of the order, only the billing services, as admin users,
+	// evaluate for others.
+	Username string `json:"username,omitempty"`
+}
+
+type EvaluateResult struct {
+	Serial   string          `json:"serial"`
+	Kind     string          `json:"kind"`
+	Discount models.Amount   `json:"discount"`
+	Payable  models.Amount   `json:"payable"`
+	Currency models.Currency `json:"currency"`
+}
+
+// EvaluateCoupon tells the billing services what a coupon takes off an
+// order, if the caller could hold it now. The coupon is not changed.
+func EvaluateCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", loggedURL(r))
+	logger.Info("Begin evaluate coupon handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	correctInput := []string{"code", "order_total"}
+	info := &evaluateInfo{}
+	err := common.ParseRequestJsonIntoWithValidateParams(r, correctInput, info)
+	if err != nil {
+		logger.Error("Parse body err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
+		return
+	}
+
+	// the failed lookups of a billing service are counted for its user.
+	holder := username
+	var guard *lookupGuard
+	if checkAdminUsers(username) {
+		if info.Username != "" {
+			holder = strings.ToLower(info.Username)
+		}
+		guard = newServiceLookupGuard(username, strings.ToLower(info.Username))
+	} else if info.Username != "" && !strings.EqualFold(info.Username, username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	} else {
+		guard = newLookupGuard(r, username)
+	}
+	if e := guard.check(w); e != nil {
+		JsonResult(w, http.StatusTooManyRequests, e, nil)
+		return
+	}
+	order := &models.Order{Total: info.OrderTotal, PlanId: info.PlanId}
+	order.Currency, err = models.ValidateCurrency(info.Currency)
+	if err == nil && order.Total < 0 {
+		err = fmt.Errorf("order_total should not be negative")
+	}
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+		return
+	}
+
+	var coupon *models.RetrieveResult
+	now := time.Now()
+	holdInfo := &models.HoldInfo{Username: holder, Namespace: info.Namespace, HoldTime: now}
+	if code, offline := parseOfflineCode(info.Code); offline != nil {
+		holdInfo.Code = code
+		coupon, err = store.CheckCouponUsable(holdInfo)
+		if err == models.ErrCouponNotFound {
+			// not redeemed yet, an offline coupon is bound to no one.
+			coupon, err = offline.retrieveResult(code, now), nil
+		}
+	} else if code, e := validateCode(info.Code); e != nil {
+		JsonResult(w, http.StatusBadRequest, guard.observe(e), nil)
+		return
+	} else {
+		holdInfo.Code = code
+		coupon, err = store.CheckCouponUsable(holdInfo)
+	}
+	if err == nil && !models.CanTransit(coupon.Status, models.CouponStatus_Used) {
+		err = &models.TransitionError{From: coupon.Status, To: models.CouponStatus_Used}
+	}
+	if err == nil && !now.Before(coupon.ExpireOn) {
+		err = &models.TransitionError{From: models.CouponStatus_Expired, To: models.CouponStatus_Used}
+	}
+
+	var discount models.Amount
+	if err == nil {
+		discount, err = models.EvaluateCoupon(coupon.Terms(), order)
+	}
+	if err != nil {
+		logger.Info("Evaluate coupon err: %v", err)
+		JsonResult(w, http.StatusBadRequest, guard.observe(getCouponError(ErrorCodeGetCoupon, err)), nil)
+		return
+	}
+
+	logger.Info("End evaluate coupon handler.")
+	JsonResult(w, http.StatusOK, nil, &EvaluateResult{
+		Serial:   coupon.Serial,
+		Kind:     coupon.Kind,
+		Discount: discount,
+		Payable:  order.Total - discount,
+		Currency: coupon.Currency,
+	})
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func evaluateTestCoupon(t *testing.T, body string) (uint, *EvaluateResult) {
+	w := doRequest(EvaluateCoupon, "POST", "/charge/v1/coupons/evaluate", "/charge/v1/coupons/evaluate?region=cn-north-1", body)
+	result := &EvaluateResult{}
+	return parseResultData(t, w, result), result
+}
+
+func TestEvaluateCouponOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "percentage", "expire_on": 30, "amount": 50, "percent_off": 20, "min_spend": 100}`)
+	if created.Kind != models.CouponKind_Percentage {
+		t.Fatalf("unexpected coupon: %+v", created)
+	}
+
+	code, result := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 120}`)
+	if code != ErrorCodeNone || result.Discount != 2400 || result.Payable != 9600 || result.Kind != models.CouponKind_Percentage {
+		t.Fatalf("evaluate a percentage coupon: %d %+v", code, result)
+	}
+	code, result = evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 1000}`)
+	if code != ErrorCodeNone || result.Discount != 5000 {
+		t.Fatalf("evaluate a capped percentage coupon: %d %+v", code, result)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+created.Code+`", "order_total": 99.99}`); code != ErrorCodeCouponNotApplicable {
+		t.Fatalf("evaluate a percentage coupon below min_spend: %d", code)
+	}
+
+	// evaluating doesn't change the coupon, and it is not for recharges
+	coupon, err := getCouponStore().LookupCoupon(strings.ToLower(created.Code))
+	if err != nil || coupon.Status != models.CouponStatus_Available || coupon.PercentOff != 20 {
+		t.Fatalf("evaluated coupon: %+v, %v", coupon, err)
+	}
+	if code := useCouponCode(t, created.Serial, created.Code); code != ErrorCodeCouponNotApplicable {
+		t.Fatalf("use a percentage coupon: %d", code)
+	}
+	if len(*calls) != 0 {
+		t.Fatalf("unexpected recharges: %v", *calls)
+	}
+
+	trial := createTestCoupon(t, `{"kind": "free_trial", "expire_on": 30, "amount": 0, "plan_id": "plan-1"}`)
+	code, result = evaluateTestCoupon(t, `{"code": "`+trial.Code+`", "order_total": 30, "plan_id": "plan-1"}`)
+	if code != ErrorCodeNone || result.Discount != 3000 || result.Payable != 0 {
+		t.Fatalf("evaluate a free trial coupon: %d %+v", code, result)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+trial.Code+`", "order_total": 30, "plan_id": "plan-2"}`); code != ErrorCodeCouponNotApplicable {
+		t.Fatalf("evaluate a free trial coupon of another plan: %d", code)
+	}
+	// only the kinds with an amount require it.
+	createTestCoupon(t, `{"kind": "free_trial", "expire_on": 30, "plan_id": "plan-1"}`)
+
+	recharge := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+recharge.Code+`", "order_total": 30}`); code != ErrorCodeCouponNotApplicable {
+		t.Fatalf("evaluate a recharge coupon: %d", code)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+genCode()+`", "order_total": 30}`); code != ErrorCodeGetCouponNotExsit {
+		t.Fatalf("evaluate a missing coupon: %d", code)
+	}
+
+	for _, body := range []string{
+		`{"kind": "percentage", "expire_on": 30, "amount": 50, "percent_off": 120}`,
+		`{"kind": "fixed_off", "expire_on": 30, "amount": 10, "plan_id": "plan-1"}`,
+		`{"kind": "gift", "expire_on": 30, "amount": 10}`,
+		`{"kind": "fixed_off", "expire_on": 30}`,
+		`{"kind": "free_trial", "expire_on": 30, "amount": 10, "plan_id": "plan-1"}`,
+	} {
+		w := doRequest(CreateCoupon, "POST", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1", body)
+		if code := parseResultData(t, w, nil); code != ErrorCodeInvalidParameters {
+			t.Errorf("create %s: %d", body, code)
+		}
+	}
+}
+
+func TestEvaluateUnusableCouponOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	others := createTestCoupon(t, `{"kind": "fixed_off", "expire_on": 30, "amount": 10, "bound_username": "bob"}`)
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+others.Code+`", "order_total": 30}`); code != ErrorCodeCouponNotForUser {
+		t.Errorf("evaluate a coupon of another user: %d", code)
+	}
+
+	team := createTestCoupon(t, `{"kind": "fixed_off", "expire_on": 30, "amount": 10, "bound_namespace": "team-*"}`)
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+team.Code+`", "order_total": 30, "namespace": "ns1"}`); code != ErrorCodeCouponNotForUser {
+		t.Errorf("evaluate a coupon of a namespace pattern in another namespace: %d", code)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+team.Code+`", "order_total": 30, "namespace": "team-a"}`); code != ErrorCodeNone {
+		t.Errorf("evaluate a coupon of a namespace pattern in the namespace: %d", code)
+	}
+
+	// the only redemption is held by a checkout.
+	held := createTestCoupon(t, `{"kind": "fixed_off", "expire_on": 30, "amount": 10}`)
+	if _, code := holdCouponCode(t, held.Code, `{"namespace": "ns1", "ttl": 300}`); code != ErrorCodeNone {
+		t.Fatalf("hold a coupon: %d", code)
+	}
+	if code, _ := evaluateTestCoupon(t, `{"code": "`+held.Code+`", "order_total": 30}`); code != ErrorCodeCouponHeld {
+		t.Errorf("evaluate a held coupon: %d", code)
+	}
+}
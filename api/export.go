@@ -0,0 +1,370 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+//=============================================================
+// the exports of the coupon list for finance and ops. The list
+// is read by cursor pages and written out page by page, so an
+// export never holds more than a page in memory.
+//=============================================================
+
+var exportPageSize = 1000
+
+type exportColumn struct {
+	name    string
+	numeric bool
+	value   func(r *models.CouponRecord, mask bool) string
+}
+
+func formatExportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// exportColumns are the columns which can be exported. Only the prefixes
+// of the codes are kept, so the code is its prefix, or all masked.
+var exportColumns = map[string]*exportColumn{
+	"serial": {"serial", false, func(r *models.CouponRecord, mask bool) string { return strings.ToUpper(r.Serial) }},
+	"code": {"code", false, func(r *models.CouponRecord, mask bool) string {
+		if mask || r.CodePrefix == "" {
+			return "****-****"
+		}
+		return strings.ToUpper(r.CodePrefix) + "-****"
+	}},
+	"kind":     {"kind", false, func(r *models.CouponRecord, mask bool) string { return r.Kind }},
+	"amount":   {"amount", true, func(r *models.CouponRecord, mask bool) string { return r.Amount.String() }},
+	"currency": {"currency", false, func(r *models.CouponRecord, mask bool) string { return string(r.Currency) }},
+	"status":   {"status", false, func(r *models.CouponRecord, mask bool) string { return string(r.Status) }},
+	"redemptions": {"redemptions", true, func(r *models.CouponRecord, mask bool) string {
+		return strconv.Itoa(r.Redemptions)
+	}},
+	"username":  {"username", false, func(r *models.CouponRecord, mask bool) string { return r.Username }},
+	"namespace": {"namespace", false, func(r *models.CouponRecord, mask bool) string { return r.Namespace }},
+	"use_time": {"use_time", false, func(r *models.CouponRecord, mask bool) string {
+		if r.UseTime == nil {
+			return ""
+		}
+		return formatExportTime(*r.UseTime)
+	}},
+	"create_at": {"create_at", false, func(r *models.CouponRecord, mask bool) string { return formatExportTime(r.CreateAt) }},
+	"expire_on": {"expire_on", false, func(r *models.CouponRecord, mask bool) string { return formatExportTime(r.ExpireOn) }},
+	"campaign_id": {"campaign_id", false, func(r *models.CouponRecord, mask bool) string {
+		if r.CampaignId == 0 {
+			return ""
+		}
+		return strconv.FormatInt(r.CampaignId, 10)
+	}},
+}
+
+var defaultExportColumns = []string{"serial", "code", "amount", "status", "username", "namespace", "use_time"}
+
+// exportColumnsFromQuery returns the columns of a comma separated list, in
+// its order, or the default columns for "".
+func exportColumnsFromQuery(list string) ([]*exportColumn, *Error) {
+	names := defaultExportColumns
+	if list != "" {
+		names = strings.Split(list, ",")
+	}
+
+	columns := make([]*exportColumn, 0, len(names))
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		column, ok := exportColumns[name]
+		if !ok {
+			return nil, GetError2(ErrorCodeInvalidParameters, "unknown column: "+name)
+		} else if seen[name] {
+			return nil, GetError2(ErrorCodeInvalidParameters, "duplicated column: "+name)
+		}
+		seen[name] = true
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// ExportCoupons streams the coupons selected by the filters of the list, as
+// csv or xlsx. The status is sent before the first row, so an error in the
+// middle can only be logged, and the export is cut short.
+func ExportCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin export coupons handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	//只有管理员才可以调这个API
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	filter, e := couponFilterFromQuery(r)
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, e, nil)
+		return
+	}
+	orderBy, err := models.ValidateOrderBy(r.Form.Get("orderby"))
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+		return
+	}
+	sortOrder := models.ValidateSortOrder(r.Form.Get("sortorder"), false)
+	columns, e := exportColumnsFromQuery(r.Form.Get("columns"))
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, e, nil)
+		return
+	}
+	mask := optionalBoolParamInQuery(r, "mask", false)
+
+	format := strings.ToLower(r.Form.Get("format"))
+	var newWriter func(w io.Writer, columns []*exportColumn) exportWriter
+	switch format {
+	case "", "csv":
+		format, newWriter = "csv", newCsvExportWriter
+	case "xlsx":
+		newWriter = newXlsxExportWriter
+	default:
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, "unsupported format: "+format), nil)
+		return
+	}
+
+	// the first page is read before the status is sent, so a failed store
+	// is still reported as an error.
+	page, err := store.PageCoupons(filter, orderBy, sortOrder, "", exportPageSize, false)
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeQueryCoupons, err.Error()), nil)
+		return
+	}
+	logger.Info("%s exports coupons: %s", username, r.URL.RawQuery)
+
+	filename := fmt.Sprintf("coupons-%s.%s", time.Now().UTC().Format("20060102150405"), format)
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	writer := newWriter(w, columns)
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.name
+	}
+	err = writer.writeRow(header)
+
+	rows := 0
+	cells := make([]string, len(columns))
+	for err == nil {
+		for _, record := range page.Results {
+			for i, c := range columns {
+				cells[i] = c.value(record, mask)
+			}
+			if err = writer.writeRow(cells); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = writer.flush()
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		rows += len(page.Results)
+		if err != nil || page.Next == "" {
+			break
+		}
+		page, err = store.PageCoupons(filter, orderBy, sortOrder, page.Next, exportPageSize, false)
+	}
+	if err == nil {
+		err = writer.close()
+	}
+	if err != nil {
+		logger.Error("Export coupons (%s) err after %d rows: %v", filename, rows, err)
+		return
+	}
+
+	logger.Info("End export coupons handler, %d rows.", rows)
+}
+
+var exportContentTypes = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// exportWriter writes the rows of an export, the first row is the header.
+type exportWriter interface {
+	writeRow(cells []string) error
+	// flush pushes the rows written out.
+	flush() error
+	// close ends the export.
+	close() error
+}
+
+//=============================================================
+// csv
+//=============================================================
+
+type csvExportWriter struct {
+	writer  *csv.Writer
+	columns []*exportColumn
+	escaped []string
+	header  bool
+}
+
+func newCsvExportWriter(w io.Writer, columns []*exportColumn) exportWriter {
+	return &csvExportWriter{writer: csv.NewWriter(w), columns: columns, escaped: make([]string, len(columns))}
+}
+
+func (cw *csvExportWriter) writeRow(cells []string) error {
+	if !cw.header {
+		cw.header = true
+		return cw.writer.Write(cells)
+	}
+	for i, cell := range cells {
+		cw.escaped[i] = cell
+		if !cw.columns[i].numeric {
+			cw.escaped[i] = csvSafe(cell)
+		}
+	}
+	return cw.writer.Write(cw.escaped)
+}
+
+func (cw *csvExportWriter) flush() error {
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+func (cw *csvExportWriter) close() error {
+	return cw.flush()
+}
+
+// csvSafe keeps a spreadsheet from taking a cell, such as a username, as
+// a formula.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+//=============================================================
+// xlsx, a zip of SpreadsheetML parts with one sheet, whose
+// cells are inline strings or numbers.
+//=============================================================
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="coupons" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+type xlsxExportWriter struct {
+	zip     *zip.Writer
+	sheet   io.Writer
+	columns []*exportColumn
+	header  bool
+	err     error
+}
+
+func newXlsxExportWriter(w io.Writer, columns []*exportColumn) exportWriter {
+	xw := &xlsxExportWriter{zip: zip.NewWriter(w), columns: columns}
+	for _, part := range xlsxParts {
+		xw.writePart(part.name, part.content)
+	}
+	xw.sheet, xw.err = xw.create("xl/worksheets/sheet1.xml")
+	xw.write(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return xw
+}
+
+func (xw *xlsxExportWriter) create(name string) (io.Writer, error) {
+	if xw.err != nil {
+		return nil, xw.err
+	}
+	return xw.zip.Create(name)
+}
+
+func (xw *xlsxExportWriter) writePart(name, content string) {
+	part, err := xw.create(name)
+	if err == nil {
+		_, err = io.WriteString(part, content)
+	}
+	xw.err = err
+}
+
+// write writes s to the sheet, the first error is kept.
+func (xw *xlsxExportWriter) write(s string) {
+	if xw.err == nil {
+		_, xw.err = io.WriteString(xw.sheet, s)
+	}
+}
+
+func (xw *xlsxExportWriter) writeRow(cells []string) error {
+	header := !xw.header
+	xw.header = true
+
+	xw.write("<row>")
+	for i, cell := range cells {
+		if cell == "" {
+			xw.write("<c/>")
+		} else if xw.columns[i].numeric && !header {
+			xw.write("<c><v>" + cell + "</v></c>")
+		} else {
+			var escaped bytes.Buffer
+			xml.EscapeText(&escaped, []byte(cell))
+			xw.write(`<c t="inlineStr"><is><t>` + escaped.String() + "</t></is></c>")
+		}
+	}
+	xw.write("</row>")
+	return xw.err
+}
+
+func (xw *xlsxExportWriter) flush() error {
+	if xw.err == nil {
+		xw.err = xw.zip.Flush()
+	}
+	return xw.err
+}
+
+func (xw *xlsxExportWriter) close() error {
+	xw.write("</sheetData></worksheet>")
+	if xw.err == nil {
+		xw.err = xw.zip.Close()
+	}
+	return xw.err
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func exportCoupons(query string) *httptest.ResponseRecorder {
+	return doRequest(ExportCoupons, "GET", "/charge/v1/export/coupons", "/charge/v1/export/coupons?region=cn-north-1&"+query, "")
+}
+
+func TestExportCouponsCsvOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+	defer func(size int) { exportPageSize = size }(exportPageSize)
+	exportPageSize = 2
+
+	var serials []string
+	for i := 0; i < 5; i++ {
+		created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+		serials = append(serials, created.Serial)
+	}
+	used := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 20}`)
+	if err := redeemAs(t, used, "=cmd"); err != nil {
+		t.Fatalf("use a coupon: %v", err)
+	}
+
+	// all the pages are exported, in the order of the list.
+	w := exportCoupons("orderby=serial&sortorder=asc&status=available")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("export coupons: %d %s", w.Code, w.Body.String())
+	}
+	records := readCsv(t, w.Body.String(), "code")
+	if len(records) != len(serials) || len(records[0]) != len(defaultExportColumns) {
+		t.Fatalf("exported %v", records)
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i-1][0] >= records[i][0] {
+			t.Fatalf("exported out of order: %v", records)
+		}
+	}
+
+	w = exportCoupons("status=used&columns=serial,code,amount,username,use_time&mask=true")
+	records = readCsv(t, w.Body.String(), "code")
+	if len(records) != 1 || records[0][0] != used.Serial || records[0][1] != "****-****" ||
+		records[0][2] != "20.00" || records[0][3] != "'=cmd" || records[0][4] == "" {
+		t.Fatalf("exported %v", records)
+	}
+	w = exportCoupons("status=used&columns=serial,code")
+	if records = readCsv(t, w.Body.String(), "code"); records[0][1] != used.Code[:4]+"-****" {
+		t.Fatalf("exported an unmasked code %v", records)
+	}
+
+	for _, query := range []string{"columns=serial,password", "columns=serial,serial", "format=pdf", "orderby=CREATE_TIME"} {
+		if code := parseResultData(t, exportCoupons(query), nil); code != ErrorCodeInvalidParameters {
+			t.Errorf("%s: %d", query, code)
+		}
+	}
+	AdminUsers = []string{"admin"}
+	if code := parseResultData(t, exportCoupons(""), nil); code != ErrorCodePermissionDenied {
+		t.Fatalf("export as a user: %d", code)
+	}
+}
+
+func TestExportCouponsXlsxOffline(t *testing.T) {
+	setupMemoryStore(t)
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	w := exportCoupons("format=xlsx&columns=serial,amount,status")
+	if w.Code != 200 || !strings.Contains(w.Header().Get("Content-Disposition"), ".xlsx") {
+		t.Fatalf("export coupons as xlsx: %d %s", w.Code, w.Body.String())
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("read xlsx err: %v", err)
+	}
+	var sheet string
+	for _, f := range archive.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			r, _ := f.Open()
+			b, _ := ioutil.ReadAll(r)
+			sheet = string(b)
+		}
+	}
+	want := `<row><c t="inlineStr"><is><t>` + created.Serial + `</t></is></c><c><v>10.00</v></c>` +
+		`<c t="inlineStr"><is><t>available</t></is></c></row>`
+	if len(archive.File) != 5 || strings.Count(sheet, "<row>") != 2 || !strings.Contains(sheet, want) ||
+		!strings.HasSuffix(sheet, "</sheetData></worksheet>") {
+		t.Fatalf("unexpected sheet: %s", sheet)
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+)
+
+// fakeDriver is a database/sql driver which records every statement and
+// its bound args. Without hooks, selects return no rows and updates
+// affect nothing.
+type fakeDriver struct {
+	mu    sync.Mutex
+	stmts []fakeStmtLog
+
+	queryHook func(query string, args []driver.Value) ([]string, [][]driver.Value)
+	execHook  func(query string, args []driver.Value) int64
+}
+
+type fakeStmtLog struct {
+	query string
+	args  []driver.Value
+}
+
+var theFakeDriver = &fakeDriver{}
+
+func init() {
+	sql.Register("couponfake", theFakeDriver)
+}
+
+func openFakeDB() *sql.DB {
+	db, err := sql.Open("couponfake", "")
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+func (d *fakeDriver) reset() {
+	d.mu.Lock()
+	d.stmts = nil
+	d.queryHook = nil
+	d.execHook = nil
+	d.mu.Unlock()
+}
+
+func (d *fakeDriver) log() []fakeStmtLog {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]fakeStmtLog{}, d.stmts...)
+}
+
+func (d *fakeDriver) record(query string, args []driver.Value) {
+	d.mu.Lock()
+	d.stmts = append(d.stmts, fakeStmtLog{query: query, args: args})
+	d.mu.Unlock()
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{d: c.d, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.record(s.query, args)
+
+	s.d.mu.Lock()
+	hook := s.d.execHook
+	s.d.mu.Unlock()
+	if hook == nil {
+		return fakeResult(0), nil
+	}
+	return fakeResult(hook(s.query, args)), nil
+}
+
+// fakeResult is the affected rows, LastInsertId is always 1.
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return 1, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return int64(r), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.record(s.query, args)
+
+	s.d.mu.Lock()
+	hook := s.d.queryHook
+	s.d.mu.Unlock()
+	if hook == nil {
+		return &fakeRows{}, nil
+	}
+	columns, values := hook(s.query, args)
+	return &fakeRows{columns: columns, values: values}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
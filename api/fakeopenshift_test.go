@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/openshift"
+)
+
+// fakeOpenShift serves the projects of DataFoundry, the test user can
+// access every project but the forbidden ones.
+type fakeOpenShift struct {
+	mu        sync.Mutex
+	forbidden map[string]bool
+	failing   bool
+	requests  int
+}
+
+var theFakeOpenShift = &fakeOpenShift{}
+
+func init() {
+	server := httptest.NewTLSServer(theFakeOpenShift)
+	osAdminClients = map[string]*openshift.OpenshiftClient{
+		DfRegion_CnNorth01: openshift.CreateUserOpenshiftClient("fake", server.URL),
+	}
+	theFakeOpenShift.reset()
+}
+
+// reset forgets the forbidden projects, and the cached accesses of them.
+func (f *fakeOpenShift) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forbidden = map[string]bool{}
+	f.failing = false
+	f.requests = 0
+	namespaceAccesses = newNamespaceAccessCache()
+}
+
+func (f *fakeOpenShift) forbid(namespace string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forbidden[namespace] = true
+}
+
+func (f *fakeOpenShift) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeOpenShift) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func (f *fakeOpenShift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests++
+	forbidden, failing := f.forbidden, f.failing
+	f.mu.Unlock()
+
+	namespace := strings.TrimPrefix(r.URL.Path, "/oapi/v1/projects/")
+	switch {
+	case failing:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case r.Method != "GET" || namespace == r.URL.Path || r.Header.Get("Authorization") != "Bearer test":
+		writeFakeStatus(w, http.StatusUnauthorized, "Unauthorized")
+	case forbidden[namespace]:
+		writeFakeStatus(w, http.StatusForbidden, `User "local" cannot get project "`+namespace+`"`)
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "Project",
+			"apiVersion": "v1",
+			"metadata":   map[string]string{"name": namespace},
+		})
+	}
+}
+
+func writeFakeStatus(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"kind": "Status", "apiVersion": "v1", "status": "Failure", "message": message, "code": code,
+	})
+}
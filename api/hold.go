@@ -0,0 +1,224 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/common"
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+//=============================================================
+// a checkout holds a coupon while the user pays, then confirms the
+// hold to use the coupon, or releases it. A hold which is neither
+// confirmed nor released in its ttl expires by itself.
+//=============================================================
+
+const (
+	holdDefaultTTL = 15 * 60 // seconds
+	holdMinTTL     = 60
+	holdMaxTTL     = 60 * 60
+
+	holdTokenBytes = 16
+)
+
+type holdRequest struct {
+	Namespace string `json:"namespace"`
+	TTL       int    `json:"ttl,omitempty"` // seconds
+}
+
+// HoldCoupon holds a redemption of the coupon of code for the user, and
+// returns the token to confirm or release it with.
+func HoldCoupon(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", loggedURL(r))
+	logger.Info("Begin hold a coupon handler.")
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	guard := newLookupGuard(r, username)
+	if e := guard.check(w); e != nil {
+		JsonResult(w, http.StatusTooManyRequests, e, nil)
+		return
+	}
+
+	correctInput := []string{"namespace"}
+	req := &holdRequest{}
+	err := common.ParseRequestJsonIntoWithValidateParams(r, correctInput, req)
+	if err != nil {
+		logger.Error("Parse body err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
+		return
+	}
+	if req.TTL == 0 {
+		req.TTL = holdDefaultTTL
+	}
+	if req.TTL < holdMinTTL || req.TTL > holdMaxTTL {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters,
+			fmt.Sprintf("ttl should be in [%d, %d] seconds", holdMinTTL, holdMaxTTL)), nil)
+		return
+	}
+
+	if e := checkNamespace(r.Header.Get("Authorization"), region, username, req.Namespace); e != nil {
+		JsonResult(w, namespaceErrorStatus(e), e, nil)
+		return
+	}
+
+	now := time.Now()
+	info := &models.HoldInfo{
+		Username:  username,
+		Namespace: req.Namespace,
+		Region:    region,
+		HoldTime:  now,
+		ExpireAt:  now.Add(time.Duration(req.TTL) * time.Second),
+	}
+	if code, offline := parseOfflineCode(params.ByName("code")); offline != nil {
+		info.Code = code
+		useInfo := &models.UseInfo{Serial: offline.serial(), Code: code, Username: username, Use_time: now}
+		e = saveOfflineCoupon(store, useInfo, offline)
+	} else {
+		info.Code, e = validateCode(params.ByName("code"))
+	}
+	if e != nil {
+		JsonResult(w, http.StatusBadRequest, guard.observe(e), nil)
+		return
+	}
+
+	info.Token, err = genHoldToken()
+	if err != nil {
+		logger.Error("Generate hold token err: %v", err)
+		JsonResult(w, http.StatusInternalServerError, GetError2(ErrorCodeHoldCoupon, err.Error()), nil)
+		return
+	}
+
+	hold, err := store.HoldCoupon(info)
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, guard.observe(getCouponError(ErrorCodeHoldCoupon, err)), nil)
+		return
+	}
+
+	logger.Info("End hold a coupon handler.")
+	JsonResult(w, http.StatusOK, nil, hold)
+}
+
+// RetrieveHold returns a hold of the user.
+func RetrieveHold(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin retrieve a hold handler.")
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	hold, err := store.RetrieveHold(params.ByName("token"), username)
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, getCouponError(ErrorCodeHoldCoupon, err), nil)
+		return
+	}
+
+	logger.Info("End retrieve a hold handler.")
+	JsonResult(w, http.StatusOK, nil, hold)
+}
+
+// ConfirmHold uses the held coupon, into the namespace of the hold.
+func ConfirmHold(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", r.URL)
+	logger.Info("Begin confirm a hold handler.")
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	result, entry, err := store.ConfirmHold(params.ByName("token"), username, region, time.Now())
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, getCouponError(ErrorCodeUseCoupon, err), nil)
+		return
+	}
+	// only the recharge coupons are credited, the discounts are taken off
+	// the order by the billing services.
+	if entry != nil && deliverRecharge(store, entry) {
+		result.RechargeStatus = models.OutboxStatus_Delivered
+	}
+
+	logger.Info("End confirm a hold handler.")
+	JsonResult(w, http.StatusOK, nil, result)
+}
+
+// ReleaseHold frees the held coupon, releasing a hold twice is fine.
+func ReleaseHold(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: DELETE %v.", r.URL)
+	logger.Info("Begin release a hold handler.")
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	if err := store.ReleaseHold(params.ByName("token"), username); err != nil {
+		JsonResult(w, http.StatusBadRequest, getCouponError(ErrorCodeHoldCoupon, err), nil)
+		return
+	}
+
+	logger.Info("End release a hold handler.")
+	JsonResult(w, http.StatusOK, nil, nil)
+}
+
+func genHoldToken() (string, error) {
+	b := make([]byte, holdTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func holdCouponCode(t *testing.T, code, body string) (*models.CouponHold, uint) {
+	w := doRequest(HoldCoupon, "POST", "/charge/v1/coupons/:code/holds",
+		"/charge/v1/coupons/"+code+"/holds?region=cn-north-1", body)
+	hold := &models.CouponHold{}
+	return hold, parseResultData(t, w, hold)
+}
+
+func confirmHold(t *testing.T, token string) (*models.UseResult, uint) {
+	w := doRequest(ConfirmHold, "POST", "/charge/v1/holds/:token/confirm",
+		"/charge/v1/holds/"+token+"/confirm?region=cn-north-1", "")
+	result := &models.UseResult{}
+	return result, parseResultData(t, w, result)
+}
+
+func releaseHold(t *testing.T, token string) uint {
+	w := doRequest(ReleaseHold, "DELETE", "/charge/v1/holds/:token", "/charge/v1/holds/"+token+"?region=cn-north-1", "")
+	return parseResultData(t, w, nil)
+}
+
+func TestHoldCouponOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+
+	hold, code := holdCouponCode(t, created.Code, `{"namespace": "ns1", "ttl": 300}`)
+	if code != ErrorCodeNone || len(hold.Token) != 2*holdTokenBytes || !strings.EqualFold(hold.Serial, created.Serial) ||
+		hold.Status != models.HoldStatus_Active || hold.Coupon == nil || hold.Coupon.Amount != 1000 {
+		t.Fatalf("hold a coupon: %d %+v", code, hold)
+	}
+	if d := hold.ExpireAt.Sub(time.Now()); d < 290*time.Second || d > 300*time.Second {
+		t.Fatalf("unexpected hold expire_at: %v", hold.ExpireAt)
+	}
+
+	// a held coupon can't be used or held by others.
+	if code := useCouponCode(t, created.Serial, created.Code); code != ErrorCodeCouponHeld {
+		t.Fatalf("use a held coupon: %d", code)
+	}
+	if _, code := holdCouponCode(t, created.Code, `{"namespace": "ns1"}`); code != ErrorCodeCouponHeld {
+		t.Fatalf("hold a held coupon: %d", code)
+	}
+	for _, body := range []string{`{"namespace": "ns1", "ttl": 10}`, `{"namespace": "ns1", "ttl": 7200}`, `{"ttl": 300}`} {
+		if _, code := holdCouponCode(t, created.Code, body); code != ErrorCodeInvalidParameters && code != ErrorCodeParseJsonFailed {
+			t.Errorf("hold with %s: %d", body, code)
+		}
+	}
+
+	w := doRequest(RetrieveHold, "GET", "/charge/v1/holds/:token", "/charge/v1/holds/"+hold.Token+"?region=cn-north-1", "")
+	retrieved := &models.CouponHold{}
+	if code := parseResultData(t, w, retrieved); code != ErrorCodeNone || retrieved.Token != "" || retrieved.Status != models.HoldStatus_Active {
+		t.Fatalf("retrieve a hold: %s", w.Body.String())
+	}
+
+	result, code := confirmHold(t, hold.Token)
+	if code != ErrorCodeNone || result.Amount != 1000 || result.Namespace != "ns1" {
+		t.Fatalf("confirm a hold: %d %+v", code, result)
+	}
+	if len(*calls) != 1 || (*calls)[0].namespace != "ns1" {
+		t.Fatalf("unexpected recharges: %v", *calls)
+	}
+	if _, code := confirmHold(t, hold.Token); code != ErrorCodeHoldNotActive {
+		t.Fatalf("confirm a hold twice: %d", code)
+	}
+	if code := releaseHold(t, hold.Token); code != ErrorCodeHoldNotActive {
+		t.Fatalf("release a confirmed hold: %d", code)
+	}
+	if _, code := confirmHold(t, "0123456789abcdef0123456789abcdef"); code != ErrorCodeHoldNotExist {
+		t.Fatalf("confirm a nonexistent hold: %d", code)
+	}
+}
+
+func TestConfirmHoldRegionOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	hold, code := holdCouponCode(t, created.Code, `{"namespace": "ns1"}`)
+	if code != ErrorCodeNone || hold.Region != "cn-north-1" {
+		t.Fatalf("hold a coupon: %d %+v", code, hold)
+	}
+
+	// the namespace of the hold is checked in cn-north-1 only.
+	w := doRequest(ConfirmHold, "POST", "/charge/v1/holds/:token/confirm",
+		"/charge/v1/holds/"+hold.Token+"/confirm?region=cn-north-2", "")
+	if code := parseResultData(t, w, nil); code != ErrorCodeHoldRegion || len(*calls) != 0 {
+		t.Fatalf("confirm a hold in another region: %s", w.Body.String())
+	}
+	if _, code := confirmHold(t, hold.Token); code != ErrorCodeNone || len(*calls) != 1 || (*calls)[0].region != "cn-north-1" {
+		t.Fatalf("confirm a hold: %d %v", code, *calls)
+	}
+}
+
+func TestReleaseHoldOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	hold, code := holdCouponCode(t, created.Code, `{"namespace": "ns1"}`)
+	if code != ErrorCodeNone {
+		t.Fatalf("hold a coupon: %d", code)
+	}
+
+	// another user doesn't see the hold.
+	store := getCouponStore()
+	if err := store.ReleaseHold(hold.Token, "bob"); err != models.ErrHoldNotFound {
+		t.Fatalf("release a hold of another user: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := releaseHold(t, hold.Token); code != ErrorCodeNone {
+			t.Fatalf("release a hold: %d", code)
+		}
+	}
+	if _, code := confirmHold(t, hold.Token); code != ErrorCodeHoldNotActive {
+		t.Fatalf("confirm a released hold: %d", code)
+	}
+	if code := useCouponCode(t, created.Serial, created.Code); code != ErrorCodeNone || len(*calls) != 1 {
+		t.Fatalf("use a released coupon: %d", code)
+	}
+}
+
+func TestExpireHoldOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 2}`)
+	store := getCouponStore()
+	past := time.Now().Add(-time.Hour)
+	code := strings.ToLower(created.Code)
+	for _, token := range []string{"expired1", "expired2"} {
+		_, err := store.HoldCoupon(&models.HoldInfo{
+			Code: code, Token: token, Username: "local", Namespace: "ns1", HoldTime: past, ExpireAt: past.Add(time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("hold a coupon: %v", err)
+		}
+	}
+
+	// the overdue holds are shown expired, and don't take the coupon.
+	hold, err := store.RetrieveHold("expired1", "local")
+	if err != nil || hold.Status != models.HoldStatus_Expired {
+		t.Fatalf("retrieve an overdue hold: %+v, %v", hold, err)
+	}
+	if n, err := store.ExpireHolds(time.Now(), 100); err != nil || n != 2 {
+		t.Fatalf("ExpireHolds = %d, %v, want 2", n, err)
+	}
+	if n, _ := store.ExpireHolds(time.Now(), 100); n != 0 {
+		t.Fatalf("ExpireHolds twice = %d, want 0", n)
+	}
+	if _, code := confirmHold(t, "expired1"); code != ErrorCodeHoldExpired {
+		t.Fatalf("confirm an expired hold: %d", code)
+	}
+	if code := releaseHold(t, "expired2"); code != ErrorCodeNone {
+		t.Fatalf("release an expired hold: %d", code)
+	}
+
+	// an overdue hold which is not swept yet is released on the next hold.
+	_, err = store.HoldCoupon(&models.HoldInfo{
+		Code: code, Token: "overdue", Username: "local", Namespace: "ns1", HoldTime: past, ExpireAt: past.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("hold a coupon: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, code := holdCouponCode(t, created.Code, `{"namespace": "ns1"}`); code != ErrorCodeNone {
+			t.Fatalf("hold a coupon with an overdue hold: %d", code)
+		}
+	}
+	if _, code := holdCouponCode(t, created.Code, `{"namespace": "ns1"}`); code != ErrorCodeCouponHeld {
+		t.Fatalf("hold a fully held coupon: %d", code)
+	}
+}
+
+func TestConfirmDiscountHoldOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	// a discount is held while the order is paid, and confirmed without
+	// any recharge.
+	created := createTestCoupon(t, `{"kind": "percentage", "expire_on": 30, "amount": 50, "percent_off": 20}`)
+	hold, code := holdCouponCode(t, created.Code, `{"namespace": "ns1"}`)
+	if code != ErrorCodeNone {
+		t.Fatalf("hold a percentage coupon: %d", code)
+	}
+	result, code := confirmHold(t, hold.Token)
+	if code != ErrorCodeNone || result.RechargeStatus != "" || len(*calls) != 0 {
+		t.Fatalf("confirm a percentage coupon: %d %+v", code, result)
+	}
+	if _, code := holdCouponCode(t, created.Code, `{"namespace": "ns1"}`); code != ErrorCodeCouponHasUsed {
+		t.Fatalf("hold a used coupon: %d", code)
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/openshift"
+	projectapi "github.com/openshift/origin/pkg/project/api/v1"
+)
+
+//=============================================================
+// a coupon is only redeemed into a namespace the user can access,
+// which is checked with the user token on DataFoundry, and cached
+// for a while.
+//=============================================================
+
+const (
+	namespaceAllowedTTL = time.Minute
+	namespaceDeniedTTL  = 10 * time.Second
+
+	maxNamespaceCacheEntries = 10000
+)
+
+// a DNS label, as the names of kubernetes namespaces.
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+type namespaceAccess struct {
+	allowed  bool
+	expireAt time.Time
+}
+
+type namespaceAccessCache struct {
+	mu      sync.Mutex
+	entries map[string]namespaceAccess
+}
+
+func newNamespaceAccessCache() *namespaceAccessCache {
+	return &namespaceAccessCache{entries: map[string]namespaceAccess{}}
+}
+
+var namespaceAccesses = newNamespaceAccessCache()
+
+func (c *namespaceAccessCache) get(key string, now time.Time) (allowed, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	access, ok := c.entries[key]
+	if !ok || !now.Before(access.expireAt) {
+		return false, false
+	}
+	return access.allowed, true
+}
+
+func (c *namespaceAccessCache) put(key string, allowed bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxNamespaceCacheEntries {
+		for k, access := range c.entries {
+			if !now.Before(access.expireAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNamespaceCacheEntries {
+			c.entries = map[string]namespaceAccess{}
+		}
+	}
+
+	ttl := namespaceDeniedTTL
+	if allowed {
+		ttl = namespaceAllowedTTL
+	}
+	c.entries[key] = namespaceAccess{allowed: allowed, expireAt: now.Add(ttl)}
+}
+
+// checkNamespace makes sure the user of token can access namespace in region.
+func checkNamespace(token, region, username, namespace string) *Error {
+	if !namespaceRegexp.MatchString(namespace) || len(namespace) > 63 {
+		return GetError2(ErrorCodeInvalidParameters, "namespace: "+namespace)
+	}
+
+	now := time.Now()
+	key := region + "/" + username + "/" + namespace
+	allowed, ok := namespaceAccesses.get(key, now)
+	if !ok {
+		var err error
+		allowed, err = accessNamespace(token, region, namespace)
+		if err != nil {
+			logger.Error("Check namespace (%s) of %s @ region (%s) err: %v", namespace, username, region, err)
+			return GetError2(ErrorCodeCheckNamespace, err.Error())
+		}
+		namespaceAccesses.put(key, allowed, now)
+	}
+
+	if !allowed {
+		logger.Warn("User %s can't access namespace (%s) @ region (%s).", username, namespace, region)
+		return GetError2(ErrorCodeNamespaceForbidden, namespace)
+	}
+	return nil
+}
+
+// namespaceErrorStatus is the http status of an error of checkNamespace.
+func namespaceErrorStatus(e *Error) int {
+	switch e.code {
+	case ErrorCodeNamespaceForbidden:
+		return http.StatusForbidden
+	case ErrorCodeCheckNamespace:
+		return http.StatusBadGateway
+	}
+	return http.StatusBadRequest
+}
+
+// accessNamespace gets the project of namespace with the user token, a
+// user who is not a member gets forbidden or not found.
+func accessNamespace(token, region, namespace string) (bool, error) {
+	oc := osAdminClients[region]
+	if oc == nil {
+		return false, fmt.Errorf("no datafoundry client @ region (%s).", region)
+	}
+	osRest := openshift.NewOpenshiftREST(oc.NewOpenshiftClient(token))
+	osRest.OGet("/projects/"+namespace, &projectapi.Project{})
+	if e, ok := osRest.Err.(*openshift.StatusError); ok {
+		if e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+	}
+	if osRest.Err != nil {
+		return false, osRest.Err
+	}
+	return true, nil
+}
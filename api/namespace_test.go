@@ -0,0 +1,55 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func TestUseCouponNamespaceOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 3}`)
+
+	theFakeOpenShift.forbid("others")
+	for i := 0; i < 2; i++ {
+		if code := useCouponIn(t, created.Serial, created.Code, "others"); code != ErrorCodeNamespaceForbidden {
+			t.Fatalf("use a coupon into a forbidden namespace: %d", code)
+		}
+	}
+	coupon, _ := getCouponStore().LookupCoupon(strings.ToLower(created.Code))
+	if coupon.Status != models.CouponStatus_Available || coupon.Redemptions != 0 || len(*calls) != 0 {
+		t.Fatalf("a coupon is used into a forbidden namespace: %+v %v", coupon, *calls)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := useCouponIn(t, created.Serial, created.Code, "ns1"); code != ErrorCodeNone {
+			t.Fatalf("use a coupon into an accessible namespace: %d", code)
+		}
+	}
+	// both the denial and the access are cached
+	if n := theFakeOpenShift.requestCount(); n != 2 {
+		t.Fatalf("%d project requests, want 2", n)
+	}
+
+	for _, namespace := range []string{"../users/~", "NS1", ""} {
+		if code := useCouponIn(t, created.Serial, created.Code, namespace); code != ErrorCodeInvalidParameters {
+			t.Fatalf("use a coupon into %q: %d", namespace, code)
+		}
+	}
+
+	// a failed check is not cached
+	theFakeOpenShift.setFailing(true)
+	if code := useCouponIn(t, created.Serial, created.Code, "ns2"); code != ErrorCodeCheckNamespace {
+		t.Fatalf("use a coupon when the namespace can't be checked: %d", code)
+	}
+	theFakeOpenShift.setFailing(false)
+	if code := useCouponIn(t, created.Serial, created.Code, "ns2"); code != ErrorCodeNone {
+		t.Fatalf("use a coupon after the check recovers: %d", code)
+	}
+	if len(*calls) != 3 {
+		t.Fatalf("unexpected recharges: %v", *calls)
+	}
+}
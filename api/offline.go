@@ -0,0 +1,244 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/common"
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+//=============================================================
+// offline coupons are not saved when they are minted, their code carries
+// the amount, the expiry and a nonce, signed with COUPON_OFFLINE_KEY.
+// The first redemption saves the coupon, so the code can't be replayed.
+//=============================================================
+
+const (
+	offlineCodeVersion = 1
+
+	// version, amount in fen, expiry in unix seconds, nonce and the
+	// truncated HMAC-SHA256 of the fields before it.
+	offlinePayloadLength = 1 + 4 + 4 + 8
+	offlineMacLength     = 8
+	offlineCodeLength    = 40 // base32 of the 25 bytes
+
+	offlineSerialPrefix = "of"
+)
+
+// Crockford's alphabet, without i, l, o and u.
+const offlineAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// the codes are 25 bytes, a multiple of 5, so they are never padded.
+var (
+	offlineEncoding = base32.NewEncoding(offlineAlphabet)
+	offlineCodeGen  = &codeGenerator{alphabet: offlineAlphabet, length: offlineCodeLength}
+)
+
+// offlineKey signs the offline codes, offline coupons are disabled
+// without it.
+var offlineKey []byte
+
+func initOfflineKey() {
+	offlineKey = []byte(os.Getenv("COUPON_OFFLINE_KEY"))
+	logger.Info("Offline coupons enabled: %v.", len(offlineKey) > 0)
+}
+
+type offlineCoupon struct {
+	Amount   models.Amount
+	ExpireOn time.Time
+	Nonce    [8]byte
+}
+
+func (c *offlineCoupon) serial() string {
+	return offlineSerialPrefix + hex.EncodeToString(c.Nonce[:])
+}
+
+func offlineMac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, offlineKey)
+	mac.Write(payload)
+	return mac.Sum(nil)[:offlineMacLength]
+}
+
+// mintOfflineCode draws a nonce for c and returns its signed code.
+func mintOfflineCode(c *offlineCoupon) (string, error) {
+	if _, err := rand.Read(c.Nonce[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, offlinePayloadLength, offlinePayloadLength+offlineMacLength)
+	b[0] = offlineCodeVersion
+	binary.BigEndian.PutUint32(b[1:5], uint32(c.Amount))
+	binary.BigEndian.PutUint32(b[5:9], uint32(c.ExpireOn.Unix()))
+	copy(b[9:], c.Nonce[:])
+	return offlineEncoding.EncodeToString(append(b, offlineMac(b)...)), nil
+}
+
+// parseOfflineCode returns the normalized code and its coupon, or nil if
+// code is not an offline code signed with offlineKey.
+func parseOfflineCode(code string) (string, *offlineCoupon) {
+	if len(offlineKey) == 0 {
+		return "", nil
+	}
+	code = offlineCodeGen.normalize(code)
+	if len(code) != offlineCodeLength {
+		return "", nil
+	}
+	b, err := offlineEncoding.DecodeString(code)
+	if err != nil || len(b) != offlinePayloadLength+offlineMacLength || b[0] != offlineCodeVersion {
+		return "", nil
+	}
+	if !hmac.Equal(b[offlinePayloadLength:], offlineMac(b[:offlinePayloadLength])) {
+		return "", nil
+	}
+
+	c := &offlineCoupon{
+		Amount:   models.Amount(binary.BigEndian.Uint32(b[1:5])),
+		ExpireOn: time.Unix(int64(binary.BigEndian.Uint32(b[5:9])), 0).UTC(),
+	}
+	copy(c.Nonce[:], b[9:offlinePayloadLength])
+	return code, c
+}
+
+// coupon is the row saved on the first redemption, its unique serial and
+// code hash block the replays.
+func (c *offlineCoupon) coupon(code string) *models.Coupon {
+	return &models.Coupon{
+		Serial:   c.serial(),
+		Code:     code,
+		Kind:     models.CouponKind_Offline,
+		ExpireOn: c.ExpireOn,
+		Amount:   c.Amount,
+		Currency: models.Currency_CNY,
+	}
+}
+
+// retrieveResult describes an offline coupon that is not redeemed yet.
+func (c *offlineCoupon) retrieveResult(code string, now time.Time) *models.RetrieveResult {
+	status := models.CouponStatus_Available
+	if !now.Before(c.ExpireOn) {
+		status = models.CouponStatus_Expired
+	}
+	return &models.RetrieveResult{
+		Serial:     c.serial(),
+		CodePrefix: code[:4],
+		Kind:       models.CouponKind_Offline,
+		ExpireOn:   c.ExpireOn,
+		Amount:     c.Amount,
+		Currency:   models.Currency_CNY,
+		Status:     status,
+	}
+}
+
+// saveOfflineCoupon saves an offline coupon on its first redemption, it
+// is already saved if its serial or code is taken.
+func saveOfflineCoupon(store models.CouponStore, useInfo *models.UseInfo, c *offlineCoupon) *Error {
+	if !strings.EqualFold(useInfo.Serial, c.serial()) {
+		return GetError2(ErrorCodeGetCouponNotExsit, "This coupon does not exist.")
+	}
+	if !useInfo.Use_time.Before(c.ExpireOn) {
+		return getCouponError(ErrorCodeUseCoupon, &models.TransitionError{From: models.CouponStatus_Expired, To: models.CouponStatus_Used})
+	}
+	_, err := store.CreateCoupon(c.coupon(useInfo.Code), useInfo.Username)
+	if err != nil && err != models.ErrCouponCodeConflict {
+		logger.Error("Save offline coupon (%s) err: %v", useInfo.Serial, err)
+		return GetError2(ErrorCodeUseCoupon, err.Error())
+	}
+	return nil
+}
+
+type offlineMintInfo struct {
+	createInfo
+	Number int `json:"number"`
+}
+
+// MintOfflineCoupons signs number offline codes and returns the
+// serial/code list as a csv download, nothing is saved.
+func MintOfflineCoupons(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: POST %v.", loggedURL(r))
+	logger.Info("Begin mint offline coupons handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	//只有管理员才可以调这个API
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	if len(offlineKey) == 0 {
+		JsonResult(w, http.StatusBadRequest, GetError(ErrorCodeOfflineDisabled), nil)
+		return
+	}
+
+	correctInput := []string{"expire_on", "amount", "number"}
+	info := &offlineMintInfo{}
+	err := common.ParseRequestJsonIntoWithValidateParams(r, correctInput, info)
+	if err != nil {
+		logger.Error("Parse body err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
+		return
+	}
+
+	// the kind is always offline, and the code only keeps whole seconds.
+	info.Kind = ""
+	coupon, err := info.coupon(time.Now())
+	if err == nil {
+		coupon.ExpireOn = coupon.ExpireOn.Truncate(time.Second)
+	}
+	if err == nil && coupon.Amount > math.MaxUint32 {
+		err = fmt.Errorf("amount should be at most %s", models.Amount(math.MaxUint32))
+	}
+	if err == nil && (coupon.ExpireOn.Unix() > math.MaxUint32 || coupon.ExpireOn.Unix() < 0) {
+		err = fmt.Errorf("expire_on is out of range: %s", coupon.ExpireOn.Format(time.RFC3339))
+	}
+	if err == nil && (coupon.MaxRedemptions > 1 || coupon.PerUserLimit > 0) {
+		err = fmt.Errorf("offline coupons are single use")
+	}
+	if err == nil && (coupon.BoundUsername != "" || coupon.BoundNamespace != "") {
+		err = fmt.Errorf("offline coupons can't be bound")
+	}
+	if err == nil && (info.Number < 1 || info.Number > models.MaxCampaignCoupons) {
+		err = fmt.Errorf("number should be in [1, %d]", models.MaxCampaignCoupons)
+	}
+	if err != nil {
+		logger.Error("Validate mint info err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+		return
+	}
+
+	filename := fmt.Sprintf("offline-%s.csv", time.Now().UTC().Format("20060102150405"))
+	writeCouponsCsv(w, filename, true, func(f func(c *models.CampaignCoupon) error) error {
+		for i := 0; i < info.Number; i++ {
+			c := &offlineCoupon{Amount: coupon.Amount, ExpireOn: coupon.ExpireOn}
+			code, err := mintOfflineCode(c)
+			if err != nil {
+				return err
+			}
+			if err := f(&models.CampaignCoupon{Serial: c.serial(), Code: code}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	logger.Info("Minted %d offline coupons by %s.", info.Number, username)
+	logger.Info("End mint offline coupons handler.")
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func mintTestOfflineCoupons(t *testing.T, body string) [][]string {
+	w := doRequest(MintOfflineCoupons, "POST", "/charge/v1/coupons/offline", "/charge/v1/coupons/offline?region=cn-north-1", body)
+	if w.Code != 200 {
+		t.Fatalf("mint offline coupons: %d %s", w.Code, w.Body.String())
+	}
+	return readCsv(t, w.Body.String(), "code")
+}
+
+func countTestCoupons(t *testing.T) int64 {
+	count, _, err := getCouponStore().QueryCoupons(nil, "", false, 0, 10)
+	if err != nil {
+		t.Fatalf("query coupons err: %v", err)
+	}
+	return count
+}
+
+func TestOfflineCouponOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+	offlineKey = []byte("test-offline-key")
+	defer func() { offlineKey = nil }()
+
+	coupons := mintTestOfflineCoupons(t, `{"expire_on": 30, "amount": 12.5, "number": 3}`)
+	if len(coupons) != 3 || coupons[0][0] == coupons[1][0] || coupons[0][1] == coupons[1][1] {
+		t.Fatalf("unexpected offline coupons: %v", coupons)
+	}
+	if n := countTestCoupons(t); n != 0 {
+		t.Fatalf("minting saved %d coupons", n)
+	}
+
+	// an offline coupon can be retrieved before it is saved
+	serial, code := coupons[0][0], coupons[0][1]
+	retrieved := &models.RetrieveResult{}
+	w := doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+code+"?region=cn-north-1", "")
+	if code := parseResultData(t, w, retrieved); code != ErrorCodeNone {
+		t.Fatalf("retrieve an offline coupon: %d", code)
+	}
+	if !strings.EqualFold(retrieved.Serial, serial) || retrieved.Amount != 1250 || retrieved.Status != models.CouponStatus_Available {
+		t.Fatalf("unexpected offline coupon: %+v", retrieved)
+	}
+	if n := countTestCoupons(t); n != 0 {
+		t.Fatalf("retrieving saved %d coupons", n)
+	}
+
+	if code := useCouponCode(t, serial, strings.ToLower(code)); code != ErrorCodeNone {
+		t.Fatalf("use an offline coupon: %d", code)
+	}
+	if len(*calls) != 1 || (*calls)[0].amount != 1250 {
+		t.Fatalf("unexpected recharges: %v", *calls)
+	}
+	if code := useCouponCode(t, serial, code); code != ErrorCodeCouponHasUsed {
+		t.Fatalf("replay an offline coupon: %d", code)
+	}
+	if n := countTestCoupons(t); n != 1 {
+		t.Fatalf("offline coupons saved: %d", n)
+	}
+
+	// another serial doesn't match the code
+	if code := useCouponCode(t, coupons[2][0], coupons[1][1]); code != ErrorCodeGetCouponNotExsit {
+		t.Fatalf("use an offline coupon with another serial: %d", code)
+	}
+
+	// a code is only offline with a valid signature
+	tampered := []byte(strings.ToLower(coupons[1][1]))
+	if tampered[5] == '0' {
+		tampered[5] = '1'
+	} else {
+		tampered[5] = '0'
+	}
+	if code := useCouponCode(t, coupons[1][0], string(tampered)); code != ErrorCodeInvalidCouponCode {
+		t.Fatalf("use a tampered offline coupon: %d", code)
+	}
+	if len(*calls) != 1 {
+		t.Fatalf("unexpected recharges: %v", *calls)
+	}
+}
+
+func TestExpiredOfflineCouponOffline(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+	offlineKey = []byte("test-offline-key")
+	defer func() { offlineKey = nil }()
+
+	c := &offlineCoupon{Amount: 1000, ExpireOn: time.Now().Add(-time.Hour).Truncate(time.Second).UTC()}
+	code, err := mintOfflineCode(c)
+	if err != nil {
+		t.Fatalf("mint offline code err: %v", err)
+	}
+	if parsed, offline := parseOfflineCode(formatCode(code)); parsed != code || *offline != *c {
+		t.Fatalf("parse offline code: %s %+v, want %s %+v", parsed, offline, code, c)
+	}
+
+	if code := useCouponCode(t, c.serial(), code); code != ErrorCodeCouponHasExpired {
+		t.Fatalf("use an expired offline coupon: %d", code)
+	}
+	if n := countTestCoupons(t); n != 0 {
+		t.Fatalf("an expired offline coupon saved %d coupons", n)
+	}
+}
+
+func TestOfflineCouponDisabled(t *testing.T) {
+	setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+	offlineKey = nil
+
+	w := doRequest(MintOfflineCoupons, "POST", "/charge/v1/coupons/offline", "/charge/v1/coupons/offline?region=cn-north-1",
+		`{"expire_on": 30, "amount": 10, "number": 1}`)
+	if code := parseResultData(t, w, nil); code != ErrorCodeOfflineDisabled {
+		t.Fatalf("mint offline coupons without a key: %d", code)
+	}
+
+	w = doRequest(CreateCoupon, "POST", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1",
+		`{"kind": "offline", "expire_on": 30, "amount": 10}`)
+	if code := parseResultData(t, w, nil); code != ErrorCodeInvalidParameters {
+		t.Fatalf("create an offline coupon: %d", code)
+	}
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+//======================================================
+// deliver the recharges queued in DF_COUPON_OUTBOX
+//======================================================
+
+const (
+	rechargeDispatchInterval = 10 * time.Second
+	rechargeDispatchBatch    = 20
+	rechargeLease            = time.Minute
+	rechargeMaxAttempts      = 8
+	rechargeRetryMax         = 30 * time.Minute
+)
+
+// the first retry waits rechargeRetryBase, then doubles.
+var rechargeRetryBase = 30 * time.Second
+
+// StartRechargeDispatcher retries the undelivered recharges in background.
+func StartRechargeDispatcher() {
+	go func() {
+		ticker := time.NewTicker(rechargeDispatchInterval)
+		for range ticker.C {
+			dispatchRecharges()
+		}
+	}()
+}
+
+// dispatchRecharges delivers one batch of due recharges, and returns
+// how many of them are delivered.
+func dispatchRecharges() int {
+	store := getCouponStore()
+	if store == nil {
+		return 0
+	}
+
+	entries, err := store.ClaimPendingRecharges(rechargeDispatchBatch, rechargeLease)
+	if err != nil {
+		logger.Error("ClaimPendingRecharges err: %v", err)
+	}
+
+	delivered := 0
+	for _, entry := range entries {
+		if deliverRecharge(store, entry) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// deliverRecharge calls the recharge service once for entry and records
+// the result. After rechargeMaxAttempts failures, the recharge is given
+// up and the coupon is put back.
+func deliverRecharge(store models.CouponStore, entry *models.RechargeOutbox) bool {
+	err := rechargeFunc(entry.Region, entry.RechargeKey(), entry.Username, entry.Namespace, entry.Amount)
+	if err == nil {
+		if err := store.MarkRechargeDelivered(entry.Id); err != nil {
+			logger.Error("MarkRechargeDelivered (%d) err: %v", entry.Id, err)
+		}
+		return true
+	}
+
+	attempts := entry.Attempts + 1
+	if attempts >= rechargeMaxAttempts {
+		logger.Error("recharge of coupon (%s) failed %d times, give up: %v", entry.Serial, attempts, err)
+		if err := store.CompensateRecharge(entry.Id, err.Error()); err != nil {
+			logger.Error("CompensateRecharge (%d) err: %v", entry.Id, err)
+		}
+		return false
+	}
+
+	logger.Warn("recharge of coupon (%s) failed %d times: %v", entry.Serial, attempts, err)
+	nextTryAt := time.Now().Add(rechargeBackoff(attempts))
+	if err := store.MarkRechargeRetry(entry.Id, nextTryAt, err.Error()); err != nil {
+		logger.Error("MarkRechargeRetry (%d) err: %v", entry.Id, err)
+	}
+	return false
+}
+
+func rechargeBackoff(attempts int) time.Duration {
+	d := rechargeRetryBase
+	for i := 1; i < attempts && d < rechargeRetryMax; i++ {
+		d *= 2
+	}
+	if d > rechargeRetryMax {
+		d = rechargeRetryMax
+	}
+	return d
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+// flakyRecharge fails the first failures calls.
+func flakyRecharge(failures int) *[]rechargeCall {
+	var mu sync.Mutex
+	calls := &[]rechargeCall{}
+	rechargeFunc = func(region, serial, username, namespace string, amount models.Amount) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*calls = append(*calls, rechargeCall{region, serial, username, namespace, amount})
+		if len(*calls) <= failures {
+			return errors.New("recharge service is down")
+		}
+		return nil
+	}
+	return calls
+}
+
+func useTestCoupon(t *testing.T, created *models.CreateResult) *models.UseResult {
+	usePath := "/charge/v1/coupons/use/" + created.Serial + "?region=cn-north-1"
+	useBody := `{"code": "` + created.Code + `", "namespace": "ns1"}`
+	w := doRequest(UseCoupon, "PUT", "/charge/v1/coupons/use/:serial", usePath, useBody)
+	used := &models.UseResult{}
+	if code := parseResultData(t, w, used); code != ErrorCodeNone {
+		t.Fatalf("use coupon: %s", w.Body.String())
+	}
+	return used
+}
+
+func TestRechargeRetried(t *testing.T) {
+	setupMemoryStore(t)
+	calls := flakyRecharge(2)
+	rechargeRetryBase = 0
+	defer func() {
+		rechargeFunc = couponRecharge
+		rechargeRetryBase = 30 * time.Second
+	}()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 68}`)
+	used := useTestCoupon(t, created)
+	if used.RechargeStatus != models.OutboxStatus_Pending {
+		t.Fatalf("recharge status = %q, want pending", used.RechargeStatus)
+	}
+
+	if n := dispatchRecharges(); n != 0 {
+		t.Fatalf("%d recharges delivered, want 0", n)
+	}
+	if n := dispatchRecharges(); n != 1 {
+		t.Fatalf("%d recharges delivered, want 1", n)
+	}
+	if n := dispatchRecharges(); n != 0 {
+		t.Fatalf("a delivered recharge is delivered again")
+	}
+
+	if len(*calls) != 3 {
+		t.Fatalf("%d recharge calls, want 3", len(*calls))
+	}
+	for _, call := range *calls {
+		if call.serial != (*calls)[0].serial {
+			t.Errorf("idempotency key changed: %s != %s", call.serial, (*calls)[0].serial)
+		}
+	}
+}
+
+func TestRechargeCompensated(t *testing.T) {
+	setupMemoryStore(t)
+	calls := flakyRecharge(rechargeMaxAttempts)
+	rechargeRetryBase = 0
+	defer func() {
+		rechargeFunc = couponRecharge
+		rechargeRetryBase = 30 * time.Second
+	}()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 68}`)
+	useTestCoupon(t, created)
+
+	for i := 0; i < rechargeMaxAttempts; i++ {
+		dispatchRecharges()
+	}
+	if len(*calls) != rechargeMaxAttempts {
+		t.Fatalf("%d recharge calls, want %d", len(*calls), rechargeMaxAttempts)
+	}
+
+	// the coupon is given back, and can be used again.
+	w := doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/"+created.Code+"?region=cn-north-1", "")
+	retrieved := &models.RetrieveResult{}
+	if code := parseResultData(t, w, retrieved); code != ErrorCodeNone || retrieved.Status != "available" {
+		t.Fatalf("retrieve a compensated coupon: %s", w.Body.String())
+	}
+
+	used := useTestCoupon(t, created)
+	if used.RechargeStatus != models.OutboxStatus_Delivered {
+		t.Fatalf("recharge status = %q, want delivered", used.RechargeStatus)
+	}
+}
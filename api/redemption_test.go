@@ -0,0 +1,181 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+func redeemAs(t *testing.T, created *models.CreateResult, username string) error {
+	store := getCouponStore()
+	_, entry, err := store.UseCoupon(&models.UseInfo{
+		Serial: created.Serial, Code: created.Code, Username: username, Namespace: username, Use_time: time.Now(),
+	})
+	if err == nil {
+		deliverRecharge(store, entry)
+	}
+	return err
+}
+
+func TestMultiUseCouponOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 3, "per_user_limit": 2}`)
+
+	for _, username := range []string{"alice", "alice"} {
+		if err := redeemAs(t, created, username); err != nil {
+			t.Fatalf("use a multi use coupon as %s: %v", username, err)
+		}
+	}
+	if err := redeemAs(t, created, "alice"); err != models.ErrCouponUserLimitReached {
+		t.Fatalf("use a multi use coupon over the per user limit: %v", err)
+	}
+	coupon, _ := getCouponStore().LookupCoupon(strings.ToLower(created.Code))
+	if coupon.Status != models.CouponStatus_Available || coupon.Redemptions != 2 {
+		t.Fatalf("unexpected coupon: %+v", coupon)
+	}
+
+	if err := redeemAs(t, created, "bob"); err != nil {
+		t.Fatalf("use the last redemption: %v", err)
+	}
+	if err := redeemAs(t, created, "carol"); err == nil {
+		t.Fatalf("use a coupon after its last redemption")
+	} else if e, ok := err.(*models.TransitionError); !ok || e.From != models.CouponStatus_Used {
+		t.Fatalf("use a coupon after its last redemption: %v", err)
+	}
+
+	// every redemption is recorded and recharged with its own key
+	w := doRequest(CouponRedemptions, "GET", "/charge/v1/history/coupons/:serial/redemptions",
+		"/charge/v1/history/coupons/"+created.Serial+"/redemptions?region=cn-north-1", "")
+	var redemptions []*models.Redemption
+	if code := parseResultData(t, w, &redemptions); code != ErrorCodeNone || len(redemptions) != 3 {
+		t.Fatalf("coupon redemptions: %s", w.Body.String())
+	}
+	if redemptions[2].Username != "bob" || redemptions[2].Amount != 1000 {
+		t.Fatalf("unexpected redemption: %+v", redemptions[2])
+	}
+	keys := map[string]bool{}
+	for _, call := range *calls {
+		keys[call.serial] = true
+	}
+	if len(*calls) != 3 || len(keys) != 3 {
+		t.Fatalf("unexpected recharges: %v", *calls)
+	}
+
+	if code := useCouponCode(t, created.Serial, created.Code); code != ErrorCodeCouponHasUsed {
+		t.Fatalf("use a used up coupon: %d", code)
+	}
+	for _, body := range []string{
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": -1}`,
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 3, "per_user_limit": 4}`,
+	} {
+		w := doRequest(CreateCoupon, "POST", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1", body)
+		if code := parseResultData(t, w, nil); code != ErrorCodeInvalidParameters {
+			t.Errorf("create %s: %d", body, code)
+		}
+	}
+}
+
+func usePromoCode(t *testing.T, code string) uint {
+	w := doRequest(UseCouponCode, "POST", "/charge/v1/coupons/:code/use", "/charge/v1/coupons/"+code+"/use?region=cn-north-1",
+		`{"namespace": "ns1"}`)
+	return parseResultData(t, w, nil)
+}
+
+func TestPromoCodeOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 1000, "per_user_limit": 1, "code": "NewYear-2027"}`)
+	if created.Code != "NEWYEAR2027" {
+		t.Fatalf("unexpected promo code: %+v", created)
+	}
+
+	// the promo code is looked up and used alone, the users don't know the serial.
+	w := doRequest(RetrieveCoupon, "GET", "/charge/v1/coupons/:code", "/charge/v1/coupons/newyear2027?region=cn-north-1", "")
+	retrieved := &models.RetrieveResult{}
+	if code := parseResultData(t, w, retrieved); code != ErrorCodeNone || !strings.EqualFold(retrieved.Serial, created.Serial) {
+		t.Fatalf("retrieve a promo code: %s", w.Body.String())
+	}
+	if code := usePromoCode(t, "NEWYEAR2027"); code != ErrorCodeNone || len(*calls) != 1 {
+		t.Fatalf("use a promo code: %d", code)
+	}
+	if code := usePromoCode(t, "NEWYEAR2027"); code != ErrorCodeCouponUserLimit {
+		t.Fatalf("use a promo code twice: %d", code)
+	}
+	if err := redeemAs(t, created, "bob"); err != nil {
+		t.Fatalf("use a promo code as another user: %v", err)
+	}
+	if code := usePromoCode(t, "NEWYEAR2028"); code != ErrorCodeGetCouponNotExsit {
+		t.Fatalf("use a nonexistent promo code: %d", code)
+	}
+
+	for body, want := range map[string]uint{
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "code": "SPRING2027"}`:                           ErrorCodeInvalidParameters,
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 10, "code": "spring"}`:        ErrorCodeInvalidParameters,
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 10, "code": "spring'2027"}`:   ErrorCodeInvalidParameters,
+		`{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 10, "code": "new-year-2027"}`: ErrorCodeCreateCoupon,
+	} {
+		w := doRequest(CreateCoupon, "POST", "/charge/v1/coupons", "/charge/v1/coupons?region=cn-north-1", body)
+		if code := parseResultData(t, w, nil); code != want {
+			t.Errorf("create %s: %s", body, w.Body.String())
+		}
+	}
+}
+
+func TestMultiUseCouponCompensatedOffline(t *testing.T) {
+	setupMemoryStore(t)
+	calls := flakyRecharge(rechargeMaxAttempts)
+	rechargeRetryBase = 0
+	defer func() {
+		rechargeFunc = couponRecharge
+		rechargeRetryBase = 30 * time.Second
+	}()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 2, "per_user_limit": 1}`)
+	if err := redeemAs(t, created, "alice"); err != nil {
+		t.Fatalf("use a multi use coupon: %v", err)
+	}
+	for i := 1; i < rechargeMaxAttempts; i++ {
+		dispatchRecharges()
+	}
+	if len(*calls) != rechargeMaxAttempts {
+		t.Fatalf("%d recharge calls, want %d", len(*calls), rechargeMaxAttempts)
+	}
+
+	// the failed redemption doesn't count for the coupon or the user
+	coupon, _ := getCouponStore().LookupCoupon(strings.ToLower(created.Code))
+	if coupon.Redemptions != 0 {
+		t.Fatalf("unexpected coupon: %+v", coupon)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err := redeemAs(t, created, username); err != nil {
+			t.Fatalf("use a compensated coupon as %s: %v", username, err)
+		}
+	}
+	if call := (*calls)[len(*calls)-1]; call.serial == (*calls)[0].serial {
+		t.Fatalf("recharge key reused: %s", call.serial)
+	}
+}
+
+func TestUseMultiUseCouponConcurrentlyOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	defer func() { rechargeFunc = couponRecharge }()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 10}`)
+	if succeeded := useConcurrently(t, created.Serial, created.Code, 64); succeeded != 10 {
+		t.Errorf("%d redemptions succeeded, want 10", succeeded)
+	}
+	if len(*calls) != 10 {
+		t.Errorf("%d recharge callbacks, want 10", len(*calls))
+	}
+
+	// all the requests are of the same user
+	created = createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 10, "per_user_limit": 1}`)
+	if succeeded := useConcurrently(t, created.Serial, created.Code, 64); succeeded != 1 {
+		t.Errorf("%d redemptions of a user succeeded, want 1", succeeded)
+	}
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/asiainfoLDP/datafoundry_coupon/common"
 	"github.com/asiainfoLDP/datafoundry_coupon/models"
@@ -37,7 +38,7 @@ func BuildDataFoundryClient(infoEnv string, durPhase time.Duration) *openshift.O
 	info := os.Getenv(infoEnv)
 	params := strings.Split(strings.TrimSpace(info), " ")
 	if len(params) != 3 {
-		logger.Emergency("BuildDataFoundryClient, len(params) is not correct: ", len(params))
+		logger.Emergency("BuildDataFoundryClient, len(params) is not correct: %d", len(params))
 	}
 
 	return openshift.CreateOpenshiftClient(infoEnv, params[0], params[1], params[2], durPhase)
@@ -118,7 +119,7 @@ func authDF(userToken, region string) (*userapi.User, error) {
 	//osRest := openshift.NewOpenshiftREST(openshift.NewOpenshiftClient(userToken))
 	oc := osAdminClients[region]
 	if oc == nil {
-		return nil, fmt.Errorf("user noud found @ region (%s).")
+		return nil, fmt.Errorf("user noud found @ region (%s).", region)
 	}
 	oc = oc.NewOpenshiftClient(userToken)
 	osRest := openshift.NewOpenshiftREST(oc)
@@ -142,27 +143,77 @@ func dfUser(user *userapi.User) string {
 //call recharge api
 //====================================================
 
-func couponRecharge(region, couponSerial, username, namespace string, amount float32) error {
+// rechargeFunc and refundFunc are replaced in ut to run without the
+// recharge service.
+var (
+	rechargeFunc = couponRecharge
+	refundFunc   = couponRefund
+)
+
+type rechargeRequest struct {
+	Namespace string        `json:"namespace"`
+	Amount    models.Amount `json:"amount"`
+	Reason    string        `json:"reason"`
+	User      string        `json:"user"`
+	Paymode   string        `json:"paymode"`
+}
+
+// rechargeKey is the serial of the coupon and its redemption, see
+// models.RechargeOutbox.RechargeKey.
+func couponRecharge(region, rechargeKey, username, namespace string, amount models.Amount) error {
 	logger.Info("Call remote recharge....")
-	body := fmt.Sprintf(
-		`{"namespace":"%s", "amount":%.3f, "reason":"%s", "user":"%s", "paymode":"%s"}`,
-		namespace, amount, couponSerial, username, "coupon",
-	)
+	// a retried recharge is credited only once by the recharge service.
+	return callRechargeService(region, "couponrecharge", rechargeKey, &rechargeRequest{
+		Namespace: namespace,
+		Amount:    amount,
+		Reason:    rechargeKey,
+		User:      username,
+		Paymode:   "coupon",
+	})
+}
+
+// couponRefund debits the recharge of rechargeKey back from namespace,
+// a retried refund is debited only once.
+func couponRefund(region, rechargeKey, username, namespace string, amount models.Amount) error {
+	logger.Info("Call remote refund....")
+	return callRechargeService(region, "couponrefund", rechargeKey+"-refund", &rechargeRequest{
+		Namespace: namespace,
+		Amount:    amount,
+		Reason:    rechargeKey,
+		User:      username,
+		Paymode:   "coupon",
+	})
+}
+
+func callRechargeService(region, api, idempotencyKey string, req *rechargeRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
 
 	//RechargeSercice1 := "http://datafoundry.recharge.app.dataos.io:80"
-	url := fmt.Sprintf("%s/charge/v1/couponrecharge?region=%s", RechargeSercice, region)
+	url := fmt.Sprintf("%s/charge/v1/%s?region=%s", RechargeSercice, api, region)
 
 	oc := osAdminClients[region]
-	logger.Info("Call %s recharge. token: %s", url, oc.BearerToken())
-	response, data, err := common.RemoteCallWithJsonBody("POST", url, oc.BearerToken(), "", []byte(body))
+	if oc == nil {
+		return fmt.Errorf("no datafoundry client @ region (%s).", region)
+	}
+	logger.Info("Call %s %s. token: %s", url, api, oc.BearerToken())
+
+	headers := map[string]string{
+		"Content-Type":    "application/json; charset=utf-8",
+		"Authorization":   oc.BearerToken(),
+		"Idempotency-Key": idempotencyKey,
+	}
+	response, data, err := common.RemoteCallWithHeaders("POST", url, headers, body)
 	if err != nil {
-		logger.Error("recharge err: %v", err)
+		logger.Error("%s err: %v", api, err)
 		return err
 	}
 
 	if response.StatusCode != http.StatusOK {
-		logger.Info("makeRecharge remote (%s) status code: %d. data=%s", url, response.StatusCode, string(data))
-		return fmt.Errorf("makeRecharge remote (%s) status code: %d.", url, response.StatusCode)
+		logger.Info("%s remote (%s) status code: %d. data=%s", api, url, response.StatusCode, string(data))
+		return fmt.Errorf("%s remote (%s) status code: %d.", api, url, response.StatusCode)
 	}
 
 	return nil
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/common"
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+	"github.com/julienschmidt/httprouter"
+)
+
+const maxReversalReasonLength = 255
+
+type reversalRequest struct {
+	RedemptionId int64  `json:"redemption_id,omitempty"`
+	Policy       string `json:"policy"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// ReverseRedemption refunds a redemption of a coupon and takes it off the
+// coupon, which is revoked or can be used again, as the policy says.
+// The refund is idempotent, a failed reversal can be retried.
+func ReverseRedemption(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: PUT %v.", r.URL)
+	logger.Info("Begin reverse a redemption handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	//只有管理员才可以调这个API
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	correctInput := []string{"policy"}
+	req := &reversalRequest{}
+	err := common.ParseRequestJsonIntoWithValidateParams(r, correctInput, req)
+	if err != nil {
+		logger.Error("Parse body err: %v", err)
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeParseJsonFailed, err.Error()), nil)
+		return
+	}
+	info := &models.ReversalInfo{
+		Serial:       params.ByName("serial"),
+		RedemptionId: req.RedemptionId,
+		Reason:       req.Reason,
+		Operator:     username,
+	}
+	info.Policy, err = models.ValidateReversalPolicy(req.Policy)
+	if err == nil && req.RedemptionId < 0 {
+		err = fmt.Errorf("redemption_id should be positive")
+	}
+	if err == nil && len(req.Reason) > maxReversalReasonLength {
+		err = fmt.Errorf("reason should be at most %d bytes", maxReversalReasonLength)
+	}
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeInvalidParameters, err.Error()), nil)
+		return
+	}
+
+	_, entry, err := store.PrepareReversal(info)
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, getCouponError(ErrorCodeReverseRedemption, err), nil)
+		return
+	}
+	// the coupons which are not rechargeable have nothing to refund.
+	if entry != nil {
+		err := refundFunc(entry.Region, entry.RechargeKey(), entry.Username, entry.Namespace, entry.Amount)
+		if err != nil {
+			logger.Error("refund of coupon (%s) err: %v", entry.Serial, err)
+			JsonResult(w, http.StatusBadGateway, GetError2(ErrorCodeRefundRecharge, err.Error()), nil)
+			return
+		}
+	}
+
+	reversal, err := store.ReverseRedemption(info, entry != nil)
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, getCouponError(ErrorCodeReverseRedemption, err), nil)
+		return
+	}
+
+	logger.Info("End reverse a redemption handler.")
+	JsonResult(w, http.StatusOK, nil, reversal)
+}
+
+func CouponReversals(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logger.Info("Request url: GET %v.", r.URL)
+	logger.Info("Begin coupon reversals handler.")
+
+	r.ParseForm()
+	region := r.Form.Get("region")
+	username, e := validateAuth(r.Header.Get("Authorization"), region)
+	if e != nil {
+		JsonResult(w, http.StatusUnauthorized, e, nil)
+		return
+	}
+	logger.Debug("username:%v", username)
+
+	if !checkAdminUsers(username) {
+		JsonResult(w, http.StatusUnauthorized, GetError(ErrorCodePermissionDenied), nil)
+		return
+	}
+
+	store := getCouponStore()
+	if store == nil {
+		logger.Warn("Get coupon store is nil.")
+		JsonResult(w, http.StatusInternalServerError, GetError(ErrorCodeDbNotInitlized), nil)
+		return
+	}
+
+	reversals, err := store.CouponReversals(params.ByName("serial"))
+	if err != nil {
+		JsonResult(w, http.StatusBadRequest, GetError2(ErrorCodeGetCoupon, err.Error()), nil)
+		return
+	}
+
+	logger.Info("End coupon reversals handler.")
+	JsonResult(w, http.StatusOK, nil, reversals)
+}
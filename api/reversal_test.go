@@ -0,0 +1,154 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/asiainfoLDP/datafoundry_coupon/models"
+)
+
+// stubRefund records the refunds, the first failures of them fail.
+func stubRefund(failures int) *[]rechargeCall {
+	var mu sync.Mutex
+	calls := &[]rechargeCall{}
+	refundFunc = func(region, serial, username, namespace string, amount models.Amount) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*calls = append(*calls, rechargeCall{region, serial, username, namespace, amount})
+		if len(*calls) <= failures {
+			return errors.New("recharge service is down")
+		}
+		return nil
+	}
+	return calls
+}
+
+func reverseRedemption(t *testing.T, serial, body string) (*models.Reversal, uint) {
+	w := doRequest(ReverseRedemption, "PUT", "/charge/v1/coupons/revoke/:serial",
+		"/charge/v1/coupons/revoke/"+serial+"?region=cn-north-1", body)
+	reversal := &models.Reversal{}
+	return reversal, parseResultData(t, w, reversal)
+}
+
+func TestRevokeCouponOffline(t *testing.T) {
+	setupMemoryStore(t)
+	refunds := stubRefund(1)
+	defer func() {
+		rechargeFunc = couponRecharge
+		refundFunc = couponRefund
+	}()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	if _, code := reverseRedemption(t, created.Serial, `{"policy": "revoke"}`); code != ErrorCodeRedemptionNotExist {
+		t.Fatalf("revoke an unused coupon: %d", code)
+	}
+	useTestCoupon(t, created)
+
+	for _, body := range []string{`{"policy": "delete"}`, `{"policy": "revoke", "redemption_id": -1}`} {
+		if _, code := reverseRedemption(t, created.Serial, body); code != ErrorCodeInvalidParameters {
+			t.Errorf("reverse with %s: %d", body, code)
+		}
+	}
+
+	// a failed refund changes nothing, and can be retried.
+	body := `{"policy": "revoke", "reason": "abused"}`
+	if _, code := reverseRedemption(t, created.Serial, body); code != ErrorCodeRefundRecharge {
+		t.Fatalf("revoke with the refund failed: %d", code)
+	}
+	reversal, code := reverseRedemption(t, created.Serial, body)
+	if code != ErrorCodeNone || !reversal.Refunded || reversal.Policy != models.ReversalPolicy_Revoke ||
+		reversal.Username != "local" || reversal.Namespace != "ns1" || reversal.Amount != 1000 || reversal.Operator != "local" {
+		t.Fatalf("revoke a used coupon: %d %+v", code, reversal)
+	}
+	serial := strings.ToLower(created.Serial)
+	if len(*refunds) != 2 || (*refunds)[1].serial != serial+"-1" || (*refunds)[1].amount != 1000 {
+		t.Fatalf("unexpected refunds: %v", *refunds)
+	}
+
+	coupon, _ := getCouponStore().LookupCoupon(strings.ToLower(created.Code))
+	if coupon.Status != models.CouponStatus_Revoked || coupon.Redemptions != 0 {
+		t.Fatalf("unexpected revoked coupon: %+v", coupon)
+	}
+	if code := useCouponCode(t, created.Serial, created.Code); code != ErrorCodeCouponRevoked {
+		t.Fatalf("use a revoked coupon: %d", code)
+	}
+	if _, code := reverseRedemption(t, created.Serial, body); code != ErrorCodeRedemptionNotExist {
+		t.Fatalf("revoke a coupon twice: %d", code)
+	}
+
+	w := doRequest(CouponReversals, "GET", "/charge/v1/history/coupons/:serial/reversals",
+		"/charge/v1/history/coupons/"+created.Serial+"/reversals?region=cn-north-1", "")
+	var reversals []*models.Reversal
+	if code := parseResultData(t, w, &reversals); code != ErrorCodeNone || len(reversals) != 1 || reversals[0].Reason != "abused" {
+		t.Fatalf("coupon reversals: %s", w.Body.String())
+	}
+}
+
+func TestRestoreCouponOffline(t *testing.T) {
+	calls := setupMemoryStore(t)
+	refunds := stubRefund(0)
+	defer func() {
+		rechargeFunc = couponRecharge
+		refundFunc = couponRefund
+	}()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10, "max_redemptions": 2}`)
+	for _, username := range []string{"alice", "bob"} {
+		if err := redeemAs(t, created, username); err != nil {
+			t.Fatalf("use a multi use coupon as %s: %v", username, err)
+		}
+	}
+
+	// the redemption of alice is given back, the coupon can be used once more.
+	redemptions, _ := getCouponStore().CouponRedemptions(created.Serial)
+	body := fmt.Sprintf(`{"policy": "restore", "redemption_id": %d}`, redemptions[0].Id)
+	reversal, code := reverseRedemption(t, created.Serial, body)
+	if code != ErrorCodeNone || reversal.Username != "alice" || !reversal.Refunded {
+		t.Fatalf("restore a redemption: %d %+v", code, reversal)
+	}
+	if len(*refunds) != 1 || (*refunds)[0].serial != (*calls)[0].serial || (*refunds)[0].namespace != "alice" {
+		t.Fatalf("unexpected refunds: %v, recharges: %v", *refunds, *calls)
+	}
+	coupon, _ := getCouponStore().LookupCoupon(strings.ToLower(created.Code))
+	if coupon.Status != models.CouponStatus_Available || coupon.Redemptions != 1 {
+		t.Fatalf("unexpected restored coupon: %+v", coupon)
+	}
+	if err := redeemAs(t, created, "carol"); err != nil {
+		t.Fatalf("use a restored coupon: %v", err)
+	}
+}
+
+func TestReverseUndeliveredRedemptionOffline(t *testing.T) {
+	setupMemoryStore(t)
+	flakyRecharge(1)
+	refunds := stubRefund(0)
+	defer func() {
+		rechargeFunc = couponRecharge
+		refundFunc = couponRefund
+	}()
+
+	created := createTestCoupon(t, `{"kind": "recharge", "expire_on": 30, "amount": 10}`)
+	if err := redeemAs(t, created, "alice"); err != nil {
+		t.Fatalf("use a coupon: %v", err)
+	}
+	if _, code := reverseRedemption(t, created.Serial, `{"policy": "revoke"}`); code != ErrorCodeRechargePending {
+		t.Fatalf("revoke a pending recharge: %d", code)
+	}
+
+	// a discount has no recharge to refund.
+	discount := createTestCoupon(t, `{"kind": "percentage", "expire_on": 30, "amount": 50, "percent_off": 20}`)
+	hold, code := holdCouponCode(t, discount.Code, `{"namespace": "ns1"}`)
+	if code != ErrorCodeNone {
+		t.Fatalf("hold a discount: %d", code)
+	}
+	if _, code := confirmHold(t, hold.Token); code != ErrorCodeNone {
+		t.Fatalf("confirm a discount: %d", code)
+	}
+	reversal, code := reverseRedemption(t, discount.Serial, `{"policy": "restore"}`)
+	if code != ErrorCodeNone || reversal.Refunded || len(*refunds) != 0 {
+		t.Fatalf("restore a discount: %d %+v", code, reversal)
+	}
+}
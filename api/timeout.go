@@ -40,7 +40,7 @@ func TimeoutHandleWithMessage(h httprouter.Handle, dt time.Duration, msg string)
 				tw.w.Write(body)
 			}
 			tw.timedOut = true
-			logger.Warn("timeout: %s", r.URL.String())
+			logger.Warn("timeout: %s", loggedURL(r))
 		}
 	}
 }
@@ -78,3 +78,15 @@ func (tw *timeoutWriter) WriteHeader(code int) {
 	tw.wroteHeader = true
 	tw.w.WriteHeader(code)
 }
+
+// Flush lets the streaming handlers push their data out.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
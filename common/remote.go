@@ -25,6 +25,21 @@ var logger = log.GetLogger()
 func RemoteCallWithBody(method, url string, token, user string, body []byte, contentType string) (*http.Response, []byte, error) {
 	//log.DefaultLogger().Debugf("method: %s, url: %s, token: %s, contentType: %s, body: %s", method, url, token, contentType, string(body))
 
+	headers := make(map[string]string, 3)
+	if contentType != "" {
+		headers["Content-Type"] = contentType
+	}
+	if token != "" {
+		headers["Authorization"] = token
+	}
+	if user != "" {
+		headers["User"] = user
+	}
+
+	return RemoteCallWithHeaders(method, url, headers, body)
+}
+
+func RemoteCallWithHeaders(method, url string, headers map[string]string, body []byte) (*http.Response, []byte, error) {
 	var request *http.Request
 	var err error
 	if len(body) == 0 {
@@ -36,14 +51,8 @@ func RemoteCallWithBody(method, url string, token, user string, body []byte, con
 	if err != nil {
 		return nil, nil, err
 	}
-	if contentType != "" {
-		request.Header.Set("Content-Type", contentType)
-	}
-	if token != "" {
-		request.Header.Set("Authorization", token)
-	}
-	if user != "" {
-		request.Header.Set("User", user)
+	for k, v := range headers {
+		request.Header.Set(k, v)
 	}
 	client := &http.Client{
 		Timeout: time.Duration(GeneralRemoteCallTimeout) * time.Second,
@@ -8,6 +8,7 @@ import (
 	"github.com/asiainfoLDP/datafoundry_coupon/models"
 	"github.com/asiainfoLDP/datafoundry_coupon/router"
 	"net/http"
+	"os"
 )
 
 const SERVERPORT = 8574
@@ -39,8 +40,20 @@ func main() {
 	//new a router
 	router.NewRouter(initRouter)
 
+	// the codes are hashed with COUPON_CODE_KEY, also by the db upgrades.
+	if err := models.CheckCodeKey(); err != nil {
+		logger.Error("Check code key err: %v", err)
+		os.Exit(1)
+	}
+
 	// init db
 	models.InitDB()
+	api.SetCouponStore(models.NewMysqlStore(models.GetDB))
+	// the failed lookups are counted in memory unless the replicas share them.
+	if os.Getenv("COUPON_ATTEMPT_STORE") == "mysql" {
+		api.SetAttemptStore(models.NewMysqlAttemptStore(models.GetDB))
+	}
+	api.StartRechargeDispatcher()
 
 	service := newService(SERVERPORT)
 	address := fmt.Sprintf(":%d", service.httpPort)
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+//=============================================================
+// the failed attempts to look up coupon codes, counted by keys such
+// as a user or an ip, in a sliding window. A key with too many
+// failures is locked out for a while.
+//=============================================================
+
+type AttemptStore interface {
+	// LockedUntil returns when the lockout of key ends, it is zero if key
+	// is not locked out at now.
+	LockedUntil(key string, now time.Time) (time.Time, error)
+	// RecordFailure records a failure of key at now, and returns how many
+	// failures key has in the window before now, including this one.
+	RecordFailure(key string, now time.Time, window time.Duration) (int, error)
+	// Lock locks key out until until.
+	Lock(key string, until time.Time) error
+}
+
+//=============================================================
+// memory, the failures are only counted by this replica.
+//=============================================================
+
+// a sweep of the idle keys runs when there are more keys than this.
+const maxMemoryAttemptKeys = 100000
+
+type memoryAttempts struct {
+	failures    []time.Time
+	lockedUntil time.Time
+	idleAfter   time.Time
+}
+
+type memoryAttemptStore struct {
+	mu   sync.Mutex
+	keys map[string]*memoryAttempts
+}
+
+func NewMemoryAttemptStore() AttemptStore {
+	return &memoryAttemptStore{keys: map[string]*memoryAttempts{}}
+}
+
+func (s *memoryAttemptStore) LockedUntil(key string, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.keys[key]
+	if a == nil || !now.Before(a.lockedUntil) {
+		return time.Time{}, nil
+	}
+	return a.lockedUntil, nil
+}
+
+func (s *memoryAttemptStore) RecordFailure(key string, now time.Time, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.keys[key]
+	if a == nil {
+		if len(s.keys) >= maxMemoryAttemptKeys {
+			s.sweep(now)
+		}
+		a = &memoryAttempts{}
+		s.keys[key] = a
+	}
+
+	since := now.Add(-window)
+	kept := a.failures[:0]
+	for _, t := range a.failures {
+		if t.After(since) {
+			kept = append(kept, t)
+		}
+	}
+	a.failures = append(kept, now)
+	if idle := now.Add(window); idle.After(a.idleAfter) {
+		a.idleAfter = idle
+	}
+	return len(a.failures), nil
+}
+
+func (s *memoryAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.keys[key]
+	if a == nil {
+		a = &memoryAttempts{}
+		s.keys[key] = a
+	}
+	if until.After(a.lockedUntil) {
+		a.lockedUntil = until
+	}
+	if until.After(a.idleAfter) {
+		a.idleAfter = until
+	}
+	return nil
+}
+
+// sweep forgets the keys which neither have failures in their window nor
+// are locked out, s.mu must be held.
+func (s *memoryAttemptStore) sweep(now time.Time) {
+	for key, a := range s.keys {
+		if !now.Before(a.idleAfter) {
+			delete(s.keys, key)
+		}
+	}
+}
+
+//=============================================================
+// mysql, the failures are shared by all replicas.
+//=============================================================
+
+// at most this many expired rows are removed by a call.
+const attemptPruneBatch = 100
+
+type mysqlAttemptStore struct {
+	getDB func() *sql.DB
+}
+
+// NewMysqlAttemptStore returns an AttemptStore in DF_COUPON_ATTEMPT and
+// DF_COUPON_LOCKOUT of the db returned by getDB.
+func NewMysqlAttemptStore(getDB func() *sql.DB) AttemptStore {
+	return &mysqlAttemptStore{getDB: getDB}
+}
+
+func (s *mysqlAttemptStore) db() (*sql.DB, error) {
+	db := s.getDB()
+	if db == nil {
+		return nil, ErrDbNotInitlized
+	}
+	return db, nil
+}
+
+func (s *mysqlAttemptStore) LockedUntil(key string, now time.Time) (time.Time, error) {
+	db, err := s.db()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var until time.Time
+	sqlstr := `select LOCKED_UNTIL from DF_COUPON_LOCKOUT where ATTEMPT_KEY = ? and LOCKED_UNTIL > ?`
+	err = db.QueryRow(sqlstr, key, now.UTC()).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return time.Time{}, err
+	}
+	return until, nil
+}
+
+func (s *mysqlAttemptStore) RecordFailure(key string, now time.Time, window time.Duration) (int, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, err
+	}
+
+	now = now.UTC()
+	since := now.Add(-window)
+	if _, err := db.Exec(`delete from DF_COUPON_ATTEMPT where FAIL_AT <= ? limit ?`, since, attemptPruneBatch); err != nil {
+		logger.Error("Exec err : %v", err)
+		return 0, err
+	}
+	if _, err := db.Exec(`insert into DF_COUPON_ATTEMPT (ATTEMPT_KEY, FAIL_AT) values (?, ?)`, key, now); err != nil {
+		logger.Error("Exec err : %v", err)
+		return 0, err
+	}
+
+	var n int
+	sqlstr := `select count(*) from DF_COUPON_ATTEMPT where ATTEMPT_KEY = ? and FAIL_AT > ?`
+	if err := db.QueryRow(sqlstr, key, since).Scan(&n); err != nil {
+		logger.Error("Scan err : %v", err)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *mysqlAttemptStore) Lock(key string, until time.Time) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+
+	until = until.UTC()
+	if _, err := db.Exec(`delete from DF_COUPON_LOCKOUT where LOCKED_UNTIL <= ? limit ?`, time.Now().UTC(), attemptPruneBatch); err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+	sqlstr := `insert into DF_COUPON_LOCKOUT (ATTEMPT_KEY, LOCKED_UNTIL) values (?, ?)
+				on duplicate key update LOCKED_UNTIL = greatest(LOCKED_UNTIL, values(LOCKED_UNTIL))`
+	if _, err := db.Exec(sqlstr, key, until); err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryAttemptStore(t *testing.T) {
+	store := NewMemoryAttemptStore()
+	now := time.Now()
+	window := 10 * time.Minute
+
+	for i, at := range []time.Duration{0, 5 * time.Minute, 9 * time.Minute, 12 * time.Minute} {
+		n, _ := store.RecordFailure("user:alice", now.Add(at), window)
+		// the failure at 0 has slid out of the window at 12 minutes.
+		if want := []int{1, 2, 3, 3}[i]; n != want {
+			t.Errorf("failures at %v = %d, want %d", at, n, want)
+		}
+	}
+	if n, _ := store.RecordFailure("user:bob", now, window); n != 1 {
+		t.Errorf("failures of another key = %d", n)
+	}
+
+	until := now.Add(15 * time.Minute)
+	store.Lock("user:alice", until)
+	store.Lock("user:alice", now.Add(time.Minute))
+	if got, _ := store.LockedUntil("user:alice", now); !got.Equal(until) {
+		t.Errorf("LockedUntil = %v, want %v", got, until)
+	}
+	if got, _ := store.LockedUntil("user:alice", until); !got.IsZero() {
+		t.Errorf("LockedUntil after the lockout = %v", got)
+	}
+	if got, _ := store.LockedUntil("user:bob", now); !got.IsZero() {
+		t.Errorf("LockedUntil of another key = %v", got)
+	}
+}
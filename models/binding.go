@@ -0,0 +1,48 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+//=============================================================
+// a coupon can be bound to a user with BOUND_USERNAME, and to a
+// namespace or a glob pattern of namespaces, such as "team-*",
+// with BOUND_NAMESPACE. Empty is no binding.
+//=============================================================
+
+var ErrCouponNotForUser = errors.New("The coupon is bound to another user or namespace.")
+
+// ValidateBinding checks the binding of a new coupon, and returns it
+// in lower case, as the usernames and namespaces of DataFoundry.
+func ValidateBinding(username, namespace string) (string, string, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	namespace = strings.ToLower(strings.TrimSpace(namespace))
+	if len(username) > 32 {
+		return "", "", fmt.Errorf("bound_username should be at most 32 characters")
+	}
+	if len(namespace) > 64 || strings.Contains(namespace, "/") {
+		return "", "", fmt.Errorf("bound_namespace should be a namespace or a pattern of at most 64 characters")
+	}
+	if _, err := path.Match(namespace, ""); err != nil {
+		return "", "", fmt.Errorf("bound_namespace is not a valid pattern: %v", err)
+	}
+	return username, namespace, nil
+}
+
+// checkBinding checks that username can use a coupon bound to boundUsername
+// and boundNamespace, in namespace. The namespace is not checked if it is
+// empty, the coupon is just read then.
+func checkBinding(boundUsername, boundNamespace, username, namespace string) error {
+	if boundUsername != "" && !strings.EqualFold(boundUsername, username) {
+		return ErrCouponNotForUser
+	}
+	if boundNamespace != "" && namespace != "" {
+		if matched, _ := path.Match(boundNamespace, strings.ToLower(namespace)); !matched {
+			return ErrCouponNotForUser
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestCheckBinding(t *testing.T) {
+	cases := []struct {
+		boundUsername, boundNamespace string
+		username, namespace           string
+		allowed                       bool
+	}{
+		{"", "", "alice", "ns1", true},
+		{"alice", "", "alice", "ns1", true},
+		{"alice", "", "Alice", "ns1", true},
+		{"alice", "", "bob", "ns1", false},
+		{"", "ns1", "bob", "ns1", true},
+		{"", "ns1", "bob", "ns2", false},
+		{"", "team-*", "bob", "team-a", true},
+		{"", "team-*", "bob", "Team-A", true},
+		{"", "team-*", "bob", "other", false},
+		{"", "team-?", "bob", "team-ab", false},
+		{"", "ns1", "bob", "", true}, // a read
+		{"alice", "ns1", "bob", "", false},
+	}
+	for _, c := range cases {
+		err := checkBinding(c.boundUsername, c.boundNamespace, c.username, c.namespace)
+		if c.allowed && err != nil || !c.allowed && err != ErrCouponNotForUser {
+			t.Errorf("checkBinding(%+v) = %v", c, err)
+		}
+	}
+
+	if username, namespace, err := ValidateBinding(" Alice ", "Team-*"); err != nil || username != "alice" || namespace != "team-*" {
+		t.Errorf("ValidateBinding = %s, %s, %v", username, namespace, err)
+	}
+	for _, namespace := range []string{"team-[", "team/a"} {
+		if _, _, err := ValidateBinding("", namespace); err == nil {
+			t.Errorf("ValidateBinding(%s) is accepted", namespace)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//=============================================================
+// DF_COUPON_CAMPAIGN, a campaign groups the coupons created in
+// batches, its status, window and budget gate them all.
+//=============================================================
+
+const MaxCampaignCoupons = 10000
+
+// rows per multi-row insert
+const batchInsertRows = 500
+
+type CampaignStatus string
+
+const (
+	CampaignStatus_Draft  CampaignStatus = "draft"
+	CampaignStatus_Active CampaignStatus = "active"
+	CampaignStatus_Paused CampaignStatus = "paused"
+	CampaignStatus_Closed CampaignStatus = "closed"
+)
+
+var campaignTransitions = map[CampaignStatus][]CampaignStatus{
+	CampaignStatus_Draft:  {CampaignStatus_Active, CampaignStatus_Closed},
+	CampaignStatus_Active: {CampaignStatus_Paused, CampaignStatus_Closed},
+	CampaignStatus_Paused: {CampaignStatus_Active, CampaignStatus_Closed},
+	CampaignStatus_Closed: {},
+}
+
+func canTransitCampaign(from, to CampaignStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range campaignTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrCampaignNotFound        = errors.New("The campaign does not exist.")
+	ErrCampaignNotActive       = errors.New("The campaign of the coupon is not active.")
+	ErrCampaignBudgetExhausted = errors.New("The budget of the campaign is exhausted.")
+	ErrCampaignClosed          = errors.New("The campaign is closed.")
+)
+
+type Campaign struct {
+	Id       int64          `json:"id"`
+	Name     string         `json:"name"`
+	Currency Currency       `json:"currency"`
+	Budget   Amount         `json:"budget"` // 0 means no limit
+	Spent    Amount         `json:"spent"`
+	StartAt  *time.Time     `json:"start_at,omitempty"`
+	EndAt    *time.Time     `json:"end_at,omitempty"`
+	Status   CampaignStatus `json:"status"`
+	Number   int            `json:"number"` // of coupons
+	CreateBy string         `json:"create_by"`
+	CreateAt time.Time      `json:"create_at"`
+}
+
+// CampaignUpdate holds the fields to change, nil ones are kept.
+type CampaignUpdate struct {
+	Name    *string         `json:"name"`
+	Budget  *Amount         `json:"budget"`
+	StartAt *time.Time      `json:"start_at"`
+	EndAt   *time.Time      `json:"end_at"`
+	Status  *CampaignStatus `json:"status"`
+}
+
+func (c *Campaign) validate() error {
+	if c.Budget < 0 {
+		return errors.New("budget should not be negative")
+	}
+	if c.StartAt != nil && c.EndAt != nil && !c.StartAt.Before(*c.EndAt) {
+		return errors.New("start_at should be before end_at")
+	}
+	if _, ok := campaignTransitions[c.Status]; !ok {
+		return fmt.Errorf("unknown campaign status: %s", c.Status)
+	}
+	return nil
+}
+
+func (c *Campaign) apply(update *CampaignUpdate) error {
+	if update.Status != nil {
+		if !canTransitCampaign(c.Status, *update.Status) {
+			return fmt.Errorf("The campaign can't be %s when it is %s.", *update.Status, c.Status)
+		}
+		c.Status = *update.Status
+	}
+	if update.Name != nil {
+		c.Name = *update.Name
+	}
+	if update.Budget != nil {
+		c.Budget = *update.Budget
+	}
+	if update.StartAt != nil {
+		c.StartAt = utcTime(update.StartAt)
+	}
+	if update.EndAt != nil {
+		c.EndAt = utcTime(update.EndAt)
+	}
+	return c.validate()
+}
+
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := expireInstant(*t)
+	return &utc
+}
+
+// checkOpen returns an error if the coupons of c can't be retrieved,
+// provided or used at now.
+func (c *Campaign) checkOpen(now time.Time) error {
+	if c.Status != CampaignStatus_Active {
+		return ErrCampaignNotActive
+	}
+	if c.StartAt != nil && now.Before(*c.StartAt) || c.EndAt != nil && !now.Before(*c.EndAt) {
+		return ErrCampaignNotActive
+	}
+	if c.Budget > 0 && c.Spent >= c.Budget {
+		return ErrCampaignBudgetExhausted
+	}
+	return nil
+}
+
+// checkSpend returns an error if a coupon of amount can't be used at now.
+func (c *Campaign) checkSpend(amount Amount, now time.Time) error {
+	if err := c.checkOpen(now); err != nil {
+		return err
+	}
+	if c.Budget > 0 && c.Spent+amount > c.Budget {
+		return ErrCampaignBudgetExhausted
+	}
+	return nil
+}
+
+// openCampaignsCond is the sql version of checkOpen, for the coupons.
+func openCampaignsCond(now time.Time) (string, []interface{}) {
+	return `(CAMPAIGN_ID is null or CAMPAIGN_ID in (select ID from DF_COUPON_CAMPAIGN where STATUS = ?
+				and (START_AT is null or START_AT <= ?) and (END_AT is null or END_AT > ?)
+				and (BUDGET_FEN = 0 or SPENT_FEN < BUDGET_FEN)))`,
+		[]interface{}{string(CampaignStatus_Active), now.UTC(), now.UTC()}
+}
+
+const campaignColumns = `ID, NAME, CURRENCY, BUDGET_FEN, SPENT_FEN, START_AT, END_AT, STATUS, NUMBER, CREATE_BY, CREATE_AT`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCampaign(row rowScanner) (*Campaign, error) {
+	c := &Campaign{}
+	err := row.Scan(&c.Id, &c.Name, &c.Currency, &c.Budget, &c.Spent, &c.StartAt, &c.EndAt,
+		&c.Status, &c.Number, &c.CreateBy, &c.CreateAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func getCampaign(tx queryer, id int64, forUpdate bool) (*Campaign, error) {
+	sqlstr := `select ` + campaignColumns + ` from DF_COUPON_CAMPAIGN where ID = ?`
+	if forUpdate {
+		sqlstr += " FOR UPDATE"
+	}
+	c, err := scanCampaign(tx.QueryRow(sqlstr, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrCampaignNotFound
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return nil, err
+	}
+	return c, nil
+}
+
+func insertCampaign(tx queryer, c *Campaign) error {
+	sqlstr := `insert into DF_COUPON_CAMPAIGN (
+				NAME, CURRENCY, BUDGET_FEN, SPENT_FEN, START_AT, END_AT, STATUS, NUMBER, CREATE_BY
+				) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(sqlstr, c.Name, string(c.Currency), c.Budget, c.Spent, c.StartAt, c.EndAt,
+		string(c.Status), c.Number, c.CreateBy)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+	c.Id, err = result.LastInsertId()
+	return err
+}
+
+// prepareCampaign validates a new campaign and fills its defaults.
+func prepareCampaign(c *Campaign, operator string) error {
+	currency, err := ValidateCurrency(c.Currency)
+	if err != nil {
+		return err
+	}
+	c.Currency = currency
+	if c.Status == "" {
+		c.Status = CampaignStatus_Draft
+	}
+	c.StartAt, c.EndAt = utcTime(c.StartAt), utcTime(c.EndAt)
+	c.Spent, c.Number = 0, 0
+	c.CreateBy = operator
+	c.CreateAt = time.Now().UTC().Truncate(time.Second)
+	return c.validate()
+}
+
+func CreateCampaign(db *sql.DB, campaign *Campaign, operator string) (*Campaign, error) {
+	logger.Info("Begin create a campaign model.")
+
+	if err := prepareCampaign(campaign, operator); err != nil {
+		return nil, err
+	}
+	if err := insertCampaign(db, campaign); err != nil {
+		return nil, err
+	}
+
+	logger.Info("End create a campaign model.")
+	return campaign, nil
+}
+
+func RetrieveCampaign(db *sql.DB, id int64) (*Campaign, error) {
+	c, err := getCampaign(db, id, false)
+	if err == ErrCampaignNotFound {
+		return nil, nil
+	}
+	return c, err
+}
+
+func QueryCampaigns(db *sql.DB, status string, offset int64, limit int) (int64, []*Campaign, error) {
+	where, args := "", []interface{}{}
+	if status != "" {
+		where, args = "where STATUS = ?", append(args, status)
+	}
+
+	count := int64(0)
+	err := db.QueryRow(`select COUNT(*) from DF_COUPON_CAMPAIGN `+where, args...).Scan(&count)
+	if err != nil {
+		logger.Error("Scan err : %v", err)
+		return 0, nil, err
+	}
+	if count == 0 {
+		return 0, []*Campaign{}, nil
+	}
+	validateOffsetAndLimit(count, &offset, &limit)
+
+	sqlstr := `select ` + campaignColumns + ` from DF_COUPON_CAMPAIGN ` + where + ` order by ID desc limit ? offset ?`
+	rows, err := db.Query(sqlstr, append(args, limit, offset)...)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	campaigns := make([]*Campaign, 0, limit)
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			logger.Error("Scan err : %v", err)
+			return 0, nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return 0, nil, err
+	}
+	return count, campaigns, nil
+}
+
+func UpdateCampaign(db *sql.DB, id int64, update *CampaignUpdate) (*Campaign, error) {
+	var campaign *Campaign
+	err := inTx(db, func(tx *sql.Tx) error {
+		c, err := getCampaign(tx, id, true)
+		if err != nil {
+			return err
+		}
+		if err := c.apply(update); err != nil {
+			return err
+		}
+
+		sqlstr := `update DF_COUPON_CAMPAIGN set NAME = ?, BUDGET_FEN = ?, START_AT = ?, END_AT = ?, STATUS = ?
+					where ID = ?`
+		_, err = tx.Exec(sqlstr, c.Name, c.Budget, c.StartAt, c.EndAt, string(c.Status), id)
+		if err != nil {
+			logger.Error("Exec err : %v", err)
+			return err
+		}
+		campaign = c
+		return nil
+	})
+	return campaign, err
+}
+
+// spendCampaignBudget locks the campaign and takes amount from its
+// budget, in the transaction using the coupon.
+func spendCampaignBudget(tx queryer, id int64, amount Amount, now time.Time) error {
+	c, err := getCampaign(tx, id, true)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSpend(amount, now); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`update DF_COUPON_CAMPAIGN set SPENT_FEN = SPENT_FEN + ? where ID = ?`, amount, id)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
+
+// refundCampaignBudget gives back the amount of a compensated coupon.
+func refundCampaignBudget(tx queryer, serial string, amount Amount) error {
+	sqlstr := `update DF_COUPON_CAMPAIGN set SPENT_FEN = SPENT_FEN - ?
+				where ID = (select CAMPAIGN_ID from DF_COUPON where SERIAL = ?)`
+	_, err := tx.Exec(sqlstr, amount, serial)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
+
+//=============================================================
+// batches
+//=============================================================
+
+// CampaignCoupon is a line of the serial/code list of a campaign. Code is
+// only known when the coupon is created, later only CodePrefix is.
+type CampaignCoupon struct {
+	Serial     string
+	Code       string
+	CodePrefix string
+}
+
+// newCampaignCoupons returns the coupons to insert, they take kind,
+// terms and expiry from template.
+func newCampaignCoupons(campaignId int64, template *Coupon, codes []*CampaignCoupon) []*Coupon {
+	coupons := make([]*Coupon, len(codes))
+	for i, c := range codes {
+		coupons[i] = &Coupon{
+			Serial:     strings.ToLower(c.Serial),
+			Code:       strings.ToLower(c.Code),
+			Kind:       template.Kind,
+			ExpireOn:   expireInstant(template.ExpireOn),
+			Amount:     template.Amount,
+			Currency:   template.Currency,
+			PercentOff: template.PercentOff,
+			MinSpend:   template.MinSpend,
+			PlanId:     template.PlanId,
+
+			MaxRedemptions: maxRedemptionsOrOne(template.MaxRedemptions),
+			PerUserLimit:   template.PerUserLimit,
+			BoundUsername:  template.BoundUsername,
+			BoundNamespace: template.BoundNamespace,
+			CampaignId:     campaignId,
+		}
+	}
+	return coupons
+}
+
+// validateBatch checks that the coupons of template can join campaign.
+func validateBatch(campaign *Campaign, template *Coupon, codes []*CampaignCoupon) error {
+	if len(codes) == 0 || len(codes) > MaxCampaignCoupons {
+		return fmt.Errorf("the number of coupons should be in [1, %d]", MaxCampaignCoupons)
+	}
+	if campaign.Status == CampaignStatus_Closed {
+		return ErrCampaignClosed
+	}
+	if template.Currency == "" {
+		template.Currency = DefaultCurrency
+	}
+	if template.Currency != campaign.Currency {
+		return fmt.Errorf("the currency of the coupons (%s) is not the one of the campaign (%s)",
+			template.Currency, campaign.Currency)
+	}
+	return nil
+}
+
+// CreateCouponBatch creates the coupons of template with codes in the
+// campaign in one transaction. If campaign.Id is 0, the campaign is
+// created too.
+func CreateCouponBatch(db *sql.DB, campaign *Campaign, template *Coupon, codes []*CampaignCoupon, operator string) (*Campaign, error) {
+	logger.Info("Begin create a coupon batch model.")
+
+	if campaign.Id == 0 {
+		if err := prepareCampaign(campaign, operator); err != nil {
+			return nil, err
+		}
+	}
+
+	err := inTx(db, func(tx *sql.Tx) error {
+		if campaign.Id == 0 {
+			if err := insertCampaign(tx, campaign); err != nil {
+				return err
+			}
+		} else {
+			c, err := getCampaign(tx, campaign.Id, true)
+			if err != nil {
+				return err
+			}
+			campaign = c
+		}
+		if err := validateBatch(campaign, template, codes); err != nil {
+			return err
+		}
+
+		coupons := newCampaignCoupons(campaign.Id, template, codes)
+		for start := 0; start < len(coupons); start += batchInsertRows {
+			end := start + batchInsertRows
+			if end > len(coupons) {
+				end = len(coupons)
+			}
+			if err := insertBatchCoupons(tx, coupons[start:end], operator); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`update DF_COUPON_CAMPAIGN set NUMBER = NUMBER + ? where ID = ?`, len(coupons), campaign.Id)
+		if err != nil {
+			logger.Error("Exec err : %v", err)
+			return err
+		}
+		campaign.Number += len(coupons)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("End create a coupon batch model.")
+	return campaign, nil
+}
+
+func insertBatchCoupons(tx *sql.Tx, coupons []*Coupon, operator string) error {
+	rows := make([]string, len(coupons))
+	args := make([]interface{}, 0, len(coupons)*17)
+	for i, c := range coupons {
+		rows[i] = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, c.Serial, hashCode(c.Code), codePrefix(c.Code), c.Kind, c.ExpireOn,
+			c.Amount.String(), c.Amount, string(c.Currency), c.PercentOff, c.MinSpend, c.PlanId,
+			c.MaxRedemptions, c.PerUserLimit, c.BoundUsername, c.BoundNamespace,
+			string(CouponStatus_Available), c.CampaignId)
+	}
+	sqlstr := `insert into DF_COUPON (
+				SERIAL, CODE_HASH, CODE_PREFIX, KIND, EXPIRE_ON, AMOUNT, AMOUNT_FEN, CURRENCY,
+				PERCENT_OFF, MIN_SPEND_FEN, PLAN_ID, MAX_REDEMPTIONS, PER_USER_LIMIT,
+				BOUND_USERNAME, BOUND_NAMESPACE, STATUS, CAMPAIGN_ID
+				) values ` + strings.Join(rows, ", ")
+	if _, err := tx.Exec(sqlstr, args...); isDuplicateKey(err) {
+		logger.Warn("Exec err : %v", err)
+		return ErrCouponCodeConflict
+	} else if err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+
+	args = args[:0]
+	for i, c := range coupons {
+		rows[i] = "(?, ?, ?, ?)"
+		args = append(args, c.Serial, "", string(CouponStatus_Available), operator)
+	}
+	sqlstr = `insert into DF_COUPON_STATUS_LOG (SERIAL, FROM_STATUS, TO_STATUS, OPERATOR) values ` +
+		strings.Join(rows, ", ")
+	if _, err := tx.Exec(sqlstr, args...); err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+	return nil
+}
+
+// ScanCampaignCoupons calls f with the serial and code prefix of each coupon
+// of the campaign, in creation order, without loading them all in memory.
+func ScanCampaignCoupons(db *sql.DB, campaignId int64, f func(c *CampaignCoupon) error) error {
+	query := &selectQuery{
+		columns:   []string{"SERIAL", "CODE_PREFIX"},
+		where:     newSqlWhere().eq("CAMPAIGN_ID", campaignId),
+		orderBy:   orderByClause("ID", true),
+		unlimited: true,
+	}
+	sqlstr, args := query.build()
+	rows, err := db.Query(sqlstr, args...)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := &CampaignCoupon{}
+		if err := rows.Scan(&c.Serial, &c.CodePrefix); err != nil {
+			logger.Error("Scan err : %v", err)
+			return err
+		}
+		if err := f(c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+//=============================================================
+// a code is the secret to redeem a coupon, only its HMAC-SHA256
+// digest and a short prefix for support are saved in DF_COUPON.
+//=============================================================
+
+// shown to support staff, it doesn't help to guess the rest.
+const codePrefixLength = 4
+
+// codeKey is COUPON_CODE_KEY. Changing it invalidates all the codes.
+var codeKey = []byte(os.Getenv("COUPON_CODE_KEY"))
+
+var ErrNoCodeKey = errors.New("COUPON_CODE_KEY is not set")
+
+// CheckCodeKey is called before the service starts. Without COUPON_CODE_KEY
+// the digests could be made by anyone who reads them, so it fails, unless
+// COUPON_ALLOW_EMPTY_CODE_KEY is yes, which is for local runs only.
+func CheckCodeKey() error {
+	if len(codeKey) > 0 {
+		return nil
+	}
+	if os.Getenv("COUPON_ALLOW_EMPTY_CODE_KEY") != "yes" {
+		return ErrNoCodeKey
+	}
+	logger.Warn("COUPON_CODE_KEY is not set, coupon codes are hashed without a key.")
+	return nil
+}
+
+// hashCode is saved in CODE_HASH, codes are case insensitive.
+func hashCode(code string) string {
+	mac := hmac.New(sha256.New, codeKey)
+	mac.Write([]byte(strings.ToLower(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// codePrefix is saved in CODE_PREFIX.
+func codePrefix(code string) string {
+	code = strings.ToLower(code)
+	if len(code) > codePrefixLength {
+		code = code[:codePrefixLength]
+	}
+	return code
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHashCode(t *testing.T) {
+	defer func(key []byte) { codeKey = key }(codeKey)
+
+	code := "abcd2345efgh6789jkmn"
+	digest := hashCode(code)
+	if len(digest) != 64 || strings.Contains(digest, code) {
+		t.Fatalf("unexpected digest: %s", digest)
+	}
+	if hashCode(strings.ToUpper(code)) != digest {
+		t.Errorf("digest depends on the case")
+	}
+	if hashCode(code[:19]+"p") == digest {
+		t.Errorf("different codes have the same digest")
+	}
+
+	codeKey = []byte("another key")
+	if hashCode(code) == digest {
+		t.Errorf("digest doesn't depend on the key")
+	}
+
+	if p := codePrefix("ABCD2345"); p != "abcd" {
+		t.Errorf("codePrefix = %s, want abcd", p)
+	}
+}
+
+func TestCheckCodeKey(t *testing.T) {
+	defer func(key []byte) { codeKey = key }(codeKey)
+	defer os.Setenv("COUPON_ALLOW_EMPTY_CODE_KEY", os.Getenv("COUPON_ALLOW_EMPTY_CODE_KEY"))
+
+	codeKey = nil
+	os.Setenv("COUPON_ALLOW_EMPTY_CODE_KEY", "")
+	if err := CheckCodeKey(); err != ErrNoCodeKey {
+		t.Errorf("CheckCodeKey without a key = %v", err)
+	}
+	os.Setenv("COUPON_ALLOW_EMPTY_CODE_KEY", "yes")
+	if err := CheckCodeKey(); err != nil {
+		t.Errorf("CheckCodeKey allowed without a key = %v", err)
+	}
+
+	codeKey = []byte("a key")
+	os.Setenv("COUPON_ALLOW_EMPTY_CODE_KEY", "")
+	if err := CheckCodeKey(); err != nil {
+		t.Errorf("CheckCodeKey with a key = %v", err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 type Coupon struct {
@@ -15,49 +17,111 @@ type Coupon struct {
 	Code     string    `json:"code"`
 	Kind     string    `json:"kind,omitempty"`
 	ExpireOn time.Time `json:"expire_on,omitempty"`
-	Amount   float32   `json:"amount,omitempty"`
+	Amount   Amount    `json:"amount,omitempty"`
+	Currency Currency  `json:"currency,omitempty"`
+
+	// the terms of the discount kinds
+	PercentOff int    `json:"percent_off,omitempty"`
+	MinSpend   Amount `json:"min_spend,omitempty"`
+	PlanId     string `json:"plan_id,omitempty"`
+
+	// 0 is 1, a single use coupon, PerUserLimit 0 is no limit.
+	MaxRedemptions int `json:"max_redemptions,omitempty"`
+	PerUserLimit   int `json:"per_user_limit,omitempty"`
+
+	// the user and the namespace (pattern) the coupon is bound to, see checkBinding.
+	BoundUsername  string `json:"bound_username,omitempty"`
+	BoundNamespace string `json:"bound_namespace,omitempty"`
+
+	CampaignId int64 `json:"campaign_id,omitempty"`
 }
 
-type createResult struct {
-	Serial   string  `json:"serial"`
-	Code     string  `json:"code"`
-	ExpireOn string  `json:"expire_on"`
-	Amount   float32 `json:"amount"`
+func (c *Coupon) Terms() *CouponTerms {
+	return &CouponTerms{Kind: c.Kind, Amount: c.Amount, Currency: c.Currency,
+		PercentOff: c.PercentOff, MinSpend: c.MinSpend, PlanId: c.PlanId}
+}
+
+type CreateResult struct {
+	Serial   string   `json:"serial"`
+	Code     string   `json:"code"`
+	Kind     string   `json:"kind,omitempty"`
+	ExpireOn string   `json:"expire_on"`
+	Amount   Amount   `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+// ErrCouponCodeConflict is returned when the serial or code of a new
+// coupon is taken, the caller should retry with new ones.
+var ErrCouponCodeConflict = errors.New("The serial or code of the coupon is taken.")
+
+// mysqlErDupEntry is ER_DUP_ENTRY, a unique key violation.
+const mysqlErDupEntry = 1062
+
+func isDuplicateKey(err error) bool {
+	e, ok := err.(*mysql.MySQLError)
+	return ok && e.Number == mysqlErDupEntry
 }
 
-func CreateCoupon(db *sql.DB, couponInfo *Coupon) (*createResult, error) {
+func CreateCoupon(db *sql.DB, couponInfo *Coupon, operator string) (*CreateResult, error) {
 	logger.Info("Begin create a Coupon model.")
 
-	sqlstr := fmt.Sprintf(`insert into DF_COUPON (
-				SERIAL, CODE, KIND, EXPIRE_ON, AMOUNT, STATUS
-				) values (?, ?, ?, ?, ?, ?)`,
-	)
+	// AMOUNT is kept for the readers of the old schema.
+	sqlstr := `insert into DF_COUPON (
+				SERIAL, CODE_HASH, CODE_PREFIX, KIND, EXPIRE_ON, AMOUNT, AMOUNT_FEN, CURRENCY,
+				PERCENT_OFF, MIN_SPEND_FEN, PLAN_ID, MAX_REDEMPTIONS, PER_USER_LIMIT,
+				BOUND_USERNAME, BOUND_NAMESPACE, STATUS
+				) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	couponInfo.Serial = strings.ToLower(couponInfo.Serial)
 	couponInfo.Code = strings.ToLower(couponInfo.Code)
-	_, err := db.Exec(sqlstr,
-		couponInfo.Serial, couponInfo.Code, couponInfo.Kind, couponInfo.ExpireOn.Format("2006-01-02"),
-		couponInfo.Amount, "available",
-	)
+	couponInfo.ExpireOn = expireInstant(couponInfo.ExpireOn)
+	if couponInfo.Currency == "" {
+		couponInfo.Currency = DefaultCurrency
+	}
+	couponInfo.MaxRedemptions = maxRedemptionsOrOne(couponInfo.MaxRedemptions)
+	err := inTx(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(sqlstr,
+			couponInfo.Serial, hashCode(couponInfo.Code), codePrefix(couponInfo.Code), couponInfo.Kind, couponInfo.ExpireOn,
+			couponInfo.Amount.String(), couponInfo.Amount, string(couponInfo.Currency),
+			couponInfo.PercentOff, couponInfo.MinSpend, couponInfo.PlanId,
+			couponInfo.MaxRedemptions, couponInfo.PerUserLimit,
+			couponInfo.BoundUsername, couponInfo.BoundNamespace,
+			string(CouponStatus_Available),
+		)
+		if isDuplicateKey(err) {
+			logger.Warn("Exec err : %v", err)
+			return ErrCouponCodeConflict
+		} else if err != nil {
+			logger.Error("Exec err : %v", err)
+			return err
+		}
+		return logTransition(tx, couponInfo.Serial, "", CouponStatus_Available, operator)
+	})
 	if err != nil {
-		logger.Error("Exec err : %v", err)
 		return nil, err
 	}
 
-	result := &createResult{Serial: strings.ToUpper(couponInfo.Serial),
+	result := &CreateResult{Serial: strings.ToUpper(couponInfo.Serial),
 		Code:     strings.ToUpper(couponInfo.Code),
-		ExpireOn: couponInfo.ExpireOn.Format("2006-01-02"),
+		Kind:     couponInfo.Kind,
+		ExpireOn: couponInfo.ExpireOn.Format(time.RFC3339),
 		Amount:   couponInfo.Amount,
+		Currency: couponInfo.Currency,
 	}
 
 	logger.Info("End create a plan model.")
 	return result, err
 }
 
-func DeleteCoupon(db *sql.DB, couponId string) error {
+// DeleteCoupon doesn't remove the coupon, but makes it unavailable.
+func DeleteCoupon(db *sql.DB, couponId, operator string) error {
 	logger.Info("Begin delete a plan model.")
 
-	err := modifyCouponStatusToN(db, couponId)
+	err := inTx(db, func(tx *sql.Tx) error {
+		where := newSqlWhere().eq("SERIAL", strings.ToLower(couponId))
+		_, err := transitCoupon(tx, where, CouponStatus_Unavailable, operator, nil)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -66,24 +130,79 @@ func DeleteCoupon(db *sql.DB, couponId string) error {
 	return err
 }
 
-type retrieveResult struct {
-	Serial   string    `json:"serial"`
-	ExpireOn time.Time `json:"expire_on"`
-	Amount   float32   `json:"amount"`
-	Status   string    `json:"status"`
+type RetrieveResult struct {
+	Serial     string       `json:"serial"`
+	CodePrefix string       `json:"code_prefix"`
+	Kind       string       `json:"kind,omitempty"`
+	ExpireOn   time.Time    `json:"expire_on"`
+	Amount     Amount       `json:"amount"`
+	Currency   Currency     `json:"currency"`
+	Status     CouponStatus `json:"status"`
+
+	PercentOff int    `json:"percent_off,omitempty"`
+	MinSpend   Amount `json:"min_spend,omitempty"`
+	PlanId     string `json:"plan_id,omitempty"`
+
+	MaxRedemptions int `json:"max_redemptions,omitempty"`
+	PerUserLimit   int `json:"per_user_limit,omitempty"`
+	Redemptions    int `json:"redemptions"`
+
+	BoundUsername  string `json:"bound_username,omitempty"`
+	BoundNamespace string `json:"bound_namespace,omitempty"`
+
+	// the redemptions held by checkouts, see CouponHold.
+	Holds int `json:"holds,omitempty"`
+
+	CampaignId int64 `json:"campaign_id,omitempty"`
+}
+
+func (r *RetrieveResult) Terms() *CouponTerms {
+	return &CouponTerms{Kind: r.Kind, Amount: r.Amount, Currency: r.Currency,
+		PercentOff: r.PercentOff, MinSpend: r.MinSpend, PlanId: r.PlanId}
 }
 
-func RetrieveCouponByID(db *sql.DB, couponId string) (*retrieveResult, error) {
+// RetrieveCouponByID reads the coupon of a code for operator, without
+// changing it.
+func RetrieveCouponByID(db *sql.DB, couponId, operator string) (*RetrieveResult, error) {
 	logger.Info("Begin get a coupon by id model.")
 
-	couponId = strings.ToLower(couponId)
+	coupon, err := lookupSingleCoupon(db, newSqlWhere().eq("CODE_HASH", hashCode(couponId)))
+	if coupon == nil || err != nil {
+		return nil, err
+	}
+	if err := checkBinding(coupon.BoundUsername, coupon.BoundNamespace, operator, ""); err != nil {
+		return nil, err
+	}
 
 	logger.Info("End get a coupon by id model.")
-	return getSingleCoupon(db, fmt.Sprintf("CODE = '%s'", couponId))
+	return coupon, nil
+}
+
+// ClaimCoupon is RetrieveCouponByID which marks an available coupon queried,
+// so it is not provided to others any more.
+func ClaimCoupon(db *sql.DB, couponId, operator string) (*RetrieveResult, error) {
+	coupon, err := RetrieveCouponByID(db, couponId, operator)
+	if coupon == nil || err != nil {
+		return nil, err
+	}
+
+	err = updateCouponStatusToQ(db, coupon, operator)
+	if err != nil {
+		return nil, err
+	}
+
+	return coupon, nil
+}
+
+// LookupCoupon reads the coupon of a code, without changing it.
+func LookupCoupon(db *sql.DB, code string) (*RetrieveResult, error) {
+	return lookupSingleCoupon(db, newSqlWhere().eq("CODE_HASH", hashCode(code)))
 }
 
-func getSingleCoupon(db *sql.DB, sqlWhere string) (*retrieveResult, error) {
-	coupons, err := queryCoupons(db, sqlWhere, "", 1, 0)
+// lookupSingleCoupon returns nil if there is no such coupon, or an error
+// if its campaign is not open.
+func lookupSingleCoupon(db *sql.DB, where *sqlWhere) (*RetrieveResult, error) {
+	coupons, err := queryCoupons(db, where, "", 1, 0)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -97,54 +216,83 @@ func getSingleCoupon(db *sql.DB, sqlWhere string) (*retrieveResult, error) {
 		return nil, nil
 	}
 
-	err = updateCouponStatusToQ(db, coupons[0])
-	if err != nil {
-		return nil, err
+	if id := coupons[0].CampaignId; id != 0 {
+		campaign, err := getCampaign(db, id, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := campaign.checkOpen(time.Now()); err != nil {
+			return nil, err
+		}
 	}
 
 	return coupons[0], nil
 }
 
-func updateCouponStatusToQ(db *sql.DB, result *retrieveResult) error {
-	sqlstr := fmt.Sprintf(`update DF_COUPON set status = "queried" where SERIAL = '%s' and STATUS = 'available'`, result.Serial)
+func updateCouponStatusToQ(db *sql.DB, result *RetrieveResult, operator string) error {
+	if result.Status != CouponStatus_Available {
+		return nil
+	}
 
-	_, err := db.Exec(sqlstr)
-	if err != nil {
-		logger.Error("Exec err : %v", err)
+	err := inTx(db, func(tx *sql.Tx) error {
+		return transitLockedCoupon(tx, result.Serial, CouponStatus_Available, CouponStatus_Queried, operator, nil)
+	})
+	if err == ErrCouponStatusConflict {
+		return nil // changed by others just now, the read result is still fine.
+	} else if err != nil {
 		return err
 	}
+	result.Status = CouponStatus_Queried
+	return nil
+}
 
-	return err
+// providePool selects the coupons which can be provided. A provided coupon
+// gets a new code, so the pool has only the single use coupons which are
+// never used or held, bound to no one and in no campaign, whose old codes
+// have not been handed out.
+func providePool() *sqlWhere {
+	return newSqlWhere().eq("STATUS", string(CouponStatus_Available)).
+		eq("MAX_REDEMPTIONS", 1).eq("REDEMPTIONS", 0).eq("HOLDS", 0).
+		eq("BOUND_USERNAME", "").eq("BOUND_NAMESPACE", "").
+		and("CAMPAIGN_ID is null")
 }
 
-func ProvideCoupon(db *sql.DB, numberStr, amountStr string) (int64, []string, error) {
-	number, err := ValidateNumber(numberStr, 1)
+// inProvidePool is the memory version of providePool.
+func (c *memoryCoupon) inProvidePool() bool {
+	return c.Status == CouponStatus_Available &&
+		c.MaxRedemptions == 1 && c.Redemptions == 0 && c.Holds == 0 &&
+		c.BoundUsername == "" && c.BoundNamespace == "" &&
+		c.CampaignId == 0
+}
+
+// ProvideCoupon gives out at most number coupons of the provide pool. Only
+// the digests of their codes are saved, so they get new codes from newCode,
+// which are returned once here.
+func ProvideCoupon(db *sql.DB, numberStr, amountStr, operator string, newCode func() string) (int64, []string, error) {
+	number, err := validateProvideNumber(numberStr)
 	if err != nil {
 		logger.Error("Catch err: %v.", err)
 		return 0, nil, err
 	}
 
-	var sqlWhere string
-
-	if amountStr == "" {
-		sqlWhere = "STATUS='available'"
-	} else {
+	where := providePool()
+	if amountStr != "" {
 		amount, err := ValidateAmount(amountStr)
 		if err != nil {
 			logger.Error("Catch err: %v.", err)
 			return 0, nil, err
 		}
-		sqlWhere = fmt.Sprintf("STATUS='available' AND AMOUNT=%d", amount)
+		where.eq("AMOUNT_FEN", amount)
 	}
 
-	codes, err := provideCodes(db, sqlWhere, number)
+	serials, err := provideSerials(db, where, number)
 	//coupons, err := queryCoupons(db, sqlWhere, "", number, 0)
 	if err != nil {
 		logger.Error("Catch err: %v.", err)
 		return 0, nil, err
 	}
 
-	err = updateCouponsStatusToP(db, codes)
+	codes, err := updateCouponsStatusToP(db, serials, operator, newCode)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -152,27 +300,42 @@ func ProvideCoupon(db *sql.DB, numberStr, amountStr string) (int64, []string, er
 	return int64(len(codes)), codes, nil
 }
 
-func provideCodes(db *sql.DB, sqlWhere string, number int) ([]string, error) {
-	sql := fmt.Sprintf("select CODE from DF_COUPON "+
-		"WHERE %s limit %d offset %d",
-		sqlWhere, number, 0)
-	rows, err := db.Query(sql)
+func provideSerials(db *sql.DB, where *sqlWhere, number int) ([]string, error) {
+	query := &selectQuery{columns: []string{"SERIAL"}, where: where, limit: number}
+	sqlstr, args := query.build()
+	rows, err := db.Query(sqlstr, args...)
 	if err != nil {
-		logger.Error("Query err:", err)
+		logger.Error("Query err: %v", err)
 		return nil, err
 	}
 	defer rows.Close()
 
-	logger.Info(">>>>>>>%s", sql)
+	logger.Debug(">>> %s", sqlstr)
 
-	var codes []string
+	var serials []string
 	for rows.Next() {
-		var code string
-		rows.Scan(&code)
-		codes = append(codes, code)
+		var serial string
+		rows.Scan(&serial)
+		serials = append(serials, serial)
 	}
 
-	return codes, nil
+	return serials, nil
+}
+
+// maxProvideNumber is the most coupons a provide call gives out.
+const maxProvideNumber = 100
+
+// validateProvideNumber returns the number of coupons to provide, 1 by
+// default, from 1 to maxProvideNumber.
+func validateProvideNumber(numberStr string) (int, error) {
+	number, err := ValidateNumber(numberStr, 1)
+	if err != nil {
+		return 0, err
+	}
+	if number < 1 || number > maxProvideNumber {
+		return 0, fmt.Errorf("number should be from 1 to %d", maxProvideNumber)
+	}
+	return number, nil
 }
 
 func ValidateNumber(numberStr string, defaultNumber int) (int, error) {
@@ -190,73 +353,83 @@ func ValidateNumber(numberStr string, defaultNumber int) (int, error) {
 	return number, nil
 }
 
-func ValidateAmount(amountStr string) (int, error) {
-	amount, err := strconv.Atoi(amountStr)
+func ValidateAmount(amountStr string) (Amount, error) {
+	amount, err := ParseAmount(amountStr)
 	if err != nil {
-		logger.Error("strconv.Atoi err: %v.", err)
+		logger.Error("ParseAmount err: %v.", err)
 		return 0, err
 	}
 
 	return amount, err
 }
 
-func updateCouponsStatusToP(db *sql.DB, codes []string) error {
-	var sql string
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	for _, code := range codes {
-		sql = fmt.Sprintf(`update DF_COUPON set status = "provided" where CODE = '%s' and STATUS = 'available'`, code)
-
-		_, err = tx.Exec(sql)
-		if err != nil {
-			logger.Error("Exec err: %v", err)
-			err = tx.Rollback()
-			if err != nil {
-				logger.Error("db rollback err: %v", err)
-				return err
+// updateCouponsStatusToP returns the new codes of the coupons which are
+// provided by this call, the ones taken by others concurrently, or out of
+// the pool by now, are skipped.
+func updateCouponsStatusToP(db *sql.DB, serials []string, operator string, newCode func() string) ([]string, error) {
+	provided := make([]string, 0, len(serials))
+	err := inTx(db, func(tx *sql.Tx) error {
+		for _, serial := range serials {
+			code := newCode()
+			sets := newUpdateQuery().set("CODE_HASH", hashCode(code)).set("CODE_PREFIX", codePrefix(code))
+			_, err := transitCoupon(tx, providePool().eq("SERIAL", serial), CouponStatus_Provided, operator, sets)
+			if isDuplicateKey(err) {
+				return ErrCouponCodeConflict
+			}
+			switch err.(type) {
+			case nil:
+				provided = append(provided, code)
+			case *TransitionError:
+				logger.Warn("coupon is not provided: %v", err)
+			default:
+				if err != ErrCouponStatusConflict && err != ErrCouponNotFound {
+					return err
+				}
 			}
-			return err
 		}
-	}
-	err = tx.Commit()
+		return nil
+	})
 	if err != nil {
-		logger.Error("db commit err: %v", err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	return provided, nil
 }
 
-func queryCoupons(db *sql.DB, sqlWhere, orderBy string, limit int, offset int64, sqlParams ...interface{}) ([]*retrieveResult, error) {
-	offset_str := ""
-	if offset > 0 {
-		offset_str = fmt.Sprintf("offset %d", offset)
+var retrieveColumns = []string{"SERIAL", "CODE_PREFIX", "KIND", "EXPIRE_ON", "AMOUNT_FEN", "CURRENCY", "STATUS",
+	"PERCENT_OFF", "MIN_SPEND_FEN", "PLAN_ID", "MAX_REDEMPTIONS", "PER_USER_LIMIT", "REDEMPTIONS",
+	"BOUND_USERNAME", "BOUND_NAMESPACE", "HOLDS", "CAMPAIGN_ID"}
+
+// scanCoupon scans retrieveColumns into coupon, and the columns after them
+// into extra.
+func scanCoupon(rows *sql.Rows, coupon *RetrieveResult, extra ...interface{}) error {
+	var campaignId sql.NullInt64
+	dest := []interface{}{
+		&coupon.Serial, &coupon.CodePrefix, &coupon.Kind, &coupon.ExpireOn, &coupon.Amount, &coupon.Currency, &coupon.Status,
+		&coupon.PercentOff, &coupon.MinSpend, &coupon.PlanId,
+		&coupon.MaxRedemptions, &coupon.PerUserLimit, &coupon.Redemptions,
+		&coupon.BoundUsername, &coupon.BoundNamespace, &coupon.Holds, &campaignId,
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		logger.Error("Scan err : %v", err)
+		return err
 	}
+	coupon.CampaignId = campaignId.Int64
+	return nil
+}
 
-	logger.Debug("sqlWhere=%v", sqlWhere)
-	sqlWhereAll := ""
-	if sqlWhere != "" {
-		sqlWhereAll = fmt.Sprintf("WHERE %s", sqlWhere)
-	} else {
-		sqlWhereAll = fmt.Sprintf(" %s", sqlWhere)
-	}
-
-	sql_str := fmt.Sprintf(`select
-					SERIAL, EXPIRE_ON, AMOUNT, STATUS
-					from DF_COUPON
-					%s %s
-					limit %d
-					%s
-					`,
-		sqlWhereAll,
-		orderBy,
-		limit,
-		offset_str)
+func queryCoupons(db *sql.DB, where *sqlWhere, orderBy string, limit int, offset int64) ([]*RetrieveResult, error) {
+	query := &selectQuery{
+		columns: retrieveColumns,
+		where:   where,
+		orderBy: orderBy,
+		limit:   limit,
+		offset:  offset,
+	}
+	sql_str, sqlParams := query.build()
 	rows, err := db.Query(sql_str, sqlParams...)
 
-	logger.Info(">>> %v", sql_str)
+	logger.Debug(">>> %v", sql_str)
 
 	if err != nil {
 		logger.Error("Query err : %v", err)
@@ -264,14 +437,10 @@ func queryCoupons(db *sql.DB, sqlWhere, orderBy string, limit int, offset int64,
 	}
 	defer rows.Close()
 
-	coupons := make([]*retrieveResult, 0, 100)
+	coupons := make([]*RetrieveResult, 0, 100)
 	for rows.Next() {
-		coupon := &retrieveResult{}
-		err := rows.Scan(
-			&coupon.Serial, &coupon.ExpireOn, &coupon.Amount, &coupon.Status,
-		)
-		if err != nil {
-			logger.Error("Scan err : %v", err)
+		coupon := &RetrieveResult{}
+		if err := scanCoupon(rows, coupon); err != nil {
 			return nil, err
 		}
 		//validateApp(s) // already done in scanAppWithRows
@@ -286,52 +455,77 @@ func queryCoupons(db *sql.DB, sqlWhere, orderBy string, limit int, offset int64,
 	return coupons, nil
 }
 
-func modifyCouponStatusToN(db *sql.DB, couponId string) error {
-	sqlstr := fmt.Sprintf(`update DF_COUPON set status = "unavailable" where SERIAL = '%s' and STATUS = 'available'`, couponId)
+// CouponRecord is the full record of a coupon, for the admins.
+type CouponRecord struct {
+	RetrieveResult
 
-	_, err := db.Exec(sqlstr)
-	if err != nil {
-		logger.Error("Exec err : %v", err)
-		return err
-	}
+	id int64 // the key of the cursors
 
-	return err
+	CreateAt  time.Time  `json:"create_at"`
+	UseTime   *time.Time `json:"use_time,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Namespace string     `json:"namespace,omitempty"`
 }
 
-func QueryCoupons(db *sql.DB, kind, orderBy string, sortOrder bool, offset int64, limit int) (int64, []*retrieveResult, error) {
-	logger.Info("Begin get coupon list model.")
-
-	sqlParams := make([]interface{}, 0, 4)
-
-	// ...
+func queryCouponRecords(db *sql.DB, where *sqlWhere, orderBy string, limit int, offset int64) ([]*CouponRecord, error) {
+	query := &selectQuery{
+		columns: append(append([]string{}, retrieveColumns...), "CREATE_AT", "USE_TIME", "USERNAME", "NAMESPACE", "ID"),
+		where:   where,
+		orderBy: orderBy,
+		limit:   limit,
+		offset:  offset,
+	}
+	sql_str, sqlParams := query.build()
+	rows, err := db.Query(sql_str, sqlParams...)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return nil, err
+	}
+	defer rows.Close()
 
-	sqlWhere := ""
-	kind = strings.ToLower(kind)
-	if kind != "" {
-		if sqlWhere == "" {
-			sqlWhere = "KIND = ?"
-		} else {
-			sqlWhere = sqlWhere + " and KIND = ?"
+	records := []*CouponRecord{}
+	for rows.Next() {
+		record := &CouponRecord{}
+		var useTime mysql.NullTime
+		var username, namespace sql.NullString
+		if err := scanCoupon(rows, &record.RetrieveResult, &record.CreateAt, &useTime, &username, &namespace, &record.id); err != nil {
+			return nil, err
+		}
+		if useTime.Valid {
+			record.UseTime = &useTime.Time
 		}
-		sqlParams = append(sqlParams, kind)
+		record.Username, record.Namespace = username.String, namespace.String
+		records = append(records, record)
 	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : ", err)
+		return nil, err
+	}
+	return records, nil
+}
 
-	// ...
-
-	switch strings.ToLower(orderBy) {
-	default:
-		orderBy = "EXPIRE_ON"
-		sortOrder = false
-	case "createtime":
-		orderBy = "CREATE_TIME"
+// RetrieveCouponBySerial returns the record of a coupon, or nil if there is
+// no such coupon. It is read as it is, even if its campaign is closed.
+func RetrieveCouponBySerial(db *sql.DB, serial string) (*CouponRecord, error) {
+	records, err := queryCouponRecords(db, newSqlWhere().eq("SERIAL", strings.ToLower(serial)), "", 1, 0)
+	if err != nil || len(records) == 0 {
+		return nil, err
 	}
+	return records[0], nil
+}
 
-	sqlSort := fmt.Sprintf("%s %s", orderBy, sortOrderText[sortOrder])
+// QueryCoupons returns the coupons selected by filter, sorted by the column
+// orderBy returned by ValidateOrderBy.
+func QueryCoupons(db *sql.DB, filter *CouponFilter, orderBy string, sortOrder bool, offset int64, limit int) (int64, []*CouponRecord, error) {
+	logger.Info("Begin get coupon list model.")
 
-	// ...
+	where := filter.where()
+	if orderBy == "" {
+		orderBy, sortOrder = defaultOrderBy, false
+	}
 
-	logger.Debug("sqlWhere=%v", sqlWhere)
-	return getCouponList(db, offset, limit, sqlWhere, sqlSort, sqlParams...)
+	logger.Debug("where=%v", where)
+	return getCouponList(db, offset, limit, where, orderByClause(orderBy, sortOrder))
 }
 
 const (
@@ -354,51 +548,29 @@ func ValidateSortOrder(sortOrder string, defaultOrder bool) bool {
 	return defaultOrder
 }
 
-func ValidateOrderBy(orderBy string) string {
-	switch orderBy {
-	case "createtime":
-		return "CREATE_TIME"
-	}
-
-	return ""
-}
-
-func getCouponList(db *sql.DB, offset int64, limit int, sqlWhere string, sqlSort string, sqlParams ...interface{}) (int64, []*retrieveResult, error) {
-	//if strings.TrimSpace(sqlWhere) == "" {
-	//	return 0, nil, errors.New("sqlWhere can't be blank")
-	//}
-
-	count, err := queryCouponsCount(db, sqlWhere, sqlParams...)
+func getCouponList(db *sql.DB, offset int64, limit int, where *sqlWhere, orderBy string) (int64, []*CouponRecord, error) {
+	count, err := queryCouponsCount(db, where)
 	logger.Debug("count: %v", count)
 	if err != nil {
 		return 0, nil, err
 	}
 	if count == 0 {
-		return 0, []*retrieveResult{}, nil
+		return 0, []*CouponRecord{}, nil
 	}
 	validateOffsetAndLimit(count, &offset, &limit)
 
-	logger.Debug("sqlWhere=%v", sqlWhere)
-	subs, err := queryCoupons(db, sqlWhere,
-		fmt.Sprintf(`order by %s`, sqlSort),
-		limit, offset, sqlParams...)
+	subs, err := queryCouponRecords(db, where, orderBy, limit, offset)
 
 	return count, subs, err
 }
 
-func queryCouponsCount(db *sql.DB, sqlWhere string, sqlParams ...interface{}) (int64, error) {
-	sqlWhere = strings.TrimSpace(sqlWhere)
-	sql_where_all := ""
-	if sqlWhere != "" {
-		sql_where_all = fmt.Sprintf("where %s", sqlWhere)
-	}
-
+func queryCouponsCount(db *sql.DB, where *sqlWhere) (int64, error) {
 	count := int64(0)
-	sql_str := fmt.Sprintf(`select COUNT(*) from DF_COUPON %s`, sql_where_all)
+	sql_str := fmt.Sprintf(`select COUNT(*) from %s %s`, tableCoupon, where)
 	logger.Debug(">>>\n"+
 		"	%s", sql_str)
-	logger.Debug("sqlParams: %v", sqlParams)
-	err := db.QueryRow(sql_str, sqlParams...).Scan(&count)
+	logger.Debug("sqlParams: %v", where.params())
+	err := db.QueryRow(sql_str, where.params()...).Scan(&count)
 	if err != nil {
 		logger.Error("Scan err : %v", err)
 		return 0, err
@@ -427,90 +599,164 @@ type UseInfo struct {
 	Code      string    `json:"code"`
 	Username  string    `json:"username"`
 	Namespace string    `json:"namespace"`
+	Region    string    `json:"-"`
 	Use_time  time.Time `json:"recharge_time"`
 }
 
-type useResult struct {
-	Amount    float32 `json:"amount"`
-	Namespace string  `json:"namespace"`
+type UseResult struct {
+	Amount         Amount   `json:"amount"`
+	Currency       Currency `json:"currency"`
+	Namespace      string   `json:"namespace"`
+	RechargeStatus string   `json:"recharge_status,omitempty"`
 }
 
-func UseCoupon(db *sql.DB, useInfo *UseInfo, callback func() error) (*useResult, error) {
+// UseCoupon marks the coupon used and queues its recharge in
+// DF_COUPON_OUTBOX in one transaction, the returned outbox entry is
+// to be delivered by the caller or the recharge dispatcher. The coupon is
+// of the serial and code of useInfo, or of the code alone without serial.
+func UseCoupon(db *sql.DB, useInfo *UseInfo) (*UseResult, *RechargeOutbox, error) {
 	logger.Info("Begin use a coupon model.")
 
 	useInfo.Serial = strings.ToLower(useInfo.Serial)
-	useInfo.Code = strings.ToLower(useInfo.Code)
+	where := newSqlWhere().eq("CODE_HASH", hashCode(useInfo.Code))
+	if useInfo.Serial != "" {
+		where = where.eq("SERIAL", useInfo.Serial)
+	}
+	result, entry, err := useCoupon(db, where, useInfo, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	logger.Info("End use a coupon model.")
+	return result, entry, nil
+}
+
+// useCoupon redeems the coupon of where, in the slot of hold if it is not
+// nil. Only the rechargeable kinds can be used without a hold, and only
+// they get an outbox entry.
+func useCoupon(db *sql.DB, where *sqlWhere, useInfo *UseInfo, hold *CouponHold) (*UseResult, *RechargeOutbox, error) {
 	tx, err := db.Begin()
 	if err != nil {
 		logger.Error("Begin a trasaction err: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
-	return func() (*useResult, error) {
-		type db struct{}
-		sql := "SELECT AMOUNT, EXPIRE_ON, STATUS FROM DF_COUPON WHERE SERIAL=? AND CODE=?"
-		row := tx.QueryRow(sql, useInfo.Serial, useInfo.Code)
-		logger.Info(">>>\n%v\n%v, %v", sql, useInfo.Serial, useInfo.Code)
-
-		var amount float32
-		var expireOn time.Time
-		var status string
-		err = row.Scan(&amount, &expireOn, &status)
+	return func() (*UseResult, *RechargeOutbox, error) {
+		// lock the row, so concurrent redemptions of the same coupon queue here.
+		locked, err := lockCoupon(tx, where)
 		if err != nil {
 			tx.Rollback()
-			logger.Error("Scan err : %v", err)
-			return nil, err
+			return nil, nil, err
+		}
+		logger.Info("expireOn=%v, amount=%v, status=%v", locked.expireOn, locked.amount, locked.status)
+
+		if err := checkTransition(locked.status, CouponStatus_Used); err != nil {
+			tx.Rollback()
+			return nil, nil, err
 		}
-		logger.Info("expireOn=%v, amount=%v, status=%v", expireOn, amount, status)
-
-		if status == "expired" {
-			return nil, errors.New("The coupon has expired.")
-		} else if status == "used" {
-			return nil, errors.New("The coupon has used.")
-		} else if status == "unavailable" {
-			return nil, errors.New("The coupon unavailable.")
+		rechargeable := checkRechargeable(locked.kind)
+		if hold == nil && rechargeable != nil {
+			tx.Rollback()
+			return nil, nil, rechargeable
+		}
+		if err := checkBinding(locked.boundUsername, locked.boundNamespace, useInfo.Username, useInfo.Namespace); err != nil {
+			tx.Rollback()
+			return nil, nil, err
 		}
 
-		useInfo.Use_time = useInfo.Use_time.UTC().Add(time.Hour * 8)
+		useInfo.Use_time = useInfo.Use_time.UTC()
 		logger.Info("use time: %v", useInfo.Use_time)
 
-		duration := expireOn.Sub(useInfo.Use_time)
-		logger.Info("duration: %v", duration)
-
-		if duration < 0 {
-			sql = "UPDATE DF_COUPON SET STATUS='expired' WHERE SERIAL=? AND CODE=?"
-			_, err := tx.Exec(sql, useInfo.Serial, useInfo.Code)
+		if couponExpired(locked.expireOn, useInfo.Use_time) {
+			err := transitLockedCoupon(tx, locked.serial, locked.status, CouponStatus_Expired, Operator_System, nil)
 			if err != nil {
 				tx.Rollback()
-				logger.Error("Exec err : %v", err)
-				return nil, err
+				return nil, nil, err
+			}
+			if err := tx.Commit(); err != nil {
+				logger.Error("db commit err: %v", err)
 			}
-			logger.Info(">>>\n%v\n%v, %v", sql, useInfo.Serial, useInfo.Code)
-			return nil, errors.New("The coupon has expired.")
+			return nil, nil, &TransitionError{From: CouponStatus_Expired, To: CouponStatus_Used}
 		}
 
-		sql = "UPDATE DF_COUPON SET USE_TIME=?, USERNAME=?, NAMESPACE=?, STATUS=? WHERE SERIAL=? AND CODE=?"
-		_, err = tx.Exec(sql, useInfo.Use_time, useInfo.Username, useInfo.Namespace, "used", useInfo.Serial, useInfo.Code)
-		if err != nil {
+		if err := releaseOverdueHolds(tx, locked, useInfo.Use_time); err != nil {
 			tx.Rollback()
-			logger.Error("Exec err : %v", err)
-			return nil, err
+			return nil, nil, err
+		}
+		update := newUpdateQuery().
+			set("USE_TIME", useInfo.Use_time).
+			set("USERNAME", useInfo.Username).
+			set("NAMESPACE", useInfo.Namespace)
+		if hold != nil {
+			// the slot and the user limit are taken by the hold already.
+			if err := confirmLockedHold(tx, locked, hold, useInfo.Use_time); err != nil {
+				if err == ErrHoldExpired {
+					if err := tx.Commit(); err != nil {
+						logger.Error("db commit err: %v", err)
+					}
+				} else {
+					tx.Rollback()
+				}
+				return nil, nil, err
+			}
+			update.set("HOLDS", locked.holds)
+		} else {
+			if locked.redemptions+locked.holds >= locked.maxRedemptions {
+				tx.Rollback()
+				return nil, nil, ErrCouponHeld
+			}
+			if err := checkUserLimit(tx, locked, useInfo.Username); err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
 		}
-		logger.Info(">>>\n%v\n%v, %v, %v, %v, %v", sql,
-			useInfo.Use_time, useInfo.Username, useInfo.Namespace, useInfo.Serial, useInfo.Code)
 
-		err = callback()
+		// the campaign row is locked too, so concurrent redemptions can't overspend it.
+		if locked.campaignId != 0 {
+			if err := spendCampaignBudget(tx, locked.campaignId, locked.amount, useInfo.Use_time); err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
+		}
+
+		// the status condition and the affected rows check make sure only
+		// one redemption wins, even if the row lock is not honoured.
+		redemption := &Redemption{Username: useInfo.Username, Namespace: useInfo.Namespace, Amount: locked.amount, UseTime: useInfo.Use_time}
+		err = redeemLockedCoupon(tx, locked, redemption, update)
 		if err != nil {
 			tx.Rollback()
-			return nil, err
+			return nil, nil, err
+		}
+		logger.Info(">>> use coupon: %v, %v, %v, %v", useInfo.Use_time, useInfo.Username, useInfo.Namespace, locked.serial)
+
+		var entry *RechargeOutbox
+		if rechargeable == nil {
+			entry = &RechargeOutbox{
+				Serial:       locked.serial,
+				RedemptionId: redemption.Id,
+				Region:       useInfo.Region,
+				Username:     useInfo.Username,
+				Namespace:    useInfo.Namespace,
+				Amount:       locked.amount,
+				Status:       OutboxStatus_Pending,
+				NextTryAt:    time.Now().Add(RechargeGracePeriod),
+			}
+			err = insertRechargeOutbox(tx, entry)
+			if err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
 		}
 
-		tx.Commit()
-		useResult := &useResult{Amount: amount, Namespace: useInfo.Namespace}
-
-		logger.Info("End use a coupon model.")
-
-		return useResult, nil
+		err = tx.Commit()
+		if err != nil {
+			logger.Error("db commit err: %v", err)
+			return nil, nil, err
+		}
+		useResult := &UseResult{Amount: locked.amount, Currency: locked.currency, Namespace: useInfo.Namespace}
+		if entry != nil {
+			useResult.RechargeStatus = entry.Status
+		}
+		return useResult, entry, nil
 	}()
 }
 
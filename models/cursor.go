@@ -0,0 +1,264 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//=============================================================
+// keyset pagination of the coupon list. A cursor is the sort
+// value and the ID of the last coupon seen, the next page starts
+// right after it, so neither COUNT(*) nor OFFSET is needed.
+//=============================================================
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// CouponPage is a page of the coupon list, Next and Prev are the cursors
+// of the pages around it, empty if there are no such pages.
+type CouponPage struct {
+	Total   *int64          `json:"total,omitempty"`
+	Results []*CouponRecord `json:"results"`
+	Next    string          `json:"next,omitempty"`
+	Prev    string          `json:"prev,omitempty"`
+}
+
+// couponCursor is encoded in the cursors, a cursor is only valid for the
+// sort it is made by.
+type couponCursor struct {
+	Column   string `json:"c"`
+	Asc      bool   `json:"a"`
+	Value    string `json:"v"`
+	Id       int64  `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+func (c *couponCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCouponCursor(token, column string, asc bool) (*couponCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &couponCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.Column != column || c.Asc != asc {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := c.value(); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// nullUseTime is how a NULL USE_TIME is compared, before all use times,
+// as mysql sorts NULL first.
+var nullUseTime = time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newCouponCursor(r *CouponRecord, column string, asc, backward bool) *couponCursor {
+	c := &couponCursor{Column: column, Asc: asc, Id: r.id, Backward: backward}
+	switch column {
+	case "CREATE_AT":
+		c.Value = r.CreateAt.UTC().Format(time.RFC3339Nano)
+	case "USE_TIME":
+		useTime := nullUseTime
+		if r.UseTime != nil {
+			useTime = *r.UseTime
+		}
+		c.Value = useTime.UTC().Format(time.RFC3339Nano)
+	case "AMOUNT_FEN":
+		c.Value = strconv.FormatInt(int64(r.Amount), 10)
+	case "SERIAL":
+		c.Value = r.Serial
+	case "STATUS":
+		c.Value = string(r.Status)
+	default:
+		c.Value = r.ExpireOn.UTC().Format(time.RFC3339Nano)
+	}
+	return c
+}
+
+// value returns the sort value of c as the type of its column.
+func (c *couponCursor) value() (interface{}, error) {
+	switch c.Column {
+	case "CREATE_AT", "USE_TIME", "EXPIRE_ON":
+		return time.Parse(time.RFC3339Nano, c.Value)
+	case "AMOUNT_FEN":
+		amount, err := strconv.ParseInt(c.Value, 10, 64)
+		return Amount(amount), err
+	case "SERIAL", "STATUS":
+		return c.Value, nil
+	}
+	return nil, ErrInvalidCursor
+}
+
+// forward reports whether the page after c is in the sort order.
+func (c *couponCursor) forward() bool {
+	return c == nil || !c.Backward
+}
+
+// after appends the keyset condition of the coupons after c in the order
+// of the page, to where.
+func (c *couponCursor) after(where *sqlWhere) {
+	op := "<"
+	if c.Asc != c.Backward {
+		op = ">"
+	}
+	value, _ := c.value()
+	column := mustColumn(c.Column)
+	if c.Column == "USE_TIME" {
+		column = "COALESCE(USE_TIME, ?)"
+		where.and(fmt.Sprintf("(%s %s ? or (%s = ? and ID %s ?))", column, op, column, op),
+			nullUseTime, value, nullUseTime, value, c.Id)
+		return
+	}
+	where.and(fmt.Sprintf("(%s %s ? or (%s = ? and ID %s ?))", column, op, column, op), value, value, c.Id)
+}
+
+// pageOrderBy is the order of a page, ties are broken by ID.
+func pageOrderBy(column string, asc bool) string {
+	return fmt.Sprintf("order by %s %s, ID %s", mustColumn(column), sortOrderText[asc], sortOrderText[asc])
+}
+
+// pageCoupons makes the page after token by fetch, which returns at most
+// limit coupons after a cursor sorted by column, in asc order or not.
+func pageCoupons(orderBy string, asc bool, token string, limit int,
+	fetch func(c *couponCursor, column string, asc bool, limit int) ([]*CouponRecord, error)) (*CouponPage, error) {
+	if orderBy == "" {
+		orderBy, asc = defaultOrderBy, false
+	}
+	var cursor *couponCursor
+	if token != "" {
+		var err error
+		if cursor, err = decodeCouponCursor(token, orderBy, asc); err != nil {
+			return nil, err
+		}
+	}
+
+	forward := cursor.forward()
+	records, err := fetch(cursor, orderBy, asc == forward, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	more := len(records) > limit
+	if more {
+		records = records[:limit]
+	}
+	if !forward {
+		for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+			records[i], records[j] = records[j], records[i]
+		}
+	}
+
+	page := &CouponPage{Results: records}
+	if len(records) == 0 {
+		return page, nil
+	}
+	// a page which is come to from one side has more on that side.
+	if forward && more || !forward && cursor != nil {
+		page.Next = newCouponCursor(records[len(records)-1], orderBy, asc, false).encode()
+	}
+	if !forward && more || forward && cursor != nil {
+		page.Prev = newCouponCursor(records[0], orderBy, asc, true).encode()
+	}
+	return page, nil
+}
+
+// PageCoupons returns the page after token of the coupons selected by
+// filter, the first page if token is "". The total is only counted if
+// withTotal.
+func PageCoupons(db *sql.DB, filter *CouponFilter, orderBy string, sortOrder bool, token string, limit int, withTotal bool) (*CouponPage, error) {
+	page, err := pageCoupons(orderBy, sortOrder, token, limit, func(c *couponCursor, column string, asc bool, limit int) ([]*CouponRecord, error) {
+		where := filter.where()
+		if c != nil {
+			c.after(where)
+		}
+		return queryCouponRecords(db, where, pageOrderBy(column, asc), limit, 0)
+	})
+	if err != nil || !withTotal {
+		return page, err
+	}
+
+	total, err := queryCouponsCount(db, filter.where())
+	if err != nil {
+		return nil, err
+	}
+	page.Total = &total
+	return page, nil
+}
+
+// pageMemoryCoupons is PageCoupons of coupons in memory.
+func pageMemoryCoupons(coupons []*memoryCoupon, orderBy string, sortOrder bool, token string, limit int) (*CouponPage, error) {
+	return pageCoupons(orderBy, sortOrder, token, limit, func(c *couponCursor, column string, asc bool, limit int) ([]*CouponRecord, error) {
+		// the order of the page, ties are broken by ID.
+		compare := func(a, b *memoryCoupon) int {
+			n := compareCoupons(a, b, column)
+			if n == 0 {
+				n = a.Id - b.Id
+			}
+			if !asc {
+				n = -n
+			}
+			return n
+		}
+
+		sorted := append([]*memoryCoupon{}, coupons...)
+		sort.Sort(&couponsByCompare{coupons: sorted, compare: compare})
+
+		var pivot *memoryCoupon
+		if c != nil {
+			pivot = c.memoryCoupon()
+		}
+		records := []*CouponRecord{}
+		for _, coupon := range sorted {
+			if pivot != nil && compare(coupon, pivot) <= 0 {
+				continue
+			}
+			if records = append(records, coupon.record()); len(records) == limit {
+				break
+			}
+		}
+		return records, nil
+	})
+}
+
+// couponsByCompare sorts coupons in the order of compare.
+type couponsByCompare struct {
+	coupons []*memoryCoupon
+	compare func(a, b *memoryCoupon) int
+}
+
+func (s *couponsByCompare) Len() int           { return len(s.coupons) }
+func (s *couponsByCompare) Swap(i, j int)      { s.coupons[i], s.coupons[j] = s.coupons[j], s.coupons[i] }
+func (s *couponsByCompare) Less(i, j int) bool { return s.compare(s.coupons[i], s.coupons[j]) < 0 }
+
+// memoryCoupon is a coupon which sorts where c is.
+func (c *couponCursor) memoryCoupon() *memoryCoupon {
+	coupon := &memoryCoupon{}
+	coupon.Id = int(c.Id)
+	value, _ := c.value()
+	switch c.Column {
+	case "CREATE_AT":
+		coupon.CreateAt = value.(time.Time)
+	case "USE_TIME":
+		if t := value.(time.Time); !t.Equal(nullUseTime) {
+			coupon.UseTime = t
+		}
+	case "AMOUNT_FEN":
+		coupon.Amount = value.(Amount)
+	case "SERIAL":
+		coupon.Serial = value.(string)
+	case "STATUS":
+		coupon.Status = CouponStatus(value.(string))
+	default:
+		coupon.ExpireOn = value.(time.Time)
+	}
+	return coupon
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCouponCursorAfter(t *testing.T) {
+	useTime := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	record := &CouponRecord{id: 42, UseTime: &useTime}
+	record.Amount = 1000
+
+	cases := []struct {
+		column   string
+		asc      bool
+		backward bool
+		cond     string
+		args     []interface{}
+	}{
+		{"AMOUNT_FEN", true, false, "(AMOUNT_FEN > ? or (AMOUNT_FEN = ? and ID > ?))", []interface{}{Amount(1000), Amount(1000), int64(42)}},
+		{"AMOUNT_FEN", false, false, "(AMOUNT_FEN < ? or (AMOUNT_FEN = ? and ID < ?))", []interface{}{Amount(1000), Amount(1000), int64(42)}},
+		{"AMOUNT_FEN", true, true, "(AMOUNT_FEN < ? or (AMOUNT_FEN = ? and ID < ?))", []interface{}{Amount(1000), Amount(1000), int64(42)}},
+		{"USE_TIME", true, false, "(COALESCE(USE_TIME, ?) > ? or (COALESCE(USE_TIME, ?) = ? and ID > ?))",
+			[]interface{}{nullUseTime, useTime, nullUseTime, useTime, int64(42)}},
+	}
+	for _, c := range cases {
+		token := newCouponCursor(record, c.column, c.asc, c.backward).encode()
+		cursor, err := decodeCouponCursor(token, c.column, c.asc)
+		if err != nil {
+			t.Fatalf("decode %s: %v", token, err)
+		}
+		where := newSqlWhere()
+		cursor.after(where)
+		if where.String() != "WHERE "+c.cond || !reflect.DeepEqual(where.params(), c.args) {
+			t.Errorf("%+v: %s %v", c, where, where.params())
+		}
+	}
+
+	token := newCouponCursor(record, "AMOUNT_FEN", true, false).encode()
+	for _, sort := range []struct {
+		column string
+		asc    bool
+	}{{"AMOUNT_FEN", false}, {"SERIAL", true}} {
+		if _, err := decodeCouponCursor(token, sort.column, sort.asc); err != ErrInvalidCursor {
+			t.Errorf("decode a cursor of another sort %+v: %v", sort, err)
+		}
+	}
+	if _, err := decodeCouponCursor("not base64!", "AMOUNT_FEN", true); err != ErrInvalidCursor {
+		t.Errorf("decode a malformed cursor: %v", err)
+	}
+}
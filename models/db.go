@@ -54,6 +54,8 @@ func InitDB() {
 
 	go updateDB()
 
+	startExpirySweeper()
+
 	logger.Info("Init db succeed.")
 	return
 }
@@ -125,8 +127,10 @@ func connectDB() {
 	}
 }
 
+const couponDbName = "datafoundry:coupon" // don't change the name
+
 func upgradeDB() {
-	err := TryToUpgradeDatabase(DB(), "datafoundry:coupon", os.Getenv("MYSQL_CONFIG_DONT_UPGRADE_TABLES") != "yes") // don't change the name
+	err := TryToUpgradeDatabase(DB(), couponDbName, os.Getenv("MYSQL_CONFIG_DONT_UPGRADE_TABLES") != "yes")
 	if err != nil {
 		logger.Error("TryToUpgradeDatabase error: %v.", err)
 	}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	stat "github.com/asiainfoLDP/datafoundry_coupon/statistics"
+)
+
+//=============================================================
+// the expiry sweeper moves the overdue coupons to expired, so
+// they are not listed or provided as available any more.
+//=============================================================
+
+const (
+	expirySweepInterval   = time.Minute
+	expirySweepBatch      = 100
+	expirySweepMaxBatches = 50
+	expirySweepLease      = 5 * time.Minute
+)
+
+var (
+	// DF_ITEM_STAT keys. The lease value is the minute (since epoch)
+	// until which a replica holds the sweeper, 0 means free.
+	expirySweepLeaseKey = stat.GetGeneralStatKey(couponDbName, "expiry") + "#lease"
+	expiredCouponsKey   = stat.GetGeneralStatKey(couponDbName, "coupons") + "#expired"
+)
+
+// EXPIRE_ON and USE_TIME are UTC instants, the mysql driver converts
+// time.Time args to UTC and reads DATETIME columns as UTC.
+
+// expireInstant is how an expiry time is saved, DATETIME keeps seconds only.
+func expireInstant(expireOn time.Time) time.Time {
+	return expireOn.UTC().Truncate(time.Second)
+}
+
+// couponExpired reports whether a coupon expiring on expireOn is overdue at now.
+// The sweeper query below must agree with it.
+func couponExpired(expireOn, now time.Time) bool {
+	return !now.Before(expireOn)
+}
+
+// expireCoupons moves at most limit coupons which are overdue at now to
+// expired, and returns how many of them are moved.
+func expireCoupons(db *sql.DB, now time.Time, limit int) (int, error) {
+	overdue := func() *sqlWhere {
+		return newSqlWhere().
+			in("STATUS", statusesTo(CouponStatus_Expired)...).
+			and("EXPIRE_ON <= ?", now.UTC())
+	}
+
+	query := &selectQuery{columns: []string{"SERIAL"}, where: overdue(), orderBy: orderByClause("EXPIRE_ON", true), limit: limit}
+	sqlstr, args := query.build()
+	rows, err := db.Query(sqlstr, args...)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return 0, err
+	}
+	serials := make([]string, 0, limit)
+	for rows.Next() {
+		var serial string
+		if err := rows.Scan(&serial); err != nil {
+			rows.Close()
+			logger.Error("Scan err : %v", err)
+			return 0, err
+		}
+		serials = append(serials, serial)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return 0, err
+	}
+
+	expired := 0
+	for _, serial := range serials {
+		err := inTx(db, func(tx *sql.Tx) error {
+			_, err := transitCoupon(tx, overdue().eq("SERIAL", serial), CouponStatus_Expired, Operator_System, nil)
+			return err
+		})
+		switch err.(type) {
+		case nil:
+			expired++
+			continue
+		case *TransitionError:
+			continue
+		}
+		if err == ErrCouponNotFound || err == ErrCouponStatusConflict {
+			continue // used or deleted meanwhile
+		}
+		return expired, err
+	}
+
+	return expired, nil
+}
+
+// startExpirySweeper sweeps the overdue coupons in background.
+func startExpirySweeper() {
+	go func() {
+		store := NewMysqlStore(GetDB)
+		ticker := time.NewTicker(expirySweepInterval)
+		for range ticker.C {
+			db := GetDB()
+			if db == nil {
+				continue
+			}
+			sweepExpiredCoupons(db, store)
+		}
+	}()
+}
+
+// sweepExpiredCoupons expires the overdue coupons and holds batch by batch,
+// if this replica gets the lease. It returns how many coupons are expired.
+func sweepExpiredCoupons(db *sql.DB, store CouponStore) int {
+	lease, ok := acquireExpirySweepLease(db)
+	if !ok {
+		return 0
+	}
+	defer releaseExpirySweepLease(db, lease)
+
+	total := 0
+	for i := 0; i < expirySweepMaxBatches; i++ {
+		n, err := store.ExpireCoupons(time.Now(), expirySweepBatch)
+		total += n
+		if err != nil {
+			logger.Error("ExpireCoupons err: %v", err)
+			break
+		}
+		if n < expirySweepBatch {
+			break
+		}
+	}
+
+	holds := 0
+	for i := 0; i < expirySweepMaxBatches; i++ {
+		n, err := store.ExpireHolds(time.Now(), expirySweepBatch)
+		holds += n
+		if err != nil {
+			logger.Error("ExpireHolds err: %v", err)
+			break
+		}
+		if n < expirySweepBatch {
+			break
+		}
+	}
+	if holds > 0 {
+		logger.Info("%d coupon holds are expired.", holds)
+	}
+
+	if total > 0 {
+		logger.Info("%d coupons are expired.", total)
+		if _, err := stat.UpdateStat(db, expiredCouponsKey, total); err != nil {
+			logger.Error("UpdateStat (%s) err: %v", expiredCouponsKey, err)
+		}
+	}
+	return total
+}
+
+func acquireExpirySweepLease(db *sql.DB) (int, bool) {
+	now := int(time.Now().Unix() / 60)
+	old, err := stat.RetrieveStat(db, expirySweepLeaseKey)
+	if err != nil {
+		logger.Error("RetrieveStat (%s) err: %v", expirySweepLeaseKey, err)
+		return 0, false
+	}
+	if old > now {
+		return 0, false // held by another replica
+	}
+
+	lease := now + int(expirySweepLease/time.Minute)
+	if _, err := stat.SetStatIf(db, expirySweepLeaseKey, lease, old); err != nil {
+		if err != stat.ErrOldStatNotMatch {
+			logger.Warn("SetStatIf (%s) err: %v", expirySweepLeaseKey, err)
+		}
+		return 0, false
+	}
+	return lease, true
+}
+
+func releaseExpirySweepLease(db *sql.DB, lease int) {
+	_, err := stat.SetStatIf(db, expirySweepLeaseKey, 0, lease)
+	if err != nil && err != stat.ErrOldStatNotMatch {
+		logger.Warn("SetStatIf (%s) err: %v", expirySweepLeaseKey, err)
+	}
+}
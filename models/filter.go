@@ -0,0 +1,205 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//=============================================================
+// the filters and the sort fields of the coupon list.
+//=============================================================
+
+// CouponFilter selects the coupons of the list, its zero value selects all.
+// A time range includes From and excludes To, a zero bound is open.
+// Username and Namespace are of the last redemption.
+type CouponFilter struct {
+	Kind      string
+	Status    CouponStatus
+	MinAmount *Amount
+	MaxAmount *Amount
+
+	CreateFrom, CreateTo time.Time
+	ExpireFrom, ExpireTo time.Time
+	UseFrom, UseTo       time.Time
+
+	Username     string
+	Namespace    string
+	CampaignId   int64
+	SerialPrefix string
+}
+
+// Validate normalizes f, and checks its bounds.
+func (f *CouponFilter) Validate() error {
+	f.Kind = strings.ToLower(f.Kind)
+	f.SerialPrefix = strings.ToLower(f.SerialPrefix)
+	f.Status = CouponStatus(strings.ToLower(string(f.Status)))
+
+	if f.Status != "" && !knownCouponStatus(f.Status) {
+		return fmt.Errorf("unknown status: %s", f.Status)
+	}
+	if f.MinAmount != nil && f.MaxAmount != nil && *f.MinAmount > *f.MaxAmount {
+		return errors.New("min_amount should not be greater than max_amount")
+	}
+	for _, r := range []struct {
+		name     string
+		from, to time.Time
+	}{{"create", f.CreateFrom, f.CreateTo}, {"expire", f.ExpireFrom, f.ExpireTo}, {"use", f.UseFrom, f.UseTo}} {
+		if !r.from.IsZero() && !r.to.IsZero() && !r.from.Before(r.to) {
+			return fmt.Errorf("%s_from should be before %s_to", r.name, r.name)
+		}
+	}
+	if f.CampaignId < 0 {
+		return errors.New("campaign_id should be positive")
+	}
+	return nil
+}
+
+func (f *CouponFilter) where() *sqlWhere {
+	where := newSqlWhere()
+	if f == nil {
+		return where
+	}
+
+	if f.Kind != "" {
+		where.eq("KIND", f.Kind)
+	}
+	if f.Status != "" {
+		where.eq("STATUS", string(f.Status))
+	}
+	if f.MinAmount != nil {
+		where.cmp("AMOUNT_FEN", ">=", *f.MinAmount)
+	}
+	if f.MaxAmount != nil {
+		where.cmp("AMOUNT_FEN", "<=", *f.MaxAmount)
+	}
+	where.between("CREATE_AT", f.CreateFrom, f.CreateTo)
+	where.between("EXPIRE_ON", f.ExpireFrom, f.ExpireTo)
+	where.between("USE_TIME", f.UseFrom, f.UseTo)
+	if f.Username != "" {
+		where.eq("USERNAME", f.Username)
+	}
+	if f.Namespace != "" {
+		where.eq("NAMESPACE", f.Namespace)
+	}
+	if f.CampaignId != 0 {
+		where.eq("CAMPAIGN_ID", f.CampaignId)
+	}
+	if f.SerialPrefix != "" {
+		where.prefix("SERIAL", f.SerialPrefix)
+	}
+	return where
+}
+
+// match is the memory version of where.
+func (f *CouponFilter) match(c *memoryCoupon) bool {
+	if f == nil {
+		return true
+	}
+
+	inRange := func(t, from, to time.Time) bool {
+		return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+	}
+	usedInRange := f.UseFrom.IsZero() && f.UseTo.IsZero() ||
+		!c.UseTime.IsZero() && inRange(c.UseTime, f.UseFrom, f.UseTo)
+
+	return (f.Kind == "" || c.Kind == f.Kind) &&
+		(f.Status == "" || c.Status == f.Status) &&
+		(f.MinAmount == nil || c.Amount >= *f.MinAmount) &&
+		(f.MaxAmount == nil || c.Amount <= *f.MaxAmount) &&
+		inRange(c.CreateAt, f.CreateFrom, f.CreateTo) &&
+		inRange(c.ExpireOn, f.ExpireFrom, f.ExpireTo) &&
+		usedInRange &&
+		(f.Username == "" || c.Username == f.Username) &&
+		(f.Namespace == "" || c.Namespace == f.Namespace) &&
+		(f.CampaignId == 0 || c.CampaignId == f.CampaignId) &&
+		strings.HasPrefix(c.Serial, f.SerialPrefix)
+}
+
+func knownCouponStatus(status CouponStatus) bool {
+	switch status {
+	case CouponStatus_Available, CouponStatus_Queried, CouponStatus_Provided, CouponStatus_Used,
+		CouponStatus_Expired, CouponStatus_Unavailable, CouponStatus_Revoked:
+		return true
+	}
+	return false
+}
+
+// couponSortFields maps the sort fields of the list to their columns.
+var couponSortFields = map[string]string{
+	"createtime": "CREATE_AT", // the old name of create_at
+	"create_at":  "CREATE_AT",
+	"expire_on":  "EXPIRE_ON",
+	"use_time":   "USE_TIME",
+	"amount":     "AMOUNT_FEN",
+	"serial":     "SERIAL",
+	"status":     "STATUS",
+}
+
+// defaultOrderBy is the column the list is sorted by without a sort field,
+// in desc order.
+const defaultOrderBy = "EXPIRE_ON"
+
+// ValidateOrderBy returns the column of a sort field, "" is the default
+// order, by expire_on desc.
+func ValidateOrderBy(orderBy string) (string, error) {
+	if orderBy == "" {
+		return "", nil
+	}
+	column, ok := couponSortFields[strings.ToLower(orderBy)]
+	if !ok {
+		return "", fmt.Errorf("unsupported orderby: %s", orderBy)
+	}
+	return column, nil
+}
+
+// compareCoupons is the memory version of sorting by column.
+func compareCoupons(a, b *memoryCoupon, column string) int {
+	compareTimes := func(x, y time.Time) int {
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+		return 0
+	}
+
+	switch column {
+	case "CREATE_AT":
+		return compareTimes(a.CreateAt, b.CreateAt)
+	case "USE_TIME":
+		return compareTimes(a.UseTime, b.UseTime)
+	case "AMOUNT_FEN":
+		switch {
+		case a.Amount < b.Amount:
+			return -1
+		case a.Amount > b.Amount:
+			return 1
+		}
+		return 0
+	case "SERIAL":
+		return strings.Compare(a.Serial, b.Serial)
+	case "STATUS":
+		return strings.Compare(string(a.Status), string(b.Status))
+	}
+	return compareTimes(a.ExpireOn, b.ExpireOn)
+}
+
+// couponsByColumn sorts coupons by column, in asc order or not.
+type couponsByColumn struct {
+	coupons []*memoryCoupon
+	column  string
+	asc     bool
+}
+
+func (s *couponsByColumn) Len() int      { return len(s.coupons) }
+func (s *couponsByColumn) Swap(i, j int) { s.coupons[i], s.coupons[j] = s.coupons[j], s.coupons[i] }
+func (s *couponsByColumn) Less(i, j int) bool {
+	n := compareCoupons(s.coupons[i], s.coupons[j], s.column)
+	if s.asc {
+		return n < 0
+	}
+	return n > 0
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCouponFilterWhere(t *testing.T) {
+	min, max := Amount(1000), Amount(5000)
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	filter := &CouponFilter{
+		Kind: "Recharge", Status: "USED", MinAmount: &min, MaxAmount: &max,
+		CreateFrom: from, UseTo: from.AddDate(0, 1, 0),
+		Username: "alice", CampaignId: 7, SerialPrefix: "DF_1%",
+	}
+	if err := filter.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+
+	where := filter.where()
+	want := "WHERE KIND = ? and STATUS = ? and AMOUNT_FEN >= ? and AMOUNT_FEN <= ? and CREATE_AT >= ? and " +
+		"USE_TIME < ? and USERNAME = ? and CAMPAIGN_ID = ? and SERIAL like ?"
+	if where.String() != want {
+		t.Errorf("where = %s\nwant %s", where, want)
+	}
+	args := []interface{}{"recharge", "used", min, max, from.UTC(), from.AddDate(0, 1, 0).UTC(), "alice", int64(7), `df\_1\%%`}
+	if !reflect.DeepEqual(where.params(), args) {
+		t.Errorf("params = %v, want %v", where.params(), args)
+	}
+
+	if where := (*CouponFilter)(nil).where(); where.String() != "" {
+		t.Errorf("where of no filter = %s", where)
+	}
+}
+
+func TestValidateCouponFilter(t *testing.T) {
+	min, max := Amount(5000), Amount(1000)
+	now := time.Now()
+	invalid := []CouponFilter{
+		{Status: "lost"},
+		{MinAmount: &min, MaxAmount: &max},
+		{CreateFrom: now, CreateTo: now},
+		{ExpireFrom: now, ExpireTo: now.Add(-time.Hour)},
+		{CampaignId: -1},
+	}
+	for _, filter := range invalid {
+		if err := filter.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil", filter)
+		}
+	}
+}
+
+func TestValidateOrderBy(t *testing.T) {
+	for orderBy, column := range map[string]string{"": "", "createtime": "CREATE_AT", "Amount": "AMOUNT_FEN", "use_time": "USE_TIME"} {
+		if got, err := ValidateOrderBy(orderBy); err != nil || got != column {
+			t.Errorf("ValidateOrderBy(%q) = %q, %v, want %q", orderBy, got, err, column)
+		}
+	}
+	for _, orderBy := range []string{"CREATE_TIME", "CODE_HASH", "expire_on; drop table DF_COUPON"} {
+		if _, err := ValidateOrderBy(orderBy); err == nil {
+			t.Errorf("ValidateOrderBy(%q) = nil", orderBy)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+//=============================================================
+// DF_COUPON_HOLD, a checkout holds a redemption of a coupon for a
+// while, then confirms it to use the coupon, or releases it. A hold
+// not confirmed in time expires and frees its redemption. HOLDS of
+// DF_COUPON counts the active holds, which are taken as redeemed.
+//=============================================================
+
+type HoldStatus string
+
+const (
+	HoldStatus_Active    HoldStatus = "active"
+	HoldStatus_Confirmed HoldStatus = "confirmed"
+	HoldStatus_Released  HoldStatus = "released"
+	HoldStatus_Expired   HoldStatus = "expired"
+)
+
+var (
+	ErrCouponHeld     = errors.New("The coupon is held by a checkout.")
+	ErrHoldNotFound   = errors.New("The hold does not exist.")
+	ErrHoldExpired    = errors.New("The hold has expired.")
+	ErrHoldNotActive  = errors.New("The hold has been confirmed or released.")
+	ErrHoldConflicted = errors.New("The hold token is taken.")
+	ErrHoldRegion     = errors.New("The hold is made in another region.")
+)
+
+type HoldInfo struct {
+	Code      string
+	Token     string
+	Username  string
+	Namespace string
+	Region    string
+	HoldTime  time.Time
+	ExpireAt  time.Time
+}
+
+type CouponHold struct {
+	// Token is only returned when the hold is created.
+	Token     string     `json:"token,omitempty"`
+	Serial    string     `json:"serial"`
+	Username  string     `json:"username"`
+	Namespace string     `json:"namespace"`
+	Region    string     `json:"region"`
+	Status    HoldStatus `json:"status"`
+	ExpireAt  time.Time  `json:"expire_at"`
+	CreateAt  time.Time  `json:"create_at"`
+
+	Coupon *RetrieveResult `json:"coupon,omitempty"`
+}
+
+// overdue reports an active hold which is expired at now, but not
+// marked yet.
+func (h *CouponHold) overdue(now time.Time) bool {
+	return h.Status == HoldStatus_Active && !now.Before(h.ExpireAt)
+}
+
+// useInfo returns the use of the coupon which confirms the hold in region.
+// A hold made before holds had regions is confirmed in region.
+func (h *CouponHold) useInfo(region string, now time.Time) (*UseInfo, error) {
+	if h.Region != "" && h.Region != region {
+		return nil, ErrHoldRegion
+	}
+	return &UseInfo{Serial: h.Serial, Username: h.Username, Namespace: h.Namespace, Region: region, Use_time: now}, nil
+}
+
+func HoldCoupon(db *sql.DB, info *HoldInfo) (*CouponHold, error) {
+	logger.Info("Begin hold a coupon model.")
+
+	info.HoldTime = info.HoldTime.UTC()
+	hold := &CouponHold{
+		Token:     info.Token,
+		Username:  info.Username,
+		Namespace: info.Namespace,
+		Region:    info.Region,
+		Status:    HoldStatus_Active,
+		ExpireAt:  expireInstant(info.ExpireAt),
+		CreateAt:  info.HoldTime,
+	}
+	err := inTx(db, func(tx *sql.Tx) error {
+		c, err := lockCoupon(tx, newSqlWhere().eq("CODE_HASH", hashCode(info.Code)))
+		if err != nil {
+			return err
+		}
+		if err := checkHoldable(tx, c, info); err != nil {
+			return err
+		}
+		hold.Serial = c.serial
+
+		sqlstr := `insert into DF_COUPON_HOLD (TOKEN_HASH, SERIAL, USERNAME, NAMESPACE, REGION, STATUS, EXPIRE_AT) values (?, ?, ?, ?, ?, ?, ?)`
+		_, err = tx.Exec(sqlstr, hashCode(info.Token), c.serial, info.Username, info.Namespace, info.Region, string(HoldStatus_Active), hold.ExpireAt)
+		if isDuplicateKey(err) {
+			logger.Warn("Exec err : %v", err)
+			return ErrHoldConflicted
+		} else if err != nil {
+			logger.Error("Exec err : %v", err)
+			return err
+		}
+
+		c.holds++
+		return updateHolds(tx, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hold.Coupon, err = lookupSingleCoupon(db, newSqlWhere().eq("SERIAL", hold.Serial))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("End hold a coupon model.")
+	return hold, nil
+}
+
+// checkHoldable checks that the locked coupon c can be used by the holder
+// of info, and has a redemption to hold.
+func checkHoldable(tx queryer, c *lockedCoupon, info *HoldInfo) error {
+	if err := checkUsable(tx, c, info); err != nil {
+		return err
+	}
+
+	if err := releaseOverdueHolds(tx, c, info.HoldTime); err != nil {
+		return err
+	}
+	if c.redemptions+c.holds >= c.maxRedemptions {
+		return ErrCouponHeld
+	}
+	return checkUserLimit(tx, c, info.Username)
+}
+
+// checkUsable checks that the coupon c can be used by the holder of info,
+// whether it has a redemption left or not.
+func checkUsable(tx queryer, c *lockedCoupon, info *HoldInfo) error {
+	if err := checkTransition(c.status, CouponStatus_Used); err != nil {
+		return err
+	}
+	if err := checkBinding(c.boundUsername, c.boundNamespace, info.Username, info.Namespace); err != nil {
+		return err
+	}
+	if couponExpired(c.expireOn, info.HoldTime) {
+		return &TransitionError{From: CouponStatus_Expired, To: CouponStatus_Used}
+	}
+	if c.campaignId != 0 {
+		campaign, err := getCampaign(tx, c.campaignId, false)
+		if err != nil {
+			return err
+		}
+		if err := campaign.checkOpen(info.HoldTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckCouponUsable is HoldCoupon without the hold, it returns the coupon of
+// info.Code if the holder of info can hold it now. The coupon is neither
+// locked nor changed, so a hold right after it may still fail.
+func CheckCouponUsable(db *sql.DB, info *HoldInfo) (*RetrieveResult, error) {
+	info.HoldTime = info.HoldTime.UTC()
+	c, err := readCoupon(db, newSqlWhere().eq("CODE_HASH", hashCode(info.Code)), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUsable(db, c, info); err != nil {
+		return nil, err
+	}
+
+	// the overdue holds are not counted, instead of released.
+	if c.holds > 0 {
+		err := db.QueryRow(`select count(*) from DF_COUPON_HOLD where SERIAL = ? and STATUS = ? and EXPIRE_AT > ?`,
+			c.serial, string(HoldStatus_Active), info.HoldTime).Scan(&c.holds)
+		if err != nil {
+			logger.Error("Scan err : %v", err)
+			return nil, err
+		}
+	}
+	if c.redemptions+c.holds >= c.maxRedemptions {
+		return nil, ErrCouponHeld
+	}
+	if err := checkUserLimit(db, c, info.Username); err != nil {
+		return nil, err
+	}
+
+	coupon, err := lookupSingleCoupon(db, newSqlWhere().eq("SERIAL", c.serial))
+	if err == nil && coupon == nil {
+		err = ErrCouponNotFound
+	}
+	return coupon, err
+}
+
+// RetrieveHold returns the hold of token if it is of username.
+func RetrieveHold(db *sql.DB, token, username string) (*CouponHold, error) {
+	hold, err := lookupHold(db, hashCode(token), username)
+	if err != nil {
+		return nil, err
+	}
+	if hold.overdue(time.Now()) {
+		hold.Status = HoldStatus_Expired
+	}
+	return hold, nil
+}
+
+// ConfirmHold uses the coupon of the hold of token, as UseCoupon. The
+// namespace of the hold is checked in its region, so it must be confirmed
+// in the same region.
+func ConfirmHold(db *sql.DB, token, username, region string, now time.Time) (*UseResult, *RechargeOutbox, error) {
+	logger.Info("Begin confirm a hold model.")
+
+	hold, err := lookupHold(db, hashCode(token), username)
+	if err != nil {
+		return nil, nil, err
+	}
+	hold.Token = token
+	if err := checkHoldActive(hold.Status); err != nil {
+		return nil, nil, err
+	}
+
+	useInfo, err := hold.useInfo(region, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, entry, err := useCoupon(db, newSqlWhere().eq("SERIAL", hold.Serial), useInfo, hold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Info("End confirm a hold model.")
+	return result, entry, nil
+}
+
+// ReleaseHold frees the redemption held by token, releasing a released
+// or expired hold again is fine.
+func ReleaseHold(db *sql.DB, token, username string) error {
+	hold, err := lookupHold(db, hashCode(token), username)
+	if err != nil {
+		return err
+	}
+	hold.Token = token
+	if hold.Status == HoldStatus_Released {
+		return nil
+	}
+
+	return inTx(db, func(tx *sql.Tx) error {
+		c, err := lockCoupon(tx, newSqlWhere().eq("SERIAL", hold.Serial))
+		if err != nil {
+			return err
+		}
+		err = closeLockedHold(tx, c, hold, HoldStatus_Released, time.Now())
+		if err == ErrHoldExpired {
+			return nil
+		}
+		return err
+	})
+}
+
+// ExpireHolds marks at most the holds of limit coupons which are overdue
+// at now expired, and returns how many holds are expired.
+func ExpireHolds(db *sql.DB, now time.Time, limit int) (int, error) {
+	sqlstr := `select distinct SERIAL from DF_COUPON_HOLD where STATUS = ? and EXPIRE_AT <= ? limit ?`
+	rows, err := db.Query(sqlstr, string(HoldStatus_Active), now.UTC(), limit)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return 0, err
+	}
+	serials := make([]string, 0, limit)
+	for rows.Next() {
+		var serial string
+		if err := rows.Scan(&serial); err != nil {
+			rows.Close()
+			logger.Error("Scan err : %v", err)
+			return 0, err
+		}
+		serials = append(serials, serial)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return 0, err
+	}
+
+	expired := 0
+	for _, serial := range serials {
+		err := inTx(db, func(tx *sql.Tx) error {
+			c, err := lockCoupon(tx, newSqlWhere().eq("SERIAL", serial))
+			if err != nil {
+				return err
+			}
+			n, err := expireLockedHolds(tx, c, now)
+			expired += n
+			return err
+		})
+		if err == ErrCouponNotFound {
+			continue
+		} else if err != nil {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
+// releaseOverdueHolds frees the redemptions of the overdue holds of the
+// locked coupon c, before its redemptions are counted.
+func releaseOverdueHolds(tx queryer, c *lockedCoupon, now time.Time) error {
+	if c.holds == 0 {
+		return nil
+	}
+	_, err := expireLockedHolds(tx, c, now)
+	return err
+}
+
+func expireLockedHolds(tx queryer, c *lockedCoupon, now time.Time) (int, error) {
+	sqlstr := `update DF_COUPON_HOLD set STATUS = ? where SERIAL = ? and STATUS = ? and EXPIRE_AT <= ?`
+	result, err := tx.Exec(sqlstr, string(HoldStatus_Expired), c.serial, string(HoldStatus_Active), now.UTC())
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	if c.holds -= int(n); c.holds < 0 {
+		c.holds = 0
+	}
+	return int(n), updateHolds(tx, c)
+}
+
+func updateHolds(tx queryer, c *lockedCoupon) error {
+	update := newUpdateQuery().set("HOLDS", c.holds)
+	update.where = newSqlWhere().eq("SERIAL", c.serial)
+	_, err := update.exec(tx)
+	return err
+}
+
+// confirmLockedHold closes hold as confirmed, the caller redeems the
+// locked coupon c with the new HOLDS of c.
+func confirmLockedHold(tx queryer, c *lockedCoupon, hold *CouponHold, now time.Time) error {
+	return closeLockedHold(tx, c, hold, HoldStatus_Confirmed, now)
+}
+
+// closeLockedHold moves the active hold of the locked coupon c to `to`.
+// It returns ErrHoldExpired if the hold is expired before now.
+func closeLockedHold(tx queryer, c *lockedCoupon, hold *CouponHold, to HoldStatus, now time.Time) error {
+	if err := releaseOverdueHolds(tx, c, now); err != nil {
+		return err
+	}
+	// the coupon lock keeps the holds of it from changing.
+	current, err := lookupHold(tx, hashCode(hold.Token), hold.Username)
+	if err != nil {
+		return err
+	}
+	if err := checkHoldActive(current.Status); err != nil {
+		return err
+	}
+
+	sqlstr := `update DF_COUPON_HOLD set STATUS = ? where TOKEN_HASH = ? and STATUS = ?`
+	if _, err := tx.Exec(sqlstr, string(to), hashCode(hold.Token), string(HoldStatus_Active)); err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+	if c.holds--; c.holds < 0 {
+		c.holds = 0
+	}
+	if to == HoldStatus_Confirmed {
+		return nil // HOLDS is updated with the redemption.
+	}
+	return updateHolds(tx, c)
+}
+
+func checkHoldActive(status HoldStatus) error {
+	switch status {
+	case HoldStatus_Active:
+		return nil
+	case HoldStatus_Expired:
+		return ErrHoldExpired
+	}
+	return ErrHoldNotActive
+}
+
+// lookupHold returns the hold of tokenHash, a hold of another user is
+// not found. Its Token is not set.
+func lookupHold(q queryer, tokenHash, username string) (*CouponHold, error) {
+	sqlstr := `select SERIAL, USERNAME, NAMESPACE, REGION, STATUS, EXPIRE_AT, CREATE_AT from DF_COUPON_HOLD where TOKEN_HASH = ?`
+	hold := &CouponHold{}
+	err := q.QueryRow(sqlstr, tokenHash).Scan(&hold.Serial, &hold.Username, &hold.Namespace, &hold.Region, &hold.Status, &hold.ExpireAt, &hold.CreateAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrHoldNotFound
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return nil, err
+	}
+	if !strings.EqualFold(hold.Username, username) {
+		return nil, ErrHoldNotFound
+	}
+	return hold, nil
+}
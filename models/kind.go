@@ -0,0 +1,240 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+//=============================================================
+// coupon kinds, what a coupon is worth is decided by its kind
+//=============================================================
+
+const (
+	CouponKind_Recharge = "recharge"
+
+	// CouponKind_Offline coupons are minted as signed codes without rows,
+	// a row is created when one is redeemed.
+	CouponKind_Offline = "offline"
+
+	// AMOUNT is the cap of the discount, 0 < PERCENT_OFF <= 100.
+	CouponKind_Percentage = "percentage"
+	// AMOUNT is taken off the orders of at least MIN_SPEND.
+	CouponKind_FixedOff = "fixed_off"
+	// the orders of PLAN_ID are free.
+	CouponKind_FreeTrial = "free_trial"
+)
+
+// CouponTerms are the parameters of a coupon, interpreted by its kind.
+type CouponTerms struct {
+	Kind       string
+	Amount     Amount
+	Currency   Currency
+	PercentOff int
+	MinSpend   Amount
+	PlanId     string
+}
+
+// Order is what the billing services evaluate a coupon against.
+type Order struct {
+	Total    Amount
+	Currency Currency
+	PlanId   string
+}
+
+type CouponKind interface {
+	// Validate checks the terms of a new coupon.
+	Validate(terms *CouponTerms) error
+	// Discount returns what the coupon takes off order, or a
+	// NotApplicableError. order is in the currency of the coupon.
+	Discount(terms *CouponTerms, order *Order) (Amount, error)
+	// Rechargeable reports whether the coupon is redeemed by a recharge
+	// of its amount, the other kinds are redeemed by the billing services.
+	Rechargeable() bool
+}
+
+var couponKinds = map[string]CouponKind{}
+
+func init() {
+	RegisterCouponKind(CouponKind_Recharge, rechargeKind{})
+	RegisterCouponKind(CouponKind_Offline, offlineKind{})
+	RegisterCouponKind(CouponKind_Percentage, percentageKind{})
+	RegisterCouponKind(CouponKind_FixedOff, fixedOffKind{})
+	RegisterCouponKind(CouponKind_FreeTrial, freeTrialKind{})
+}
+
+// RegisterCouponKind must be called before the service starts.
+func RegisterCouponKind(name string, kind CouponKind) {
+	if _, ok := couponKinds[name]; ok {
+		panic("coupon kind registered twice: " + name)
+	}
+	couponKinds[name] = kind
+}
+
+// ValidateKind normalizes the kind of a new coupon, "" is a recharge coupon.
+func ValidateKind(name string) (string, error) {
+	name = strings.ToLower(name)
+	if name == "" {
+		return CouponKind_Recharge, nil
+	}
+	if _, ok := couponKinds[name]; !ok {
+		return "", fmt.Errorf("unsupported kind: %s", name)
+	}
+	return name, nil
+}
+
+// savedCouponKind returns the kind of a saved coupon, the coupons saved
+// before the kinds were registered are recharge coupons.
+func savedCouponKind(name string) CouponKind {
+	if kind, ok := couponKinds[name]; ok {
+		return kind
+	}
+	return couponKinds[CouponKind_Recharge]
+}
+
+// ValidateTerms checks the terms of a new coupon with its kind.
+func ValidateTerms(terms *CouponTerms) error {
+	if terms.MinSpend < 0 {
+		return fmt.Errorf("min_spend should not be negative")
+	}
+	return savedCouponKind(terms.Kind).Validate(terms)
+}
+
+// NotApplicableError tells why a coupon can't be applied.
+type NotApplicableError struct {
+	Reason string
+}
+
+func (e *NotApplicableError) Error() string {
+	return "The coupon is not applicable: " + e.Reason + "."
+}
+
+// EvaluateCoupon returns what the coupon of terms takes off order, at
+// most the order total.
+func EvaluateCoupon(terms *CouponTerms, order *Order) (Amount, error) {
+	if order.Currency != terms.Currency {
+		return 0, &NotApplicableError{fmt.Sprintf("the coupon is in %s", terms.Currency)}
+	}
+	discount, err := savedCouponKind(terms.Kind).Discount(terms, order)
+	if err != nil {
+		return 0, err
+	}
+	if discount > order.Total {
+		discount = order.Total
+	}
+	return discount, nil
+}
+
+// checkRechargeable rejects the coupons which are not redeemed by a recharge.
+func checkRechargeable(kind string) error {
+	if !savedCouponKind(kind).Rechargeable() {
+		return &NotApplicableError{fmt.Sprintf("a %s coupon can't be used for a recharge", kind)}
+	}
+	return nil
+}
+
+// unusedTerms rejects the terms which are set but mean nothing to a kind.
+func unusedTerms(terms *CouponTerms, amount, percentOff, minSpend, planId bool) error {
+	switch {
+	case amount && terms.Amount != 0:
+		return fmt.Errorf("a %s coupon has no amount", terms.Kind)
+	case percentOff && terms.PercentOff != 0:
+		return fmt.Errorf("a %s coupon has no percent_off", terms.Kind)
+	case minSpend && terms.MinSpend != 0:
+		return fmt.Errorf("a %s coupon has no min_spend", terms.Kind)
+	case planId && terms.PlanId != "":
+		return fmt.Errorf("a %s coupon has no plan_id", terms.Kind)
+	}
+	return nil
+}
+
+func checkMinSpend(terms *CouponTerms, order *Order) error {
+	if order.Total < terms.MinSpend {
+		return &NotApplicableError{fmt.Sprintf("the order should be at least %s", terms.MinSpend)}
+	}
+	return nil
+}
+
+type rechargeKind struct{}
+
+func (rechargeKind) Validate(terms *CouponTerms) error {
+	if terms.Amount <= 0 {
+		return fmt.Errorf("amount should be positive")
+	}
+	return unusedTerms(terms, false, true, true, true)
+}
+
+func (rechargeKind) Discount(terms *CouponTerms, order *Order) (Amount, error) {
+	return 0, &NotApplicableError{"a recharge coupon is not a discount"}
+}
+
+func (rechargeKind) Rechargeable() bool { return true }
+
+type offlineKind struct {
+	rechargeKind
+}
+
+func (offlineKind) Validate(terms *CouponTerms) error {
+	return fmt.Errorf("offline coupons are minted, not created")
+}
+
+type percentageKind struct{}
+
+func (percentageKind) Validate(terms *CouponTerms) error {
+	if terms.PercentOff <= 0 || terms.PercentOff > 100 {
+		return fmt.Errorf("percent_off should be in [1, 100]")
+	}
+	if terms.Amount <= 0 {
+		return fmt.Errorf("amount, the cap of the discount, should be positive")
+	}
+	return unusedTerms(terms, false, false, false, true)
+}
+
+// Discount rounds down to fen.
+func (percentageKind) Discount(terms *CouponTerms, order *Order) (Amount, error) {
+	if err := checkMinSpend(terms, order); err != nil {
+		return 0, err
+	}
+	discount := order.Total * Amount(terms.PercentOff) / 100
+	if discount > terms.Amount {
+		discount = terms.Amount
+	}
+	return discount, nil
+}
+
+func (percentageKind) Rechargeable() bool { return false }
+
+type fixedOffKind struct{}
+
+func (fixedOffKind) Validate(terms *CouponTerms) error {
+	if terms.Amount <= 0 {
+		return fmt.Errorf("amount should be positive")
+	}
+	return unusedTerms(terms, false, true, false, true)
+}
+
+func (fixedOffKind) Discount(terms *CouponTerms, order *Order) (Amount, error) {
+	if err := checkMinSpend(terms, order); err != nil {
+		return 0, err
+	}
+	return terms.Amount, nil
+}
+
+func (fixedOffKind) Rechargeable() bool { return false }
+
+type freeTrialKind struct{}
+
+func (freeTrialKind) Validate(terms *CouponTerms) error {
+	if terms.PlanId == "" {
+		return fmt.Errorf("plan_id should be set")
+	}
+	return unusedTerms(terms, true, true, true, false)
+}
+
+func (freeTrialKind) Discount(terms *CouponTerms, order *Order) (Amount, error) {
+	if order.PlanId != terms.PlanId {
+		return 0, &NotApplicableError{"the coupon is for plan " + terms.PlanId}
+	}
+	return order.Total, nil
+}
+
+func (freeTrialKind) Rechargeable() bool { return false }
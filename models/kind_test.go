@@ -0,0 +1,85 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestValidateTerms(t *testing.T) {
+	valid := []CouponTerms{
+		{Kind: CouponKind_Recharge, Amount: 1000},
+		{Kind: CouponKind_Percentage, Amount: 5000, PercentOff: 20},
+		{Kind: CouponKind_Percentage, Amount: 5000, PercentOff: 100, MinSpend: 10000},
+		{Kind: CouponKind_FixedOff, Amount: 1000, MinSpend: 10000},
+		{Kind: CouponKind_FreeTrial, PlanId: "plan-1"},
+	}
+	for _, terms := range valid {
+		if err := ValidateTerms(&terms); err != nil {
+			t.Errorf("ValidateTerms(%+v) = %v", terms, err)
+		}
+	}
+
+	invalid := []CouponTerms{
+		{Kind: CouponKind_Recharge},
+		{Kind: CouponKind_Recharge, Amount: 1000, PercentOff: 10},
+		{Kind: CouponKind_Offline, Amount: 1000},
+		{Kind: CouponKind_Percentage, Amount: 5000},
+		{Kind: CouponKind_Percentage, Amount: 5000, PercentOff: 101},
+		{Kind: CouponKind_Percentage, PercentOff: 20},
+		{Kind: CouponKind_FixedOff, Amount: 1000, MinSpend: -1},
+		{Kind: CouponKind_FixedOff, Amount: 1000, PlanId: "plan-1"},
+		{Kind: CouponKind_FreeTrial},
+		{Kind: CouponKind_FreeTrial, PlanId: "plan-1", Amount: 1000},
+	}
+	for _, terms := range invalid {
+		if err := ValidateTerms(&terms); err == nil {
+			t.Errorf("ValidateTerms(%+v) is accepted", terms)
+		}
+	}
+
+	if kind, err := ValidateKind(""); err != nil || kind != CouponKind_Recharge {
+		t.Errorf("ValidateKind(\"\") = %s, %v", kind, err)
+	}
+	if _, err := ValidateKind("gift"); err == nil {
+		t.Errorf("ValidateKind(gift) is accepted")
+	}
+}
+
+func TestEvaluateCoupon(t *testing.T) {
+	percentage := &CouponTerms{Kind: CouponKind_Percentage, Amount: 5000, Currency: Currency_CNY, PercentOff: 15}
+	fixedOff := &CouponTerms{Kind: CouponKind_FixedOff, Amount: 2000, Currency: Currency_CNY, MinSpend: 10000}
+	freeTrial := &CouponTerms{Kind: CouponKind_FreeTrial, Currency: Currency_CNY, PlanId: "plan-1"}
+	cases := []struct {
+		terms *CouponTerms
+		order Order
+		want  Amount
+	}{
+		{percentage, Order{Total: 10000, Currency: Currency_CNY}, 1500},
+		{percentage, Order{Total: 999, Currency: Currency_CNY}, 149}, // rounded down
+		{percentage, Order{Total: 100000, Currency: Currency_CNY}, 5000},
+		{fixedOff, Order{Total: 10000, Currency: Currency_CNY}, 2000},
+		{freeTrial, Order{Total: 3000, Currency: Currency_CNY, PlanId: "plan-1"}, 3000},
+		{&CouponTerms{Kind: CouponKind_FixedOff, Amount: 2000, Currency: Currency_CNY}, Order{Total: 1500, Currency: Currency_CNY}, 1500},
+	}
+	for _, c := range cases {
+		if got, err := EvaluateCoupon(c.terms, &c.order); err != nil || got != c.want {
+			t.Errorf("EvaluateCoupon(%+v, %+v) = %d, %v, want %d", c.terms, c.order, got, err, c.want)
+		}
+	}
+
+	notApplicable := []struct {
+		terms *CouponTerms
+		order Order
+	}{
+		{fixedOff, Order{Total: 9999, Currency: Currency_CNY}},
+		{freeTrial, Order{Total: 3000, Currency: Currency_CNY, PlanId: "plan-2"}},
+		{percentage, Order{Total: 10000, Currency: "USD"}},
+		{&CouponTerms{Kind: CouponKind_Recharge, Amount: 1000, Currency: Currency_CNY}, Order{Total: 10000, Currency: Currency_CNY}},
+	}
+	for _, c := range notApplicable {
+		if _, err := EvaluateCoupon(c.terms, &c.order); err == nil {
+			t.Errorf("EvaluateCoupon(%+v, %+v) is applicable", c.terms, c.order)
+		} else if _, ok := err.(*NotApplicableError); !ok {
+			t.Errorf("EvaluateCoupon(%+v, %+v) = %v", c.terms, c.order, err)
+		}
+	}
+}
@@ -0,0 +1,1094 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=============================================================
+// an in-memory CouponStore, it is goroutine-safe and mirrors
+// the mysql behaviours, mainly for ut and local running.
+//=============================================================
+
+type memoryCoupon struct {
+	Coupon // without Code, as the mysql store
+
+	CodeHash   string
+	CodePrefix string
+
+	Status      CouponStatus
+	CreateAt    time.Time
+	UseTime     time.Time
+	Username    string
+	Namespace   string
+	Redemptions int
+	Holds       int
+}
+
+func newMemoryCoupon(coupon Coupon, createAt time.Time) *memoryCoupon {
+	c := &memoryCoupon{Coupon: coupon, Status: CouponStatus_Available, CreateAt: createAt}
+	c.setCode(coupon.Code)
+	return c
+}
+
+func (c *memoryCoupon) setCode(code string) {
+	c.Code = ""
+	c.CodeHash, c.CodePrefix = hashCode(code), codePrefix(code)
+}
+
+func (c *memoryCoupon) retrieveResult() *RetrieveResult {
+	return &RetrieveResult{
+		Serial:     c.Serial,
+		CodePrefix: c.CodePrefix,
+		Kind:       c.Kind,
+		ExpireOn:   c.ExpireOn,
+		Amount:     c.Amount,
+		Currency:   c.Currency,
+		Status:     c.Status,
+
+		PercentOff: c.PercentOff,
+		MinSpend:   c.MinSpend,
+		PlanId:     c.PlanId,
+
+		MaxRedemptions: c.MaxRedemptions,
+		PerUserLimit:   c.PerUserLimit,
+		Redemptions:    c.Redemptions,
+
+		BoundUsername:  c.BoundUsername,
+		BoundNamespace: c.BoundNamespace,
+		Holds:          c.Holds,
+
+		CampaignId: c.CampaignId,
+	}
+}
+
+func (c *memoryCoupon) record() *CouponRecord {
+	record := &CouponRecord{
+		RetrieveResult: *c.retrieveResult(),
+		id:             int64(c.Id),
+		CreateAt:       c.CreateAt,
+		Username:       c.Username,
+		Namespace:      c.Namespace,
+	}
+	if !c.UseTime.IsZero() {
+		useTime := c.UseTime
+		record.UseTime = &useTime
+	}
+	return record
+}
+
+type memoryStore struct {
+	mu sync.Mutex
+
+	lastId   int
+	coupons  []*memoryCoupon // in creation order
+	provided map[string]time.Time
+
+	lastOutboxId int64
+	outbox       []*RechargeOutbox
+
+	lastRedemptionId int64
+	redemptions      []*Redemption
+
+	holds []*memoryHold
+
+	lastReversalId int64
+	reversals      []*Reversal
+
+	history []*StatusTransition
+
+	campaigns []*Campaign
+}
+
+func NewMemoryStore() CouponStore {
+	return &memoryStore{provided: make(map[string]time.Time)}
+}
+
+func (s *memoryStore) Available() bool {
+	return true
+}
+
+func (s *memoryStore) CreateCoupon(couponInfo *Coupon, operator string) (*CreateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	couponInfo.Serial = strings.ToLower(couponInfo.Serial)
+	couponInfo.Code = strings.ToLower(couponInfo.Code)
+
+	couponInfo.ExpireOn = expireInstant(couponInfo.ExpireOn)
+	if couponInfo.Currency == "" {
+		couponInfo.Currency = DefaultCurrency
+	}
+	couponInfo.MaxRedemptions = maxRedemptionsOrOne(couponInfo.MaxRedemptions)
+	if s.taken(couponInfo.Serial, couponInfo.Code) {
+		return nil, ErrCouponCodeConflict
+	}
+
+	s.lastId++
+	coupon := newMemoryCoupon(*couponInfo, time.Now())
+	coupon.Id = s.lastId
+	s.coupons = append(s.coupons, coupon)
+	s.history = append(s.history, &StatusTransition{
+		Serial: coupon.Serial, To: CouponStatus_Available, Operator: operator, CreateAt: coupon.CreateAt,
+	})
+
+	return &CreateResult{
+		Serial:   strings.ToUpper(couponInfo.Serial),
+		Code:     strings.ToUpper(couponInfo.Code),
+		Kind:     couponInfo.Kind,
+		ExpireOn: couponInfo.ExpireOn.Format(time.RFC3339),
+		Amount:   couponInfo.Amount,
+		Currency: couponInfo.Currency,
+	}, nil
+}
+
+// taken is the memory version of the unique keys on SERIAL and CODE_HASH,
+// s.mu must be held.
+func (s *memoryStore) taken(serial, code string) bool {
+	codeHash := hashCode(code)
+	return s.find(func(c *memoryCoupon) bool { return c.Serial == serial || c.CodeHash == codeHash }) != nil
+}
+
+// transit is the memory version of transitLockedCoupon, s.mu must be held.
+func (s *memoryStore) transit(c *memoryCoupon, to CouponStatus, operator string) error {
+	if err := checkTransition(c.Status, to); err != nil {
+		return err
+	}
+	s.history = append(s.history, &StatusTransition{
+		Serial: c.Serial, From: c.Status, To: to, Operator: operator, CreateAt: time.Now(),
+	})
+	c.Status = to
+	return nil
+}
+
+func (s *memoryStore) find(match func(c *memoryCoupon) bool) *memoryCoupon {
+	for _, c := range s.coupons {
+		if match(c) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) LookupCoupon(code string) (*RetrieveResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codeHash := hashCode(code)
+	c := s.find(func(c *memoryCoupon) bool { return c.CodeHash == codeHash })
+	if c == nil {
+		return nil, nil
+	}
+	if err := s.checkCampaignOpen(c, time.Now()); err != nil {
+		return nil, err
+	}
+	return c.retrieveResult(), nil
+}
+
+func (s *memoryStore) RetrieveCouponByID(code, operator string) (*RetrieveResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.retrieve(code, operator)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	return c.retrieveResult(), nil
+}
+
+func (s *memoryStore) ClaimCoupon(code, operator string) (*RetrieveResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.retrieve(code, operator)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	if c.Status == CouponStatus_Available {
+		s.transit(c, CouponStatus_Queried, operator)
+	}
+	return c.retrieveResult(), nil
+}
+
+// retrieve is RetrieveCouponByID returning the coupon, s.mu must be held.
+func (s *memoryStore) retrieve(code, operator string) (*memoryCoupon, error) {
+	codeHash := hashCode(code)
+	c := s.find(func(c *memoryCoupon) bool { return c.CodeHash == codeHash })
+	if c == nil {
+		return nil, nil
+	}
+	if err := s.checkCampaignOpen(c, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := checkBinding(c.BoundUsername, c.BoundNamespace, operator, ""); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *memoryStore) RetrieveCouponBySerial(serial string) (*CouponRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	serial = strings.ToLower(serial)
+	c := s.find(func(c *memoryCoupon) bool { return c.Serial == serial })
+	if c == nil {
+		return nil, nil
+	}
+	return c.record(), nil
+}
+
+func (s *memoryStore) QueryCoupons(filter *CouponFilter, orderBy string, sortOrder bool, offset int64, limit int) (int64, []*CouponRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matched := make([]*memoryCoupon, 0, len(s.coupons))
+	for _, c := range s.coupons {
+		if filter.match(c) {
+			matched = append(matched, c)
+		}
+	}
+
+	if orderBy == "" {
+		orderBy, sortOrder = defaultOrderBy, false
+	}
+	sort.Stable(&couponsByColumn{coupons: matched, column: orderBy, asc: sortOrder})
+
+	count := int64(len(matched))
+	if count == 0 {
+		return 0, []*CouponRecord{}, nil
+	}
+	validateOffsetAndLimit(count, &offset, &limit)
+
+	results := make([]*CouponRecord, 0, limit)
+	for _, c := range matched[offset : offset+int64(limit)] {
+		results = append(results, c.record())
+	}
+	return count, results, nil
+}
+
+func (s *memoryStore) PageCoupons(filter *CouponFilter, orderBy string, sortOrder bool, cursor string, limit int, withTotal bool) (*CouponPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matched := make([]*memoryCoupon, 0, len(s.coupons))
+	for _, c := range s.coupons {
+		if filter.match(c) {
+			matched = append(matched, c)
+		}
+	}
+
+	page, err := pageMemoryCoupons(matched, orderBy, sortOrder, cursor, limit)
+	if err != nil || !withTotal {
+		return page, err
+	}
+	total := int64(len(matched))
+	page.Total = &total
+	return page, nil
+}
+
+func (s *memoryStore) UseCoupon(useInfo *UseInfo) (*UseResult, *RechargeOutbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	useInfo.Serial = strings.ToLower(useInfo.Serial)
+	codeHash := hashCode(useInfo.Code)
+
+	c := s.find(func(c *memoryCoupon) bool {
+		return (useInfo.Serial == "" || c.Serial == useInfo.Serial) && c.CodeHash == codeHash
+	})
+	if c == nil {
+		return nil, nil, ErrCouponNotFound
+	}
+	return s.useCoupon(c, useInfo, nil)
+}
+
+// useCoupon is the memory version of useCoupon, s.mu must be held.
+func (s *memoryStore) useCoupon(c *memoryCoupon, useInfo *UseInfo, hold *memoryHold) (*UseResult, *RechargeOutbox, error) {
+	if err := checkTransition(c.Status, CouponStatus_Used); err != nil {
+		return nil, nil, err
+	}
+	rechargeable := checkRechargeable(c.Kind)
+	if hold == nil && rechargeable != nil {
+		return nil, nil, rechargeable
+	}
+	if err := checkBinding(c.BoundUsername, c.BoundNamespace, useInfo.Username, useInfo.Namespace); err != nil {
+		return nil, nil, err
+	}
+
+	useInfo.Use_time = useInfo.Use_time.UTC()
+	if couponExpired(c.ExpireOn, useInfo.Use_time) {
+		s.transit(c, CouponStatus_Expired, Operator_System)
+		return nil, nil, &TransitionError{From: CouponStatus_Expired, To: CouponStatus_Used}
+	}
+
+	s.releaseOverdueHolds(c, useInfo.Use_time)
+	if hold != nil {
+		if err := checkHoldActive(hold.Status); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if c.Redemptions+c.Holds >= c.MaxRedemptions {
+			return nil, nil, ErrCouponHeld
+		}
+		if c.PerUserLimit > 0 && s.countRedemptions(c.Serial, useInfo.Username) >= c.PerUserLimit {
+			return nil, nil, ErrCouponUserLimitReached
+		}
+	}
+
+	if c.CampaignId != 0 {
+		campaign := s.campaign(c.CampaignId)
+		if campaign == nil {
+			return nil, nil, ErrCampaignNotFound
+		}
+		if err := campaign.checkSpend(c.Amount, useInfo.Use_time); err != nil {
+			return nil, nil, err
+		}
+		campaign.Spent += c.Amount
+	}
+
+	if hold != nil {
+		hold.Status = HoldStatus_Confirmed
+		c.Holds--
+	}
+	if c.Redemptions++; c.Redemptions >= c.MaxRedemptions {
+		s.transit(c, CouponStatus_Used, useInfo.Username)
+	}
+	c.UseTime = useInfo.Use_time
+	c.Username = useInfo.Username
+	c.Namespace = useInfo.Namespace
+
+	s.lastRedemptionId++
+	s.redemptions = append(s.redemptions, &Redemption{
+		Id: s.lastRedemptionId, Serial: c.Serial, Username: useInfo.Username, Namespace: useInfo.Namespace,
+		Amount: c.Amount, UseTime: useInfo.Use_time,
+	})
+
+	result := &UseResult{Amount: c.Amount, Currency: c.Currency, Namespace: useInfo.Namespace}
+	if rechargeable != nil {
+		return result, nil, nil
+	}
+
+	s.lastOutboxId++
+	entry := &RechargeOutbox{
+		Id:           s.lastOutboxId,
+		Serial:       c.Serial,
+		RedemptionId: s.lastRedemptionId,
+		Region:       useInfo.Region,
+		Username:     useInfo.Username,
+		Namespace:    useInfo.Namespace,
+		Amount:       c.Amount,
+		Status:       OutboxStatus_Pending,
+		NextTryAt:    time.Now().Add(RechargeGracePeriod),
+	}
+	s.outbox = append(s.outbox, entry)
+	result.RechargeStatus = entry.Status
+
+	copied := *entry
+	return result, &copied, nil
+}
+
+func (s *memoryStore) ProvideCoupon(numberStr, amountStr, operator string, newCode func() string) (int64, []string, error) {
+	number, err := validateProvideNumber(numberStr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	matchAmount := func(c *memoryCoupon) bool { return true }
+	if amountStr != "" {
+		amount, err := ValidateAmount(amountStr)
+		if err != nil {
+			return 0, nil, err
+		}
+		matchAmount = func(c *memoryCoupon) bool { return c.Amount == amount }
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var picked []*memoryCoupon
+	for _, c := range s.coupons {
+		if len(picked) >= number {
+			break
+		}
+		if c.inProvidePool() && matchAmount(c) {
+			picked = append(picked, c)
+		}
+	}
+
+	// the new codes are checked first, a collision changes nothing.
+	codes := make([]string, len(picked))
+	for i := range picked {
+		codes[i] = strings.ToLower(newCode())
+		if s.taken("", codes[i]) || containsString(codes[:i], codes[i]) {
+			return 0, nil, ErrCouponCodeConflict
+		}
+	}
+	for i, c := range picked {
+		s.transit(c, CouponStatus_Provided, operator)
+		c.setCode(codes[i])
+	}
+
+	return int64(len(codes)), codes, nil
+}
+
+func containsString(codes []string, code string) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) DeleteCoupon(serial, operator string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	serial = strings.ToLower(serial)
+	c := s.find(func(c *memoryCoupon) bool { return c.Serial == serial })
+	if c == nil {
+		return ErrCouponNotFound
+	}
+	return s.transit(c, CouponStatus_Unavailable, operator)
+}
+
+func (s *memoryStore) CouponStatusHistory(serial string) ([]*StatusTransition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	serial = strings.ToLower(serial)
+	history := make([]*StatusTransition, 0, 8)
+	for _, t := range s.history {
+		if t.Serial == serial {
+			copied := *t
+			history = append(history, &copied)
+		}
+	}
+	return history, nil
+}
+
+// campaign returns the campaign of id, s.mu must be held.
+func (s *memoryStore) campaign(id int64) *Campaign {
+	if id < 1 || id > int64(len(s.campaigns)) {
+		return nil
+	}
+	return s.campaigns[id-1]
+}
+
+// checkCampaignOpen is checkOpen for the campaign of c, s.mu must be held.
+func (s *memoryStore) checkCampaignOpen(c *memoryCoupon, now time.Time) error {
+	if c.CampaignId == 0 {
+		return nil
+	}
+	campaign := s.campaign(c.CampaignId)
+	if campaign == nil {
+		return ErrCampaignNotFound
+	}
+	return campaign.checkOpen(now)
+}
+
+func (s *memoryStore) CreateCampaign(campaign *Campaign, operator string) (*Campaign, error) {
+	if err := prepareCampaign(campaign, operator); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insertCampaign(campaign)
+	return campaign, nil
+}
+
+// insertCampaign saves a copy of campaign, s.mu must be held.
+func (s *memoryStore) insertCampaign(campaign *Campaign) {
+	campaign.Id = int64(len(s.campaigns) + 1)
+	copied := *campaign
+	s.campaigns = append(s.campaigns, &copied)
+}
+
+func (s *memoryStore) RetrieveCampaign(id int64) (*Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign := s.campaign(id)
+	if campaign == nil {
+		return nil, nil
+	}
+	copied := *campaign
+	return &copied, nil
+}
+
+func (s *memoryStore) QueryCampaigns(status string, offset int64, limit int) (int64, []*Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// newest first, as the mysql store
+	matched := make([]*Campaign, 0, len(s.campaigns))
+	for i := len(s.campaigns) - 1; i >= 0; i-- {
+		if status == "" || string(s.campaigns[i].Status) == status {
+			copied := *s.campaigns[i]
+			matched = append(matched, &copied)
+		}
+	}
+
+	count := int64(len(matched))
+	if count == 0 {
+		return 0, []*Campaign{}, nil
+	}
+	validateOffsetAndLimit(count, &offset, &limit)
+	return count, matched[offset : offset+int64(limit)], nil
+}
+
+func (s *memoryStore) UpdateCampaign(id int64, update *CampaignUpdate) (*Campaign, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	campaign := s.campaign(id)
+	if campaign == nil {
+		return nil, ErrCampaignNotFound
+	}
+	updated := *campaign
+	if err := updated.apply(update); err != nil {
+		return nil, err
+	}
+	*campaign = updated
+	return &updated, nil
+}
+
+func (s *memoryStore) CreateCouponBatch(campaign *Campaign, template *Coupon, codes []*CampaignCoupon, operator string) (*Campaign, error) {
+	if campaign.Id == 0 {
+		if err := prepareCampaign(campaign, operator); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	coupons := newCampaignCoupons(campaign.Id, template, codes)
+	serials, couponCodes := map[string]bool{}, map[string]bool{}
+	for _, c := range coupons {
+		if s.taken(c.Serial, c.Code) || serials[c.Serial] || couponCodes[c.Code] {
+			return nil, ErrCouponCodeConflict
+		}
+		serials[c.Serial], couponCodes[c.Code] = true, true
+	}
+
+	var saved *Campaign
+	if campaign.Id == 0 {
+		if err := validateBatch(campaign, template, codes); err != nil {
+			return nil, err
+		}
+		s.insertCampaign(campaign)
+		saved = s.campaign(campaign.Id)
+	} else {
+		saved = s.campaign(campaign.Id)
+		if saved == nil {
+			return nil, ErrCampaignNotFound
+		}
+		if err := validateBatch(saved, template, codes); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for _, c := range coupons {
+		c.CampaignId = saved.Id
+		s.lastId++
+		c.Id = s.lastId
+		s.coupons = append(s.coupons, newMemoryCoupon(*c, now))
+		s.history = append(s.history, &StatusTransition{
+			Serial: c.Serial, To: CouponStatus_Available, Operator: operator, CreateAt: now,
+		})
+	}
+	saved.Number += len(codes)
+
+	copied := *saved
+	return &copied, nil
+}
+
+func (s *memoryStore) ScanCampaignCoupons(campaignId int64, f func(c *CampaignCoupon) error) error {
+	s.mu.Lock()
+	var codes []*CampaignCoupon
+	for _, c := range s.coupons {
+		if c.CampaignId == campaignId {
+			codes = append(codes, &CampaignCoupon{Serial: c.Serial, CodePrefix: c.CodePrefix})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range codes {
+		if err := f(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ExpireCoupons(now time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := 0
+	for _, c := range s.coupons {
+		if expired >= limit {
+			break
+		}
+		if couponExpired(c.ExpireOn, now) && CanTransit(c.Status, CouponStatus_Expired) {
+			s.transit(c, CouponStatus_Expired, Operator_System)
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (s *memoryStore) JudgeIsProvide(info *FromUser, timeStr string) (error, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.provided[info.OpenId]; ok {
+		return nil, false
+	}
+	s.provided[info.OpenId] = time.Unix(info.Provide_time, 0)
+	return nil, true
+}
+
+func (s *memoryStore) findOutbox(id int64) *RechargeOutbox {
+	for _, entry := range s.outbox {
+		if entry.Id == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ClaimPendingRecharges(limit int, lease time.Duration) ([]*RechargeOutbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	claimed := make([]*RechargeOutbox, 0, limit)
+	for _, entry := range s.outbox {
+		if len(claimed) >= limit {
+			break
+		}
+		if entry.Status == OutboxStatus_Pending && !entry.NextTryAt.After(now) {
+			entry.NextTryAt = now.Add(lease)
+			copied := *entry
+			claimed = append(claimed, &copied)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) MarkRechargeDelivered(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry := s.findOutbox(id); entry != nil && entry.Status == OutboxStatus_Pending {
+		entry.Status = OutboxStatus_Delivered
+		entry.Attempts++
+		entry.LastError = ""
+	}
+	return nil
+}
+
+func (s *memoryStore) MarkRechargeRetry(id int64, nextTryAt time.Time, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry := s.findOutbox(id); entry != nil && entry.Status == OutboxStatus_Pending {
+		entry.Attempts++
+		entry.NextTryAt = nextTryAt
+		entry.LastError = truncateError(lastError)
+	}
+	return nil
+}
+
+func (s *memoryStore) CompensateRecharge(id int64, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.findOutbox(id)
+	if entry == nil || entry.Status != OutboxStatus_Pending {
+		return nil
+	}
+	entry.Status = OutboxStatus_Failed
+	entry.Attempts++
+	entry.LastError = truncateError(lastError)
+
+	c := s.find(func(c *memoryCoupon) bool { return c.Serial == entry.Serial })
+	if c == nil {
+		return nil
+	}
+	for i, r := range s.redemptions {
+		if r.Id == entry.RedemptionId {
+			s.redemptions = append(s.redemptions[:i], s.redemptions[i+1:]...)
+			break
+		}
+	}
+	if c.Redemptions > 0 {
+		c.Redemptions--
+	}
+	if c.Status == CouponStatus_Used {
+		s.transit(c, CouponStatus_Available, Operator_System)
+		c.UseTime = time.Time{}
+		c.Username = ""
+		c.Namespace = ""
+	}
+	if campaign := s.campaign(c.CampaignId); campaign != nil {
+		campaign.Spent -= entry.Amount
+	}
+	return nil
+}
+
+// countRedemptions is the memory version of checkUserLimit, it counts the redemptions and the active holds of the
+// user, s.mu must be held.
+func (s *memoryStore) countRedemptions(serial, username string) int {
+	n := 0
+	for _, r := range s.redemptions {
+		if r.Serial == serial && r.Username == username {
+			n++
+		}
+	}
+	for _, h := range s.holds {
+		if h.Serial == serial && h.Username == username && h.Status == HoldStatus_Active {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memoryStore) CouponRedemptions(serial string) ([]*Redemption, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	serial = strings.ToLower(serial)
+	redemptions := make([]*Redemption, 0, 8)
+	for _, r := range s.redemptions {
+		if r.Serial == serial {
+			copied := *r
+			redemptions = append(redemptions, &copied)
+		}
+	}
+	return redemptions, nil
+}
+
+func (s *memoryStore) PrepareReversal(info *ReversalInfo) (*Redemption, *RechargeOutbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info.Serial = strings.ToLower(info.Serial)
+	var found *Redemption
+	for _, r := range s.redemptions {
+		if r.Serial == info.Serial && (info.RedemptionId == 0 || r.Id == info.RedemptionId) {
+			found = r
+		}
+	}
+	if found == nil {
+		return nil, nil, ErrRedemptionNotFound
+	}
+	info.RedemptionId = found.Id
+
+	var entry *RechargeOutbox
+	for _, e := range s.outbox {
+		if e.Serial == found.Serial && e.RedemptionId == found.Id {
+			copied := *e
+			entry = &copied
+		}
+	}
+	if entry != nil {
+		var err error
+		if entry, err = checkReversibleRecharge(entry); err != nil {
+			return nil, nil, err
+		}
+	}
+	copied := *found
+	return &copied, entry, nil
+}
+
+func (s *memoryStore) ReverseRedemption(info *ReversalInfo, refunded bool) (*Reversal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info.Serial = strings.ToLower(info.Serial)
+	c := s.find(func(c *memoryCoupon) bool { return c.Serial == info.Serial })
+	if c == nil {
+		return nil, ErrCouponNotFound
+	}
+	var r *Redemption
+	for i, redemption := range s.redemptions {
+		if redemption.Id == info.RedemptionId && redemption.Serial == c.Serial {
+			r = redemption
+			s.redemptions = append(s.redemptions[:i], s.redemptions[i+1:]...)
+			break
+		}
+	}
+	if r == nil {
+		return nil, ErrRedemptionNotFound
+	}
+
+	if c.Redemptions > 0 {
+		c.Redemptions--
+	}
+	switch {
+	case info.Policy == ReversalPolicy_Restore && c.Status == CouponStatus_Used:
+		s.transit(c, CouponStatus_Available, info.Operator)
+		c.UseTime = time.Time{}
+		c.Username = ""
+		c.Namespace = ""
+	case info.Policy == ReversalPolicy_Revoke && CanTransit(c.Status, CouponStatus_Revoked):
+		s.transit(c, CouponStatus_Revoked, info.Operator)
+	}
+	if campaign := s.campaign(c.CampaignId); campaign != nil {
+		campaign.Spent -= r.Amount
+	}
+
+	s.lastReversalId++
+	reversal := &Reversal{
+		Id:           s.lastReversalId,
+		Serial:       c.Serial,
+		RedemptionId: r.Id,
+		Username:     r.Username,
+		Namespace:    r.Namespace,
+		Amount:       r.Amount,
+		UseTime:      r.UseTime,
+		Policy:       info.Policy,
+		Refunded:     refunded,
+		Reason:       info.Reason,
+		Operator:     info.Operator,
+		CreateAt:     time.Now(),
+	}
+	s.reversals = append(s.reversals, reversal)
+
+	copied := *reversal
+	return &copied, nil
+}
+
+func (s *memoryStore) CouponReversals(serial string) ([]*Reversal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	serial = strings.ToLower(serial)
+	reversals := make([]*Reversal, 0, 4)
+	for _, r := range s.reversals {
+		if r.Serial == serial {
+			copied := *r
+			reversals = append(reversals, &copied)
+		}
+	}
+	return reversals, nil
+}
+
+//=============================================================
+// holds
+//=============================================================
+
+type memoryHold struct {
+	CouponHold // without Token and Coupon
+
+	TokenHash string
+}
+
+// findHold returns the hold of token, a hold of another user is not
+// found. s.mu must be held.
+func (s *memoryStore) findHold(token, username string) *memoryHold {
+	tokenHash := hashCode(token)
+	for _, h := range s.holds {
+		if h.TokenHash == tokenHash && strings.EqualFold(h.Username, username) {
+			return h
+		}
+	}
+	return nil
+}
+
+// releaseOverdueHolds is the memory version of releaseOverdueHolds, it
+// returns how many holds are expired. s.mu must be held.
+func (s *memoryStore) releaseOverdueHolds(c *memoryCoupon, now time.Time) int {
+	n := 0
+	for _, h := range s.holds {
+		if h.Serial == c.Serial && h.overdue(now) {
+			h.Status = HoldStatus_Expired
+			n++
+		}
+	}
+	if c.Holds -= n; c.Holds < 0 {
+		c.Holds = 0
+	}
+	return n
+}
+
+func (s *memoryStore) HoldCoupon(info *HoldInfo) (*CouponHold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codeHash := hashCode(info.Code)
+	c := s.find(func(c *memoryCoupon) bool { return c.CodeHash == codeHash })
+	if c == nil {
+		return nil, ErrCouponNotFound
+	}
+
+	info.HoldTime = info.HoldTime.UTC()
+	if err := s.checkHoldable(c, info); err != nil {
+		return nil, err
+	}
+	s.releaseOverdueHolds(c, info.HoldTime)
+
+	tokenHash := hashCode(info.Token)
+	for _, h := range s.holds {
+		if h.TokenHash == tokenHash {
+			return nil, ErrHoldConflicted
+		}
+	}
+
+	hold := &memoryHold{
+		CouponHold: CouponHold{
+			Serial:    c.Serial,
+			Username:  info.Username,
+			Namespace: info.Namespace,
+			Region:    info.Region,
+			Status:    HoldStatus_Active,
+			ExpireAt:  expireInstant(info.ExpireAt),
+			CreateAt:  info.HoldTime,
+		},
+		TokenHash: tokenHash,
+	}
+	s.holds = append(s.holds, hold)
+	c.Holds++
+
+	result := hold.CouponHold
+	result.Token = info.Token
+	result.Coupon = c.retrieveResult()
+	return &result, nil
+}
+
+// checkHoldable is the memory version of checkHoldable, the overdue holds
+// are not counted, instead of released. s.mu must be held.
+func (s *memoryStore) checkHoldable(c *memoryCoupon, info *HoldInfo) error {
+	if err := checkTransition(c.Status, CouponStatus_Used); err != nil {
+		return err
+	}
+	if err := checkBinding(c.BoundUsername, c.BoundNamespace, info.Username, info.Namespace); err != nil {
+		return err
+	}
+	if couponExpired(c.ExpireOn, info.HoldTime) {
+		return &TransitionError{From: CouponStatus_Expired, To: CouponStatus_Used}
+	}
+	if err := s.checkCampaignOpen(c, info.HoldTime); err != nil {
+		return err
+	}
+
+	holds := c.Holds
+	for _, h := range s.holds {
+		if h.Serial == c.Serial && h.overdue(info.HoldTime) {
+			holds--
+		}
+	}
+	if c.Redemptions+holds >= c.MaxRedemptions {
+		return ErrCouponHeld
+	}
+	if c.PerUserLimit > 0 && s.countRedemptions(c.Serial, info.Username) >= c.PerUserLimit {
+		return ErrCouponUserLimitReached
+	}
+	return nil
+}
+
+func (s *memoryStore) CheckCouponUsable(info *HoldInfo) (*RetrieveResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	codeHash := hashCode(info.Code)
+	c := s.find(func(c *memoryCoupon) bool { return c.CodeHash == codeHash })
+	if c == nil {
+		return nil, ErrCouponNotFound
+	}
+
+	info.HoldTime = info.HoldTime.UTC()
+	if err := s.checkHoldable(c, info); err != nil {
+		return nil, err
+	}
+	return c.retrieveResult(), nil
+}
+
+func (s *memoryStore) RetrieveHold(token, username string) (*CouponHold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.findHold(token, username)
+	if h == nil {
+		return nil, ErrHoldNotFound
+	}
+	result := h.CouponHold
+	if result.overdue(time.Now()) {
+		result.Status = HoldStatus_Expired
+	}
+	return &result, nil
+}
+
+func (s *memoryStore) ConfirmHold(token, username, region string, now time.Time) (*UseResult, *RechargeOutbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.findHold(token, username)
+	if h == nil {
+		return nil, nil, ErrHoldNotFound
+	}
+	if err := checkHoldActive(h.Status); err != nil {
+		return nil, nil, err
+	}
+	c := s.find(func(c *memoryCoupon) bool { return c.Serial == h.Serial })
+	if c == nil {
+		return nil, nil, ErrCouponNotFound
+	}
+
+	useInfo, err := h.useInfo(region, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.useCoupon(c, useInfo, h)
+}
+
+func (s *memoryStore) ReleaseHold(token, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.findHold(token, username)
+	if h == nil {
+		return ErrHoldNotFound
+	}
+	c := s.find(func(c *memoryCoupon) bool { return c.Serial == h.Serial })
+	if c == nil {
+		return ErrCouponNotFound
+	}
+
+	s.releaseOverdueHolds(c, time.Now())
+	switch h.Status {
+	case HoldStatus_Released, HoldStatus_Expired:
+		return nil
+	case HoldStatus_Confirmed:
+		return ErrHoldNotActive
+	}
+	h.Status = HoldStatus_Released
+	c.Holds--
+	return nil
+}
+
+func (s *memoryStore) ExpireHolds(now time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired, coupons := 0, 0
+	for _, c := range s.coupons {
+		if coupons >= limit {
+			break
+		}
+		if n := s.releaseOverdueHolds(c, now); n > 0 {
+			expired += n
+			coupons++
+		}
+	}
+	return expired, nil
+}
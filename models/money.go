@@ -0,0 +1,104 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//=============================================================
+// money, amounts are saved as integer fen in AMOUNT_FEN
+//=============================================================
+
+type Currency string
+
+const (
+	Currency_CNY Currency = "CNY"
+
+	DefaultCurrency = Currency_CNY
+)
+
+// the recharge service only accepts CNY.
+var supportedCurrencies = map[Currency]bool{
+	Currency_CNY: true,
+}
+
+func ValidateCurrency(currency Currency) (Currency, error) {
+	if currency == "" {
+		return DefaultCurrency, nil
+	}
+	currency = Currency(strings.ToUpper(string(currency)))
+	if !supportedCurrencies[currency] {
+		return "", fmt.Errorf("unsupported currency: %s", currency)
+	}
+	return currency, nil
+}
+
+// Amount is a sum of money in fen, 1/100 of the currency unit.
+// It is a decimal in JSON, e.g. 6850 fen is 68.50, and never passes
+// through a float.
+type Amount int64
+
+var ErrInvalidAmount = errors.New("amount should be a decimal with at most 2 fraction digits")
+
+// ParseAmount parses a decimal like "68", "68.5" or "68.50".
+func ParseAmount(s string) (Amount, error) {
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	}
+
+	units, cents := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		units, cents = s[:i], s[i+1:]
+		if cents == "" || len(cents) > 2 {
+			return 0, ErrInvalidAmount
+		}
+	}
+	if units == "" || strings.IndexFunc(units+cents, notDigit) >= 0 {
+		return 0, ErrInvalidAmount
+	}
+
+	yuan, err := strconv.ParseInt(units, 10, 64)
+	if err != nil || yuan > math.MaxInt64/100-1 {
+		return 0, ErrInvalidAmount
+	}
+	fen, _ := strconv.ParseInt((cents + "00")[:2], 10, 64)
+
+	amount := Amount(yuan*100 + fen)
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+func notDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+func (a Amount) String() string {
+	sign := ""
+	fen := int64(a)
+	if fen < 0 {
+		sign, fen = "-", -fen
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, fen/100, fen%100)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON accepts both 68.5 and "68.5".
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	amount, err := ParseAmount(string(data))
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
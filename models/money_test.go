@@ -0,0 +1,48 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	cases := []struct {
+		s    string
+		want Amount
+	}{
+		{"68", 6800},
+		{"68.5", 6850},
+		{"68.50", 6850},
+		{"0.01", 1},
+		{"0.1", 10},
+		{"-3.07", -307},
+		{"19.99", 1999}, // 19.99 is 19.989999... in float32
+	}
+	for _, c := range cases {
+		if got, err := ParseAmount(c.s); err != nil || got != c.want {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", c.s, got, err, c.want)
+		}
+	}
+
+	for _, s := range []string{"", "-", ".5", "1.", "1.234", "1e2", "1,5", "abc", "99999999999999999999"} {
+		if _, err := ParseAmount(s); err == nil {
+			t.Errorf("ParseAmount(%q) is accepted", s)
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	var result struct {
+		Amount Amount `json:"amount"`
+	}
+	for _, data := range []string{`{"amount": 19.99}`, `{"amount": "19.99"}`} {
+		if err := json.Unmarshal([]byte(data), &result); err != nil || result.Amount != 1999 {
+			t.Errorf("Unmarshal(%s) = %d, %v", data, result.Amount, err)
+		}
+	}
+
+	data, _ := json.Marshal(&UseResult{Amount: 1999, Currency: Currency_CNY})
+	if string(data) != `{"amount":19.99,"currency":"CNY","namespace":""}` {
+		t.Errorf("Marshal = %s", data)
+	}
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+//=============================================================
+// DF_COUPON_OUTBOX, the recharge of a used coupon is written in
+// the same transaction as the status change and delivered later.
+//=============================================================
+
+const (
+	OutboxStatus_Pending   = "pending"
+	OutboxStatus_Delivered = "delivered"
+	OutboxStatus_Failed    = "failed"
+)
+
+// A new recharge is delivered by the use handler at once, the
+// dispatcher only picks it up after this period.
+const RechargeGracePeriod = 30 * time.Second
+
+type RechargeOutbox struct {
+	Id           int64     `json:"id"`
+	Serial       string    `json:"serial"`
+	RedemptionId int64     `json:"redemption_id,omitempty"`
+	Region       string    `json:"region"`
+	Username     string    `json:"username"`
+	Namespace    string    `json:"namespace"`
+	Amount       Amount    `json:"amount"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	NextTryAt    time.Time `json:"next_try_at"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// RechargeKey is the idempotency key of the recharge, a coupon can be used
+// more than once, so it is the serial and the redemption. The recharges
+// queued before redemptions were recorded only have the serial.
+func (e *RechargeOutbox) RechargeKey() string {
+	if e.RedemptionId == 0 {
+		return e.Serial
+	}
+	return fmt.Sprintf("%s-%d", e.Serial, e.RedemptionId)
+}
+
+func truncateError(lastError string) string {
+	if len(lastError) > 255 {
+		return lastError[:255]
+	}
+	return lastError
+}
+
+func insertRechargeOutbox(tx queryer, entry *RechargeOutbox) error {
+	sqlstr := `insert into DF_COUPON_OUTBOX (
+				SERIAL, REDEMPTION_ID, REGION, USERNAME, NAMESPACE, AMOUNT, AMOUNT_FEN, STATUS, ATTEMPTS, NEXT_TRY_AT
+				) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(sqlstr,
+		entry.Serial, entry.RedemptionId, entry.Region, entry.Username, entry.Namespace, entry.Amount.String(), entry.Amount,
+		entry.Status, entry.Attempts, entry.NextTryAt,
+	)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+
+	entry.Id, err = result.LastInsertId()
+	return err
+}
+
+// claimPendingRecharges returns the due pending recharges, each of them is
+// leased by moving its NEXT_TRY_AT, so other replicas will skip it.
+func claimPendingRecharges(db *sql.DB, limit int, lease time.Duration) ([]*RechargeOutbox, error) {
+	now := time.Now()
+	sqlstr := `select ID, SERIAL, COALESCE(REDEMPTION_ID, 0), REGION, USERNAME, NAMESPACE, AMOUNT_FEN, STATUS, ATTEMPTS, NEXT_TRY_AT
+				from DF_COUPON_OUTBOX where STATUS = ? and NEXT_TRY_AT <= ? order by NEXT_TRY_AT limit ?`
+	rows, err := db.Query(sqlstr, OutboxStatus_Pending, now, limit)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := make([]*RechargeOutbox, 0, limit)
+	for rows.Next() {
+		entry := &RechargeOutbox{}
+		err := rows.Scan(&entry.Id, &entry.Serial, &entry.RedemptionId, &entry.Region, &entry.Username, &entry.Namespace,
+			&entry.Amount, &entry.Status, &entry.Attempts, &entry.NextTryAt)
+		if err != nil {
+			logger.Error("Scan err : %v", err)
+			return nil, err
+		}
+		candidates = append(candidates, entry)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return nil, err
+	}
+
+	claimed := make([]*RechargeOutbox, 0, len(candidates))
+	sqlstr = `update DF_COUPON_OUTBOX set NEXT_TRY_AT = ? where ID = ? and STATUS = ? and NEXT_TRY_AT = ?`
+	for _, entry := range candidates {
+		leaseTo := now.Add(lease)
+		result, err := db.Exec(sqlstr, leaseTo, entry.Id, OutboxStatus_Pending, entry.NextTryAt)
+		if err != nil {
+			logger.Error("Exec err : %v", err)
+			return claimed, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			entry.NextTryAt = leaseTo
+			claimed = append(claimed, entry)
+		}
+	}
+
+	return claimed, nil
+}
+
+func markRechargeDelivered(db *sql.DB, id int64) error {
+	sqlstr := `update DF_COUPON_OUTBOX set STATUS = ?, ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = NULL
+				where ID = ? and STATUS = ?`
+	_, err := db.Exec(sqlstr, OutboxStatus_Delivered, id, OutboxStatus_Pending)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
+
+func markRechargeRetry(db *sql.DB, id int64, nextTryAt time.Time, lastError string) error {
+	sqlstr := `update DF_COUPON_OUTBOX set ATTEMPTS = ATTEMPTS + 1, NEXT_TRY_AT = ?, LAST_ERROR = ?
+				where ID = ? and STATUS = ?`
+	_, err := db.Exec(sqlstr, nextTryAt, truncateError(lastError), id, OutboxStatus_Pending)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
+
+// compensateRecharge gives up a recharge and removes its redemption, so
+// that the user can use the coupon again.
+func compensateRecharge(db *sql.DB, id int64, lastError string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Begin a trasaction err: %v", err)
+		return err
+	}
+
+	var serial string
+	var redemptionId int64
+	var amount Amount
+	err = tx.QueryRow(`select SERIAL, COALESCE(REDEMPTION_ID, 0), AMOUNT_FEN from DF_COUPON_OUTBOX where ID = ? and STATUS = ? FOR UPDATE`,
+		id, OutboxStatus_Pending).Scan(&serial, &redemptionId, &amount)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil // delivered or compensated by others
+		}
+		logger.Error("Scan err : %v", err)
+		return err
+	}
+
+	sqlstr := `update DF_COUPON_OUTBOX set STATUS = ?, ATTEMPTS = ATTEMPTS + 1, LAST_ERROR = ? where ID = ?`
+	_, err = tx.Exec(sqlstr, OutboxStatus_Failed, truncateError(lastError), id)
+	if err != nil {
+		tx.Rollback()
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+
+	err = unredeemCoupon(tx, serial, redemptionId)
+	if _, ok := err.(*TransitionError); ok {
+		logger.Warn("coupon (%s) is not put back: %v", serial, err)
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	} else if err := refundCampaignBudget(tx, serial, amount); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Error("db commit err: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//=============================================================
+// a tiny query builder, all values are bound by placeholders,
+// only identifiers from couponColumns may enter the sql text.
+//=============================================================
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+const tableCoupon = "DF_COUPON"
+
+var couponColumns = map[string]bool{
+	"ID":              true,
+	"SERIAL":          true,
+	"CODE_HASH":       true,
+	"CODE_PREFIX":     true,
+	"KIND":            true,
+	"EXPIRE_ON":       true,
+	"AMOUNT":          true,
+	"AMOUNT_FEN":      true,
+	"CURRENCY":        true,
+	"PERCENT_OFF":     true,
+	"MIN_SPEND_FEN":   true,
+	"PLAN_ID":         true,
+	"MAX_REDEMPTIONS": true,
+	"PER_USER_LIMIT":  true,
+	"REDEMPTIONS":     true,
+	"BOUND_USERNAME":  true,
+	"BOUND_NAMESPACE": true,
+	"HOLDS":           true,
+	"CREATE_AT":       true,
+	"UPDATE_AT":       true,
+	"USE_TIME":        true,
+	"USERNAME":        true,
+	"NAMESPACE":       true,
+	"STATUS":          true,
+	"CAMPAIGN_ID":     true,
+}
+
+type sqlWhere struct {
+	conds []string
+	args  []interface{}
+}
+
+func newSqlWhere() *sqlWhere {
+	return &sqlWhere{}
+}
+
+// and appends a condition, cond must only use ? for values.
+func (w *sqlWhere) and(cond string, args ...interface{}) *sqlWhere {
+	if strings.Count(cond, "?") != len(args) {
+		panic(fmt.Sprintf("sqlWhere: %q needs %d args, got %d", cond, strings.Count(cond, "?"), len(args)))
+	}
+	w.conds = append(w.conds, cond)
+	w.args = append(w.args, args...)
+	return w
+}
+
+// eq appends "column = ?".
+func (w *sqlWhere) eq(column string, value interface{}) *sqlWhere {
+	return w.and(mustColumn(column)+" = ?", value)
+}
+
+// in appends "column in (?, ?, ...)", an empty values list matches nothing.
+func (w *sqlWhere) in(column string, values ...interface{}) *sqlWhere {
+	if len(values) == 0 {
+		return w.and("1 = 0")
+	}
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	return w.and(fmt.Sprintf("%s in (%s)", mustColumn(column), marks), values...)
+}
+
+var comparisons = map[string]bool{"<": true, "<=": true, ">": true, ">=": true}
+
+// cmp appends "column op ?", op is one of <, <=, > and >=.
+func (w *sqlWhere) cmp(column, op string, value interface{}) *sqlWhere {
+	if !comparisons[op] {
+		panic(fmt.Sprintf("sqlWhere: unknown comparison %q", op))
+	}
+	return w.and(mustColumn(column)+" "+op+" ?", value)
+}
+
+// between appends "column >= from and column < to", a zero bound is open.
+func (w *sqlWhere) between(column string, from, to time.Time) *sqlWhere {
+	if !from.IsZero() {
+		w.cmp(column, ">=", from.UTC())
+	}
+	if !to.IsZero() {
+		w.cmp(column, "<", to.UTC())
+	}
+	return w
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// prefix appends "column like 'prefix%'", prefix is matched literally.
+func (w *sqlWhere) prefix(column, prefix string) *sqlWhere {
+	return w.and(mustColumn(column)+" like ?", likeEscaper.Replace(prefix)+"%")
+}
+
+func (w *sqlWhere) String() string {
+	if w == nil || len(w.conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(w.conds, " and ")
+}
+
+func (w *sqlWhere) params() []interface{} {
+	if w == nil {
+		return nil
+	}
+	return w.args
+}
+
+func mustColumn(column string) string {
+	if !couponColumns[column] {
+		panic(fmt.Sprintf("unknown DF_COUPON column: %q", column))
+	}
+	return column
+}
+
+// orderByClause returns "" if column is not a known DF_COUPON column.
+func orderByClause(column string, asc bool) string {
+	if !couponColumns[column] {
+		return ""
+	}
+	return fmt.Sprintf("order by %s %s", column, sortOrderText[asc])
+}
+
+// selectQuery is a select of DF_COUPON, limit must be positive unless the
+// query is meant to read all the rows by unlimited.
+type selectQuery struct {
+	columns   []string
+	where     *sqlWhere
+	orderBy   string
+	limit     int
+	offset    int64
+	forUpdate bool
+	unlimited bool
+}
+
+func (q *selectQuery) build() (string, []interface{}) {
+	columns := make([]string, len(q.columns))
+	for i, c := range q.columns {
+		columns[i] = mustColumn(c)
+	}
+	if q.limit < 1 && !q.unlimited {
+		panic(fmt.Sprintf("select of DF_COUPON without a limit: %d", q.limit))
+	}
+
+	args := append([]interface{}{}, q.where.params()...)
+	sqlstr := fmt.Sprintf("select %s from %s %s %s", strings.Join(columns, ", "), tableCoupon, q.where, q.orderBy)
+	if !q.unlimited {
+		sqlstr += " limit ?"
+		args = append(args, q.limit)
+		if q.offset > 0 {
+			sqlstr += " offset ?"
+			args = append(args, q.offset)
+		}
+	}
+	if q.forUpdate {
+		sqlstr += " FOR UPDATE"
+	}
+
+	return sqlstr, args
+}
+
+// updateQuery builds "update DF_COUPON set A=?, B=? WHERE ...".
+type updateQuery struct {
+	sets  []string
+	args  []interface{}
+	where *sqlWhere
+}
+
+func newUpdateQuery() *updateQuery {
+	return &updateQuery{}
+}
+
+func (q *updateQuery) set(column string, value interface{}) *updateQuery {
+	q.sets = append(q.sets, mustColumn(column)+" = ?")
+	q.args = append(q.args, value)
+	return q
+}
+
+func (q *updateQuery) build() (string, []interface{}) {
+	args := append(append([]interface{}{}, q.args...), q.where.params()...)
+	return fmt.Sprintf("update %s set %s %s", tableCoupon, strings.Join(q.sets, ", "), q.where), args
+}
+
+func (q *updateQuery) exec(db queryer) (int64, error) {
+	sqlstr, args := q.build()
+	logger.Debug(">>> %s", sqlstr)
+	result, err := db.Exec(sqlstr, args...)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
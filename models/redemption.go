@@ -0,0 +1,225 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//=============================================================
+// DF_COUPON_REDEMPTION, a coupon can be used MAX_REDEMPTIONS times
+// and PER_USER_LIMIT times by a user, every use is recorded here.
+// A coupon becomes used with its last redemption.
+//=============================================================
+
+var ErrCouponUserLimitReached = errors.New("The coupon has been used by the user as many times as allowed.")
+
+type Redemption struct {
+	Id        int64     `json:"id"`
+	Serial    string    `json:"serial"`
+	Username  string    `json:"username"`
+	Namespace string    `json:"namespace"`
+	Amount    Amount    `json:"amount"`
+	UseTime   time.Time `json:"use_time"`
+}
+
+// ValidateLimits checks the redemption limits of a new coupon, 0 is
+// a single use coupon without a per user limit.
+func ValidateLimits(maxRedemptions, perUserLimit int) error {
+	if maxRedemptions < 0 {
+		return fmt.Errorf("max_redemptions should be positive")
+	}
+	if perUserLimit < 0 || perUserLimit > maxRedemptionsOrOne(maxRedemptions) {
+		return fmt.Errorf("per_user_limit should be in [0, max_redemptions]")
+	}
+	return nil
+}
+
+func maxRedemptionsOrOne(n int) int {
+	if n <= 0 {
+		return 1
+	}
+	return n
+}
+
+// lockedCoupon is what UseCoupon and the holds read of the coupon they lock.
+type lockedCoupon struct {
+	serial     string
+	kind       string
+	amount     Amount
+	currency   Currency
+	expireOn   time.Time
+	status     CouponStatus
+	campaignId int64
+
+	maxRedemptions int
+	perUserLimit   int
+	redemptions    int
+	holds          int
+
+	boundUsername  string
+	boundNamespace string
+}
+
+// lockCoupon locks the coupon matched by where, so concurrent redemptions
+// and holds of the same coupon queue here.
+func lockCoupon(tx queryer, where *sqlWhere) (*lockedCoupon, error) {
+	return readCoupon(tx, where, true)
+}
+
+// readCoupon is lockCoupon, the coupon is only locked if forUpdate.
+func readCoupon(tx queryer, where *sqlWhere, forUpdate bool) (*lockedCoupon, error) {
+	query := &selectQuery{
+		columns: []string{"SERIAL", "KIND", "AMOUNT_FEN", "CURRENCY", "EXPIRE_ON", "STATUS", "CAMPAIGN_ID",
+			"MAX_REDEMPTIONS", "PER_USER_LIMIT", "REDEMPTIONS", "HOLDS", "BOUND_USERNAME", "BOUND_NAMESPACE"},
+		where:     where,
+		limit:     1,
+		forUpdate: forUpdate,
+	}
+	sqlstr, args := query.build()
+	logger.Debug(">>> %s", sqlstr)
+
+	c := &lockedCoupon{}
+	var campaignId sql.NullInt64
+	err := tx.QueryRow(sqlstr, args...).Scan(&c.serial, &c.kind, &c.amount, &c.currency, &c.expireOn, &c.status, &campaignId,
+		&c.maxRedemptions, &c.perUserLimit, &c.redemptions, &c.holds, &c.boundUsername, &c.boundNamespace)
+	if err == sql.ErrNoRows {
+		return nil, ErrCouponNotFound
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return nil, err
+	}
+	c.campaignId = campaignId.Int64
+	return c, nil
+}
+
+// checkUserLimit counts the redemptions and the active holds of the user,
+// c must be locked, so the concurrent uses of the same user queue before
+// the count.
+func checkUserLimit(tx queryer, c *lockedCoupon, username string) error {
+	if c.perUserLimit == 0 {
+		return nil
+	}
+	var n int
+	err := tx.QueryRow(`select count(*) from DF_COUPON_REDEMPTION where SERIAL = ? and USERNAME = ?`,
+		c.serial, username).Scan(&n)
+	if err != nil {
+		logger.Error("Scan err : %v", err)
+		return err
+	}
+	if c.holds > 0 {
+		var held int
+		err := tx.QueryRow(`select count(*) from DF_COUPON_HOLD where SERIAL = ? and USERNAME = ? and STATUS = ?`,
+			c.serial, username, string(HoldStatus_Active)).Scan(&held)
+		if err != nil {
+			logger.Error("Scan err : %v", err)
+			return err
+		}
+		n += held
+	}
+	if n >= c.perUserLimit {
+		return ErrCouponUserLimitReached
+	}
+	return nil
+}
+
+// redeemLockedCoupon records a use of the locked coupon c, with the other
+// columns in sets, and moves it to used with its last redemption.
+func redeemLockedCoupon(tx queryer, c *lockedCoupon, r *Redemption, sets *updateQuery) error {
+	sqlstr := `insert into DF_COUPON_REDEMPTION (SERIAL, USERNAME, NAMESPACE, AMOUNT_FEN, USE_TIME) values (?, ?, ?, ?, ?)`
+	result, err := tx.Exec(sqlstr, c.serial, r.Username, r.Namespace, r.Amount, r.UseTime)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+	if r.Id, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	sets.set("REDEMPTIONS", c.redemptions+1)
+	if c.redemptions+1 >= c.maxRedemptions {
+		return transitLockedCoupon(tx, c.serial, c.status, CouponStatus_Used, r.Username, sets)
+	}
+
+	// the status and the count make sure only one use wins, even if the
+	// row lock is not honoured.
+	sets.where = newSqlWhere().eq("SERIAL", c.serial).eq("STATUS", string(c.status)).eq("REDEMPTIONS", c.redemptions)
+	affected, err := sets.exec(tx)
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		logger.Warn("coupon (%s) redemption %d, affected rows: %d", c.serial, c.redemptions+1, affected)
+		return ErrCouponStatusConflict
+	}
+	return nil
+}
+
+// unredeemCoupon removes the redemption of a compensated recharge, and
+// puts the coupon back to available if it is used. The recharges queued
+// before redemptions were recorded are of single use coupons.
+func unredeemCoupon(tx queryer, serial string, redemptionId int64) error {
+	var err error
+	if redemptionId != 0 {
+		_, err = tx.Exec(`delete from DF_COUPON_REDEMPTION where ID = ?`, redemptionId)
+	} else {
+		_, err = tx.Exec(`delete from DF_COUPON_REDEMPTION where SERIAL = ?`, serial)
+	}
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+		return err
+	}
+
+	query := &selectQuery{columns: []string{"STATUS", "REDEMPTIONS"}, where: newSqlWhere().eq("SERIAL", serial), limit: 1, forUpdate: true}
+	sqlstr, args := query.build()
+	var status CouponStatus
+	var redemptions int
+	err = tx.QueryRow(sqlstr, args...).Scan(&status, &redemptions)
+	if err == sql.ErrNoRows {
+		return ErrCouponNotFound
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return err
+	}
+	if redemptions > 0 {
+		redemptions--
+	}
+
+	sets := newUpdateQuery().set("REDEMPTIONS", redemptions)
+	if status != CouponStatus_Used {
+		sets.where = newSqlWhere().eq("SERIAL", serial).eq("STATUS", string(status))
+		_, err := sets.exec(tx)
+		return err
+	}
+	sets.set("USE_TIME", nil).
+		set("USERNAME", nil).
+		set("NAMESPACE", nil)
+	return transitLockedCoupon(tx, serial, status, CouponStatus_Available, Operator_System, sets)
+}
+
+func QueryRedemptions(db *sql.DB, serial string) ([]*Redemption, error) {
+	sqlstr := `select ID, SERIAL, USERNAME, NAMESPACE, AMOUNT_FEN, USE_TIME
+				from DF_COUPON_REDEMPTION where SERIAL = ? order by ID`
+	rows, err := db.Query(sqlstr, serial)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := make([]*Redemption, 0, 8)
+	for rows.Next() {
+		r := &Redemption{}
+		if err := rows.Scan(&r.Id, &r.Serial, &r.Username, &r.Namespace, &r.Amount, &r.UseTime); err != nil {
+			logger.Error("Scan err : %v", err)
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return nil, err
+	}
+	return redemptions, nil
+}
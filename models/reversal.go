@@ -0,0 +1,222 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//=============================================================
+// DF_COUPON_REVERSAL, an admin reverses a redemption made in error
+// or by abuse. The recharge of it is refunded by the recharge
+// service first, then the redemption is removed, and the coupon is
+// revoked or gets the redemption back, as the policy says.
+//=============================================================
+
+type ReversalPolicy string
+
+const (
+	// the coupon can't be used any more.
+	ReversalPolicy_Revoke ReversalPolicy = "revoke"
+	// the coupon can be used again, as a compensated recharge.
+	ReversalPolicy_Restore ReversalPolicy = "restore"
+)
+
+var (
+	ErrRedemptionNotFound = errors.New("The redemption does not exist or has been reversed.")
+	ErrRechargePending    = errors.New("The recharge of the redemption is not delivered yet.")
+)
+
+func ValidateReversalPolicy(policy string) (ReversalPolicy, error) {
+	switch p := ReversalPolicy(strings.ToLower(policy)); p {
+	case ReversalPolicy_Revoke, ReversalPolicy_Restore:
+		return p, nil
+	}
+	return "", fmt.Errorf("policy should be %s or %s", ReversalPolicy_Revoke, ReversalPolicy_Restore)
+}
+
+type ReversalInfo struct {
+	Serial string
+	// RedemptionId is the redemption to reverse, 0 is the last one of
+	// the coupon, which is filled by PrepareReversal.
+	RedemptionId int64
+	Policy       ReversalPolicy
+	Reason       string
+	Operator     string
+}
+
+type Reversal struct {
+	Id           int64          `json:"id"`
+	Serial       string         `json:"serial"`
+	RedemptionId int64          `json:"redemption_id"`
+	Username     string         `json:"username"`
+	Namespace    string         `json:"namespace"`
+	Amount       Amount         `json:"amount"`
+	UseTime      time.Time      `json:"use_time"`
+	Policy       ReversalPolicy `json:"policy"`
+	Refunded     bool           `json:"refunded"`
+	Reason       string         `json:"reason,omitempty"`
+	Operator     string         `json:"operator"`
+	CreateAt     time.Time      `json:"create_at"`
+}
+
+// PrepareReversal finds the redemption of info, and its delivered
+// recharge to refund. The recharge is nil if the coupon is not
+// rechargeable, or its recharge has been compensated.
+func PrepareReversal(db *sql.DB, info *ReversalInfo) (*Redemption, *RechargeOutbox, error) {
+	sqlstr := `select ID, SERIAL, USERNAME, NAMESPACE, AMOUNT_FEN, USE_TIME
+				from DF_COUPON_REDEMPTION where SERIAL = ? and (ID = ? or ? = 0) order by ID desc limit 1`
+	r := &Redemption{}
+	err := db.QueryRow(sqlstr, info.Serial, info.RedemptionId, info.RedemptionId).Scan(
+		&r.Id, &r.Serial, &r.Username, &r.Namespace, &r.Amount, &r.UseTime)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrRedemptionNotFound
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return nil, nil, err
+	}
+	info.RedemptionId = r.Id
+
+	// the recharges queued before redemptions were recorded only have
+	// the serial.
+	sqlstr = `select ID, SERIAL, COALESCE(REDEMPTION_ID, 0), REGION, USERNAME, NAMESPACE, AMOUNT_FEN, STATUS, ATTEMPTS, NEXT_TRY_AT
+				from DF_COUPON_OUTBOX where SERIAL = ? and (REDEMPTION_ID = ? or REDEMPTION_ID is null) order by ID desc limit 1`
+	entry := &RechargeOutbox{}
+	err = db.QueryRow(sqlstr, r.Serial, r.Id).Scan(&entry.Id, &entry.Serial, &entry.RedemptionId, &entry.Region,
+		&entry.Username, &entry.Namespace, &entry.Amount, &entry.Status, &entry.Attempts, &entry.NextTryAt)
+	if err == sql.ErrNoRows {
+		return r, nil, nil
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return nil, nil, err
+	}
+	entry, err = checkReversibleRecharge(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, entry, nil
+}
+
+func checkReversibleRecharge(entry *RechargeOutbox) (*RechargeOutbox, error) {
+	switch entry.Status {
+	case OutboxStatus_Pending:
+		return nil, ErrRechargePending
+	case OutboxStatus_Failed:
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// ReverseRedemption removes the redemption of info, and moves the coupon
+// as info.Policy. refunded tells if its recharge has been refunded.
+func ReverseRedemption(db *sql.DB, info *ReversalInfo, refunded bool) (*Reversal, error) {
+	logger.Info("Begin reverse a redemption model.")
+
+	reversal := &Reversal{
+		Serial:       info.Serial,
+		RedemptionId: info.RedemptionId,
+		Policy:       info.Policy,
+		Refunded:     refunded,
+		Reason:       info.Reason,
+		Operator:     info.Operator,
+		CreateAt:     time.Now(),
+	}
+	err := inTx(db, func(tx *sql.Tx) error {
+		c, err := lockCoupon(tx, newSqlWhere().eq("SERIAL", info.Serial))
+		if err != nil {
+			return err
+		}
+
+		sqlstr := `select USERNAME, NAMESPACE, AMOUNT_FEN, USE_TIME from DF_COUPON_REDEMPTION where ID = ? and SERIAL = ? FOR UPDATE`
+		err = tx.QueryRow(sqlstr, info.RedemptionId, c.serial).Scan(
+			&reversal.Username, &reversal.Namespace, &reversal.Amount, &reversal.UseTime)
+		if err == sql.ErrNoRows {
+			return ErrRedemptionNotFound
+		} else if err != nil {
+			logger.Error("Scan err : %v", err)
+			return err
+		}
+		if _, err := tx.Exec(`delete from DF_COUPON_REDEMPTION where ID = ?`, info.RedemptionId); err != nil {
+			logger.Error("Exec err : %v", err)
+			return err
+		}
+
+		if err := reverseLockedCoupon(tx, c, info); err != nil {
+			return err
+		}
+		if err := refundCampaignBudget(tx, c.serial, reversal.Amount); err != nil {
+			return err
+		}
+
+		sqlstr = `insert into DF_COUPON_REVERSAL (
+					SERIAL, REDEMPTION_ID, USERNAME, NAMESPACE, AMOUNT_FEN, USE_TIME, POLICY, REFUNDED, REASON, OPERATOR
+					) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		result, err := tx.Exec(sqlstr, c.serial, info.RedemptionId, reversal.Username, reversal.Namespace, reversal.Amount,
+			reversal.UseTime, string(info.Policy), refunded, info.Reason, info.Operator)
+		if err != nil {
+			logger.Error("Exec err : %v", err)
+			return err
+		}
+		reversal.Id, err = result.LastInsertId()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("End reverse a redemption model.")
+	return reversal, nil
+}
+
+// reverseLockedCoupon takes a redemption off the locked coupon c. An
+// expired or unavailable coupon only loses the redemption.
+func reverseLockedCoupon(tx queryer, c *lockedCoupon, info *ReversalInfo) error {
+	if c.redemptions > 0 {
+		c.redemptions--
+	}
+	sets := newUpdateQuery().set("REDEMPTIONS", c.redemptions)
+
+	switch {
+	case info.Policy == ReversalPolicy_Restore && c.status == CouponStatus_Used:
+		sets.set("USE_TIME", nil).
+			set("USERNAME", nil).
+			set("NAMESPACE", nil)
+		return transitLockedCoupon(tx, c.serial, c.status, CouponStatus_Available, info.Operator, sets)
+	case info.Policy == ReversalPolicy_Revoke && CanTransit(c.status, CouponStatus_Revoked):
+		return transitLockedCoupon(tx, c.serial, c.status, CouponStatus_Revoked, info.Operator, sets)
+	}
+
+	sets.where = newSqlWhere().eq("SERIAL", c.serial)
+	_, err := sets.exec(tx)
+	return err
+}
+
+func QueryReversals(db *sql.DB, serial string) ([]*Reversal, error) {
+	sqlstr := `select ID, SERIAL, REDEMPTION_ID, USERNAME, NAMESPACE, AMOUNT_FEN, USE_TIME, POLICY, REFUNDED, REASON, OPERATOR, CREATE_AT
+				from DF_COUPON_REVERSAL where SERIAL = ? order by ID`
+	rows, err := db.Query(sqlstr, serial)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	reversals := make([]*Reversal, 0, 4)
+	for rows.Next() {
+		r := &Reversal{}
+		err := rows.Scan(&r.Id, &r.Serial, &r.RedemptionId, &r.Username, &r.Namespace, &r.Amount, &r.UseTime,
+			&r.Policy, &r.Refunded, &r.Reason, &r.Operator, &r.CreateAt)
+		if err != nil {
+			logger.Error("Scan err : %v", err)
+			return nil, err
+		}
+		reversals = append(reversals, r)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return nil, err
+	}
+	return reversals, nil
+}
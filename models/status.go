@@ -0,0 +1,116 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//=============================================================
+// coupon lifecycle
+//=============================================================
+
+type CouponStatus string
+
+const (
+	CouponStatus_Available   CouponStatus = "available"
+	CouponStatus_Queried     CouponStatus = "queried"
+	CouponStatus_Provided    CouponStatus = "provided"
+	CouponStatus_Used        CouponStatus = "used"
+	CouponStatus_Expired     CouponStatus = "expired"
+	CouponStatus_Unavailable CouponStatus = "unavailable"
+	CouponStatus_Revoked     CouponStatus = "revoked"
+)
+
+// Operator_System is recorded for the transitions not made by a user.
+const Operator_System = "system"
+
+// couponTransitions is the only place to declare how a coupon moves.
+var couponTransitions = map[CouponStatus][]CouponStatus{
+	// a partly used coupon is revoked with a reversed redemption.
+	CouponStatus_Available: {
+		CouponStatus_Queried, CouponStatus_Provided, CouponStatus_Used,
+		CouponStatus_Expired, CouponStatus_Unavailable, CouponStatus_Revoked,
+	},
+	CouponStatus_Queried: {
+		CouponStatus_Provided, CouponStatus_Used, CouponStatus_Expired, CouponStatus_Unavailable,
+		CouponStatus_Revoked,
+	},
+	CouponStatus_Provided: {
+		CouponStatus_Used, CouponStatus_Expired, CouponStatus_Unavailable, CouponStatus_Revoked,
+	},
+	CouponStatus_Used: {
+		CouponStatus_Available, // the recharge is compensated, or the redemption is reversed
+		CouponStatus_Revoked,
+	},
+	CouponStatus_Expired:     {},
+	CouponStatus_Unavailable: {},
+	CouponStatus_Revoked:     {},
+}
+
+func CanTransit(from, to CouponStatus) bool {
+	for _, s := range couponTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// statusesTo returns the statuses which can move to `to`, as sql args.
+func statusesTo(to CouponStatus) []interface{} {
+	froms := make([]string, 0, len(couponTransitions))
+	for from := range couponTransitions {
+		if CanTransit(from, to) {
+			froms = append(froms, string(from))
+		}
+	}
+	sort.Strings(froms)
+
+	args := make([]interface{}, len(froms))
+	for i, from := range froms {
+		args[i] = from
+	}
+	return args
+}
+
+var (
+	ErrCouponNotFound       = errors.New("The coupon does not exist.")
+	ErrCouponStatusConflict = errors.New("The coupon status is changed by others.")
+)
+
+type TransitionError struct {
+	From CouponStatus
+	To   CouponStatus
+}
+
+func (e *TransitionError) Error() string {
+	switch e.From {
+	case CouponStatus_Used:
+		return "The coupon has used."
+	case CouponStatus_Expired:
+		return "The coupon has expired."
+	case CouponStatus_Unavailable:
+		return "The coupon unavailable."
+	case CouponStatus_Revoked:
+		return "The coupon has been revoked."
+	}
+	return fmt.Sprintf("The coupon can't be %s when it is %s.", e.To, e.From)
+}
+
+func checkTransition(from, to CouponStatus) error {
+	if !CanTransit(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+	return nil
+}
+
+// StatusTransition is a row of DF_COUPON_STATUS_LOG.
+type StatusTransition struct {
+	Serial   string       `json:"serial"`
+	From     CouponStatus `json:"from"`
+	To       CouponStatus `json:"to"`
+	Operator string       `json:"operator"`
+	CreateAt time.Time    `json:"create_at"`
+}
@@ -0,0 +1,365 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrDbNotInitlized = errors.New("db is not inited")
+
+// CouponStore is the storage used by the coupon apis.
+type CouponStore interface {
+	// Available reports whether the store can serve requests now.
+	Available() bool
+
+	// the operator of a change is recorded in the status history.
+	CreateCoupon(coupon *Coupon, operator string) (*CreateResult, error)
+	// RetrieveCouponByID reads the coupon of a code, it doesn't change it.
+	RetrieveCouponByID(code, operator string) (*RetrieveResult, error)
+	// ClaimCoupon is RetrieveCouponByID which marks the coupon queried.
+	ClaimCoupon(code, operator string) (*RetrieveResult, error)
+	// LookupCoupon is RetrieveCouponByID without checking the binding.
+	LookupCoupon(code string) (*RetrieveResult, error)
+	RetrieveCouponBySerial(serial string) (*CouponRecord, error)
+	QueryCoupons(filter *CouponFilter, orderBy string, sortOrder bool, offset int64, limit int) (int64, []*CouponRecord, error)
+	// PageCoupons is QueryCoupons by a cursor, see CouponPage.
+	PageCoupons(filter *CouponFilter, orderBy string, sortOrder bool, cursor string, limit int, withTotal bool) (*CouponPage, error)
+	UseCoupon(useInfo *UseInfo) (*UseResult, *RechargeOutbox, error)
+	ProvideCoupon(numberStr, amountStr, operator string, newCode func() string) (int64, []string, error)
+	DeleteCoupon(serial, operator string) error
+	CouponStatusHistory(serial string) ([]*StatusTransition, error)
+	CouponRedemptions(serial string) ([]*Redemption, error)
+
+	// campaigns
+	CreateCampaign(campaign *Campaign, operator string) (*Campaign, error)
+	RetrieveCampaign(id int64) (*Campaign, error)
+	QueryCampaigns(status string, offset int64, limit int) (int64, []*Campaign, error)
+	UpdateCampaign(id int64, update *CampaignUpdate) (*Campaign, error)
+	CreateCouponBatch(campaign *Campaign, template *Coupon, codes []*CampaignCoupon, operator string) (*Campaign, error)
+	ScanCampaignCoupons(campaignId int64, f func(c *CampaignCoupon) error) error
+
+	// holds, the token of a hold is only known by its holder.
+	HoldCoupon(info *HoldInfo) (*CouponHold, error)
+	// CheckCouponUsable is HoldCoupon without the hold.
+	CheckCouponUsable(info *HoldInfo) (*RetrieveResult, error)
+	RetrieveHold(token, username string) (*CouponHold, error)
+	ConfirmHold(token, username, region string, now time.Time) (*UseResult, *RechargeOutbox, error)
+	ReleaseHold(token, username string) error
+
+	// reversals, PrepareReversal finds the redemption and the recharge to
+	// refund, ReverseRedemption removes the redemption after the refund.
+	PrepareReversal(info *ReversalInfo) (*Redemption, *RechargeOutbox, error)
+	ReverseRedemption(info *ReversalInfo, refunded bool) (*Reversal, error)
+	CouponReversals(serial string) ([]*Reversal, error)
+
+	// ExpireCoupons moves at most limit coupons which are overdue at now
+	// to expired, and returns how many of them are moved.
+	ExpireCoupons(now time.Time, limit int) (int, error)
+	// ExpireHolds expires the overdue holds of at most limit coupons, and
+	// returns how many holds are expired.
+	ExpireHolds(now time.Time, limit int) (int, error)
+
+	// JudgeIsProvide records info in DF_COUPON_PROVIDE and returns true
+	// if the user has never been provided a coupon.
+	JudgeIsProvide(info *FromUser, timeStr string) (error, bool)
+
+	// recharge outbox
+	ClaimPendingRecharges(limit int, lease time.Duration) ([]*RechargeOutbox, error)
+	MarkRechargeDelivered(id int64) error
+	MarkRechargeRetry(id int64, nextTryAt time.Time, lastError string) error
+	CompensateRecharge(id int64, lastError string) error
+}
+
+//=============================================================
+// mysql
+//=============================================================
+
+type mysqlStore struct {
+	getDB func() *sql.DB
+}
+
+// NewMysqlStore returns a CouponStore backed by the db returned by getDB,
+// which is normally GetDB.
+func NewMysqlStore(getDB func() *sql.DB) CouponStore {
+	return &mysqlStore{getDB: getDB}
+}
+
+func (s *mysqlStore) Available() bool {
+	return s.getDB() != nil
+}
+
+func (s *mysqlStore) db() (*sql.DB, error) {
+	db := s.getDB()
+	if db == nil {
+		return nil, ErrDbNotInitlized
+	}
+	return db, nil
+}
+
+func (s *mysqlStore) CreateCoupon(coupon *Coupon, operator string) (*CreateResult, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return CreateCoupon(db, coupon, operator)
+}
+
+func (s *mysqlStore) RetrieveCouponByID(code, operator string) (*RetrieveResult, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return RetrieveCouponByID(db, code, operator)
+}
+
+func (s *mysqlStore) ClaimCoupon(code, operator string) (*RetrieveResult, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return ClaimCoupon(db, code, operator)
+}
+
+func (s *mysqlStore) RetrieveCouponBySerial(serial string) (*CouponRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return RetrieveCouponBySerial(db, serial)
+}
+
+func (s *mysqlStore) LookupCoupon(code string) (*RetrieveResult, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return LookupCoupon(db, code)
+}
+
+func (s *mysqlStore) PageCoupons(filter *CouponFilter, orderBy string, sortOrder bool, cursor string, limit int, withTotal bool) (*CouponPage, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return PageCoupons(db, filter, orderBy, sortOrder, cursor, limit, withTotal)
+}
+
+func (s *mysqlStore) QueryCoupons(filter *CouponFilter, orderBy string, sortOrder bool, offset int64, limit int) (int64, []*CouponRecord, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, nil, err
+	}
+	return QueryCoupons(db, filter, orderBy, sortOrder, offset, limit)
+}
+
+func (s *mysqlStore) UseCoupon(useInfo *UseInfo) (*UseResult, *RechargeOutbox, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, nil, err
+	}
+	return UseCoupon(db, useInfo)
+}
+
+func (s *mysqlStore) ProvideCoupon(numberStr, amountStr, operator string, newCode func() string) (int64, []string, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, nil, err
+	}
+	return ProvideCoupon(db, numberStr, amountStr, operator, newCode)
+}
+
+func (s *mysqlStore) DeleteCoupon(serial, operator string) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+	return DeleteCoupon(db, serial, operator)
+}
+
+func (s *mysqlStore) CouponStatusHistory(serial string) ([]*StatusTransition, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return CouponStatusHistory(db, strings.ToLower(serial))
+}
+
+func (s *mysqlStore) CouponRedemptions(serial string) ([]*Redemption, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return QueryRedemptions(db, strings.ToLower(serial))
+}
+
+func (s *mysqlStore) PrepareReversal(info *ReversalInfo) (*Redemption, *RechargeOutbox, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Serial = strings.ToLower(info.Serial)
+	return PrepareReversal(db, info)
+}
+
+func (s *mysqlStore) ReverseRedemption(info *ReversalInfo, refunded bool) (*Reversal, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	info.Serial = strings.ToLower(info.Serial)
+	return ReverseRedemption(db, info, refunded)
+}
+
+func (s *mysqlStore) CouponReversals(serial string) ([]*Reversal, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return QueryReversals(db, strings.ToLower(serial))
+}
+
+func (s *mysqlStore) CreateCampaign(campaign *Campaign, operator string) (*Campaign, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return CreateCampaign(db, campaign, operator)
+}
+
+func (s *mysqlStore) RetrieveCampaign(id int64) (*Campaign, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return RetrieveCampaign(db, id)
+}
+
+func (s *mysqlStore) QueryCampaigns(status string, offset int64, limit int) (int64, []*Campaign, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, nil, err
+	}
+	return QueryCampaigns(db, status, offset, limit)
+}
+
+func (s *mysqlStore) UpdateCampaign(id int64, update *CampaignUpdate) (*Campaign, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return UpdateCampaign(db, id, update)
+}
+
+func (s *mysqlStore) CreateCouponBatch(campaign *Campaign, template *Coupon, codes []*CampaignCoupon, operator string) (*Campaign, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return CreateCouponBatch(db, campaign, template, codes, operator)
+}
+
+func (s *mysqlStore) ScanCampaignCoupons(campaignId int64, f func(c *CampaignCoupon) error) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+	return ScanCampaignCoupons(db, campaignId, f)
+}
+
+func (s *mysqlStore) ExpireCoupons(now time.Time, limit int) (int, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, err
+	}
+	return expireCoupons(db, now, limit)
+}
+
+func (s *mysqlStore) ExpireHolds(now time.Time, limit int) (int, error) {
+	db, err := s.db()
+	if err != nil {
+		return 0, err
+	}
+	return ExpireHolds(db, now, limit)
+}
+
+func (s *mysqlStore) HoldCoupon(info *HoldInfo) (*CouponHold, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return HoldCoupon(db, info)
+}
+
+func (s *mysqlStore) CheckCouponUsable(info *HoldInfo) (*RetrieveResult, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return CheckCouponUsable(db, info)
+}
+
+func (s *mysqlStore) RetrieveHold(token, username string) (*CouponHold, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return RetrieveHold(db, token, username)
+}
+
+func (s *mysqlStore) ConfirmHold(token, username, region string, now time.Time) (*UseResult, *RechargeOutbox, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ConfirmHold(db, token, username, region, now)
+}
+
+func (s *mysqlStore) ReleaseHold(token, username string) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+	return ReleaseHold(db, token, username)
+}
+
+func (s *mysqlStore) JudgeIsProvide(info *FromUser, timeStr string) (error, bool) {
+	db, err := s.db()
+	if err != nil {
+		return err, false
+	}
+	return JudgeIsProvide(db, info, timeStr)
+}
+
+func (s *mysqlStore) ClaimPendingRecharges(limit int, lease time.Duration) ([]*RechargeOutbox, error) {
+	db, err := s.db()
+	if err != nil {
+		return nil, err
+	}
+	return claimPendingRecharges(db, limit, lease)
+}
+
+func (s *mysqlStore) MarkRechargeDelivered(id int64) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+	return markRechargeDelivered(db, id)
+}
+
+func (s *mysqlStore) MarkRechargeRetry(id int64, nextTryAt time.Time, lastError string) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+	return markRechargeRetry(db, id, nextTryAt, lastError)
+}
+
+func (s *mysqlStore) CompensateRecharge(id int64, lastError string) error {
+	db, err := s.db()
+	if err != nil {
+		return err
+	}
+	return compensateRecharge(db, id, lastError)
+}
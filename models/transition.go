@@ -0,0 +1,108 @@
+package models
+
+import (
+	"database/sql"
+)
+
+//=============================================================
+// all status changes of DF_COUPON go through transitCoupon
+//=============================================================
+
+// transitCoupon locks the coupon matched by where, and moves it to `to`.
+// sets are the other columns to update together, it can be nil.
+func transitCoupon(tx queryer, where *sqlWhere, to CouponStatus, operator string, sets *updateQuery) (CouponStatus, error) {
+	query := &selectQuery{columns: []string{"SERIAL", "STATUS"}, where: where, limit: 1, forUpdate: true}
+	sqlstr, args := query.build()
+
+	var serial string
+	var from CouponStatus
+	err := tx.QueryRow(sqlstr, args...).Scan(&serial, &from)
+	if err == sql.ErrNoRows {
+		return "", ErrCouponNotFound
+	} else if err != nil {
+		logger.Error("Scan err : %v", err)
+		return "", err
+	}
+
+	return from, transitLockedCoupon(tx, serial, from, to, operator, sets)
+}
+
+// transitLockedCoupon is for the callers which have locked the coupon
+// and read its status already.
+func transitLockedCoupon(tx queryer, serial string, from, to CouponStatus, operator string, sets *updateQuery) error {
+	if err := checkTransition(from, to); err != nil {
+		return err
+	}
+
+	if sets == nil {
+		sets = newUpdateQuery()
+	}
+	sets.set("STATUS", string(to))
+	sets.where = newSqlWhere().eq("SERIAL", serial).eq("STATUS", string(from))
+	affected, err := sets.exec(tx)
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		logger.Warn("coupon (%s) %s -> %s, affected rows: %d", serial, from, to, affected)
+		return ErrCouponStatusConflict
+	}
+
+	return logTransition(tx, serial, from, to, operator)
+}
+
+func logTransition(tx queryer, serial string, from, to CouponStatus, operator string) error {
+	sqlstr := `insert into DF_COUPON_STATUS_LOG (SERIAL, FROM_STATUS, TO_STATUS, OPERATOR) values (?, ?, ?, ?)`
+	_, err := tx.Exec(sqlstr, serial, string(from), string(to), operator)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
+
+// inTx runs f in a transaction, which is committed if f returns nil.
+func inTx(db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Begin a trasaction err: %v", err)
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.Error("db commit err: %v", err)
+		return err
+	}
+	return nil
+}
+
+func CouponStatusHistory(db *sql.DB, serial string) ([]*StatusTransition, error) {
+	sqlstr := `select SERIAL, FROM_STATUS, TO_STATUS, OPERATOR, CREATE_AT
+				from DF_COUPON_STATUS_LOG where SERIAL = ? order by ID`
+	rows, err := db.Query(sqlstr, serial)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]*StatusTransition, 0, 8)
+	for rows.Next() {
+		t := &StatusTransition{}
+		if err := rows.Scan(&t.Serial, &t.From, &t.To, &t.Operator, &t.CreateAt); err != nil {
+			logger.Error("Scan err : %v", err)
+			return nil, err
+		}
+		history = append(history, t)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return nil, err
+	}
+
+	return history, nil
+}
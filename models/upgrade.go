@@ -17,8 +17,22 @@ import (
 
 var dbUpgraders = []DatabaseUpgrader{
 	newDatabaseUpgrader_0(),
-	//newDatabaseUpgrader_1(),
-	//newDatabaseUpgrader_2(),
+	newDatabaseUpgrader_1(),
+	newDatabaseUpgrader_2(),
+	newDatabaseUpgrader_3(),
+	newDatabaseUpgrader_4(),
+	newDatabaseUpgrader_5(),
+	newDatabaseUpgrader_6(),
+	newDatabaseUpgrader_7(),
+	newDatabaseUpgrader_8(),
+	newDatabaseUpgrader_9(),
+	newDatabaseUpgrader_10(),
+	newDatabaseUpgrader_11(),
+	newDatabaseUpgrader_12(),
+	newDatabaseUpgrader_13(),
+	newDatabaseUpgrader_14(),
+	newDatabaseUpgrader_15(),
+	//newDatabaseUpgrader_16(),
 }
 
 const (
@@ -190,3 +204,17 @@ func (upgrader DatabaseUpgrader_Base) TryToCreateTables(db *sql.DB) error {
 
 	return nil
 }
+
+// columnExists reports whether table has column. The new tables are created
+// in their latest shape by TryToCreateTables before the upgrades, so the
+// upgrades of such tables must check their columns first.
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	sqlstr := `select COUNT(*) from information_schema.COLUMNS
+				where TABLE_SCHEMA = DATABASE() and TABLE_NAME = ? and COLUMN_NAME = ?`
+	var n int
+	if err := db.QueryRow(sqlstr, table, column).Scan(&n); err != nil {
+		logger.Error("QueryRow err : %v", err)
+		return false, err
+	}
+	return n > 0, nil
+}
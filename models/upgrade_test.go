@@ -0,0 +1,257 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// schemaDriver is a database/sql driver which keeps the columns of the
+// tables only. It runs the create and alter statements of the upgrades,
+// and fails as mysql does on a duplicated or missing column.
+type schemaDriver struct {
+	tables map[string]map[string]bool
+}
+
+var theSchemaDriver = &schemaDriver{}
+
+func init() {
+	sql.Register("couponschema", theSchemaDriver)
+}
+
+func (d *schemaDriver) Open(name string) (driver.Conn, error) {
+	return schemaConn{d}, nil
+}
+
+type schemaConn struct {
+	d *schemaDriver
+}
+
+func (c schemaConn) Prepare(query string) (driver.Stmt, error) {
+	return schemaStmt{c.d, query}, nil
+}
+
+func (c schemaConn) Close() error {
+	return nil
+}
+
+func (c schemaConn) Begin() (driver.Tx, error) {
+	return schemaTx{}, nil
+}
+
+type schemaTx struct{}
+
+func (schemaTx) Commit() error   { return nil }
+func (schemaTx) Rollback() error { return nil }
+
+type schemaStmt struct {
+	d     *schemaDriver
+	query string
+}
+
+func (s schemaStmt) Close() error {
+	return nil
+}
+
+func (s schemaStmt) NumInput() int {
+	return -1
+}
+
+func (s schemaStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), s.d.exec(s.query)
+}
+
+// Query answers the column checks, the other selects return no rows.
+func (s schemaStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &schemaRows{}
+	if strings.Contains(s.query, "information_schema.COLUMNS") {
+		n := int64(0)
+		if s.d.tables[args[0].(string)][args[1].(string)] {
+			n = 1
+		}
+		rows.values = [][]driver.Value{{n}}
+	}
+	return rows, nil
+}
+
+type schemaRows struct {
+	values [][]driver.Value
+}
+
+func (r *schemaRows) Columns() []string {
+	return []string{"N"}
+}
+
+func (r *schemaRows) Close() error {
+	return nil
+}
+
+func (r *schemaRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// splitClauses splits s by the commas out of parentheses and quotes.
+func splitClauses(s string) []string {
+	clauses := []string{}
+	depth, quoted, start := 0, false, 0
+	for i, c := range s {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			clauses = append(clauses, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(clauses, strings.TrimSpace(s[start:]))
+}
+
+func isKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "PRIMARY", "KEY", "UNIQUE", "INDEX":
+		return true
+	}
+	return false
+}
+
+func (d *schemaDriver) exec(query string) error {
+	words := strings.Fields(query)
+	if len(words) < 2 {
+		return nil
+	}
+	switch strings.ToLower(words[0]) {
+	case "create":
+		// CREATE TABLE IF NOT EXISTS name (...)
+		name := words[5]
+		if d.tables[name] != nil {
+			return nil
+		}
+		body := query[strings.Index(query, "(")+1 : strings.LastIndex(query, ")")]
+		columns := map[string]bool{}
+		for _, clause := range splitClauses(body) {
+			if column := strings.Fields(clause)[0]; !isKeyword(column) {
+				columns[column] = true
+			}
+		}
+		d.tables[name] = columns
+	case "alter":
+		// alter table name clause, clause, ...
+		columns := d.tables[words[2]]
+		if columns == nil {
+			return fmt.Errorf("table %s doesn't exist", words[2])
+		}
+		body := query[strings.Index(query, words[2])+len(words[2]):]
+		for _, clause := range splitClauses(body) {
+			fields := strings.Fields(clause)
+			column := fields[1]
+			switch {
+			case isKeyword(column):
+			case fields[0] == "add" && columns[column]:
+				return fmt.Errorf("duplicate column name '%s'", column)
+			case fields[0] == "add":
+				columns[column] = true
+			case !columns[column]:
+				return fmt.Errorf("can't %s '%s'; check that column exists", fields[0], column)
+			case fields[0] == "drop":
+				delete(columns, column)
+			}
+		}
+	case "update":
+		// update name [alias join ...] set column = ...
+		columns := d.tables[words[1]]
+		if columns == nil {
+			return fmt.Errorf("table %s doesn't exist", words[1])
+		}
+		for i, word := range words {
+			if word == "set" {
+				column := words[i+1][strings.Index(words[i+1], ".")+1:]
+				if !columns[column] {
+					return fmt.Errorf("unknown column '%s' in %s", column, words[1])
+				}
+				break
+			}
+		}
+	case "insert":
+		if d.tables[words[2]] == nil {
+			return fmt.Errorf("table %s doesn't exist", words[2])
+		}
+	}
+	return nil
+}
+
+// execSqlFile runs the statements of a table creation file, the way
+// TryToCreateTables does.
+func execSqlFile(t *testing.T, db *sql.DB, file string) {
+	data, err := ioutil.ReadFile(filepath.Join("..", "_db", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqls := bytes.SplitAfter(data, []byte("DEFAULT CHARSET=UTF8;"))
+	for _, sqlstr := range sqls[:len(sqls)-1] {
+		if _, err := db.Exec(string(sqlstr)); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+	}
+}
+
+func schemaColumns(tables map[string]map[string]bool) map[string][]string {
+	schema := map[string][]string{}
+	for table, columns := range tables {
+		for column := range columns {
+			schema[table] = append(schema[table], column)
+		}
+		sort.Strings(schema[table])
+	}
+	return schema
+}
+
+// The upgrades start after the latest tables are created by TryToCreateTables,
+// they must end in the latest schema.
+func TestUpgradeToLatestSchema(t *testing.T) {
+	db, err := sql.Open("couponschema", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	lastFile := fmt.Sprintf("initdb_v%03d.sql", dbUpgraders[len(dbUpgraders)-1].NewVersion())
+	theSchemaDriver.tables = map[string]map[string]bool{}
+	execSqlFile(t, db, lastFile)
+	want := schemaColumns(theSchemaDriver.tables)
+
+	for _, version := range []int{1, 6} {
+		theSchemaDriver.tables = map[string]map[string]bool{}
+		execSqlFile(t, db, fmt.Sprintf("initdb_v%03d.sql", version))
+		execSqlFile(t, db, lastFile)
+
+		for _, upgrader := range dbUpgraders {
+			if upgrader.OldVersion() < version {
+				continue
+			}
+			if err := upgrader.Upgrade(db); err != nil {
+				t.Fatalf("upgrade from v%d, %d to %d: %v", version, upgrader.OldVersion(), upgrader.NewVersion(), err)
+			}
+		}
+		if got := schemaColumns(theSchemaDriver.tables); !reflect.DeepEqual(got, want) {
+			t.Errorf("schema upgraded from v%d:\n%v\nwant:\n%v", version, got, want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_1 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_1() *DatabaseUpgrader_1 {
+	updater := &DatabaseUpgrader_1{}
+
+	updater.currentTableCreationSqlFile = "initdb_v002.sql"
+
+	updater.oldVersion = 1
+	updater.newVersion = 2
+
+	return updater
+}
+
+// DF_COUPON_OUTBOX is a new table, it has been created by TryToCreateTables.
+func (upgrader DatabaseUpgrader_1) Upgrade(db *sql.DB) error {
+	return nil
+}
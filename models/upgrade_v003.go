@@ -0,0 +1,25 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_2 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_2() *DatabaseUpgrader_2 {
+	updater := &DatabaseUpgrader_2{}
+
+	updater.currentTableCreationSqlFile = "initdb_v003.sql"
+
+	updater.oldVersion = 2
+	updater.newVersion = 3
+
+	return updater
+}
+
+// DF_COUPON_STATUS_LOG is a new table, it has been created by TryToCreateTables.
+func (upgrader DatabaseUpgrader_2) Upgrade(db *sql.DB) error {
+	return nil
+}
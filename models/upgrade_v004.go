@@ -0,0 +1,33 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_3 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_3() *DatabaseUpgrader_3 {
+	updater := &DatabaseUpgrader_3{}
+
+	updater.currentTableCreationSqlFile = "initdb_v004.sql"
+
+	updater.oldVersion = 3
+	updater.newVersion = 4
+
+	return updater
+}
+
+// EXPIRE_ON was a date compared with the UTC+8 use time, and USE_TIME was
+// saved in UTC+8. Both are UTC instants now.
+func (upgrader DatabaseUpgrader_3) Upgrade(db *sql.DB) error {
+	sqlstr := `update DF_COUPON set
+				EXPIRE_ON = DATE_SUB(EXPIRE_ON, INTERVAL 8 HOUR),
+				USE_TIME = DATE_SUB(USE_TIME, INTERVAL 8 HOUR)`
+	_, err := db.Exec(sqlstr)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
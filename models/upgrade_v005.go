@@ -0,0 +1,48 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_4 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_4() *DatabaseUpgrader_4 {
+	updater := &DatabaseUpgrader_4{}
+
+	updater.currentTableCreationSqlFile = "initdb_v005.sql"
+
+	updater.oldVersion = 4
+	updater.newVersion = 5
+
+	return updater
+}
+
+// the amounts are moved from the DOUBLE AMOUNT columns to AMOUNT_FEN,
+// the existing coupons are all in CNY. DF_COUPON_OUTBOX has AMOUNT_FEN
+// already if it is created by TryToCreateTables in this upgrade.
+func (upgrader DatabaseUpgrader_4) Upgrade(db *sql.DB) error {
+	sqls := []string{
+		`alter table DF_COUPON
+			add AMOUNT_FEN BIGINT NOT NULL DEFAULT 0 after AMOUNT,
+			add CURRENCY VARCHAR(3) NOT NULL DEFAULT 'CNY' after AMOUNT_FEN`,
+		`update DF_COUPON set AMOUNT_FEN = ROUND(AMOUNT * 100)`,
+	}
+	exists, err := columnExists(db, "DF_COUPON_OUTBOX", "AMOUNT_FEN")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		sqls = append(sqls, `alter table DF_COUPON_OUTBOX add AMOUNT_FEN BIGINT NOT NULL DEFAULT 0 after AMOUNT`)
+	}
+	sqls = append(sqls, `update DF_COUPON_OUTBOX set AMOUNT_FEN = ROUND(AMOUNT * 100)`)
+
+	for _, sqlstr := range sqls {
+		if _, err := db.Exec(sqlstr); err != nil {
+			logger.Error("Exec (%s) err : %v", sqlstr, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_5 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_5() *DatabaseUpgrader_5 {
+	updater := &DatabaseUpgrader_5{}
+
+	updater.currentTableCreationSqlFile = "initdb_v006.sql"
+
+	updater.oldVersion = 5
+	updater.newVersion = 6
+
+	return updater
+}
+
+// DF_COUPON_CAMPAIGN is a new table, it has been created by TryToCreateTables.
+// The existing coupons belong to no campaign.
+func (upgrader DatabaseUpgrader_5) Upgrade(db *sql.DB) error {
+	sqlstr := `alter table DF_COUPON add CAMPAIGN_ID BIGINT after STATUS, add KEY (CAMPAIGN_ID)`
+	_, err := db.Exec(sqlstr)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+)
+
+type DatabaseUpgrader_6 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_6() *DatabaseUpgrader_6 {
+	updater := &DatabaseUpgrader_6{}
+
+	updater.currentTableCreationSqlFile = "initdb_v007.sql"
+
+	updater.oldVersion = 6
+	updater.newVersion = 7
+
+	return updater
+}
+
+// the batch campaigns become active campaigns without a budget or window,
+// the kind, amount and expiry are kept by their coupons. DF_COUPON_CAMPAIGN
+// is in its latest shape already if it is created by TryToCreateTables in
+// this upgrade, so only the columns in the old shape are changed.
+func (upgrader DatabaseUpgrader_6) Upgrade(db *sql.DB) error {
+	clauses := []string{}
+	for _, column := range []string{"KIND", "AMOUNT_FEN", "EXPIRE_ON"} {
+		exists, err := columnExists(db, "DF_COUPON_CAMPAIGN", column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			clauses = append(clauses, "drop "+column)
+		}
+	}
+	for _, column := range []struct{ name, definition string }{
+		{"NAME", `VARCHAR(128) NOT NULL DEFAULT '' after ID`},
+		{"BUDGET_FEN", `BIGINT NOT NULL DEFAULT 0 COMMENT '0 means no limit' after CURRENCY`},
+		{"SPENT_FEN", `BIGINT NOT NULL DEFAULT 0 after BUDGET_FEN`},
+		{"START_AT", `DATETIME COMMENT 'UTC' after SPENT_FEN`},
+		{"END_AT", `DATETIME COMMENT 'UTC' after START_AT`},
+		{"STATUS", `VARCHAR(32) NOT NULL DEFAULT 'draft' after END_AT, add KEY (STATUS)`},
+	} {
+		exists, err := columnExists(db, "DF_COUPON_CAMPAIGN", column.name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			clauses = append(clauses, "add "+column.name+" "+column.definition)
+		}
+	}
+	if len(clauses) == 0 {
+		return nil
+	}
+
+	sqls := []string{
+		`alter table DF_COUPON_CAMPAIGN ` + strings.Join(clauses, ", ") + `,
+			modify NUMBER INT NOT NULL DEFAULT 0 COMMENT 'number of coupons'`,
+		`update DF_COUPON_CAMPAIGN set STATUS = 'active'`,
+		`update DF_COUPON_CAMPAIGN c set SPENT_FEN = (
+			select COALESCE(SUM(AMOUNT_FEN), 0) from DF_COUPON where CAMPAIGN_ID = c.ID and STATUS = 'used')`,
+	}
+	for _, sqlstr := range sqls {
+		if _, err := db.Exec(sqlstr); err != nil {
+			logger.Error("Exec (%s) err : %v", sqlstr, err)
+			return err
+		}
+	}
+	return nil
+}
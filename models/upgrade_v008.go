@@ -0,0 +1,45 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_7 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_7() *DatabaseUpgrader_7 {
+	updater := &DatabaseUpgrader_7{}
+
+	updater.currentTableCreationSqlFile = "initdb_v008.sql"
+
+	updater.oldVersion = 7
+	updater.newVersion = 8
+
+	return updater
+}
+
+// The old math/rand generator repeated its sequence after each restart,
+// so there may be duplicated serials and codes. The first coupon keeps
+// its serial or code, the later ones get their ID appended, as they
+// couldn't be told apart before anyway. Then the unique keys are added.
+func (upgrader DatabaseUpgrader_7) Upgrade(db *sql.DB) error {
+	sqls := []string{
+		`update DF_COUPON c join (
+			select SERIAL, MIN(ID) ID from DF_COUPON group by SERIAL having COUNT(*) > 1
+			) d on c.SERIAL = d.SERIAL and c.ID > d.ID
+			set c.SERIAL = CONCAT(c.SERIAL, '-', c.ID)`,
+		`update DF_COUPON c join (
+			select CODE, MIN(ID) ID from DF_COUPON group by CODE having COUNT(*) > 1
+			) d on c.CODE = d.CODE and c.ID > d.ID
+			set c.CODE = CONCAT(c.CODE, '-', c.ID)`,
+		`alter table DF_COUPON add UNIQUE KEY (SERIAL), add UNIQUE KEY (CODE)`,
+	}
+	for _, sqlstr := range sqls {
+		if _, err := db.Exec(sqlstr); err != nil {
+			logger.Error("Exec (%s) err : %v", sqlstr, err)
+			return err
+		}
+	}
+	return nil
+}
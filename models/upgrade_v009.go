@@ -0,0 +1,96 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_8 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_8() *DatabaseUpgrader_8 {
+	updater := &DatabaseUpgrader_8{}
+
+	updater.currentTableCreationSqlFile = "initdb_v009.sql"
+
+	updater.oldVersion = 8
+	updater.newVersion = 9
+
+	return updater
+}
+
+// rows hashed per round
+const codeHashUpgradeBatch = 500
+
+// The plain codes are replaced by their digests with COUPON_CODE_KEY, which
+// must be set before the upgrade. MySQL has no HMAC, the digests are made here.
+func (upgrader DatabaseUpgrader_8) Upgrade(db *sql.DB) error {
+	sqlstr := `alter table DF_COUPON
+				add CODE_HASH CHAR(64) COMMENT 'HMAC-SHA256 of the code' after SERIAL,
+				add CODE_PREFIX VARCHAR(8) NOT NULL DEFAULT '' after CODE_HASH`
+	if _, err := db.Exec(sqlstr); err != nil {
+		logger.Error("Exec (%s) err : %v", sqlstr, err)
+		return err
+	}
+
+	for {
+		n, err := hashPlainCodes(db, codeHashUpgradeBatch)
+		if err != nil {
+			return err
+		}
+		if n < codeHashUpgradeBatch {
+			break
+		}
+	}
+
+	sqlstr = `alter table DF_COUPON
+				drop CODE,
+				modify CODE_HASH CHAR(64) NOT NULL COMMENT 'HMAC-SHA256 of the code',
+				add UNIQUE KEY (CODE_HASH)`
+	if _, err := db.Exec(sqlstr); err != nil {
+		logger.Error("Exec (%s) err : %v", sqlstr, err)
+		return err
+	}
+	return nil
+}
+
+// hashPlainCodes hashes at most limit codes which are not hashed yet.
+func hashPlainCodes(db *sql.DB, limit int) (int, error) {
+	rows, err := db.Query(`select ID, CODE from DF_COUPON where CODE_HASH is null limit ?`, limit)
+	if err != nil {
+		logger.Error("Query err : %v", err)
+		return 0, err
+	}
+	type plainCode struct {
+		id   int64
+		code string
+	}
+	codes := make([]plainCode, 0, limit)
+	for rows.Next() {
+		var c plainCode
+		if err := rows.Scan(&c.id, &c.code); err != nil {
+			rows.Close()
+			logger.Error("Scan err : %v", err)
+			return 0, err
+		}
+		codes = append(codes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logger.Error("Err : %v", err)
+		return 0, err
+	}
+
+	err = inTx(db, func(tx *sql.Tx) error {
+		for _, c := range codes {
+			_, err := tx.Exec(`update DF_COUPON set CODE_HASH = ?, CODE_PREFIX = ? where ID = ?`,
+				hashCode(c.code), codePrefix(c.code), c.id)
+			if err != nil {
+				logger.Error("Exec err : %v", err)
+				return err
+			}
+		}
+		return nil
+	})
+	return len(codes), err
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_9 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_9() *DatabaseUpgrader_9 {
+	updater := &DatabaseUpgrader_9{}
+
+	updater.currentTableCreationSqlFile = "initdb_v010.sql"
+
+	updater.oldVersion = 9
+	updater.newVersion = 10
+
+	return updater
+}
+
+// The terms of the discount kinds, the existing coupons are recharge
+// coupons and keep the defaults.
+func (upgrader DatabaseUpgrader_9) Upgrade(db *sql.DB) error {
+	sqlstr := `alter table DF_COUPON
+				add PERCENT_OFF INT NOT NULL DEFAULT 0 COMMENT 'percentage kind, AMOUNT_FEN is the cap' after CURRENCY,
+				add MIN_SPEND_FEN BIGINT NOT NULL DEFAULT 0 after PERCENT_OFF,
+				add PLAN_ID VARCHAR(64) NOT NULL DEFAULT '' COMMENT 'free_trial kind' after MIN_SPEND_FEN`
+	_, err := db.Exec(sqlstr)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_10 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_10() *DatabaseUpgrader_10 {
+	updater := &DatabaseUpgrader_10{}
+
+	updater.currentTableCreationSqlFile = "initdb_v011.sql"
+
+	updater.oldVersion = 10
+	updater.newVersion = 11
+
+	return updater
+}
+
+// DF_COUPON_REDEMPTION is a new table, it has been created by
+// TryToCreateTables. The existing coupons are single use, the used ones
+// get their redemptions. DF_COUPON_OUTBOX has REDEMPTION_ID already if it
+// is created by TryToCreateTables in this upgrade.
+func (upgrader DatabaseUpgrader_10) Upgrade(db *sql.DB) error {
+	sqls := []string{
+		`alter table DF_COUPON
+			add MAX_REDEMPTIONS INT NOT NULL DEFAULT 1 after PLAN_ID,
+			add PER_USER_LIMIT INT NOT NULL DEFAULT 0 COMMENT '0 is no limit' after MAX_REDEMPTIONS,
+			add REDEMPTIONS INT NOT NULL DEFAULT 0 after PER_USER_LIMIT`,
+		`insert into DF_COUPON_REDEMPTION (SERIAL, USERNAME, NAMESPACE, AMOUNT_FEN, USE_TIME)
+			select SERIAL, COALESCE(USERNAME, ''), COALESCE(NAMESPACE, ''), AMOUNT_FEN, COALESCE(USE_TIME, UPDATE_AT)
+			from DF_COUPON where STATUS = 'used'`,
+		`update DF_COUPON set REDEMPTIONS = 1 where STATUS = 'used'`,
+	}
+	exists, err := columnExists(db, "DF_COUPON_OUTBOX", "REDEMPTION_ID")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		sqls = append(sqls, `alter table DF_COUPON_OUTBOX
+			add REDEMPTION_ID BIGINT COMMENT 'DF_COUPON_REDEMPTION.ID, part of the idempotency key' after AMOUNT_FEN`)
+	}
+
+	for _, sqlstr := range sqls {
+		if _, err := db.Exec(sqlstr); err != nil {
+			logger.Error("Exec (%s) err : %v", sqlstr, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_11 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_11() *DatabaseUpgrader_11 {
+	updater := &DatabaseUpgrader_11{}
+
+	updater.currentTableCreationSqlFile = "initdb_v012.sql"
+
+	updater.oldVersion = 11
+	updater.newVersion = 12
+
+	return updater
+}
+
+// The existing coupons are not bound to any user or namespace.
+func (upgrader DatabaseUpgrader_11) Upgrade(db *sql.DB) error {
+	sqlstr := `alter table DF_COUPON
+				add BOUND_USERNAME VARCHAR(32) NOT NULL DEFAULT '' COMMENT 'only this user can use the coupon' after REDEMPTIONS,
+				add BOUND_NAMESPACE VARCHAR(64) NOT NULL DEFAULT '' COMMENT 'a namespace or a glob pattern of namespaces' after BOUND_USERNAME`
+	_, err := db.Exec(sqlstr)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
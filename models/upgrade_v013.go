@@ -0,0 +1,31 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_12 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_12() *DatabaseUpgrader_12 {
+	updater := &DatabaseUpgrader_12{}
+
+	updater.currentTableCreationSqlFile = "initdb_v013.sql"
+
+	updater.oldVersion = 12
+	updater.newVersion = 13
+
+	return updater
+}
+
+// DF_COUPON_HOLD is a new table, it has been created by TryToCreateTables.
+func (upgrader DatabaseUpgrader_12) Upgrade(db *sql.DB) error {
+	sqlstr := `alter table DF_COUPON
+				add HOLDS INT NOT NULL DEFAULT 0 COMMENT 'active rows of DF_COUPON_HOLD' after BOUND_NAMESPACE`
+	_, err := db.Exec(sqlstr)
+	if err != nil {
+		logger.Error("Exec err : %v", err)
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_13 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_13() *DatabaseUpgrader_13 {
+	updater := &DatabaseUpgrader_13{}
+
+	updater.currentTableCreationSqlFile = "initdb_v014.sql"
+
+	updater.oldVersion = 13
+	updater.newVersion = 14
+
+	return updater
+}
+
+// DF_COUPON_REVERSAL is a new table, it has been created by TryToCreateTables.
+func (upgrader DatabaseUpgrader_13) Upgrade(db *sql.DB) error {
+	return nil
+}
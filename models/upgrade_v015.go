@@ -0,0 +1,26 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_14 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_14() *DatabaseUpgrader_14 {
+	updater := &DatabaseUpgrader_14{}
+
+	updater.currentTableCreationSqlFile = "initdb_v015.sql"
+
+	updater.oldVersion = 14
+	updater.newVersion = 15
+
+	return updater
+}
+
+// DF_COUPON_ATTEMPT and DF_COUPON_LOCKOUT are new tables, they have been
+// created by TryToCreateTables.
+func (upgrader DatabaseUpgrader_14) Upgrade(db *sql.DB) error {
+	return nil
+}
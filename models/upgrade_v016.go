@@ -0,0 +1,39 @@
+package models
+
+import (
+	"database/sql"
+)
+
+type DatabaseUpgrader_15 struct {
+	DatabaseUpgrader_Base
+}
+
+func newDatabaseUpgrader_15() *DatabaseUpgrader_15 {
+	updater := &DatabaseUpgrader_15{}
+
+	updater.currentTableCreationSqlFile = "initdb_v016.sql"
+
+	updater.oldVersion = 15
+	updater.newVersion = 16
+
+	return updater
+}
+
+// DF_COUPON_HOLD gets the REGION of the namespace checked by the hold. The
+// holds before it have no region, they are confirmed in the region of the
+// confirmation as before. DF_COUPON_HOLD has REGION already if it is created
+// by TryToCreateTables in this upgrade.
+func (upgrader DatabaseUpgrader_15) Upgrade(db *sql.DB) error {
+	exists, err := columnExists(db, "DF_COUPON_HOLD", "REGION")
+	if err != nil || exists {
+		return err
+	}
+
+	sqlstr := `alter table DF_COUPON_HOLD
+		add REGION VARCHAR(32) NOT NULL DEFAULT '' COMMENT 'region of the namespace' after NAMESPACE`
+	if _, err := db.Exec(sqlstr); err != nil {
+		logger.Error("Exec (%s) err : %v", sqlstr, err)
+		return err
+	}
+	return nil
+}
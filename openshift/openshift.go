@@ -118,6 +118,21 @@ func CreateOpenshiftClient(name, host, username, password string, durPhase time.
 	return oc
 }
 
+// for the clients of user tokens only, it has no admin token.
+func CreateUserOpenshiftClient(name, host string) *OpenshiftClient {
+	host = httpsAddrMaker(host)
+	oc := &OpenshiftClient{
+		name: name,
+
+		host:    host,
+		oapiUrl: host + "/oapi/v1",
+		kapiUrl: host + "/api/v1",
+	}
+	oc.bearerToken.Store("")
+
+	return oc
+}
+
 func (oc *OpenshiftClient) BearerToken() string {
 	//return oc.bearerToken
 	return oc.bearerToken.Load().(string)
@@ -264,6 +279,17 @@ func (oc *OpenshiftClient) KRequest (method, uri string, body []byte) ([]byte, e
 }
 */
 
+// StatusError is the error of a response out of [200, 400), its message
+// is the response body.
+type StatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return string(e.Body)
+}
+
 type OpenshiftREST struct {
 	oc  *OpenshiftClient
 	Err error
@@ -313,7 +339,7 @@ func (osr *OpenshiftREST) doRequest(method, url string, bodyParams interface{},
 	//println("22222 len(data) = ", len(data), " , res.StatusCode = ", res.StatusCode)
 
 	if res.StatusCode < 200 || res.StatusCode >= 400 {
-		osr.Err = errors.New(string(data))
+		osr.Err = &StatusError{StatusCode: res.StatusCode, Body: data}
 	} else {
 		if into != nil {
 			//println("into data = ", string(data), "\n")
@@ -63,12 +63,49 @@ func InitRouter() *httprouter.Router {
 func NewRouter(router *httprouter.Router) {
 	logger.Info("new router.")
 	router.POST("/charge/v1/coupons", api.TimeoutHandle(30000*time.Millisecond, api.CreateCoupon))
+	router.POST("/charge/v1/coupons/:code", couponActions(map[string]httprouter.Handle{
+		"batch":    api.TimeoutHandle(120000*time.Millisecond, api.CreateCouponBatch),
+		"offline":  api.TimeoutHandle(120000*time.Millisecond, api.MintOfflineCoupons),
+		"evaluate": api.TimeoutHandle(10000*time.Millisecond, api.EvaluateCoupon),
+	}))
+	router.POST("/charge/v1/coupons/:code/holds", api.TimeoutHandle(10000*time.Millisecond, api.HoldCoupon))
+	router.POST("/charge/v1/coupons/:code/claim", api.TimeoutHandle(10000*time.Millisecond, api.ClaimCoupon))
+	router.POST("/charge/v1/coupons/:code/use", api.TimeoutHandle(10000*time.Millisecond, api.UseCouponCode))
 	router.DELETE("/charge/v1/coupons/:serial", api.TimeoutHandle(10000*time.Millisecond, api.DeleteCoupon))
 	//router.PUT("/charge/v1/coupons/:serial", api.TimeoutHandle(10000*time.Millisecond, handler.ModifyCoupon))
 	router.PUT("/charge/v1/coupons/use/:serial", api.TimeoutHandle(10000*time.Millisecond, api.UseCoupon))
+	router.PUT("/charge/v1/coupons/revoke/:serial", api.TimeoutHandle(30000*time.Millisecond, api.ReverseRedemption))
 	router.GET("/charge/v1/coupons/:code", api.TimeoutHandle(10000*time.Millisecond, api.RetrieveCoupon))
 	router.GET("/charge/v1/coupons", api.TimeoutHandle(10000*time.Millisecond, api.QueryCouponList))
 	router.POST("/charge/v1/provide/coupons", api.TimeoutHandle(10000*time.Millisecond, api.ProvideCoupons))
 
+	router.GET("/charge/v1/holds/:token", api.TimeoutHandle(10000*time.Millisecond, api.RetrieveHold))
+	router.POST("/charge/v1/holds/:token/confirm", api.TimeoutHandle(10000*time.Millisecond, api.ConfirmHold))
+	router.DELETE("/charge/v1/holds/:token", api.TimeoutHandle(10000*time.Millisecond, api.ReleaseHold))
+
+	router.GET("/charge/v1/export/coupons", api.TimeoutHandle(600000*time.Millisecond, api.ExportCoupons))
+	router.GET("/charge/v1/records/coupons/:serial", api.TimeoutHandle(10000*time.Millisecond, api.RetrieveCouponRecord))
 	router.GET("/charge/v1/fetch/coupons", api.TimeoutHandle(10000*time.Millisecond, api.FetchCoupons))
+	router.GET("/charge/v1/history/coupons/:serial", api.TimeoutHandle(10000*time.Millisecond, api.CouponStatusHistory))
+	router.GET("/charge/v1/history/coupons/:serial/redemptions", api.TimeoutHandle(10000*time.Millisecond, api.CouponRedemptions))
+	router.GET("/charge/v1/history/coupons/:serial/reversals", api.TimeoutHandle(10000*time.Millisecond, api.CouponReversals))
+
+	router.POST("/charge/v1/campaigns", api.TimeoutHandle(10000*time.Millisecond, api.CreateCampaign))
+	router.GET("/charge/v1/campaigns", api.TimeoutHandle(10000*time.Millisecond, api.QueryCampaignList))
+	router.GET("/charge/v1/campaigns/:id", api.TimeoutHandle(10000*time.Millisecond, api.RetrieveCampaign))
+	router.PUT("/charge/v1/campaigns/:id", api.TimeoutHandle(10000*time.Millisecond, api.UpdateCampaign))
+	router.DELETE("/charge/v1/campaigns/:id", api.TimeoutHandle(10000*time.Millisecond, api.CloseCampaign))
+	router.GET("/charge/v1/campaigns/:id/coupons", api.TimeoutHandle(120000*time.Millisecond, api.DownloadCampaignCoupons))
+}
+
+// couponActions routes POST /charge/v1/coupons/batch and the like by
+// name, httprouter can't have them beside /charge/v1/coupons/:code/holds.
+func couponActions(actions map[string]httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if handle, ok := actions[params.ByName("code")]; ok {
+			handle(w, r, params)
+			return
+		}
+		httpNotFound(w, r)
+	}
 }
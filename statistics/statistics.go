@@ -138,8 +138,9 @@ var ErrOldStatNotMatch = errors.New("old stat not match")
 // isUpdate == false means replace
 // ifOldStat is only valid when it is >= 0s
 // if old stat doesn't match ifOldStat, the old stat and error will be returned
+// the row is locked when read, so SetStatIf is a compare-and-set across processes
 func updateOrSetStat(db *sql.DB, key string, delta, ifOldStat int, isUpdate bool) (int, error) {
-	sqlget := `select STAT_VALUE from DF_ITEM_STAT where STAT_KEY=?`
+	sqlget := `select STAT_VALUE from DF_ITEM_STAT where STAT_KEY=? FOR UPDATE`
 
 	tx, err := db.Begin()
 	if err != nil {